@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Apache %t timestamp layout
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog writes every request in Apache Combined Log Format, so GoAccess,
+// AWStats and friends can read it directly. With per-host files, each
+// configured host gets hostDir/<host>.log; everything else (dashboard,
+// scanners with made-up Host headers) goes to the main file.
+type AccessLog struct {
+	main    *FileLogger
+	hostDir string // empty unless per-host files are enabled
+	open    func(path string) (*FileLogger, error)
+
+	mu    sync.Mutex
+	hosts map[string]*FileLogger
+}
+
+func NewAccessLog(path string, perHost bool, open func(path string) (*FileLogger, error)) (*AccessLog, error) {
+	main, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	al := &AccessLog{main: main, open: open, hosts: make(map[string]*FileLogger)}
+	if perHost {
+		al.hostDir = filepath.Join(filepath.Dir(path), "access")
+		if err := os.MkdirAll(al.hostDir, 0755); err != nil {
+			main.Close()
+			return nil, err
+		}
+	}
+	return al, nil
+}
+
+// accessLogMiddleware logs each request handled by next
+func (app *App) accessLogMiddleware(next http.Handler) http.Handler {
+	if app.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// Captured up front: the proxy rewrites the request on its way through
+		host := strings.ToLower(strings.Split(r.Host, ":")[0])
+		requestLine := r.Method + " " + r.RequestURI + " " + r.Proto
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		routeKey, rt := app.lookupRoute(host)
+		if rt == nil {
+			routeKey = ""
+		}
+		app.accessLog.Write(routeKey, formatCombined(app.ipPolicy.ClientIP(r), start, requestLine,
+			rec.Status(), rec.bytes, r.Referer(), r.UserAgent()))
+	})
+}
+
+// formatCombined renders one Combined Log Format line
+func formatCombined(clientIP string, t time.Time, requestLine string, status int, bytes int64, referer, userAgent string) string {
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s\n",
+		clientIP, t.Format(clfTimeLayout), clfQuote(requestLine), status, size, clfQuote(referer), clfQuote(userAgent))
+}
+
+// clfQuote quotes a field the way Apache does, escaping quotes, backslashes
+// and control characters so a crafted header can't forge log lines
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Write queues a line for host's file; host is a configured route key or ""
+func (al *AccessLog) Write(host, line string) {
+	if al.hostDir == "" || host == "" || host == defaultRouteKey {
+		al.main.Write(line)
+		return
+	}
+
+	al.mu.Lock()
+	fl, ok := al.hosts[host]
+	if !ok {
+		var err error
+		fl, err = al.open(filepath.Join(al.hostDir, host+".log"))
+		if err != nil {
+			al.mu.Unlock()
+			slog.Error("Error opening access log, using main file", "host", host, "err", err)
+			al.main.Write(line)
+			return
+		}
+		fl.SetPaused(al.main.paused.Load())
+		al.hosts[host] = fl
+	}
+	al.mu.Unlock()
+	fl.Write(line)
+}
+
+// SetPaused pauses or resumes every access log file
+func (al *AccessLog) SetPaused(paused bool) {
+	if al == nil {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.main.SetPaused(paused)
+	for _, fl := range al.hosts {
+		fl.SetPaused(paused)
+	}
+}
+
+func (al *AccessLog) Close() {
+	if al == nil {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	for _, fl := range al.hosts {
+		fl.Close()
+	}
+	al.main.Close()
+}
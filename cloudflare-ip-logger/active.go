@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients tracked at once across all hosts; further ones aren't counted
+// until older ones age out, so a flood of spoofed sources can't grow memory
+const activeMaxClients = 100000
+
+// ActiveVisitors remembers when each visitor IP was last seen per host, for
+// the last ACTIVE_WINDOW, so "currently online" counts don't scan the
+// database
+type ActiveVisitors struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]map[string]time.Time // host -> client IP -> last request
+	clients   int
+	lastPrune time.Time
+}
+
+func NewActiveVisitors(window time.Duration) *ActiveVisitors {
+	return &ActiveVisitors{window: window, seen: make(map[string]map[string]time.Time)}
+}
+
+// Record notes a visitor request; ones older than the window are ignored
+func (a *ActiveVisitors) Record(ip, host string, t time.Time) {
+	now := time.Now()
+	if now.Sub(t) > a.window {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastPrune) > time.Minute {
+		a.prune(now.Add(-a.window))
+		a.lastPrune = now
+	}
+	ips := a.seen[host]
+	if ips == nil {
+		ips = make(map[string]time.Time)
+		a.seen[host] = ips
+	}
+	last, ok := ips[ip]
+	switch {
+	case !ok && a.clients >= activeMaxClients:
+	case !ok:
+		ips[ip] = t
+		a.clients++
+	case t.After(last):
+		ips[ip] = t
+	}
+}
+
+// prune drops clients not seen since before; a.mu must be held
+func (a *ActiveVisitors) prune(before time.Time) {
+	for host, ips := range a.seen {
+		for ip, last := range ips {
+			if last.Before(before) {
+				delete(ips, ip)
+				a.clients--
+			}
+		}
+		if len(ips) == 0 {
+			delete(a.seen, host)
+		}
+	}
+}
+
+// ActiveHost is one host's count in an /stats/active response
+type ActiveHost struct {
+	Host   string `json:"host"`
+	Active int    `json:"active"`
+}
+
+// Count returns the distinct IPs seen within the last d, over every host
+// visible allows and per host, busiest first
+func (a *ActiveVisitors) Count(d time.Duration, now time.Time, visible func(host string) bool) (int, []ActiveHost) {
+	since := now.Add(-d)
+	all := make(map[string]bool)
+	hosts := []ActiveHost{}
+	a.mu.Lock()
+	for host, ips := range a.seen {
+		if !visible(host) {
+			continue
+		}
+		n := 0
+		for ip, last := range ips {
+			if !last.Before(since) {
+				all[ip] = true
+				n++
+			}
+		}
+		if n > 0 {
+			hosts = append(hosts, ActiveHost{Host: host, Active: n})
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Active != hosts[j].Active {
+			return hosts[i].Active > hosts[j].Active
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+	return len(all), hosts
+}
+
+// CountHost is Count for a single host
+func (a *ActiveVisitors) CountHost(host string, d time.Duration, now time.Time) int {
+	n, _ := a.Count(d, now, func(h string) bool { return h == host })
+	return n
+}
+
+// GET /_proxy/stats/active?minutes=5
+//
+// Distinct visitor IPs seen in the last minutes (default 5, at most
+// ACTIVE_WINDOW), in total and per host. Host-scoped users only see theirs.
+func (app *App) handleActiveVisitors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maxMinutes := int(app.active.window / time.Minute)
+	minutes := min(5, maxMinutes)
+	if v := r.URL.Query().Get("minutes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMinutes {
+			http.Error(w, "minutes must be between 1 and "+strconv.Itoa(maxMinutes), http.StatusBadRequest)
+			return
+		}
+		minutes = n
+	}
+	u := requestUser(r)
+	total, hosts := app.active.Count(time.Duration(minutes)*time.Minute, time.Now(), u.CanSee)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window_minutes": minutes,
+		"active":         total,
+		"hosts":          hosts,
+	})
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+var (
+	errAdminNotFound           = errors.New("not found")
+	errAdminVersionMismatch    = errors.New("version mismatch")
+	errAdminAlreadyExists      = errors.New("already exists")
+	errAdminPreconditionNeeded = errors.New("If-Match header required")
+	errAdminInvalid            = errors.New("invalid object")
+)
+
+// AdminObject is one managed item. Data is opaque JSON owned by the feature
+// that consumes the kind; Version increments on every write and is the ETag.
+type AdminObject struct {
+	ID        string          `json:"id"`
+	Data      json.RawMessage `json:"data"`
+	Version   int64           `json:"version"`
+	UpdatedAt string          `json:"updated_at"`
+}
+
+func (o AdminObject) ETag() string {
+	return `"` + strconv.FormatInt(o.Version, 10) + `"`
+}
+
+// AdminCollection is the storage behind one kind. ifMatch is the version the
+// caller last saw (0 = none); Put with ifMatch -1 means create-only.
+type AdminCollection interface {
+	List() ([]AdminObject, error)
+	Get(id string) (AdminObject, error)
+	Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error)
+	Delete(id string, ifMatch int64) error
+}
+
+// collectionETag changes whenever any object in the list is added, removed or
+// updated
+func collectionETag(objects []AdminObject) string {
+	h := fnv.New64a()
+	for _, o := range objects {
+		fmt.Fprintf(h, "%s:%d;", o.ID, o.Version)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// sqlAdminCollection stores objects of one kind in the admin_objects table
+type sqlAdminCollection struct {
+	db   *sql.DB
+	kind string
+}
+
+func initAdminSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS admin_objects (
+		kind TEXT NOT NULL,
+		id TEXT NOT NULL,
+		data TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (kind, id)
+	);`)
+	return err
+}
+
+func (c *sqlAdminCollection) List() ([]AdminObject, error) {
+	rows, err := c.db.Query(`SELECT id, data, version, updated_at FROM admin_objects
+		WHERE kind = ? ORDER BY id`, c.kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := []AdminObject{}
+	for rows.Next() {
+		var o AdminObject
+		var data string
+		if err := rows.Scan(&o.ID, &data, &o.Version, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		o.Data = json.RawMessage(data)
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+func (c *sqlAdminCollection) Get(id string) (AdminObject, error) {
+	var o AdminObject
+	var data string
+	err := c.db.QueryRow(`SELECT id, data, version, updated_at FROM admin_objects
+		WHERE kind = ? AND id = ?`, c.kind, id).Scan(&o.ID, &data, &o.Version, &o.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return o, errAdminNotFound
+	}
+	o.Data = json.RawMessage(data)
+	return o, err
+}
+
+func (c *sqlAdminCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	now := store.FormatTime(time.Now())
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return AdminObject{}, err
+	}
+	defer tx.Rollback()
+
+	var current int64
+	err = tx.QueryRow("SELECT version FROM admin_objects WHERE kind = ? AND id = ?", c.kind, id).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		if ifMatch > 0 {
+			return AdminObject{}, errAdminNotFound
+		}
+		_, err = tx.Exec(`INSERT INTO admin_objects (kind, id, data, version, updated_at)
+			VALUES (?, ?, ?, 1, ?)`, c.kind, id, string(data), now)
+		current = 0
+	case err != nil:
+		return AdminObject{}, err
+	case ifMatch < 0:
+		return AdminObject{}, errAdminAlreadyExists
+	case ifMatch == 0:
+		return AdminObject{}, errAdminPreconditionNeeded
+	case ifMatch != current:
+		return AdminObject{}, errAdminVersionMismatch
+	default:
+		_, err = tx.Exec(`UPDATE admin_objects SET data = ?, version = version + 1, updated_at = ?
+			WHERE kind = ? AND id = ?`, string(data), now, c.kind, id)
+	}
+	if err != nil {
+		return AdminObject{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AdminObject{}, err
+	}
+	return AdminObject{ID: id, Data: data, Version: current + 1, UpdatedAt: now}, nil
+}
+
+func (c *sqlAdminCollection) Delete(id string, ifMatch int64) error {
+	if ifMatch == 0 {
+		return errAdminPreconditionNeeded
+	}
+	res, err := c.db.Exec("DELETE FROM admin_objects WHERE kind = ? AND id = ? AND version = ?", c.kind, id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.Get(id); err == errAdminNotFound {
+			return errAdminNotFound
+		}
+		return errAdminVersionMismatch
+	}
+	return nil
+}
+
+// AdminAPI serves the /_proxy/admin/{kind}[/{id}] surface
+type AdminAPI struct {
+	collections map[string]AdminCollection
+	token       string
+	users       *Users
+	open        bool        // ADMIN_UNAUTHENTICATED: allow everyone while no token or user exists
+	onEvent     func(Event) // set to add changes to the events timeline
+}
+
+func NewAdminAPI(db *sql.DB, token string) (*AdminAPI, error) {
+	if err := initAdminSchema(db); err != nil {
+		return nil, err
+	}
+	users, err := NewUsers(db)
+	if err != nil {
+		return nil, err
+	}
+	// Features register their own kinds, see Register
+	api := &AdminAPI{collections: make(map[string]AdminCollection), token: token, users: users}
+	api.collections["users"] = userCollection{users: users, requireAdmin: token == ""}
+	return api, nil
+}
+
+// Register adds a kind under /_proxy/admin, backed by the feature's storage
+func (api *AdminAPI) Register(kind string, c AdminCollection) {
+	api.collections[kind] = c
+}
+
+// Authenticate returns the account the request's bearer token belongs to:
+// the built-in admin for ADMIN_TOKEN, else a user, else nil
+func (api *AdminAPI) Authenticate(r *http.Request) *User {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if api.token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(api.token)) == 1 {
+		return &User{Name: "admin", Role: roleAdmin}
+	}
+	return api.users.Lookup(got)
+}
+
+// errAdminUnconfigured answers admin requests on an instance without
+// ADMIN_TOKEN or accounts
+const errAdminUnconfigured = "Admin API disabled: set ADMIN_TOKEN or create an admin account with the users add command"
+
+// unconfigured reports whether neither ADMIN_TOKEN nor any account exists.
+// Accounts are re-read while there are none, so one created with the users
+// add command is picked up without a restart.
+func (api *AdminAPI) unconfigured() bool {
+	if api.token != "" || api.users.Any() {
+		return false
+	}
+	if err := api.users.reload(); err != nil {
+		slog.Error("Error loading users", "err", err)
+	}
+	return !api.users.Any()
+}
+
+// Authorize requires an admin (ADMIN_TOKEN or an admin user), writing a 401
+// for no or an unknown token and a 403 for viewers. Without either
+// configured it refuses everything, unless ADMIN_UNAUTHENTICATED is set.
+// Other mutating endpoints use it too.
+func (api *AdminAPI) Authorize(w http.ResponseWriter, r *http.Request) bool {
+	if api.unconfigured() {
+		if !api.open {
+			http.Error(w, errAdminUnconfigured, http.StatusForbidden)
+		}
+		return api.open
+	}
+	user := api.Authenticate(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if user.Role != roleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// IsAdmin reports whether Authorize would let r through, without answering it
+func (api *AdminAPI) IsAdmin(r *http.Request) bool {
+	if api.unconfigured() {
+		return api.open
+	}
+	user := api.Authenticate(r)
+	return user != nil && user.Role == roleAdmin
+}
+
+// parseIfMatch returns the version in an If-Match header: 0 if absent, -1 for
+// If-None-Match: * (create only)
+func parseIfMatch(r *http.Request) (int64, error) {
+	if r.Header.Get("If-None-Match") == "*" {
+		return -1, nil
+	}
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" {
+		return 0, nil
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+	v, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid If-Match value %q", tag)
+	}
+	return v, nil
+}
+
+func newAdminID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAdminInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err {
+	case errAdminNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errAdminVersionMismatch, errAdminAlreadyExists:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errAdminPreconditionNeeded:
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, etag string, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET    /_proxy/admin                 - list kinds
+// GET    /_proxy/admin/{kind}          - list objects (ETag covers the collection)
+// POST   /_proxy/admin/{kind}          - create with a generated id
+// GET    /_proxy/admin/{kind}/{id}     - fetch one (ETag = version)
+// PUT    /_proxy/admin/{kind}/{id}     - replace; requires If-Match, or If-None-Match: * to create
+// DELETE /_proxy/admin/{kind}/{id}     - delete; requires If-Match
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !api.Authorize(w, r) {
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	if rest == "" {
+		kinds := make([]string, 0, len(api.collections))
+		for kind := range api.collections {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(kinds)
+		return
+	}
+
+	kind, id, _ := strings.Cut(rest, "/")
+	coll, ok := api.collections[kind]
+	if !ok {
+		http.Error(w, "Unknown admin kind", http.StatusNotFound)
+		return
+	}
+
+	if id == "" {
+		api.serveCollection(w, r, kind, coll)
+		return
+	}
+	api.serveObject(w, r, kind, coll, id)
+}
+
+// changed adds a write to the events timeline. Kinds with an event kind of
+// their own (bans, triage tags, maintenance, share tokens) report it instead.
+func (api *AdminAPI) changed(r *http.Request, kind, id, action string) {
+	switch kind {
+	case "bans", "ip-tags", "maintenance", "share-tokens":
+		return
+	}
+	if api.onEvent == nil {
+		return
+	}
+	msg := fmt.Sprintf("%s/%s %s", kind, id, action)
+	if u := api.Authenticate(r); u != nil {
+		msg += " by " + u.Name
+	}
+	api.onEvent(Event{Kind: "config", Message: msg})
+}
+
+func (api *AdminAPI) serveCollection(w http.ResponseWriter, r *http.Request, kind string, coll AdminCollection) {
+	switch r.Method {
+	case http.MethodGet:
+		objects, err := coll.List()
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		etag := collectionETag(objects)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, etag, objects)
+
+	case http.MethodPost:
+		data, err := readAdminBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj, err := coll.Put(newAdminID(), data, -1)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		api.changed(r, kind, obj.ID, "created")
+		writeAdminJSON(w, http.StatusCreated, obj.ETag(), obj)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (api *AdminAPI) serveObject(w http.ResponseWriter, r *http.Request, kind string, coll AdminCollection, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		obj, err := coll.Get(id)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		if r.Header.Get("If-None-Match") == obj.ETag() {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, obj.ETag(), obj)
+
+	case http.MethodPut:
+		ifMatch, err := parseIfMatch(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := readAdminBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj, err := coll.Put(id, data, ifMatch)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		status, action := http.StatusOK, "updated"
+		if obj.Version == 1 {
+			status, action = http.StatusCreated, "created"
+		}
+		api.changed(r, kind, id, action)
+		writeAdminJSON(w, status, obj.ETag(), obj)
+
+	case http.MethodDelete:
+		ifMatch, err := parseIfMatch(r)
+		if err != nil || ifMatch < 0 {
+			http.Error(w, "invalid If-Match", http.StatusBadRequest)
+			return
+		}
+		if err := coll.Delete(id, ifMatch); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		api.changed(r, kind, id, "deleted")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// readAdminBody accepts any JSON value up to 1MB
+func readAdminBody(r *http.Request) (json.RawMessage, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(body) {
+		return nil, errors.New("body must be valid JSON")
+	}
+	return json.RawMessage(body), nil
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Annotation kinds
+const (
+	annotationIncident    = "incident"
+	annotationMaintenance = "maintenance"
+)
+
+// Longest annotation note kept
+const maxAnnotationNote = 2000
+
+// Annotation explains a stretch of time: an incident or a maintenance window
+// on some hosts, or all of them. Charts and the status page show it over the
+// traffic it affected.
+type Annotation struct {
+	ID        string   `json:"id"`
+	Kind      string   `json:"kind"`
+	StartsAt  string   `json:"starts_at"`
+	EndsAt    string   `json:"ends_at,omitempty"` // empty while ongoing
+	Hosts     []string `json:"hosts"`             // empty = every host
+	Note      string   `json:"note"`
+	Internal  bool     `json:"internal,omitempty"` // kept off the public status and share pages
+	CreatedBy string   `json:"created_by,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// annotationData is the editable part of an annotation, as sent by clients
+type annotationData struct {
+	Kind     string   `json:"kind"`
+	StartsAt string   `json:"starts_at"`          // default now
+	EndsAt   string   `json:"ends_at,omitempty"`  // empty = ongoing
+	Duration string   `json:"duration,omitempty"` // e.g. 2h, instead of ends_at
+	Hosts    []string `json:"hosts"`
+	Note     string   `json:"note"`
+	Internal bool     `json:"internal,omitempty"`
+}
+
+var errAnnotationNotFound = errors.New("no such annotation")
+
+// Annotations keeps incident and maintenance annotations in their own table
+type Annotations struct {
+	db *sql.DB
+}
+
+func NewAnnotations(db *sql.DB) (*Annotations, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS annotations (
+		id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME,
+		hosts TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL,
+		internal INTEGER NOT NULL DEFAULT 0,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_annotations_starts_at ON annotations(starts_at);`)
+	if err != nil {
+		return nil, err
+	}
+	// Versioned for the admin API's annotations kind
+	if _, err := store.AddColumnIfMissing(db, "annotations", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	added, err := store.AddColumnIfMissing(db, "annotations", "updated_at", "DATETIME NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+	if added {
+		if _, err := db.Exec("UPDATE annotations SET updated_at = created_at"); err != nil {
+			return nil, err
+		}
+	}
+	return &Annotations{db: db}, nil
+}
+
+// validate normalizes d into what is stored: hosts as ",a,b," so one can be
+// matched with instr, "" for all
+func (d annotationData) validate(now time.Time) (starts string, ends sql.NullString, hosts string, err error) {
+	switch d.Kind {
+	case annotationIncident, annotationMaintenance:
+	default:
+		return "", ends, "", fmt.Errorf("kind must be %q or %q", annotationIncident, annotationMaintenance)
+	}
+	if strings.TrimSpace(d.Note) == "" {
+		return "", ends, "", errors.New("note required")
+	}
+	if len(d.Note) > maxAnnotationNote {
+		return "", ends, "", fmt.Errorf("note is longer than %d bytes", maxAnnotationNote)
+	}
+	start := now
+	if d.StartsAt != "" {
+		if start, err = time.Parse(time.RFC3339, d.StartsAt); err != nil {
+			return "", ends, "", fmt.Errorf("invalid starts_at %q", d.StartsAt)
+		}
+	}
+	switch {
+	case d.Duration != "":
+		dur, ok := parseRelative(d.Duration)
+		if !ok {
+			return "", ends, "", fmt.Errorf("invalid duration %q", d.Duration)
+		}
+		ends = sql.NullString{String: store.FormatTime(start.Add(dur)), Valid: true}
+	case d.EndsAt != "":
+		end, err := time.Parse(time.RFC3339, d.EndsAt)
+		if err != nil {
+			return "", ends, "", fmt.Errorf("invalid ends_at %q", d.EndsAt)
+		}
+		if !end.After(start) {
+			return "", ends, "", errors.New("ends_at must be after starts_at")
+		}
+		ends = sql.NullString{String: store.FormatTime(end), Valid: true}
+	}
+	var list []string
+	for _, h := range d.Hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" && !strings.Contains(h, ",") {
+			list = append(list, h)
+		}
+	}
+	if len(list) > 0 {
+		hosts = "," + strings.Join(list, ",") + ","
+	}
+	return store.FormatTime(start), ends, hosts, nil
+}
+
+const annotationColumns = "id, kind, starts_at, COALESCE(ends_at, ''), hosts, note, internal, created_by, created_at"
+
+// scanAnnotation reads annotationColumns, then any columns after them into
+// extra
+func scanAnnotation(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Annotation, error) {
+	var a Annotation
+	var hosts string
+	err := row.Scan(append([]interface{}{&a.ID, &a.Kind, &a.StartsAt, &a.EndsAt, &hosts, &a.Note, &a.Internal, &a.CreatedBy, &a.CreatedAt}, extra...)...)
+	a.Hosts = []string{}
+	if hosts = strings.Trim(hosts, ","); hosts != "" {
+		a.Hosts = strings.Split(hosts, ",")
+	}
+	return a, err
+}
+
+// Add stores a new annotation
+func (an *Annotations) Add(id string, d annotationData, createdBy string) (Annotation, error) {
+	now := time.Now()
+	starts, ends, hosts, err := d.validate(now)
+	if err != nil {
+		return Annotation{}, err
+	}
+	_, err = an.db.Exec(`INSERT INTO annotations (id, kind, starts_at, ends_at, hosts, note, internal, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, id, d.Kind, starts, ends, hosts, strings.TrimSpace(d.Note), d.Internal, createdBy, store.FormatTime(now), store.FormatTime(now))
+	if err != nil {
+		return Annotation{}, err
+	}
+	return an.Get(id)
+}
+
+// Update replaces an annotation's editable fields
+func (an *Annotations) Update(id string, d annotationData) (Annotation, error) {
+	now := time.Now()
+	starts, ends, hosts, err := d.validate(now)
+	if err != nil {
+		return Annotation{}, err
+	}
+	res, err := an.db.Exec(`UPDATE annotations SET kind = ?, starts_at = ?, ends_at = ?, hosts = ?, note = ?, internal = ?,
+		version = version + 1, updated_at = ? WHERE id = ?`,
+		d.Kind, starts, ends, hosts, strings.TrimSpace(d.Note), d.Internal, store.FormatTime(now), id)
+	if err != nil {
+		return Annotation{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Annotation{}, errAnnotationNotFound
+	}
+	return an.Get(id)
+}
+
+func (an *Annotations) Get(id string) (Annotation, error) {
+	a, err := scanAnnotation(an.db.QueryRow("SELECT "+annotationColumns+" FROM annotations WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return a, errAnnotationNotFound
+	}
+	return a, err
+}
+
+func (an *Annotations) Delete(id string) (bool, error) {
+	res, err := an.db.Exec("DELETE FROM annotations WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// annotationCollection exposes the annotations table as the "annotations"
+// admin kind; data is an annotationData
+type annotationCollection struct {
+	an *Annotations
+}
+
+func (c annotationCollection) object(a Annotation, version int64, updatedAt string) AdminObject {
+	data, _ := json.Marshal(annotationData{Kind: a.Kind, StartsAt: a.StartsAt, EndsAt: a.EndsAt, Hosts: a.Hosts, Note: a.Note, Internal: a.Internal})
+	return AdminObject{ID: a.ID, Data: data, Version: version, UpdatedAt: updatedAt}
+}
+
+func (c annotationCollection) List() ([]AdminObject, error) {
+	rows, err := c.an.db.Query("SELECT " + annotationColumns + ", version, updated_at FROM annotations ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []AdminObject{}
+	for rows.Next() {
+		var version int64
+		var updatedAt string
+		a, err := scanAnnotation(rows, &version, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, c.object(a, version, updatedAt))
+	}
+	return objects, rows.Err()
+}
+
+func (c annotationCollection) Get(id string) (AdminObject, error) {
+	var version int64
+	var updatedAt string
+	row := c.an.db.QueryRow("SELECT "+annotationColumns+", version, updated_at FROM annotations WHERE id = ?", id)
+	a, err := scanAnnotation(row, &version, &updatedAt)
+	if err == sql.ErrNoRows {
+		return AdminObject{}, errAdminNotFound
+	}
+	if err != nil {
+		return AdminObject{}, err
+	}
+	return c.object(a, version, updatedAt), nil
+}
+
+func (c annotationCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	var d annotationData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+	now := time.Now()
+	starts, ends, hosts, err := d.validate(now)
+	if err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+
+	_, err = c.Get(id)
+	switch {
+	case err == errAdminNotFound:
+		if ifMatch > 0 {
+			return AdminObject{}, errAdminNotFound
+		}
+		if _, err := c.an.Add(id, d, ""); err != nil {
+			return AdminObject{}, err
+		}
+	case err != nil:
+		return AdminObject{}, err
+	case ifMatch < 0:
+		return AdminObject{}, errAdminAlreadyExists
+	case ifMatch == 0:
+		return AdminObject{}, errAdminPreconditionNeeded
+	default:
+		res, err := c.an.db.Exec(`UPDATE annotations SET kind = ?, starts_at = ?, ends_at = ?, hosts = ?, note = ?, internal = ?,
+			version = version + 1, updated_at = ? WHERE id = ? AND version = ?`,
+			d.Kind, starts, ends, hosts, strings.TrimSpace(d.Note), d.Internal, store.FormatTime(now), id, ifMatch)
+		if err != nil {
+			return AdminObject{}, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return AdminObject{}, errAdminVersionMismatch
+		}
+	}
+	return c.Get(id)
+}
+
+func (c annotationCollection) Delete(id string, ifMatch int64) error {
+	if ifMatch == 0 {
+		return errAdminPreconditionNeeded
+	}
+	res, err := c.an.db.Exec("DELETE FROM annotations WHERE id = ? AND version = ?", id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.Get(id); errors.Is(err, errAdminNotFound) {
+			return errAdminNotFound
+		}
+		return errAdminVersionMismatch
+	}
+	return nil
+}
+
+// List returns the annotations overlapping [from, until), oldest first.
+// Either end may be empty for an open range; host, if set, keeps those that
+// cover it.
+func (an *Annotations) List(from, until, host string) ([]Annotation, error) {
+	return listAnnotations(an.db, from, until, host)
+}
+
+// listAnnotations is List on any database with the annotations table, such
+// as the reporter's read connection
+func listAnnotations(db *sql.DB, from, until, host string) ([]Annotation, error) {
+	query := "SELECT " + annotationColumns + " FROM annotations WHERE 1=1"
+	var args []interface{}
+	if from != "" {
+		query += " AND (ends_at IS NULL OR ends_at > ?)"
+		args = append(args, from)
+	}
+	if until != "" {
+		query += " AND starts_at < ?"
+		args = append(args, until)
+	}
+	if host != "" {
+		query += " AND (hosts = '' OR instr(hosts, ?) > 0)"
+		args = append(args, ","+strings.ToLower(host)+",")
+	}
+	rows, err := db.Query(query+" ORDER BY starts_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Annotation{}
+	for rows.Next() {
+		a, err := scanAnnotation(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// Covers reports whether a covers host
+func (a Annotation) Covers(host string) bool {
+	if len(a.Hosts) == 0 {
+		return true
+	}
+	for _, h := range a.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether a is in effect at t (in the stored layout)
+func (a Annotation) Active(t string) bool {
+	return a.StartsAt <= t && (a.EndsAt == "" || a.EndsAt > t)
+}
+
+// visibleAnnotations keeps the annotations user may see: those for all hosts
+// and those on at least one of theirs, with the others' names dropped
+func visibleAnnotations(list []Annotation, user *User) []Annotation {
+	if user == nil || len(user.Hosts) == 0 {
+		return list
+	}
+	visible := []Annotation{}
+	for _, a := range list {
+		if len(a.Hosts) == 0 {
+			visible = append(visible, a)
+			continue
+		}
+		var hosts []string
+		for _, h := range a.Hosts {
+			if user.CanSee(h) {
+				hosts = append(hosts, h)
+			}
+		}
+		if len(hosts) > 0 {
+			a.Hosts = hosts
+			visible = append(visible, a)
+		}
+	}
+	return visible
+}
+
+// /_proxy/annotations[/{id}]:
+//
+//	GET    /annotations?since=7d&until=2024-01-02&host=example.com&kind=incident&tz=Europe/Berlin
+//	GET    /annotations/{id}
+//	POST   /annotations       {"kind": "incident", "starts_at": "...", "duration": "2h", "hosts": ["example.com"], "note": "..."}  (admin)
+//	PUT    /annotations/{id}  the same fields; leaving ends_at out reopens it  (admin)
+//	DELETE /annotations/{id}  (admin)
+func (app *App) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/annotations"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		query := r.URL.Query()
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format, err := exportFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var bounds [2]string
+		for i, param := range []string{"since", "until"} {
+			if v := query.Get(param); v != "" {
+				if bounds[i], err = parseTimeParam(v, loc); err != nil {
+					http.Error(w, param+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		list, err := app.annotations.List(bounds[0], bounds[1], query.Get("host"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = visibleAnnotations(list, requestUser(r))
+		filtered := []Annotation{}
+		for _, a := range list {
+			if kind := query.Get("kind"); kind != "" && a.Kind != kind {
+				continue
+			}
+			a.StartsAt = formatStoredTime(a.StartsAt, loc)
+			if a.EndsAt != "" {
+				a.EndsAt = formatStoredTime(a.EndsAt, loc)
+			}
+			a.CreatedAt = formatStoredTime(a.CreatedAt, loc)
+			filtered = append(filtered, a)
+		}
+		writeList(w, format, "annotations", filtered)
+
+	case r.Method == http.MethodGet:
+		a, err := app.annotations.Get(id)
+		if err != nil {
+			annotationError(w, err)
+			return
+		}
+		visible := visibleAnnotations([]Annotation{a}, requestUser(r))
+		if len(visible) == 0 {
+			annotationError(w, errAnnotationNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(visible[0])
+
+	case r.Method == http.MethodPost && id == "", r.Method == http.MethodPut && id != "":
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		var d annotationData
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&d); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Users limited to some hosts annotate only those
+		if user := requestUser(r); user != nil && len(user.Hosts) > 0 {
+			if len(d.Hosts) == 0 {
+				http.Error(w, "hosts required", http.StatusBadRequest)
+				return
+			}
+			for _, h := range d.Hosts {
+				if !user.CanSee(h) {
+					http.Error(w, "Unknown host "+h, http.StatusNotFound)
+					return
+				}
+			}
+		}
+		var a Annotation
+		var err error
+		status := http.StatusOK
+		if id == "" {
+			createdBy := ""
+			if u := app.admin.Authenticate(r); u != nil {
+				createdBy = u.Name
+			}
+			a, err = app.annotations.Add(newAdminID(), d, createdBy)
+			status = http.StatusCreated
+		} else {
+			a, err = app.annotations.Update(id, d)
+		}
+		if err != nil {
+			annotationError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(a)
+
+	case r.Method == http.MethodDelete && id != "":
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		if a, err := app.annotations.Get(id); err == nil && len(visibleAnnotations([]Annotation{a}, requestUser(r))) == 0 {
+			annotationError(w, errAnnotationNotFound)
+			return
+		}
+		found, err := app.annotations.Delete(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			annotationError(w, errAnnotationNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// annotationError answers with 404 for a missing annotation, else 400: the
+// store's other errors are all about the request
+func annotationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAnnotationNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// publicAnnotations lists the annotations a public page about hosts may show
+// over [from, until): not internal, and naming only those hosts
+func (app *App) publicAnnotations(from, until string, hosts []string) []Annotation {
+	list, err := app.annotations.List(from, until, "")
+	if err != nil {
+		return []Annotation{}
+	}
+	public := []Annotation{}
+	for _, a := range list {
+		if a.Internal {
+			continue
+		}
+		if len(a.Hosts) > 0 && hosts != nil {
+			var shown []string
+			for _, h := range hosts {
+				if a.Covers(h) {
+					shown = append(shown, h)
+				}
+			}
+			if len(shown) == 0 {
+				continue
+			}
+			a.Hosts = shown
+		}
+		a.CreatedBy = ""
+		public = append(public, a)
+	}
+	return public
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// How often retention pruning runs
+const retentionInterval = time.Hour
+
+// Retention deletes connections older than CONNECTION_RETENTION from every
+// database. With ARCHIVE_CONNECTIONS the expiring rows are first appended to
+// gzipped NDJSON files under DATA_DIR/archive, one per database and UTC day,
+// and only deleted once their file is written and synced.
+type Retention struct {
+	keep      time.Duration
+	archive   string // archive directory, or "" to hard-delete
+	databases func() map[string]*sql.DB
+	scan      func(row interface{ Scan(...interface{}) error }) (ConnectionLog, error)
+
+	mu        sync.Mutex
+	lastRun   time.Time
+	lastError string
+	archived  int64
+	pruned    int64
+}
+
+func NewRetention(keep time.Duration, archiveDir string, databases func() map[string]*sql.DB,
+	scan func(row interface{ Scan(...interface{}) error }) (ConnectionLog, error)) (*Retention, error) {
+	if archiveDir != "" {
+		if err := os.MkdirAll(archiveDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Retention{keep: keep, archive: archiveDir, databases: databases, scan: scan}, nil
+}
+
+// Run prunes every interval, starting immediately
+func (rt *Retention) Run(interval time.Duration) {
+	for {
+		rt.PruneAll()
+		time.Sleep(interval)
+	}
+}
+
+func (rt *Retention) PruneAll() {
+	cutoff := store.FormatTime(time.Now().Add(-rt.keep))
+	var errs []string
+	var archived, pruned int64
+	for name, db := range rt.databases() {
+		var n int64
+		var err error
+		if rt.archive != "" {
+			n, err = rt.archiveBefore(name, db, cutoff)
+			archived += n
+		} else {
+			n, err = pruneTable(db, "connections", cutoff)
+		}
+		pruned += n
+		if err != nil {
+			slog.Error("Retention: pruning failed", "database", name, "err", err)
+			errs = append(errs, name+": "+err.Error())
+		}
+	}
+	if pruned > 0 {
+		slog.Info("Retention: pruned old connections", "rows", pruned, "archived", archived, "older_than", rt.keep)
+	}
+	rt.mu.Lock()
+	rt.lastRun = time.Now()
+	rt.lastError = strings.Join(errs, "; ")
+	rt.archived += archived
+	rt.pruned += pruned
+	rt.mu.Unlock()
+}
+
+// archiveBefore moves db's rows older than cutoff into the archive a day at
+// a time, oldest first
+func (rt *Retention) archiveBefore(name string, db *sql.DB, cutoff string) (int64, error) {
+	var total int64
+	for {
+		var oldest sql.NullString
+		if err := db.QueryRow("SELECT MIN(timestamp) FROM connections WHERE timestamp < ?", cutoff).Scan(&oldest); err != nil {
+			return total, err
+		}
+		if !oldest.Valid {
+			return total, nil
+		}
+		day, err := time.Parse("2006-01-02", oldest.String[:min(len(oldest.String), 10)])
+		if err != nil {
+			return total, fmt.Errorf("unexpected timestamp %q", oldest.String)
+		}
+		end := store.FormatTime(day.AddDate(0, 0, 1))
+		if end > cutoff {
+			end = cutoff
+		}
+		n, err := rt.archiveRange(name, db, day, oldest.String, end)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// archiveRange appends the rows in [start, end) to day's archive file as a
+// new gzip member, then deletes them. Rows written meanwhile get higher ids
+// and are left for the next round.
+func (rt *Retention) archiveRange(name string, db *sql.DB, day time.Time, start, end string) (int64, error) {
+	path := archivePath(rt.archive, name, day)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	var maxID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM connections WHERE timestamp >= ? AND timestamp < ?", start, end).Scan(&maxID); err != nil {
+		return 0, err
+	}
+	rows, err := db.Query("SELECT "+connectionColumns+" FROM connections WHERE timestamp >= ? AND timestamp < ? AND id <= ? ORDER BY seq",
+		start, end, maxID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	var n int64
+	for rows.Next() {
+		c, err := rt.scan(rows)
+		if err != nil {
+			return 0, err
+		}
+		// The triage tag is looked up when reading, it isn't part of the row
+		c.Tag = ""
+		if err := enc.Encode(c); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	// Written; now the rows can go, in batches so writers aren't locked out
+	var deleted int64
+	for {
+		res, err := db.Exec("DELETE FROM connections WHERE id IN (SELECT id FROM connections WHERE timestamp >= ? AND timestamp < ? AND id <= ? LIMIT ?)",
+			start, end, maxID, pruneBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		k, _ := res.RowsAffected()
+		deleted += k
+		if k < pruneBatchSize {
+			break
+		}
+	}
+	if deleted != n {
+		slog.Warn("Retention: archived and deleted row counts differ", "database", name, "day", day.Format("2006-01-02"), "archived", n, "deleted", deleted)
+	}
+	return deleted, nil
+}
+
+// archivePath is the file a database's rows from day are archived to, e.g.
+// archive/connections/2026-01-31.ndjson.gz or
+// archive/hosts/blog.example.com/2026-01-31.ndjson.gz
+func archivePath(dir, name string, day time.Time) string {
+	return filepath.Join(dir, filepath.FromSlash(name), day.Format("2006-01-02")+".ndjson.gz")
+}
+
+func (rt *Retention) Info() map[string]interface{} {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	info := map[string]interface{}{
+		"keep":        rt.keep.String(),
+		"archiving":   rt.archive != "",
+		"pruned_rows": rt.pruned,
+		"error":       rt.lastError,
+	}
+	if rt.archive != "" {
+		info["archived_rows"] = rt.archived
+	}
+	if !rt.lastRun.IsZero() {
+		info["last_run"] = rt.lastRun.Format(time.RFC3339)
+	}
+	return info
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Archived days loaded at once, and how long one stays loaded after it was
+// last queried
+const (
+	maxLoadedArchives = 4
+	archiveLoadTTL    = time.Hour
+)
+
+// ArchiveStore loads days archived by ARCHIVE_CONNECTIONS back into scratch
+// in-memory databases, so an investigation can query them through the
+// normal API with ?archive=. Nothing is written back to the live databases.
+type ArchiveStore struct {
+	dir string
+
+	mu     sync.Mutex
+	loaded map[string]*LoadedArchive // by name, e.g. connections/2025-01-31
+}
+
+// LoadedArchive is an archived day held in a scratch database
+type LoadedArchive struct {
+	Name      string    `json:"name"`
+	Rows      int64     `json:"rows"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	db        *sql.DB
+}
+
+// ArchiveFile is one database's archive of one day
+type ArchiveFile struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	Loaded bool   `json:"loaded"`
+}
+
+func NewArchiveStore(dir string) *ArchiveStore {
+	return &ArchiveStore{dir: dir, loaded: make(map[string]*LoadedArchive)}
+}
+
+// parseArchiveName splits an archive name into its database and day. A bare
+// day means the main database's archive.
+func parseArchiveName(name string) (database, day string, err error) {
+	name = strings.Trim(name, "/")
+	database, day = "connections", name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		database, day = name[:i], name[i+1:]
+	}
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		return "", "", fmt.Errorf("invalid archive day %q (expected YYYY-MM-DD)", day)
+	}
+	host, partitioned := strings.CutPrefix(database, "hosts/")
+	if database != "connections" && (!partitioned || host == "" || strings.ContainsAny(host, `/\`) || strings.HasPrefix(host, ".")) {
+		return "", "", fmt.Errorf("invalid archive database %q (expected connections or hosts/<hostname>)", database)
+	}
+	return database, day, nil
+}
+
+// path is the archive file for a name accepted by parseArchiveName
+func (a *ArchiveStore) path(name string) (string, string, error) {
+	database, day, err := parseArchiveName(name)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(a.dir, filepath.FromSlash(database), day+".ndjson.gz"), database + "/" + day, nil
+}
+
+// List returns every archived day, oldest first per database
+func (a *ArchiveStore) List() ([]ArchiveFile, error) {
+	var files []ArchiveFile
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".ndjson.gz") {
+			return nil
+		}
+		rel, _ := filepath.Rel(a.dir, strings.TrimSuffix(path, ".ndjson.gz"))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, ArchiveFile{Name: filepath.ToSlash(rel), Bytes: info.Size()})
+		return nil
+	})
+	a.mu.Lock()
+	for i := range files {
+		files[i].Loaded = a.loaded[files[i].Name] != nil
+	}
+	a.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, err
+}
+
+// Loaded lists the days currently in scratch databases
+func (a *ArchiveStore) Loaded() []LoadedArchive {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]LoadedArchive, 0, len(a.loaded))
+	for _, la := range a.loaded {
+		list = append(list, *la)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Load reads an archived day into a fresh scratch database, or extends the
+// stay of one already loaded
+func (a *ArchiveStore) Load(name string) (LoadedArchive, error) {
+	path, name, err := a.path(name)
+	if err != nil {
+		return LoadedArchive{}, err
+	}
+	a.mu.Lock()
+	if la := a.loaded[name]; la != nil {
+		la.ExpiresAt = time.Now().Add(archiveLoadTTL)
+		a.mu.Unlock()
+		return *la, nil
+	}
+	full := len(a.loaded) >= maxLoadedArchives
+	a.mu.Unlock()
+	if full {
+		return LoadedArchive{}, fmt.Errorf("%d archived days are loaded already; unload one first", maxLoadedArchives)
+	}
+
+	db, err := store.OpenMemory(fmt.Sprintf("archive-%s-%d", name, time.Now().UnixNano()))
+	if err != nil {
+		return LoadedArchive{}, err
+	}
+	n, err := importArchive(path, db, false)
+	if err != nil {
+		db.Close()
+		return LoadedArchive{}, err
+	}
+	now := time.Now()
+	la := &LoadedArchive{Name: name, Rows: n, LoadedAt: now, ExpiresAt: now.Add(archiveLoadTTL), db: db}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if prev := a.loaded[name]; prev != nil {
+		// Loaded by a concurrent request meanwhile
+		db.Close()
+		return *prev, nil
+	}
+	a.loaded[name] = la
+	return *la, nil
+}
+
+// Reader returns the scratch database for a loaded day and extends its
+// stay, or nil
+func (a *ArchiveStore) Reader(name string) *sql.DB {
+	_, name, err := a.path(name)
+	if err != nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	la := a.loaded[name]
+	if la == nil {
+		return nil
+	}
+	la.ExpiresAt = time.Now().Add(archiveLoadTTL)
+	return la.db
+}
+
+// Unload drops a loaded day's scratch database
+func (a *ArchiveStore) Unload(name string) bool {
+	_, name, err := a.path(name)
+	if err != nil {
+		return false
+	}
+	a.mu.Lock()
+	la := a.loaded[name]
+	delete(a.loaded, name)
+	a.mu.Unlock()
+	if la == nil {
+		return false
+	}
+	la.db.Close()
+	return true
+}
+
+// Run unloads days that haven't been queried for archiveLoadTTL
+func (a *ArchiveStore) Run() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		var expired []*LoadedArchive
+		a.mu.Lock()
+		for name, la := range a.loaded {
+			if now.After(la.ExpiresAt) {
+				expired = append(expired, la)
+				delete(a.loaded, name)
+			}
+		}
+		a.mu.Unlock()
+		for _, la := range expired {
+			la.db.Close()
+		}
+	}
+}
+
+// importArchive inserts the rows of an archive file into db's connections,
+// creating the schema first. With skipExisting, rows whose seq db already
+// has are left out, so a day can be imported again safely.
+func importArchive(path string, db *sql.DB, skipExisting bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.CreateSchema(db); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(insertConnectionSQL)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var c ConnectionLog
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		if c.Timestamp, err = time.Parse(time.RFC3339, c.TimestampStr); err != nil {
+			return 0, fmt.Errorf("line %d: invalid timestamp %q", line, c.TimestampStr)
+		}
+		if skipExisting && c.Seq != "" {
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM connections WHERE seq = ?)", c.Seq).Scan(&exists); err != nil {
+				return 0, err
+			}
+			if exists {
+				continue
+			}
+		}
+		if _, err := insert.Exec(connectionArgs(c)...); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+type archiveDBKey struct{}
+
+// archiveReader points readerFor at a loaded archived day when the request
+// asks for one with ?archive=
+func (app *App) archiveReader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("archive")
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		db := app.archives.Reader(name)
+		if db == nil {
+			http.Error(w, "Archive "+name+" isn't loaded; POST to /archive/"+name+" first", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), archiveDBKey{}, db)))
+	})
+}
+
+// GET /_proxy/archive                    - archived days and the ones loaded
+// POST /_proxy/archive/{name}            - load a day, e.g. 2025-01-31 or hosts/blog.example.com/2025-01-31
+// DELETE /_proxy/archive/{name}          - unload it
+func (app *App) handleArchive(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/archive"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		files, err := app.archives.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if files == nil {
+			files = []ArchiveFile{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files, "loaded": app.archives.Loaded()})
+	case r.Method == http.MethodPost && name != "":
+		la, err := app.archives.Load(name)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "No archive for "+name, http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(la)
+	case r.Method == http.MethodDelete && name != "":
+		if !app.archives.Unload(name) {
+			http.Error(w, name+" isn't loaded", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func runArchive(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s archive list\n       %s archive import NAME\n", os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 || args[0] != "list" && args[0] != "import" {
+		usage()
+	}
+	fs := flag.NewFlagSet("archive "+args[0], flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding archive/")
+	fs.Parse(args[1:])
+	archives := NewArchiveStore(*dataDir + "/archive")
+
+	if args[0] == "list" {
+		files, err := archives.List()
+		if err != nil {
+			log.Fatalf("archive: %v", err)
+		}
+		for _, f := range files {
+			fmt.Printf("%s\t%s\n", f.Name, formatBytes(uint64(f.Bytes)))
+		}
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path, name, err := archives.path(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("archive: %v", err)
+	}
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("archive: %v", err)
+	}
+	database, _, _ := parseArchiveName(name)
+	db, err := store.Open(filepath.Join(*dataDir, filepath.FromSlash(database)+".db"))
+	if err != nil {
+		log.Fatalf("archive: %v", err)
+	}
+	defer db.Close()
+	n, err := importArchive(path, db, true)
+	if err != nil {
+		log.Fatalf("archive: %s: %v", name, err)
+	}
+	fmt.Printf("%s: %d rows imported into %s.db\n", name, n, database)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	robotsPath  = "/robots.txt"
+	faviconPath = "/favicon.ico"
+)
+
+// assetPolicy answers /robots.txt and /favicon.ico for a host at the proxy,
+// so crawlers and browsers don't reach (and 404 at) the backend
+type assetPolicy struct {
+	robots      []byte // nil passes the request through
+	favicon     []byte // nil passes through; empty answers 204
+	faviconType string
+	quiet       bool // don't log requests for either path
+	modTime     time.Time
+}
+
+// newAssetPolicy builds the policy from a route's robots, favicon and
+// quiet_assets options, or returns nil when none are set
+func newAssetPolicy(cfg ProxyConfig) (*assetPolicy, error) {
+	if cfg.Robots == "" && cfg.Favicon == "" && !cfg.QuietAssets {
+		return nil, nil
+	}
+	p := &assetPolicy{quiet: cfg.QuietAssets, modTime: time.Now()}
+
+	switch cfg.Robots {
+	case "":
+	case "disallow":
+		p.robots = []byte("User-agent: *\nDisallow: /\n")
+	case "allow":
+		p.robots = []byte("User-agent: *\nDisallow:\n")
+	default:
+		data, err := os.ReadFile(cfg.Robots)
+		if err != nil {
+			return nil, fmt.Errorf("robots: %w", err)
+		}
+		p.robots = data
+	}
+
+	switch cfg.Favicon {
+	case "":
+	case "none":
+		p.favicon = []byte{}
+	case "default":
+		p.favicon, p.faviconType = defaultFavicon, "image/png"
+	default:
+		data, err := os.ReadFile(cfg.Favicon)
+		if err != nil {
+			return nil, fmt.Errorf("favicon: %w", err)
+		}
+		p.favicon = data
+		if p.faviconType = mime.TypeByExtension(filepath.Ext(cfg.Favicon)); p.faviconType == "" {
+			p.faviconType = "image/x-icon"
+		}
+	}
+	return p, nil
+}
+
+// Quiet reports whether a request for path shouldn't be logged
+func (p *assetPolicy) Quiet(path string) bool {
+	return p != nil && p.quiet && (path == robotsPath || path == faviconPath)
+}
+
+// Serve answers the request if the policy covers it
+func (p *assetPolicy) Serve(w http.ResponseWriter, r *http.Request) bool {
+	if p == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	var body []byte
+	var contentType string
+	switch r.URL.Path {
+	case robotsPath:
+		body, contentType = p.robots, "text/plain; charset=utf-8"
+	case faviconPath:
+		body, contentType = p.favicon, p.faviconType
+	}
+	if body == nil {
+		return false
+	}
+	if len(body) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(24*60*60))
+	http.ServeContent(w, r, "", p.modTime, bytes.NewReader(body))
+	return true
+}
+
+// defaultFavicon is a 16x16 orange dot, drawn once at startup
+var defaultFavicon = func() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	orange := color.NRGBA{R: 0xf4, G: 0x81, B: 0x20, A: 0xff}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			dx, dy := float64(x)-7.5, float64(y)-7.5
+			if dx*dx+dy*dy <= 7.5*7.5 {
+				img.Set(x, y, orange)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}()
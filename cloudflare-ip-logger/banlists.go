@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/clientip"
+	"cf-ip-logger/pkg/store"
+)
+
+// Largest ban list read, from a request body or a download
+const maxBanListSize = 16 << 20
+
+// Names a list's bans are stored under
+var banSourcePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// BanImport is what replacing one source's bans with a list did
+type BanImport struct {
+	Source  string `json:"source"`
+	Added   int    `json:"added"`
+	Kept    int    `json:"kept"`    // already on the list; reason and expiry refreshed
+	Removed int    `json:"removed"` // no longer on the list
+	Invalid int    `json:"invalid"` // lines that aren't an IP or CIDR
+}
+
+type banListEntry struct {
+	cidr   string
+	reason string
+}
+
+// parseBanList reads one IP or CIDR per line, as in Spamhaus DROP
+// ("1.10.16.0/20 ; SBL256894"), FireHOL netsets or an export of this
+// logger's. Text after ; or # is the entry's reason; blank and comment
+// lines are skipped.
+func parseBanList(r io.Reader) ([]banListEntry, int, error) {
+	var entries []banListEntry
+	invalid := 0
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(io.LimitReader(r, maxBanListSize))
+	for scanner.Scan() {
+		line, comment := scanner.Text(), ""
+		if i := strings.IndexAny(line, ";#"); i >= 0 {
+			line, comment = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ipNet := clientip.ParseIPOrCIDR(fields[0])
+		if ipNet == nil {
+			invalid++
+			continue
+		}
+		if cidr := ipNet.String(); !seen[cidr] {
+			seen[cidr] = true
+			entries = append(entries, banListEntry{cidr: cidr, reason: comment})
+		}
+	}
+	return entries, invalid, scanner.Err()
+}
+
+// Import replaces source's bans with entries in one transaction: new ones
+// are added, ones still listed keep their id with the reason, expiry and
+// observe flag refreshed, and ones no longer listed are removed. Bans by
+// hand and from other sources are left alone. reason is used for entries
+// without their own.
+func (bl *BanList) Import(source string, entries []banListEntry, reason string, expires sql.NullString, observe bool) (BanImport, error) {
+	res := BanImport{Source: source}
+	if !banSourcePattern.MatchString(source) {
+		return res, fmt.Errorf("invalid source %q (letters, digits, '.', '_' and '-')", source)
+	}
+	tx, err := bl.db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	existing := make(map[string]string)
+	rows, err := tx.Query("SELECT id, cidr FROM bans WHERE source = ?", source)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		var id, cidr string
+		if rows.Scan(&id, &cidr) == nil {
+			existing[cidr] = id
+		}
+	}
+	rows.Close()
+
+	now := store.FormatTime(time.Now())
+	for _, e := range entries {
+		r := orDefault(e.reason, orDefault(reason, source))
+		if id, ok := existing[e.cidr]; ok {
+			delete(existing, e.cidr)
+			_, err = tx.Exec(`UPDATE bans SET reason = ?, expires_at = ?, observe = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+				r, expires, observe, now, id)
+			res.Kept++
+		} else {
+			_, err = tx.Exec(`INSERT INTO bans (id, cidr, reason, expires_at, observe, source, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, newAdminID(), e.cidr, r, expires, observe, source, now, now)
+			res.Added++
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	for _, id := range existing {
+		if _, err := tx.Exec("DELETE FROM bans WHERE id = ?", id); err != nil {
+			return res, err
+		}
+		res.Removed++
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+
+	msg := fmt.Sprintf("Imported ban list %s: %d added, %d kept, %d removed", source, res.Added, res.Kept, res.Removed)
+	slog.Info("Imported ban list", "source", source, "added", res.Added, "kept", res.Kept, "removed", res.Removed)
+	if res.Added > 0 || res.Removed > 0 {
+		bl.event(Event{Kind: "ban", Severity: severityInfo, Message: msg})
+	}
+	return res, bl.reload()
+}
+
+// RemoveSource deletes all of one imported list's bans
+func (bl *BanList) RemoveSource(source string) (int64, error) {
+	res, err := bl.db.Exec("DELETE FROM bans WHERE source = ?", source)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		slog.Info("Removed ban list", "source", source, "bans", n)
+		bl.event(Event{Kind: "ban", Message: fmt.Sprintf("Removed %d bans from %s", n, source)})
+	}
+	return n, bl.reload()
+}
+
+// writeBanList writes bans in the format parseBanList reads, so an export
+// can be imported elsewhere with its reasons
+func writeBanList(w io.Writer, bans []Ban) {
+	fmt.Fprintf(w, "; cf-ip-logger bans, exported %s\n", store.FormatTime(time.Now()))
+	for _, b := range bans {
+		if b.Reason != "" {
+			fmt.Fprintf(w, "%s ; %s\n", b.CIDR, b.Reason)
+		} else {
+			fmt.Fprintln(w, b.CIDR)
+		}
+	}
+}
+
+// POST /_proxy/bans/import?source=spamhaus-drop&duration=48h&reason=...&observe=true
+//
+// The body is the list, one IP or CIDR per line.
+func (app *App) handleBanImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	// validate only looks at the expiry here; the entries bring their CIDRs
+	_, expires, err := banData{CIDR: "0.0.0.0/32", Duration: query.Get("duration"), ExpiresAt: query.Get("expires_at")}.validate(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, invalid, err := parseBanList(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := app.bans.Import(query.Get("source"), entries, query.Get("reason"), expires, query.Get("observe") == "true")
+	res.Invalid = invalid
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// GET /_proxy/bans/export?source=spamhaus-drop - the bans as a list import reads
+func (app *App) handleBanExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bans, err := app.bans.List(r.URL.Query().Get("source"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeBanList(w, bans)
+}
+
+// BanFeed is a published list imported every BAN_LIST_INTERVAL
+type BanFeed struct {
+	Source string
+	URL    string
+}
+
+// parseBanFeeds reads BAN_LISTS, "spamhaus-drop=https://www.spamhaus.org/drop/drop.txt,..."
+func parseBanFeeds(spec string) ([]BanFeed, error) {
+	var feeds []BanFeed
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		source, url, ok := strings.Cut(entry, "=")
+		source, url = strings.TrimSpace(source), strings.TrimSpace(url)
+		if !ok || !banSourcePattern.MatchString(source) || !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("%q: expected source=http(s) URL", entry)
+		}
+		feeds = append(feeds, BanFeed{Source: source, URL: url})
+	}
+	return feeds, nil
+}
+
+// fetchBanList downloads and parses one list
+func fetchBanList(ctx context.Context, url string) ([]banListEntry, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", "cf-ip-logger")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return parseBanList(resp.Body)
+}
+
+// FeedLoop imports each feed at startup and every interval. Its bans expire
+// after three intervals, so a list that can no longer be fetched lapses
+// instead of blocking forever; a list that comes back empty is not applied.
+func (bl *BanList) FeedLoop(feeds []BanFeed, interval time.Duration) {
+	for {
+		for _, f := range feeds {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			entries, invalid, err := fetchBanList(ctx, f.URL)
+			cancel()
+			if err == nil && len(entries) == 0 {
+				err = fmt.Errorf("no entries in %s", f.URL)
+			}
+			if err != nil {
+				slog.Warn("Ban list not updated", "source", f.Source, "err", err)
+				bl.event(Event{Kind: "ban", Severity: severityWarning, Message: fmt.Sprintf("Ban list %s not updated: %v", f.Source, err)})
+				continue
+			}
+			expires := sql.NullString{String: store.FormatTime(time.Now().Add(3 * interval)), Valid: true}
+			if _, err := bl.Import(f.Source, entries, "", expires, false); err != nil {
+				slog.Error("Ban list import failed", "source", f.Source, "err", err)
+			} else if invalid > 0 {
+				slog.Info("Ban list lines skipped", "source", f.Source, "lines", invalid)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// runBans implements `cf-ip-logger bans import|export` against the database
+// directly. A running instance picks up imported bans within a minute.
+func runBans(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bans import -source NAME [flags] FILE|URL|-\n       %s bans export [-source NAME]\n", os.Args[0], os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 || args[0] != "import" && args[0] != "export" {
+		usage()
+	}
+	fs := flag.NewFlagSet("bans "+args[0], flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding connections.db")
+	source := fs.String("source", "", "name of the list; import replaces this source's bans, export lists only them")
+	duration := fs.String("duration", "", "with import, expire the bans after this long, e.g. 48h or 7d (default never)")
+	reason := fs.String("reason", "", "with import, reason for entries without their own (default the source)")
+	observe := fs.Bool("observe", false, "with import, only log matching requests")
+	fs.Parse(args[1:])
+	if args[0] == "import" && (*source == "" || fs.NArg() != 1) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("bans: %v", err)
+	}
+	db, err := store.Open(*dataDir + "/connections.db")
+	if err != nil {
+		log.Fatalf("bans: %v", err)
+	}
+	defer db.Close()
+	bl, err := NewBanList(db)
+	if err != nil {
+		log.Fatalf("bans: %v", err)
+	}
+
+	if args[0] == "export" {
+		bans, err := bl.List(*source)
+		if err != nil {
+			log.Fatalf("bans: %v", err)
+		}
+		writeBanList(os.Stdout, bans)
+		return
+	}
+
+	_, expires, err := banData{CIDR: "0.0.0.0/32", Duration: *duration}.validate(time.Now())
+	if err != nil {
+		log.Fatalf("bans: %v", err)
+	}
+	var entries []banListEntry
+	var invalid int
+	switch from := fs.Arg(0); {
+	case strings.HasPrefix(from, "http://") || strings.HasPrefix(from, "https://"):
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		entries, invalid, err = fetchBanList(ctx, from)
+		cancel()
+	case from == "-":
+		entries, invalid, err = parseBanList(os.Stdin)
+	default:
+		var f *os.File
+		if f, err = os.Open(from); err == nil {
+			entries, invalid, err = parseBanList(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Fatalf("bans: %v", err)
+	}
+	res, err := bl.Import(*source, entries, *reason, expires, *observe)
+	if err != nil {
+		log.Fatalf("bans: %v", err)
+	}
+	fmt.Printf("%s: %d added, %d kept, %d removed, %d invalid lines\n", res.Source, res.Added, res.Kept, res.Removed, invalid)
+}
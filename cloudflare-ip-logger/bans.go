@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/clientip"
+	"cf-ip-logger/pkg/store"
+)
+
+// Requests refused because the client is banned, served at /debug/vars
+var bannedRequests = expvar.NewInt("banned_requests")
+
+// Ban blocks an IP or CIDR, optionally until ExpiresAt
+type Ban struct {
+	ID        string `json:"id"`
+	CIDR      string `json:"cidr"`
+	Reason    string `json:"reason"`
+	ExpiresAt string `json:"expires_at,omitempty"` // empty = permanent
+	Observe   bool   `json:"observe,omitempty"`    // log matching requests instead of refusing them
+	Source    string `json:"source,omitempty"`     // the imported list it came from; empty for bans made by hand
+	CreatedAt string `json:"created_at"`
+}
+
+// banData is the editable part of a ban, as sent by clients
+type banData struct {
+	IP        string `json:"ip,omitempty"` // alias for cidr
+	CIDR      string `json:"cidr,omitempty"`
+	Reason    string `json:"reason"`
+	Duration  string `json:"duration,omitempty"` // e.g. 24h or 7d, instead of expires_at
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Observe   bool   `json:"observe,omitempty"`
+	Source    string `json:"source,omitempty"`
+}
+
+type banEntry struct {
+	ban     Ban
+	net     *net.IPNet
+	expires time.Time // zero = permanent
+}
+
+// BanList persists bans in their own table and keeps the active ones in
+// memory for the request path. It also backs the "bans" admin kind.
+type BanList struct {
+	db       *sql.DB
+	readOnly bool // expired bans are left to the writing instance
+	onEvent  func(Event)
+
+	mu      sync.RWMutex
+	entries []banEntry
+}
+
+func NewBanList(db *sql.DB) (*BanList, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS bans (
+		id TEXT PRIMARY KEY,
+		cidr TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME,
+		created_at DATETIME NOT NULL,
+		version INTEGER NOT NULL DEFAULT 1,
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.AddColumnIfMissing(db, "bans", "observe", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if _, err := store.AddColumnIfMissing(db, "bans", "source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	bl := &BanList{db: db, readOnly: store.IsReadOnly(db)}
+	return bl, bl.reload()
+}
+
+// reload drops expired bans and rebuilds the in-memory list
+func (bl *BanList) reload() error {
+	if !bl.readOnly {
+		if _, err := bl.db.Exec("DELETE FROM bans WHERE expires_at IS NOT NULL AND expires_at <= ?", store.FormatTime(time.Now())); err != nil {
+			return err
+		}
+	}
+	bans, err := bl.List("")
+	if err != nil {
+		return err
+	}
+	var entries []banEntry
+	for _, b := range bans {
+		ipNet := clientip.ParseIPOrCIDR(b.CIDR)
+		if ipNet == nil {
+			slog.Warn("Ignoring ban with invalid CIDR", "id", b.ID, "cidr", b.CIDR)
+			continue
+		}
+		e := banEntry{ban: b, net: ipNet}
+		if b.ExpiresAt != "" {
+			e.expires, _ = time.Parse(time.RFC3339, b.ExpiresAt)
+		}
+		entries = append(entries, e)
+	}
+	bl.mu.Lock()
+	bl.entries = entries
+	bl.mu.Unlock()
+	return nil
+}
+
+// RefreshLoop purges expired bans every interval
+func (bl *BanList) RefreshLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := bl.reload(); err != nil {
+			slog.Error("Error refreshing bans", "err", err)
+		}
+	}
+}
+
+// Banned reports whether ip is covered by an active ban
+func (bl *BanList) Banned(ip string) bool {
+	return bl.Match(ip) != nil
+}
+
+// Match returns an active ban covering ip, or nil. A ban that refuses the
+// request wins over observe-only ones.
+func (bl *BanList) Match(ip string) *Ban {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	now := time.Now()
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	var match *Ban
+	for _, e := range bl.entries {
+		if e.net.Contains(parsed) && (e.expires.IsZero() || now.Before(e.expires)) {
+			ban := e.ban
+			if !ban.Observe {
+				return &ban
+			}
+			if match == nil {
+				match = &ban
+			}
+		}
+	}
+	return match
+}
+
+// List returns the bans, newest first; source narrows it to one imported
+// list's, "" returns all
+func (bl *BanList) List(source string) ([]Ban, error) {
+	query, args := `SELECT id, cidr, reason, COALESCE(expires_at, ''), observe, source, created_at FROM bans`, []interface{}{}
+	if source != "" {
+		query += " WHERE source = ?"
+		args = append(args, source)
+	}
+	rows, err := bl.db.Query(query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []Ban{}
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.CIDR, &b.Reason, &b.ExpiresAt, &b.Observe, &b.Source, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// validate normalizes d into the stored CIDR and expiry
+func (d banData) validate(now time.Time) (cidr string, expires sql.NullString, err error) {
+	target := d.CIDR
+	if target == "" {
+		target = d.IP
+	}
+	ipNet := clientip.ParseIPOrCIDR(strings.TrimSpace(target))
+	if ipNet == nil {
+		return "", expires, fmt.Errorf("invalid IP or CIDR %q", target)
+	}
+	switch {
+	case d.Duration != "":
+		dur, ok := parseRelative(d.Duration)
+		if !ok {
+			return "", expires, fmt.Errorf("invalid duration %q", d.Duration)
+		}
+		expires = sql.NullString{String: store.FormatTime(now.Add(dur)), Valid: true}
+	case d.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, d.ExpiresAt)
+		if err != nil {
+			return "", expires, fmt.Errorf("invalid expires_at %q", d.ExpiresAt)
+		}
+		expires = sql.NullString{String: store.FormatTime(t), Valid: true}
+	}
+	return ipNet.String(), expires, nil
+}
+
+// Add stores a new ban and applies it immediately
+func (bl *BanList) Add(id string, d banData) (Ban, error) {
+	now := time.Now()
+	cidr, expires, err := d.validate(now)
+	if err != nil {
+		return Ban{}, err
+	}
+	_, err = bl.db.Exec(`INSERT INTO bans (id, cidr, reason, expires_at, observe, source, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, id, cidr, d.Reason, expires, d.Observe, d.Source, store.FormatTime(now), store.FormatTime(now))
+	if err != nil {
+		return Ban{}, err
+	}
+	verb := "Banned"
+	if d.Observe {
+		verb = "Observing"
+	}
+	slog.Info(verb, "cidr", cidr, "until", orDefault(expires.String, "further notice"), "reason", d.Reason)
+	bl.event(Event{Kind: "ban", Severity: severityWarning, ClientIP: banEventIP(cidr),
+		Message: fmt.Sprintf("%s %s until %s: %s", verb, cidr, orDefault(expires.String, "further notice"), orDefault(d.Reason, "no reason given"))})
+	return Ban{ID: id, CIDR: cidr, Reason: d.Reason, ExpiresAt: expires.String, Observe: d.Observe, Source: d.Source, CreatedAt: store.FormatTime(now)}, bl.reload()
+}
+
+// Remove deletes bans by id or by the exact IP/CIDR they cover
+func (bl *BanList) Remove(idOrCIDR string) (int64, error) {
+	cidr := idOrCIDR
+	if ipNet := clientip.ParseIPOrCIDR(idOrCIDR); ipNet != nil {
+		cidr = ipNet.String()
+	}
+	res, err := bl.db.Exec("DELETE FROM bans WHERE id = ? OR cidr = ?", idOrCIDR, cidr)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		slog.Info("Unbanned", "ban", idOrCIDR)
+		bl.event(Event{Kind: "ban", ClientIP: banEventIP(cidr), Message: "Unbanned " + idOrCIDR})
+	}
+	return n, bl.reload()
+}
+
+// banEventIP is what an event about a ban on cidr records as its client IP:
+// a single address without its /32 or /128, so it matches connections
+func banEventIP(cidr string) string {
+	ip, ones, _ := strings.Cut(cidr, "/")
+	if ones == "128" || ones == "32" && !strings.Contains(ip, ":") {
+		return ip
+	}
+	return cidr
+}
+
+// event passes e to the events timeline, if one is attached
+func (bl *BanList) event(e Event) {
+	if bl.onEvent != nil {
+		bl.onEvent(e)
+	}
+}
+
+func orDefault(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// banMiddleware refuses requests from banned clients before anything else
+// (proxying, the dashboard) sees them; the refusal is logged as a blocked
+// connection. Observe-only bans and DRY_RUN let them through and mark the
+// row as observed.
+func (app *App) banMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := app.ipPolicy.ClientIP(r)
+		if ban := app.bans.Match(clientIP); ban != nil {
+			if !ban.Observe && !app.dryRun {
+				bannedRequests.Add(1)
+				if err := app.logConnection(app.extractClientInfo(withDecision(r, decisionBlocked, "ban:"+ban.ID))); err != nil {
+					slog.Error("Error logging connection", "err", err)
+				}
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			app.observe("ban", clientIP, r, "ban "+ban.ID+" on "+ban.CIDR)
+			r = withDecision(r, decisionObserved, "ban:"+ban.ID)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET    /_proxy/bans                    - list bans
+// GET    /_proxy/bans?source=NAME        - list one imported list's bans
+// POST   /_proxy/bans                    - {"ip": "1.2.3.4", "reason": "...", "duration": "24h"}
+// DELETE /_proxy/bans/{id}               - unban by id
+// DELETE /_proxy/bans?ip=1.2.3.4         - unban an IP or CIDR
+// DELETE /_proxy/bans?source=NAME        - remove an imported list's bans
+func (app *App) handleBans(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/bans"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		format, err := exportFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bans, err := app.bans.List(r.URL.Query().Get("source"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeList(w, format, "bans", bans)
+
+	case http.MethodPost:
+		var d banData
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&d); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ban, err := app.bans.Add(newAdminID(), d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ban)
+
+	case http.MethodDelete:
+		var n int64
+		var err error
+		if source := r.URL.Query().Get("source"); id == "" && source != "" {
+			n, err = app.bans.RemoveSource(source)
+		} else {
+			if id == "" {
+				id = r.URL.Query().Get("ip")
+			}
+			if id == "" {
+				http.Error(w, "ban id, ?ip= or ?source= required", http.StatusBadRequest)
+				return
+			}
+			n, err = app.bans.Remove(id)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "no such ban", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// banCollection exposes the bans table as the "bans" admin kind, with the
+// usual versioned CRUD
+type banCollection struct {
+	bl *BanList
+}
+
+func (c banCollection) object(b Ban, version int64, updatedAt string) AdminObject {
+	data, _ := json.Marshal(banData{CIDR: b.CIDR, Reason: b.Reason, ExpiresAt: b.ExpiresAt, Observe: b.Observe, Source: b.Source})
+	return AdminObject{ID: b.ID, Data: data, Version: version, UpdatedAt: updatedAt}
+}
+
+func (c banCollection) List() ([]AdminObject, error) {
+	rows, err := c.bl.db.Query(`SELECT id, cidr, reason, COALESCE(expires_at, ''), observe, source, version, updated_at FROM bans ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []AdminObject{}
+	for rows.Next() {
+		var b Ban
+		var version int64
+		var updatedAt string
+		if err := rows.Scan(&b.ID, &b.CIDR, &b.Reason, &b.ExpiresAt, &b.Observe, &b.Source, &version, &updatedAt); err != nil {
+			return nil, err
+		}
+		objects = append(objects, c.object(b, version, updatedAt))
+	}
+	return objects, rows.Err()
+}
+
+func (c banCollection) Get(id string) (AdminObject, error) {
+	var b Ban
+	var version int64
+	var updatedAt string
+	err := c.bl.db.QueryRow(`SELECT id, cidr, reason, COALESCE(expires_at, ''), observe, source, version, updated_at FROM bans WHERE id = ?`, id).
+		Scan(&b.ID, &b.CIDR, &b.Reason, &b.ExpiresAt, &b.Observe, &b.Source, &version, &updatedAt)
+	if err == sql.ErrNoRows {
+		return AdminObject{}, errAdminNotFound
+	}
+	if err != nil {
+		return AdminObject{}, err
+	}
+	return c.object(b, version, updatedAt), nil
+}
+
+func (c banCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	var d banData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, err
+	}
+	now := time.Now()
+	cidr, expires, err := d.validate(now)
+	if err != nil {
+		return AdminObject{}, err
+	}
+
+	_, err = c.Get(id)
+	switch {
+	case err == errAdminNotFound:
+		if ifMatch > 0 {
+			return AdminObject{}, errAdminNotFound
+		}
+		if _, err := c.bl.Add(id, d); err != nil {
+			return AdminObject{}, err
+		}
+	case err != nil:
+		return AdminObject{}, err
+	case ifMatch < 0:
+		return AdminObject{}, errAdminAlreadyExists
+	case ifMatch == 0:
+		return AdminObject{}, errAdminPreconditionNeeded
+	default:
+		res, err := c.bl.db.Exec(`UPDATE bans SET cidr = ?, reason = ?, expires_at = ?, observe = ?, source = ?, version = version + 1, updated_at = ?
+			WHERE id = ? AND version = ?`, cidr, d.Reason, expires, d.Observe, d.Source, store.FormatTime(now), id, ifMatch)
+		if err != nil {
+			return AdminObject{}, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return AdminObject{}, errAdminVersionMismatch
+		}
+		c.bl.event(Event{Kind: "ban", Severity: severityWarning, ClientIP: banEventIP(cidr),
+			Message: fmt.Sprintf("Ban on %s changed: until %s: %s", cidr, orDefault(expires.String, "further notice"), orDefault(d.Reason, "no reason given"))})
+		if err := c.bl.reload(); err != nil {
+			return AdminObject{}, err
+		}
+	}
+	return c.Get(id)
+}
+
+func (c banCollection) Delete(id string, ifMatch int64) error {
+	if ifMatch == 0 {
+		return errAdminPreconditionNeeded
+	}
+	var cidr string
+	c.bl.db.QueryRow("SELECT cidr FROM bans WHERE id = ?", id).Scan(&cidr)
+	res, err := c.bl.db.Exec("DELETE FROM bans WHERE id = ? AND version = ?", id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.Get(id); errors.Is(err, errAdminNotFound) {
+			return errAdminNotFound
+		}
+		return errAdminVersionMismatch
+	}
+	c.bl.event(Event{Kind: "ban", ClientIP: banEventIP(cidr), Message: "Unbanned " + cidr})
+	return c.bl.reload()
+}
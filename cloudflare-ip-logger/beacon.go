@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Rows written for client-side pageview beacons. The category keeps them out
+// of the visitor stats, which count server-side hits.
+const (
+	sourceBeacon   = "beacon"
+	categoryBeacon = "beacon"
+	maxBeaconBody  = 8 << 10
+)
+
+// beaconScript is served at /beacon.js. It posts one beacon per page load and
+// per history navigation, to the URL it was loaded from minus ".js".
+const beaconScript = `(function () {
+  var s = document.currentScript, token = s && s.getAttribute('data-token');
+  if (!token) return;
+  var endpoint = s.src.replace(/\.js(\?.*)?$/, '');
+  function send() {
+    var body = JSON.stringify({token: token, url: location.href, referrer: document.referrer});
+    if (!(navigator.sendBeacon && navigator.sendBeacon(endpoint, body))) {
+      fetch(endpoint, {method: 'POST', body: body, keepalive: true, mode: 'cors'});
+    }
+  }
+  send();
+  var push = history.pushState;
+  history.pushState = function () { push.apply(this, arguments); send(); };
+  addEventListener('popstate', send);
+})();
+`
+
+// parseBeaconTokens reads BEACON_TOKENS, host=token pairs separated by
+// commas, into token -> host. The tokens end up in public page source, so
+// each only vouches for pageviews of its own host.
+func parseBeaconTokens(spec string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		host, token, ok := strings.Cut(entry, "=")
+		host, token = strings.ToLower(strings.TrimSpace(host)), strings.TrimSpace(token)
+		if !ok || host == "" || len(token) < 8 {
+			return nil, fmt.Errorf("%q: expected host=token with a token of at least 8 characters", entry)
+		}
+		tokens[token] = host
+	}
+	return tokens, nil
+}
+
+// beaconData is a pageview reported by the snippet or a Worker
+type beaconData struct {
+	Token    string `json:"token"`
+	URL      string `json:"url"`
+	Referrer string `json:"referrer"`
+	// Only taken from senders with ingest credentials, such as a Worker
+	// reporting for the visitor it served
+	ClientIP  string `json:"client_ip"`
+	Country   string `json:"country"`
+	UserAgent string `json:"user_agent"`
+}
+
+// POST /_proxy/beacon - one pageview, as JSON of any content type so
+// navigator.sendBeacon needs no preflight
+func (app *App) handleBeacon(w http.ResponseWriter, r *http.Request) {
+	if len(app.beaconTokens) == 0 {
+		http.Error(w, "Beacons disabled", http.StatusNotFound)
+		return
+	}
+	// The token is the access, so any page may send
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBeaconBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBeaconBody {
+		http.Error(w, "Beacon too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var b beaconData
+	if err := json.Unmarshal(body, &b); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b.Token == "" {
+		b.Token = r.URL.Query().Get("token")
+	}
+	host, ok := app.beaconTokens[b.Token]
+	if !ok {
+		http.Error(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+		return
+	}
+	u, err := url.Parse(b.URL)
+	if err != nil || u.Host == "" {
+		http.Error(w, "url must be the page's absolute URL", http.StatusBadRequest)
+		return
+	}
+	pageHost := strings.ToLower(u.Hostname())
+	if canonical, _ := app.lookupRoute(pageHost); pageHost != host && canonical != host {
+		http.Error(w, "Token isn't for "+pageHost, http.StatusForbidden)
+		return
+	}
+
+	conn := app.extractClientInfo(r)
+	if b.ClientIP != "" {
+		if reason, ok := app.ingestAuth.Verify(r, body); !ok {
+			slog.Warn("Rejected beacon", "remote", conn.ClientIP, "reason", "client_ip without ingest credentials: "+reason)
+			http.Error(w, "Unauthorized: client_ip needs ingest credentials", http.StatusUnauthorized)
+			return
+		}
+		conn.ClientIP, conn.UserAgent = b.ClientIP, b.UserAgent
+		conn.Country = countryCode(b.Country)
+	}
+	conn.Method = http.MethodGet
+	conn.Host = pageHost
+	conn.Path = orDefault(u.Path, "/")
+	conn.Referer = b.Referrer
+	app.campaigns.Set(&conn, u.RawQuery)
+	conn.Category = categoryBeacon
+	conn.Source = sourceBeacon
+	if err := app.logConnection(conn); err != nil {
+		slog.Error("Error logging beacon", "err", err)
+		http.Error(w, "Failed to store beacon", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /_proxy/beacon.js
+func (app *App) handleBeaconScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	io.WriteString(w, beaconScript)
+}
+
+// BeaconHostStats compares a host's client-side pageviews with the
+// server-side GET hits the proxy logged for it
+type BeaconHostStats struct {
+	Host       string `json:"host"`
+	Pageviews  int    `json:"pageviews"`
+	Visitors   int    `json:"visitors"` // distinct IPs sending beacons
+	ServerHits int    `json:"server_hits"`
+}
+
+// BeaconPathStats is the same for one page
+type BeaconPathStats struct {
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	Pageviews  int    `json:"pageviews"`
+	ServerHits int    `json:"server_hits"`
+}
+
+// Server-side hits that a pageview can be compared with
+const serverHitCond = "(category = 'visitor' AND method = 'GET' AND source = '" + sourceProxy + "')"
+
+// GET /_proxy/stats/beacons?since=7d&until=2024-01-02&host=blog.example.com&limit=50&tz=Europe/Berlin
+//
+// Hosts that received beacons, and their most viewed pages, with pageviews
+// next to the proxy's own hits for the same host and path.
+func (app *App) handleBeaconStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cond, args, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := app.hostParam(query)
+	if host != "" {
+		cond += " AND host = ?"
+		args = append(args, host)
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	cond += scopeCond
+	args = append(args, scopeArgs...)
+	ownCond, ownArgs, err := app.ownTraffic.Filter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cond += ownCond
+	args = append(args, ownArgs...)
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 50
+	}
+
+	where := " WHERE (category = '" + categoryBeacon + "' OR " + serverHitCond + ")" + cond
+	readDB := app.readerFor(r, host)
+	hosts := []BeaconHostStats{}
+	rows, err := readDB.Query(`SELECT host, SUM(category = '`+categoryBeacon+`'),
+		COUNT(DISTINCT CASE WHEN category = '`+categoryBeacon+`' THEN client_ip END), SUM(`+serverHitCond+`)
+		FROM connections`+where+` GROUP BY host HAVING SUM(category = '`+categoryBeacon+`') > 0 ORDER BY 2 DESC`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var h BeaconHostStats
+		if err := rows.Scan(&h.Host, &h.Pageviews, &h.Visitors, &h.ServerHits); err == nil {
+			hosts = append(hosts, h)
+		}
+	}
+	rows.Close()
+
+	paths := []BeaconPathStats{}
+	rows, err = readDB.Query(`SELECT host, path, SUM(category = '`+categoryBeacon+`'), SUM(`+serverHitCond+`)
+		FROM connections`+where+` GROUP BY host, path HAVING SUM(category = '`+categoryBeacon+`') > 0 ORDER BY 3 DESC LIMIT ?`,
+		append(args, limit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p BeaconPathStats
+		if err := rows.Scan(&p.Host, &p.Path, &p.Pageviews, &p.ServerHits); err == nil {
+			paths = append(paths, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"hosts": hosts, "paths": paths})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest campaign value stored; longer ones are cut
+const maxCampaignValue = 100
+
+// The campaign fields and the query parameters that always fill them
+var campaignFields = []struct{ field, param string }{
+	{"source", "utm_source"},
+	{"medium", "utm_medium"},
+	{"campaign", "utm_campaign"},
+}
+
+// CampaignParams picks a request's utm_source, utm_medium and utm_campaign
+// out of its query string. CAMPAIGN_PARAMS adds parameters that stand in
+// for them, e.g. "ref=source,via=source,cmp=campaign"; the utm_ parameter
+// wins when both are present.
+type CampaignParams struct {
+	params map[string][]string // field -> query parameters, most preferred first
+}
+
+func NewCampaignParams(spec string) (*CampaignParams, error) {
+	c := &CampaignParams{params: make(map[string][]string)}
+	for _, f := range campaignFields {
+		c.params[f.field] = []string{f.param}
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		param, field, ok := strings.Cut(entry, "=")
+		param, field = strings.TrimSpace(param), strings.TrimSpace(field)
+		if _, known := c.params[field]; !ok || param == "" || !known {
+			return nil, fmt.Errorf("%q: expected param=source, param=medium or param=campaign", entry)
+		}
+		c.params[field] = append(c.params[field], param)
+	}
+	return c, nil
+}
+
+// Set fills conn's campaign fields from a query string
+func (c *CampaignParams) Set(conn *ConnectionLog, rawQuery string) {
+	if rawQuery == "" {
+		return
+	}
+	query, _ := url.ParseQuery(rawQuery)
+	conn.UTMSource = c.value(query, "source")
+	conn.UTMMedium = c.value(query, "medium")
+	conn.UTMCampaign = c.value(query, "campaign")
+}
+
+func (c *CampaignParams) value(query url.Values, field string) string {
+	for _, param := range c.params[field] {
+		v := strings.TrimSpace(query.Get(param))
+		if v == "" {
+			continue
+		}
+		if len(v) > maxCampaignValue {
+			v = v[:maxCampaignValue]
+			for !utf8.ValidString(v) {
+				v = v[:len(v)-1]
+			}
+		}
+		return v
+	}
+	return ""
+}
+
+// Rows from a campaign link: any of the three fields set
+const campaignCond = "(utm_source != '' OR utm_medium != '' OR utm_campaign != '')"
+
+// campaignFilter turns ?utm_source=, ?utm_medium= and ?utm_campaign= into
+// conditions starting with " AND". "none" matches rows without the field.
+func campaignFilter(query url.Values) (string, []interface{}) {
+	var cond string
+	var args []interface{}
+	for _, f := range campaignFields {
+		switch v := query.Get(f.param); v {
+		case "":
+		case "none":
+			cond += " AND " + f.param + " = ''"
+		default:
+			cond += " AND " + f.param + " = ?"
+			args = append(args, v)
+		}
+	}
+	return cond, args
+}
+
+// CampaignStats is the traffic of one source/medium/campaign combination
+type CampaignStats struct {
+	Source    string `json:"source"`
+	Medium    string `json:"medium"`
+	Campaign  string `json:"campaign"`
+	Hits      int    `json:"hits"`
+	Visitors  int    `json:"visitors"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// SourceStats is a campaign source's traffic over all its campaigns
+type SourceStats struct {
+	Source   string `json:"source"`
+	Hits     int    `json:"hits"`
+	Visitors int    `json:"visitors"`
+}
+
+// GET /_proxy/stats/campaigns?since=30d&until=2024-01-02&host=blog.example.com&category=visitor&utm_source=newsletter&limit=100&tz=Europe/Berlin
+//
+// Requests that arrived with campaign parameters, grouped by source,
+// medium and campaign, and by source alone. Visitor traffic by default,
+// category=beacon for client-side pageviews. format=csv or ndjson exports
+// the campaigns.
+func (app *App) handleCampaignStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := exportLimit(r, format, 100, 1000)
+	cond, args, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	category := query.Get("category")
+	if category == "" {
+		category = categoryVisitor
+	}
+	if category != "all" {
+		cond += " AND category = ?"
+		args = append(args, category)
+	}
+	host := app.hostParam(query)
+	if host != "" {
+		cond += " AND host = ?"
+		args = append(args, host)
+	}
+	filterCond, filterArgs := campaignFilter(query)
+	cond += filterCond
+	args = append(args, filterArgs...)
+	scopeCond, scopeArgs := hostScope(r, "host")
+	cond += scopeCond
+	args = append(args, scopeArgs...)
+	ownCond, ownArgs, err := app.ownTraffic.Filter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cond += ownCond
+	args = append(args, ownArgs...)
+
+	where := " WHERE " + campaignCond + cond
+	readDB := app.readerFor(r, host)
+	campaigns := []CampaignStats{}
+	rows, err := readDB.Query(`SELECT utm_source, utm_medium, utm_campaign, COUNT(*), COUNT(DISTINCT client_ip), MIN(timestamp), MAX(timestamp)
+		FROM connections`+where+` GROUP BY 1, 2, 3 ORDER BY 4 DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var c CampaignStats
+		if err := rows.Scan(&c.Source, &c.Medium, &c.Campaign, &c.Hits, &c.Visitors, &c.FirstSeen, &c.LastSeen); err != nil {
+			continue
+		}
+		c.FirstSeen = formatStoredTime(c.FirstSeen, loc)
+		c.LastSeen = formatStoredTime(c.LastSeen, loc)
+		campaigns = append(campaigns, c)
+	}
+	rows.Close()
+	if format != "" {
+		writeList(w, format, "campaigns", campaigns)
+		return
+	}
+
+	sources := []SourceStats{}
+	rows, err = readDB.Query(`SELECT utm_source, COUNT(*), COUNT(DISTINCT client_ip) FROM connections`+where+
+		` GROUP BY 1 ORDER BY 2 DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s SourceStats
+		if err := rows.Scan(&s.Source, &s.Hits, &s.Visitors); err == nil {
+			sources = append(sources, s)
+		}
+	}
+	var total, visitors int
+	readDB.QueryRow("SELECT COUNT(*), COUNT(DISTINCT client_ip) FROM connections"+where, args...).Scan(&total, &visitors)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"campaigns": campaigns,
+		"sources":   sources,
+		"hits":      total,
+		"visitors":  visitors,
+	})
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cf-ip-logger/pkg/store"
+)
+
+const redactedValue = "[redacted]"
+
+// Capture is one recorded request, kept so it can be inspected and replayed
+type Capture struct {
+	ID        int64       `json:"id"`
+	Timestamp string      `json:"timestamp"`
+	ClientIP  string      `json:"client_ip"`
+	Host      string      `json:"host"`
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"` // path and query as received
+	Status    int         `json:"status"`
+	BodySize  int         `json:"body_size"` // bytes stored, at most CAPTURE_MAX_BODY
+	Truncated bool        `json:"body_truncated"`
+	Headers   http.Header `json:"headers,omitempty"`
+
+	// Set for single-capture responses: the body as text, or base64 when it
+	// isn't valid UTF-8
+	BodyText   string `json:"body,omitempty"`
+	BodyBase64 string `json:"body_base64,omitempty"`
+
+	body []byte
+}
+
+// Capturer records full requests (headers and body) for selected hosts into
+// a table that keeps only the newest entries
+type Capturer struct {
+	db      *sql.DB
+	hosts   map[string]bool // nil captures every host
+	max     int64
+	maxBody int64
+	redact  map[string]bool // canonical header names stored as [redacted]
+}
+
+// NewCapturer parses CAPTURE_HOSTS-style spec ("*" or a comma-separated list
+// of hosts) and creates the captures table
+func NewCapturer(db *sql.DB, spec string, max int, maxBody int64, redact string) (*Capturer, error) {
+	c := &Capturer{db: db, max: int64(max), maxBody: maxBody, redact: make(map[string]bool)}
+	if spec != "*" {
+		c.hosts = make(map[string]bool)
+		for _, h := range strings.Split(spec, ",") {
+			if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+				c.hosts[h] = true
+			}
+		}
+	}
+	for _, h := range strings.Split(redact, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			c.redact[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return c, createCaptureTable(db)
+}
+
+func createCaptureTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS captures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		client_ip TEXT,
+		host TEXT,
+		method TEXT,
+		uri TEXT,
+		status INTEGER,
+		headers TEXT,
+		body BLOB,
+		body_truncated INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS idx_captures_host ON captures(host);
+	`)
+	return err
+}
+
+// Wants reports whether requests for host (a route key) are captured
+func (c *Capturer) Wants(host string) bool {
+	return c.hosts == nil || c.hosts[host]
+}
+
+// Begin copies r's headers and body; r.Body is replaced with an equivalent
+// reader so the proxy still forwards all of it
+func (c *Capturer) Begin(r *http.Request, clientIP string) *Capture {
+	body, complete := bufferBody(r, c.maxBody)
+	headers := r.Header.Clone()
+	for name := range headers {
+		if c.redact[name] {
+			headers[name] = []string{redactedValue}
+		}
+	}
+	return &Capture{
+		Timestamp: store.FormatTime(time.Now()),
+		ClientIP:  clientIP,
+		Host:      r.Host,
+		Method:    r.Method,
+		URI:       r.URL.RequestURI(),
+		Headers:   headers,
+		Truncated: !complete,
+		body:      body,
+	}
+}
+
+// Save stores cp with the response status and drops captures beyond the
+// newest max
+func (c *Capturer) Save(cp *Capture, status int) error {
+	headers, _ := json.Marshal(cp.Headers)
+	res, err := c.db.Exec(`INSERT INTO captures (timestamp, client_ip, host, method, uri, status, headers, body, body_truncated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cp.Timestamp, cp.ClientIP, cp.Host, cp.Method, cp.URI, status, string(headers), cp.body, cp.Truncated)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM captures WHERE id <= ?", id-c.max)
+	return err
+}
+
+// List returns captures newest first, without headers and bodies
+func (c *Capturer) List(host string, limit int) ([]Capture, error) {
+	query := `SELECT id, timestamp, client_ip, host, method, uri, status, length(body), body_truncated FROM captures`
+	var args []interface{}
+	if host != "" {
+		query += " WHERE host = ?"
+		args = append(args, host)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Capture{}
+	for rows.Next() {
+		var cp Capture
+		var size sql.NullInt64
+		if err := rows.Scan(&cp.ID, &cp.Timestamp, &cp.ClientIP, &cp.Host, &cp.Method, &cp.URI, &cp.Status, &size, &cp.Truncated); err != nil {
+			return nil, err
+		}
+		cp.BodySize = int(size.Int64)
+		list = append(list, cp)
+	}
+	return list, rows.Err()
+}
+
+var (
+	errCaptureNotFound  = errors.New("capture not found")
+	errCaptureTruncated = errors.New("the captured body was truncated; replaying it would send a partial request")
+)
+
+func (c *Capturer) Get(id int64) (*Capture, error) {
+	var cp Capture
+	var headers string
+	err := c.db.QueryRow(`SELECT id, timestamp, client_ip, host, method, uri, status, headers, body, body_truncated
+		FROM captures WHERE id = ?`, id).
+		Scan(&cp.ID, &cp.Timestamp, &cp.ClientIP, &cp.Host, &cp.Method, &cp.URI, &cp.Status, &headers, &cp.body, &cp.Truncated)
+	if err == sql.ErrNoRows {
+		return nil, errCaptureNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(headers), &cp.Headers)
+	cp.BodySize = len(cp.body)
+	return &cp, nil
+}
+
+// Match returns the capture of the request a connection row logged: same
+// client, host, method and path, stamped closest to t. nil when there is none.
+func (c *Capturer) Match(clientIP, host, method, path string, t time.Time) *Capture {
+	var id int64
+	err := c.db.QueryRow(`SELECT id FROM captures
+		WHERE client_ip = ? AND host = ? AND method = ? AND (uri = ? OR uri LIKE ? ESCAPE '\')
+		AND timestamp BETWEEN ? AND ?
+		ORDER BY abs(strftime('%s', timestamp) - ?) LIMIT 1`,
+		clientIP, host, method, path, likeEscape(path)+"?%",
+		store.FormatTime(t.Add(-captureMatchWindow)), store.FormatTime(t.Add(captureMatchWindow)), t.Unix()).Scan(&id)
+	if err != nil {
+		return nil
+	}
+	cp, err := c.Get(id)
+	if err != nil {
+		return nil
+	}
+	cp.BodyText, cp.BodyBase64 = encodeBody(cp.body)
+	return cp
+}
+
+// Delete removes one capture, or all of them when id is 0
+func (c *Capturer) Delete(id int64) (int64, error) {
+	var res sql.Result
+	var err error
+	if id == 0 {
+		res, err = c.db.Exec("DELETE FROM captures")
+	} else {
+		res, err = c.db.Exec("DELETE FROM captures WHERE id = ?", id)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ReplayResult is the backend's answer to a replayed capture
+type ReplayResult struct {
+	CaptureID  int64       `json:"capture_id"`
+	Backend    string      `json:"backend"`
+	Status     int         `json:"status"`
+	DurationMS int64       `json:"duration_ms"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+}
+
+// replayCapture re-sends cp to backend with its original method, URI, Host,
+// headers and body. Redacted headers aren't sent.
+func replayCapture(ctx context.Context, cp *Capture, backend string, noTLS bool) (*ReplayResult, error) {
+	if cp.Truncated {
+		return nil, errCaptureTruncated
+	}
+	base, err := url.Parse(backend)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid backend %q", backend)
+	}
+	target, err := url.Parse(strings.TrimSuffix(base.String(), "/") + cp.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, cp.Method, target.String(), bytes.NewReader(cp.body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range cp.Headers {
+		switch name {
+		case "Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length":
+			continue
+		}
+		if len(values) == 1 && values[0] == redactedValue {
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Host = cp.Host
+	req.Header.Set("X-Replayed-Capture", strconv.FormatInt(cp.ID, 10))
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if noTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	result := &ReplayResult{
+		CaptureID:  cp.ID,
+		Backend:    base.Redacted(),
+		Status:     resp.StatusCode,
+		DurationMS: time.Since(start).Milliseconds(),
+		Headers:    resp.Header,
+	}
+	result.Body, result.BodyBase64 = encodeBody(body)
+	return result, nil
+}
+
+// encodeBody returns b as text, or as base64 when it isn't valid UTF-8
+func encodeBody(b []byte) (text, b64 string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(b)
+}
+
+// GET    /_proxy/captures?host=example.com&limit=50 - newest captures
+// GET    /_proxy/captures/{id}                      - one capture with headers and body
+// POST   /_proxy/captures/{id}/replay               - {"backend": "http://...", "no_tls_verify": false}
+// DELETE /_proxy/captures[/{id}]                    - delete one or all
+func (app *App) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	if app.capturer == nil {
+		http.Error(w, "capture is disabled (set CAPTURE_HOSTS)", http.StatusNotFound)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/captures"), "/")
+	idPart, action, _ := strings.Cut(rest, "/")
+	var id int64
+	if idPart != "" {
+		var err error
+		if id, err = strconv.ParseInt(idPart, 10, 64); err != nil || id <= 0 {
+			http.Error(w, "invalid capture id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == 0:
+		limit := 50
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+		list, err := app.capturer.List(strings.ToLower(r.URL.Query().Get("host")), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case r.Method == http.MethodGet && action == "":
+		cp, err := app.capturer.Get(id)
+		if err != nil {
+			app.captureError(w, err)
+			return
+		}
+		cp.BodyText, cp.BodyBase64 = encodeBody(cp.body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cp)
+
+	case r.Method == http.MethodPost && action == "replay" && id != 0:
+		var opts struct {
+			Backend string `json:"backend"`
+			NoTLS   bool   `json:"no_tls_verify"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&opts); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		cp, err := app.capturer.Get(id)
+		if err != nil {
+			app.captureError(w, err)
+			return
+		}
+		if opts.Backend == "" {
+			// Default to the host's current backend
+			_, rt := app.lookupRoute(strings.ToLower(strings.Split(cp.Host, ":")[0]))
+			if rt == nil {
+				_, rt = app.lookupRoute(app.routes.Load().defaultHost)
+			}
+			if rt == nil {
+				http.Error(w, "no route for "+cp.Host+"; give a backend", http.StatusBadRequest)
+				return
+			}
+			u := *rt.url
+			if rt.pool != nil {
+				u.Host = rt.pool.Pick()
+			}
+			opts.Backend, opts.NoTLS = u.String(), rt.noTLS
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+		defer cancel()
+		result, err := replayCapture(ctx, cp, opts.Backend, opts.NoTLS)
+		if err == errCaptureTruncated {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	case r.Method == http.MethodDelete && action == "":
+		n, err := app.capturer.Delete(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if id != 0 && n == 0 {
+			http.Error(w, errCaptureNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) captureError(w http.ResponseWriter, err error) {
+	if err == errCaptureNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// runReplay implements the replay subcommand: list captures from the
+// database, or re-send some of them to a backend
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding connections.db")
+	backend := fs.String("backend", "", "backend URL to send the captures to, e.g. http://localhost:3000")
+	noTLS := fs.Bool("no-tls-verify", false, "skip TLS certificate verification")
+	list := fs.Bool("list", false, "list captures and exit")
+	host := fs.String("host", "", "with -list, only captures for this host")
+	limit := fs.Int("limit", 50, "with -list, how many captures to show")
+	verbose := fs.Bool("v", false, "print response headers and bodies")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] -backend URL id...\n       %s replay -list [-host HOST]\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("replay: %v", err)
+	}
+	db, err := store.Open(*dataDir + "/connections.db")
+	if err != nil {
+		log.Fatalf("replay: %v", err)
+	}
+	defer db.Close()
+	if err := createCaptureTable(db); err != nil {
+		log.Fatalf("replay: %v", err)
+	}
+	c := &Capturer{db: db}
+
+	if *list {
+		captures, err := c.List(strings.ToLower(*host), *limit)
+		if err != nil {
+			log.Fatalf("replay: %v", err)
+		}
+		for _, cp := range captures {
+			fmt.Printf("%d\t%s\t%s\t%s %s%s\t%d\t%d bytes\n", cp.ID, cp.Timestamp, cp.ClientIP, cp.Method, cp.Host, cp.URI, cp.Status, cp.BodySize)
+		}
+		return
+	}
+	if *backend == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, arg := range fs.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			log.Fatalf("replay: invalid capture id %q", arg)
+		}
+		cp, err := c.Get(id)
+		if err == nil {
+			var result *ReplayResult
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			result, err = replayCapture(ctx, cp, *backend, *noTLS)
+			cancel()
+			if err == nil {
+				fmt.Printf("#%d %s %s%s -> %d (%dms)\n", id, cp.Method, cp.Host, cp.URI, result.Status, result.DurationMS)
+				if *verbose {
+					for name, values := range result.Headers {
+						fmt.Printf("  %s: %s\n", name, strings.Join(values, ", "))
+					}
+					if result.BodyBase64 != "" {
+						fmt.Printf("\n  (binary body, %d bytes base64)\n\n", len(result.BodyBase64))
+					} else {
+						fmt.Printf("\n%s\n\n", result.Body)
+					}
+				}
+				continue
+			}
+		}
+		log.Printf("replay: #%d: %v", id, err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
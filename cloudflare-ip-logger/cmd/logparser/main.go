@@ -3,75 +3,45 @@ package main
 import (
 	"bufio"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"log"
 	"os"
-	"regexp"
-	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-)
-
-// CloudflaredLogEntry represents a JSON log line from cloudflared
-type CloudflaredLogEntry struct {
-	Time      string `json:"time"`
-	Level     string `json:"level"`
-	Message   string `json:"message"`
-	Msg       string `json:"msg"`
-	Origin    string `json:"originURL"`
-	ClientIP  string `json:"clientIP"`
-	CFRay     string `json:"cfRay"`
-	IP        string `json:"ip"`
-	Location  string `json:"location"`
-	FlowID    string `json:"flowId"`
-	Dest      string `json:"dest"`
-	Rule      int    `json:"ingressRule"`
-	Hostname  string `json:"hostname"`
-	Error     string `json:"error"`
-	ConnIndex int    `json:"connIndex"`
-	TraceID   string `json:"traceId"`
-	Status    int    `json:"status"`
-	Duration  int64  `json:"duration"`
-	Method    string `json:"method"`
-	Path      string `json:"path"`
-	RuleName  string `json:"ruleName"`
-}
-
-// Regex patterns for non-JSON logs
-var (
-	// Pattern: time="2024-01-15T10:30:00Z" level=info msg="Request" ip=1.2.3.4 host=example.com
-	logfmtPattern = regexp.MustCompile(`(?:ip|clientIP|client_ip)=["']?([0-9a-fA-F.:]+)["']?`)
-	hostPattern   = regexp.MustCompile(`(?:host|hostname)=["']?([a-zA-Z0-9.-]+)["']?`)
-	pathPattern   = regexp.MustCompile(`(?:path|uri|url)=["']?([^\s"']+)["']?`)
-	methodPattern = regexp.MustCompile(`(?:method)=["']?([A-Z]+)["']?`)
+	"cf-ip-logger/pkg/logline"
+	"cf-ip-logger/pkg/store"
 )
 
 type LogParser struct {
-	db      *sql.DB
-	verbose bool
+	db          *sql.DB
+	verbose     bool
+	seqGen      store.SeqGenerator
+	dedupWindow time.Duration
 }
 
 func main() {
 	dbPath := flag.String("db", "/data/connections.db", "Path to SQLite database")
 	logFile := flag.String("file", "", "Log file to tail (reads stdin if not specified)")
 	verbose := flag.Bool("verbose", false, "Verbose output")
+	dedupWindow := flag.Duration("dedup-window", 2*time.Second, "Skip requests the proxy already logged within this window (0 disables)")
 	flag.Parse()
 
-	// Open database
-	db, err := sql.Open("sqlite3", *dbPath+"?_journal_mode=WAL")
+	// Open database, encrypted when DB_KEY / DB_KEY_FILE is set (sqlcipher builds)
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("Failed to read database key: %v", err)
+	}
+	db, err := store.Open(*dbPath)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 	defer db.Close()
 
-	// Ensure table exists
-	if err := initDB(db); err != nil {
+	// Same schema and migrations as the proxy
+	if err := store.CreateSchema(db); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	parser := &LogParser{db: db, verbose: *verbose}
+	parser := &LogParser{db: db, verbose: *verbose, dedupWindow: *dedupWindow}
 
 	// Read from file or stdin
 	var scanner *bufio.Scanner
@@ -104,152 +74,37 @@ func main() {
 	}
 }
 
-func initDB(db *sql.DB) error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS connections (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-		client_ip TEXT NOT NULL,
-		country TEXT,
-		method TEXT,
-		path TEXT,
-		host TEXT,
-		user_agent TEXT,
-		referer TEXT
-	);
-	CREATE INDEX IF NOT EXISTS idx_timestamp ON connections(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_client_ip ON connections(client_ip);
-	CREATE INDEX IF NOT EXISTS idx_host ON connections(host);
-	`
-	_, err := db.Exec(schema)
-	return err
-}
-
 func (p *LogParser) processLine(line string) {
-	if line == "" {
-		return
-	}
-
-	// Try JSON first
-	if strings.HasPrefix(strings.TrimSpace(line), "{") {
-		p.parseJSON(line)
-		return
-	}
-
-	// Fall back to regex parsing
-	p.parseLogfmt(line)
-}
-
-func (p *LogParser) parseJSON(line string) {
-	var entry CloudflaredLogEntry
-	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+	req, err := logline.Parse(line)
+	if err != nil {
 		if p.verbose {
 			log.Printf("Failed to parse JSON: %v", err)
 		}
 		return
 	}
-
-	// Extract client IP from various possible fields
-	clientIP := entry.ClientIP
-	if clientIP == "" {
-		clientIP = entry.IP
-	}
-
-	// Skip if no useful request info
-	if clientIP == "" && entry.Hostname == "" {
-		// Check if it's a request-related message
-		msg := entry.Message
-		if msg == "" {
-			msg = entry.Msg
-		}
-		if !strings.Contains(strings.ToLower(msg), "request") &&
-			!strings.Contains(strings.ToLower(msg), "http") {
-			return
-		}
-	}
-
-	// Skip internal/infrastructure messages
-	msg := entry.Message
-	if msg == "" {
-		msg = entry.Msg
-	}
-	if strings.Contains(msg, "Registered tunnel connection") ||
-		strings.Contains(msg, "Initial protocol") ||
-		strings.Contains(msg, "Connection established") {
-		if p.verbose {
-			log.Printf("Skipping infrastructure log: %s", msg)
-		}
-		return
-	}
-
-	// Only log if we have at least an IP or hostname
-	if clientIP == "" && entry.Hostname == "" && entry.Origin == "" {
+	if req == nil {
 		return
 	}
-
-	// Parse timestamp
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	if entry.Time != "" {
-		if t, err := time.Parse(time.RFC3339, entry.Time); err == nil {
-			timestamp = t.Local().Format("2006-01-02 15:04:05")
-		}
-	}
-
-	// Extract hostname from origin URL if not set
-	hostname := entry.Hostname
-	if hostname == "" && entry.Origin != "" {
-		hostname = extractHostFromURL(entry.Origin)
-	}
-
-	// Extract path
-	path := entry.Path
-	if path == "" && entry.Origin != "" {
-		path = extractPathFromURL(entry.Origin)
-	}
-
-	method := entry.Method
-	if method == "" {
-		method = "GET"
+	eventTime := req.Time
+	if eventTime.IsZero() {
+		eventTime = time.Now()
 	}
-
-	p.insertConnection(timestamp, clientIP, "", method, path, hostname, "", "")
+	p.insertConnection(eventTime, req.ClientIP, "", req.Method, req.Path, req.Host, req.UserAgent, req.Referer, req.CFRay)
 }
 
-func (p *LogParser) parseLogfmt(line string) {
-	// Extract fields using regex
-	var clientIP, hostname, path, method string
-
-	if matches := logfmtPattern.FindStringSubmatch(line); len(matches) > 1 {
-		clientIP = matches[1]
-	}
-	if matches := hostPattern.FindStringSubmatch(line); len(matches) > 1 {
-		hostname = matches[1]
-	}
-	if matches := pathPattern.FindStringSubmatch(line); len(matches) > 1 {
-		path = matches[1]
-	}
-	if matches := methodPattern.FindStringSubmatch(line); len(matches) > 1 {
-		method = matches[1]
-	}
-
-	// Skip if no useful info
-	if clientIP == "" && hostname == "" {
+func (p *LogParser) insertConnection(eventTime time.Time, clientIP, country, method, path, host, userAgent, referer, cfRay string) {
+	timestamp := store.FormatTime(eventTime)
+	if p.dedupWindow > 0 && p.isDuplicate(eventTime, clientIP, method, path, host, cfRay) {
+		if p.verbose {
+			log.Printf("Skipping duplicate: %s | %s %s | %s", clientIP, method, path, host)
+		}
 		return
 	}
 
-	if method == "" {
-		method = "GET"
-	}
-
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	p.insertConnection(timestamp, clientIP, "", method, path, hostname, "", "")
-}
-
-func (p *LogParser) insertConnection(timestamp, clientIP, country, method, path, host, userAgent, referer string) {
 	_, err := p.db.Exec(`
-		INSERT INTO connections (timestamp, client_ip, country, method, path, host, user_agent, referer)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		timestamp, clientIP, country, method, path, host, userAgent, referer)
+		INSERT INTO connections (timestamp, client_ip, country, method, path, host, user_agent, referer, source, seq, cf_ray)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'logparser', ?, ?)`,
+		timestamp, clientIP, country, method, path, host, userAgent, referer, p.seqGen.New(eventTime), cfRay)
 
 	if err != nil {
 		log.Printf("Failed to insert: %v", err)
@@ -259,27 +114,24 @@ func (p *LogParser) insertConnection(timestamp, clientIP, country, method, path,
 	log.Printf("Logged: %s | %s | %s %s | %s", timestamp, clientIP, method, path, host)
 }
 
-func extractHostFromURL(url string) string {
-	// Remove protocol
-	url = strings.TrimPrefix(url, "http://")
-	url = strings.TrimPrefix(url, "https://")
-	// Get host part
-	if idx := strings.Index(url, "/"); idx != -1 {
-		url = url[:idx]
-	}
-	if idx := strings.Index(url, ":"); idx != -1 {
-		url = url[:idx]
+// isDuplicate reports whether another source (normally the proxy behind
+// this tunnel) already logged the request: same CF-Ray, or without one the
+// same client, method, host and path within the dedup window
+func (p *LogParser) isDuplicate(eventTime time.Time, clientIP, method, path, host, cfRay string) bool {
+	var id int64
+	var err error
+	if cfRay != "" {
+		err = p.db.QueryRow("SELECT id FROM connections WHERE cf_ray = ? LIMIT 1", cfRay).Scan(&id)
+	} else {
+		err = p.db.QueryRow(`SELECT id FROM connections
+			WHERE client_ip = ? AND method = ? AND host = ? AND path = ? AND source != 'logparser'
+			AND timestamp BETWEEN ? AND ? LIMIT 1`,
+			clientIP, method, host, path,
+			store.FormatTime(eventTime.Add(-p.dedupWindow)),
+			store.FormatTime(eventTime.Add(p.dedupWindow))).Scan(&id)
 	}
-	return url
-}
-
-func extractPathFromURL(url string) string {
-	// Remove protocol
-	url = strings.TrimPrefix(url, "http://")
-	url = strings.TrimPrefix(url, "https://")
-	// Get path part
-	if idx := strings.Index(url, "/"); idx != -1 {
-		return url[idx:]
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Duplicate check failed: %v", err)
 	}
-	return "/"
+	return err == nil
 }
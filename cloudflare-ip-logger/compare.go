@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// PeriodDelta compares one figure across two consecutive periods
+type PeriodDelta struct {
+	Current  int      `json:"current"`
+	Previous int      `json:"previous"`
+	Change   int      `json:"change"`
+	Percent  *float64 `json:"percent"` // nil when the previous period had nothing
+}
+
+func newPeriodDelta(current, previous int) PeriodDelta {
+	d := PeriodDelta{Current: current, Previous: previous, Change: current - previous}
+	if previous > 0 {
+		pct := math.Round(float64(current-previous)/float64(previous)*1000) / 10
+		d.Percent = &pct
+	}
+	return d
+}
+
+type HostDelta struct {
+	Host string `json:"host"`
+	PeriodDelta
+}
+
+// GET /_proxy/stats/compare?period=7d&category=visitor&network=none&ipv6_prefix=64
+//
+// Compares the last period with the one before it: total hits, unique IPs
+// (or prefixes, as in /stats) and hits per host.
+func (app *App) handleStatsCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	periodParam := r.URL.Query().Get("period")
+	if periodParam == "" {
+		periodParam = "7d"
+	}
+	period, ok := parseRelative(periodParam)
+	if !ok {
+		http.Error(w, "invalid period (expected a duration like 24h, 7d or 4w)", http.StatusBadRequest)
+		return
+	}
+	group, err := parseIPGrouping(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	category := r.URL.Query().Get("category")
+	if category == "" {
+		category = categoryVisitor
+	}
+	categoryWhere := " AND category = ?"
+	categoryArgs := []interface{}{category}
+	if category == "all" {
+		categoryWhere = ""
+		categoryArgs = nil
+	}
+	host := app.hostParam(r.URL.Query())
+	if host != "" {
+		categoryWhere += " AND host = ?"
+		categoryArgs = append(categoryArgs, host)
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	categoryWhere += scopeCond
+	categoryArgs = append(categoryArgs, scopeArgs...)
+	networkCond, networkArgs := networkFilter(r.URL.Query())
+	categoryWhere += networkCond
+	categoryArgs = append(categoryArgs, networkArgs...)
+	ownCond, ownArgs, err := app.ownTraffic.Filter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	categoryWhere += ownCond
+	categoryArgs = append(categoryArgs, ownArgs...)
+
+	readDB := app.readerFor(r, host)
+	now := time.Now()
+	bounds := []string{store.FormatTime(now.Add(-2 * period)), store.FormatTime(now.Add(-period)), store.FormatTime(now)}
+
+	// Index 0 is the previous period, 1 the current one
+	var hits, ips [2]int
+	hosts := make(map[string]*[2]int)
+	for i := 0; i < 2; i++ {
+		args := append([]interface{}{bounds[i], bounds[i+1]}, categoryArgs...)
+		where := " WHERE timestamp >= ? AND timestamp < ?" + categoryWhere
+		err := readDB.QueryRow("SELECT COUNT(*), COUNT(DISTINCT client_ip) FROM connections"+where, args...).
+			Scan(&hits[i], &ips[i])
+		if err == nil && group.Enabled() {
+			var n map[string]int
+			n, err = group.countDistinct(readDB, "SELECT '', client_ip FROM connections"+where+" GROUP BY 1, 2", args...)
+			ips[i] = n[""]
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := readDB.Query("SELECT host, COUNT(*) FROM connections"+where+" GROUP BY host", args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var host string
+			var n int
+			if err := rows.Scan(&host, &n); err != nil {
+				continue
+			}
+			if hosts[host] == nil {
+				hosts[host] = &[2]int{}
+			}
+			hosts[host][i] = n
+		}
+		rows.Close()
+	}
+
+	hostDeltas := make([]HostDelta, 0, len(hosts))
+	for host, n := range hosts {
+		hostDeltas = append(hostDeltas, HostDelta{Host: host, PeriodDelta: newPeriodDelta(n[1], n[0])})
+	}
+	sort.Slice(hostDeltas, func(i, j int) bool {
+		if hostDeltas[i].Current != hostDeltas[j].Current {
+			return hostDeltas[i].Current > hostDeltas[j].Current
+		}
+		return hostDeltas[i].Host < hostDeltas[j].Host
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"period":         periodParam,
+		"category":       category,
+		"current_since":  bounds[1],
+		"previous_since": bounds[0],
+		"total_hits":     newPeriodDelta(hits[1], hits[0]),
+		"unique_ips":     newPeriodDelta(ips[1], ips[0]),
+		"hosts":          hostDeltas,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Responses declaring up to this size get a generated ETag; larger ones, and
+// ones without a Content-Length, are streamed through without one
+const etagMaxBody = 4 << 20
+
+// responseHooks carries a host's response processing from the request
+// handler to the proxy's ModifyResponse
+type responseHooks struct {
+	rewriter *Rewriter // nil when the host has no rewrite rules
+	etag     bool
+}
+
+type responseHooksKey struct{}
+
+func (h *responseHooks) modify(resp *http.Response) error {
+	if h.rewriter != nil {
+		if err := h.rewriter.Modify(resp); err != nil {
+			return err
+		}
+	}
+	if h.etag {
+		return conditionalResponse(resp)
+	}
+	return nil
+}
+
+// conditionalResponse gives a full GET/HEAD response an ETag (a hash of the
+// body) if the backend didn't, then answers If-None-Match/If-Modified-Since
+// with 304 Not Modified instead of sending the body down the tunnel again.
+// Only bodies whose length is known up front are hashed: reading a stream,
+// long poll or chunked response to the end first would hold it back from the
+// client.
+func conditionalResponse(resp *http.Response) error {
+	req := resp.Request
+	if resp.StatusCode != http.StatusOK || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil
+	}
+
+	if resp.Header.Get("Etag") == "" && req.Method == http.MethodGet && hashableBody(resp) {
+		buf, err := io.ReadAll(io.LimitReader(resp.Body, etagMaxBody+1))
+		if len(buf) > etagMaxBody || err != nil {
+			resp.Body = readCloser{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+			return nil
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(buf))
+		sum := sha256.Sum256(buf)
+		resp.Header.Set("Etag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+
+	if notModified(req, resp.Header) {
+		resp.Body.Close()
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		for _, h := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding"} {
+			resp.Header.Del(h)
+		}
+	}
+	return nil
+}
+
+// hashableBody reports whether resp's body can be read whole before it is
+// sent: a declared length within etagMaxBody, and not an event stream
+func hashableBody(resp *http.Response) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	return resp.ContentLength >= 0 && resp.ContentLength <= etagMaxBody
+}
+
+// notModified evaluates the request's validators against the response's,
+// following RFC 9110: If-None-Match wins over If-Modified-Since
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ${VAR} or ${VAR:-default}; bare $VAR is left alone so literal dollar signs
+// in paths or passwords don't need escaping
+var configEnvPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandConfigEnv substitutes ${VAR} references in a JSON config file before
+// it is parsed. A variable that isn't set is read from the file named by
+// VAR_FILE instead (the Docker secrets convention). Values are JSON-escaped,
+// so references are only meaningful inside string values.
+func expandConfigEnv(data []byte) ([]byte, error) {
+	var missing []string
+	out := configEnvPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		groups := configEnvPattern.FindSubmatch(match)
+		name := string(groups[1])
+
+		value, ok := lookupConfigEnv(name)
+		if !ok {
+			if len(groups[2]) == 0 {
+				missing = append(missing, name)
+				return match
+			}
+			value = string(groups[3])
+		}
+
+		escaped, _ := json.Marshal(value)
+		return escaped[1 : len(escaped)-1]
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("undefined variables in config: %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+func lookupConfigEnv(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			return strings.TrimRight(string(data), "\r\n"), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigIssue is a problem with a candidate config. Entry is the 1-based
+// position of the route it concerns, 0 for the config as a whole.
+type ConfigIssue struct {
+	Entry   int    `json:"entry,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Message string `json:"message"`
+}
+
+// FieldChange is one option a candidate config changes on a route, with its
+// JSON value before and after; a side is left out where the option is unset
+type FieldChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from,omitempty"`
+	To    json.RawMessage `json:"to,omitempty"`
+}
+
+// RouteDiff is a route the candidate adds, removes or changes, by the key
+// it is routed under ("*" for a default route without a host)
+type RouteDiff struct {
+	Host    string        `json:"host"`
+	Backend string        `json:"backend,omitempty"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// ConfigPreview is what applying a candidate config would do. Errors are
+// entries that could not serve traffic (or a config a reload would reject
+// outright) and are left out of the diff; warnings are options a reload
+// would ignore on a route it keeps.
+type ConfigPreview struct {
+	Valid     bool          `json:"valid"`
+	Errors    []ConfigIssue `json:"errors"`
+	Warnings  []ConfigIssue `json:"warnings"`
+	Added     []RouteDiff   `json:"added"`
+	Removed   []RouteDiff   `json:"removed"`
+	Changed   []RouteDiff   `json:"changed"`
+	Unchanged int           `json:"unchanged"`
+
+	Probes []BackendProbe `json:"probes,omitempty"` // with ?probe=1
+}
+
+// validateRoute runs the checks a reload does while building a route,
+// without building it. An error keeps the route out; warnings are options
+// the route would be built without.
+func (app *App) validateRoute(cfg ProxyConfig) (error, []string) {
+	if cfg.Host == "" && !cfg.Default {
+		return errors.New("host is required (or default: true)"), nil
+	}
+	if cfg.Root == "" && strings.HasPrefix(cfg.Backend, "file://") {
+		cfg.Root = strings.TrimPrefix(cfg.Backend, "file://")
+	}
+	if cfg.Root != "" {
+		if _, err := newStaticSite(cfg.Root, cfg.Index, cfg.SPAFallback); err != nil {
+			return err, nil
+		}
+	} else {
+		if cfg.Backend == "" {
+			return errors.New("backend or root is required"), nil
+		}
+		u, err := url.Parse(cfg.Backend)
+		if err != nil {
+			return err, nil
+		}
+		if _, u, err = parseDiscoveryBackend(u); err != nil {
+			return err, nil
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("backend %s: expected an http:// or https:// URL with a host", u.Redacted()), nil
+		}
+		transport, err := newBackendTransport(cfg, "")
+		if err != nil {
+			return err, nil
+		}
+		transport.http.CloseIdleConnections()
+	}
+
+	var warnings []string
+	if cfg.Mirror != "" {
+		if _, err := newMirror(cfg, app.mirrorMaxBody); err != nil {
+			warnings = append(warnings, "mirror ignored: "+err.Error())
+		}
+	}
+	if len(cfg.Rewrite) > 0 {
+		if _, err := NewRewriter(cfg.Rewrite); err != nil {
+			warnings = append(warnings, "rewrite rules ignored: "+err.Error())
+		}
+	}
+	if _, err := newAssetPolicy(cfg); err != nil {
+		warnings = append(warnings, "robots/favicon ignored: "+err.Error())
+	}
+	return nil, warnings
+}
+
+// previewConfig validates a candidate config as a reload would read it and
+// compares the routes it would keep with the running ones. With probe, the
+// backends it adds or changes are checked like the health gate does.
+func (app *App) previewConfig(ctx context.Context, data []byte, probe bool) ConfigPreview {
+	p := ConfigPreview{Errors: []ConfigIssue{}, Warnings: []ConfigIssue{},
+		Added: []RouteDiff{}, Removed: []RouteDiff{}, Changed: []RouteDiff{}}
+	data, err := expandConfigEnv(data)
+	var configs []ProxyConfig
+	if err == nil {
+		err = json.Unmarshal(data, &configs)
+	}
+	if err != nil {
+		// The reload would keep the running config
+		p.Errors = append(p.Errors, ConfigIssue{Message: err.Error()})
+		return p
+	}
+
+	candidate := make(map[string]ProxyConfig)
+	entries := make(map[string]int)
+	aliases := make(map[string]string)
+	var defaults []string
+	for i, cfg := range configs {
+		issue := ConfigIssue{Entry: i + 1, Host: cfg.Host}
+		hostKey := cfg.routeKey()
+		err, warnings := app.validateRoute(cfg)
+		for _, w := range warnings {
+			issue.Message = w
+			p.Warnings = append(p.Warnings, issue)
+		}
+		if err != nil {
+			issue.Message = err.Error()
+			p.Errors = append(p.Errors, issue)
+			continue
+		}
+		if prev, ok := entries[hostKey]; ok {
+			issue.Message = fmt.Sprintf("replaces entry %d for the same host", prev)
+			p.Warnings = append(p.Warnings, issue)
+		}
+		for _, alias := range cfg.Aliases {
+			alias = strings.ToLower(alias)
+			if owner, ok := aliases[alias]; ok && owner != hostKey {
+				issue.Message = fmt.Sprintf("alias %s is also an alias of %s; the later one wins", alias, owner)
+				p.Warnings = append(p.Warnings, issue)
+			}
+			aliases[alias] = hostKey
+		}
+		if cfg.Default {
+			defaults = append(defaults, hostKey)
+		}
+		candidate[hostKey] = cfg
+		entries[hostKey] = i + 1
+	}
+	for alias, owner := range aliases {
+		if _, ok := candidate[alias]; ok {
+			p.Warnings = append(p.Warnings, ConfigIssue{Entry: entries[owner], Host: owner,
+				Message: "alias " + alias + " is also a host of its own, which the alias overrides"})
+		}
+	}
+	if len(defaults) > 1 {
+		p.Warnings = append(p.Warnings, ConfigIssue{Message: fmt.Sprintf("%d default routes; %s is used", len(defaults), defaults[len(defaults)-1])})
+	}
+
+	running := app.routes.Load().configs
+	var probed []ProxyConfig
+	for _, key := range sortedKeys(candidate) {
+		cfg := candidate[key]
+		old, ok := running[key]
+		if !ok || !sameBackend(old, cfg) {
+			probed = append(probed, cfg)
+		}
+		if !ok {
+			p.Added = append(p.Added, RouteDiff{Host: key, Backend: redactedBackend(cfg)})
+			continue
+		}
+		if changes := configChanges(old, cfg); len(changes) > 0 {
+			p.Changed = append(p.Changed, RouteDiff{Host: key, Backend: redactedBackend(cfg), Changes: changes})
+		} else {
+			p.Unchanged++
+		}
+	}
+	for _, key := range sortedKeys(running) {
+		if _, ok := candidate[key]; !ok {
+			p.Removed = append(p.Removed, RouteDiff{Host: key, Backend: redactedBackend(running[key])})
+		}
+	}
+	p.Valid = len(p.Errors) == 0
+	if probe {
+		p.Probes = app.probeCandidates(ctx, probed)
+	}
+	return p
+}
+
+// probeCandidates builds throwaway routes for configs and probes their
+// backends, reporting what the health gate would do with each
+func (app *App) probeCandidates(ctx context.Context, configs []ProxyConfig) []BackendProbe {
+	routes := make([]*route, len(configs))
+	for i, cfg := range configs {
+		if rt, err := app.newRoute(cfg, time.Hour); err == nil {
+			routes[i] = rt
+		}
+	}
+	probes := []BackendProbe{}
+	for i, p := range probeRoutes(ctx, configs, routes) {
+		if rt := routes[i]; rt != nil && rt.static == nil {
+			if rt.pool != nil {
+				rt.pool.Stop()
+			}
+			rt.transport.http.CloseIdleConnections()
+		}
+		if p != nil {
+			p.Action = app.healthGate.action(p.OK)
+			probes = append(probes, *p)
+		}
+	}
+	return probes
+}
+
+func sortedKeys(m map[string]ProxyConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redactedBackend is where a route sends requests, without URL passwords
+func redactedBackend(cfg ProxyConfig) string {
+	if cfg.Root != "" {
+		return "file://" + cfg.Root
+	}
+	if u, err := url.Parse(cfg.Backend); err == nil {
+		return u.Redacted()
+	}
+	return cfg.Backend
+}
+
+// configChanges lists the options that differ between two entries for a
+// route, by JSON field name
+func configChanges(old, cfg ProxyConfig) []FieldChange {
+	before, after := configFields(old), configFields(cfg)
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	var changes []FieldChange
+	for name := range names {
+		if string(before[name]) != string(after[name]) {
+			changes = append(changes, FieldChange{Field: name, From: before[name], To: after[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// configFields is an entry's set options as JSON, URLs without passwords
+func configFields(cfg ProxyConfig) map[string]json.RawMessage {
+	for _, u := range []*string{&cfg.Backend, &cfg.Mirror} {
+		if parsed, err := url.Parse(*u); err == nil && *u != "" {
+			*u = parsed.Redacted()
+		}
+	}
+	data, _ := json.Marshal(cfg)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	for name, v := range fields {
+		if s := string(v); s == `""` || s == "{}" {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+// POST /_proxy/config/preview?probe=1 - body: a candidate proxy-config.json
+//
+// Validates the candidate the way a reload reads it and returns the routes
+// it would add, remove and change against the running config, without
+// applying anything. probe=1 also checks the new and changed backends.
+func (app *App) handleConfigPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxConfigSize {
+		http.Error(w, "Config too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	probe, _ := strconv.ParseBool(r.URL.Query().Get("probe"))
+	json.NewEncoder(w).Encode(app.previewConfig(r.Context(), data, probe))
+}
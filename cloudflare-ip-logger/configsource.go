@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Largest proxy config accepted from a remote source
+const maxConfigSize = 1 << 20
+
+// configSource is where proxy-config.json comes from. Fetch returns the
+// current document and an opaque version; when the version equals last the
+// data may be nil. Blocking sources hold Fetch open until something changes
+// (or their wait expires), so the watcher doesn't need to poll them.
+type configSource interface {
+	Fetch(ctx context.Context, last string) (data []byte, version string, err error)
+	Blocking() bool
+	String() string
+}
+
+// newConfigSource parses CONFIG_SOURCE:
+//
+//	/data/proxy-config.json               - local file (default, PROXY_CONFIG)
+//	https://config.example.com/proxy.json - HTTP(S) URL, polled with ETags
+//	consul://consul:8500/cf-ip-logger/proxy-config
+//	etcd://etcd:2379/cf-ip-logger/proxy-config
+//
+// consul+https:// and etcd+https:// talk TLS. token is sent as a bearer token
+// (HTTP), X-Consul-Token (Consul) or Authorization (etcd).
+func newConfigSource(spec, token string) (configSource, error) {
+	if !strings.Contains(spec, "://") {
+		return &fileConfigSource{path: spec}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	kind, scheme, _ := strings.Cut(u.Scheme, "+")
+	if scheme == "" {
+		scheme = "http"
+	}
+	base := scheme + "://" + u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+
+	switch kind {
+	case "file":
+		return &fileConfigSource{path: u.Path}, nil
+	case "http", "https":
+		return &httpConfigSource{url: spec, token: token, client: client}, nil
+	case "consul":
+		// Blocking queries are held open up to consulWait, so no client timeout
+		return &consulConfigSource{base: base, key: key, token: token, client: &http.Client{}}, nil
+	case "etcd":
+		return &etcdConfigSource{base: base, key: key, token: token, client: client}, nil
+	}
+	return nil, fmt.Errorf("unsupported config source %q", u.Scheme)
+}
+
+type fileConfigSource struct {
+	path string
+}
+
+func (s *fileConfigSource) Fetch(ctx context.Context, last string) ([]byte, string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, "", err
+	}
+	version := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	if version == last {
+		return nil, version, nil
+	}
+	data, err := os.ReadFile(s.path)
+	return data, version, err
+}
+
+func (s *fileConfigSource) Blocking() bool { return false }
+func (s *fileConfigSource) String() string { return s.path }
+
+type httpConfigSource struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpConfigSource) Fetch(ctx context.Context, last string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if strings.HasPrefix(last, "etag:") {
+		req.Header.Set("If-None-Match", strings.TrimPrefix(last, "etag:"))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, last, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize))
+	if err != nil {
+		return nil, "", err
+	}
+	// Servers without ETags are compared by content
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return data, "etag:" + etag, nil
+	}
+	sum := sha256.Sum256(data)
+	return data, "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func (s *httpConfigSource) Blocking() bool { return false }
+func (s *httpConfigSource) String() string { return s.url }
+
+// How long a Consul blocking query waits for a change before returning
+const consulWait = "5m"
+
+type consulConfigSource struct {
+	base   string
+	key    string
+	token  string
+	client *http.Client
+}
+
+// Fetch uses Consul's blocking queries: with the previous X-Consul-Index the
+// request only returns once the key changes or consulWait passes
+func (s *consulConfigSource) Fetch(ctx context.Context, last string) ([]byte, string, error) {
+	q := url.Values{"raw": {""}}
+	if last != "" {
+		q.Set("index", last)
+		q.Set("wait", consulWait)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/v1/kv/"+s.key+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("consul: HTTP %d for key %s", resp.StatusCode, s.key)
+	}
+	index := resp.Header.Get("X-Consul-Index")
+	if index == last {
+		return nil, last, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize))
+	return data, index, err
+}
+
+func (s *consulConfigSource) Blocking() bool { return true }
+func (s *consulConfigSource) String() string { return "consul " + s.base + "/" + s.key }
+
+type etcdConfigSource struct {
+	base   string
+	key    string
+	token  string
+	client *http.Client
+}
+
+// Fetch reads the key through etcd's v3 JSON gateway; the key's mod_revision
+// is the version
+func (s *etcdConfigSource) Fetch(ctx context.Context, last string) ([]byte, string, error) {
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("etcd: HTTP %d for key %s", resp.StatusCode, s.key)
+	}
+	var result struct {
+		Kvs []struct {
+			ModRevision string `json:"mod_revision"`
+			Value       string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 2*maxConfigSize)).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	if len(result.Kvs) == 0 {
+		return nil, "", fmt.Errorf("etcd: key %s not found", s.key)
+	}
+	kv := result.Kvs[0]
+	if kv.ModRevision == last {
+		return nil, last, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(kv.Value)
+	return data, kv.ModRevision, err
+}
+
+func (s *etcdConfigSource) Blocking() bool { return false }
+func (s *etcdConfigSource) String() string { return "etcd " + s.base + "/" + s.key }
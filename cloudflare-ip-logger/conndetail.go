@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Columns read into a ConnectionLog, in scanConnection's order
+const connectionColumns = `id, timestamp, client_ip, country, method, path, host, user_agent, referer, category, via_cloudflare, source, seq,
+	cf_ray, cf_visitor_scheme, cf_worker, cf_city, cf_region, headers,
+	tls_version, tls_cipher, tls_sni, tls_alpn, tls_ja3, unmatched, network, decision, rule,
+	utm_source, utm_medium, utm_campaign`
+
+// scanConnection reads a row of connectionColumns, with the time in loc and
+// the client IP's triage tag
+func (app *App) scanConnection(row interface{ Scan(...interface{}) error }, loc *time.Location) (ConnectionLog, error) {
+	var c ConnectionLog
+	var headers string
+	err := row.Scan(&c.ID, &c.TimestampStr, &c.ClientIP, &c.Country, &c.Method, &c.Path, &c.Host, &c.UserAgent, &c.Referer, &c.Category, &c.ViaCF, &c.Source, &c.Seq,
+		&c.CFRay, &c.CFScheme, &c.CFWorker, &c.CFCity, &c.CFRegion, &headers,
+		&c.TLSVersion, &c.TLSCipher, &c.TLSServerName, &c.TLSALPN, &c.TLSJA3, &c.Unmatched, &c.Network, &c.Decision, &c.Rule,
+		&c.UTMSource, &c.UTMMedium, &c.UTMCampaign)
+	if err != nil {
+		return c, err
+	}
+	if headers != "" {
+		json.Unmarshal([]byte(headers), &c.Headers)
+	}
+	c.TimestampStr = formatStoredTime(c.TimestampStr, loc)
+	c.Tag = app.ipTags.TagOf(c.ClientIP)
+	return c, nil
+}
+
+// How far apart a capture and a connection row may be timed and still be
+// the same request: the capture is stamped before the backend answers
+const captureMatchWindow = 5 * time.Second
+
+// ConnectionDetail is one request with what is known about it
+type ConnectionDetail struct {
+	Connection ConnectionLog `json:"connection"`
+	Info       *IPInfo       `json:"info,omitempty"` // from ENRICH_IPS, once looked up
+	Banned     bool          `json:"banned"`
+	Capture    *Capture      `json:"capture,omitempty"` // admins only, with CAPTURE_HOSTS
+	// The same IP's requests around this one, nearest first
+	Before []ConnectionLog `json:"before"`
+	After  []ConnectionLog `json:"after"`
+}
+
+// GET /_proxy/connections/{id}?neighbors=10&tz=Europe/Berlin
+//
+// id is the row's id or its seq. With DB_PARTITION=host the id is the one
+// the cross-host view shows, which says which partition file holds the row.
+func (app *App) handleConnectionDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	neighbors := 10
+	if n, err := strconv.Atoi(r.URL.Query().Get("neighbors")); err == nil && n >= 0 && n <= 100 {
+		neighbors = n
+	}
+
+	scopeCond, scopeArgs := hostScope(r, "host")
+	db := app.readerFor(r, "")
+	// An id is looked up in the file holding it, by its primary key rather
+	// than through the view's offset ids
+	lookupDB, column, key := db, "seq", interface{}(id)
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		column, key = "id", n
+		if _, archived := r.Context().Value(archiveDBKey{}).(*sql.DB); app.partitions != nil && !archived {
+			lookupDB, key = app.partitions.Lookup(n)
+			if lookupDB == nil {
+				lookupDB = app.db
+			}
+		}
+	}
+	conn, err := app.scanConnection(lookupDB.QueryRow("SELECT "+connectionColumns+" FROM connections WHERE "+column+" = ?"+scopeCond,
+		append([]interface{}{key}, scopeArgs...)...), time.UTC)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if column == "id" {
+		conn.ID, _ = strconv.ParseInt(id, 10, 64)
+	}
+
+	detail := ConnectionDetail{
+		Info:   lookupIPInfo(app.db, conn.ClientIP),
+		Banned: app.bans.Banned(conn.ClientIP),
+		Before: []ConnectionLog{},
+		After:  []ConnectionLog{},
+	}
+	if app.capturer != nil && app.admin.IsAdmin(r) {
+		if t, err := time.Parse(time.RFC3339, conn.TimestampStr); err == nil {
+			detail.Capture = app.capturer.Match(conn.ClientIP, conn.Host, conn.Method, conn.Path, t)
+		}
+	}
+	if neighbors > 0 {
+		detail.Before, err = app.neighborConnections(db, conn, "<", "DESC", neighbors, scopeCond, scopeArgs, loc)
+		if err == nil {
+			detail.After, err = app.neighborConnections(db, conn, ">", "ASC", neighbors, scopeCond, scopeArgs, loc)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	conn.TimestampStr = formatStoredTime(conn.TimestampStr, loc)
+	detail.Connection = conn
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// neighborConnections returns up to limit of conn's client's requests on one
+// side of it by seq
+func (app *App) neighborConnections(db *sql.DB, conn ConnectionLog, cmp, order string, limit int, scopeCond string, scopeArgs []interface{}, loc *time.Location) ([]ConnectionLog, error) {
+	args := append([]interface{}{conn.ClientIP, conn.Seq}, scopeArgs...)
+	rows, err := db.Query("SELECT "+connectionColumns+" FROM connections WHERE client_ip = ? AND seq "+cmp+" ?"+scopeCond+
+		" ORDER BY seq "+order+" LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []ConnectionLog{}
+	for rows.Next() {
+		if c, err := app.scanConnection(rows, loc); err == nil {
+			list = append(list, c)
+		}
+	}
+	return list, rows.Err()
+}
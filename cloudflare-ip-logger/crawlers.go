@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Default User-Agent substrings of search engine crawlers
+const defaultCrawlerAgents = "Googlebot,bingbot,Applebot,DuckDuckBot,YandexBot,Baiduspider,Yahoo! Slurp,SeznamBot,PetalBot,Qwantify"
+
+// CrawlerAgents names the search engine crawler behind a User-Agent, matched
+// by substring (case-insensitive). The name is the substring as configured.
+type CrawlerAgents struct {
+	names []string
+}
+
+func NewCrawlerAgents(agents string) *CrawlerAgents {
+	ca := &CrawlerAgents{}
+	for _, a := range strings.Split(agents, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			ca.names = append(ca.names, a)
+		}
+	}
+	return ca
+}
+
+// expr is an SQL expression giving a row's crawler name, or NULL for other
+// clients. Its arguments come before any others in the statement.
+func (ca *CrawlerAgents) expr() (string, []interface{}) {
+	if len(ca.names) == 0 {
+		return "NULL", nil
+	}
+	var b strings.Builder
+	var args []interface{}
+	b.WriteString("CASE")
+	for _, name := range ca.names {
+		b.WriteString(" WHEN instr(lower(user_agent), ?) > 0 THEN ?")
+		args = append(args, strings.ToLower(name), name)
+	}
+	b.WriteString(" END")
+	return b.String(), args
+}
+
+// CrawlerStats is one crawler's activity over all paths
+type CrawlerStats struct {
+	Crawler   string `json:"crawler"`
+	Requests  int    `json:"requests"`
+	Paths     int    `json:"paths"`
+	IPs       int    `json:"ips"`
+	LastCrawl string `json:"last_crawl"`
+}
+
+// CrawledPath is how often a crawler fetched one path. IntervalHours is the
+// average time between its fetches, nil after a single one.
+type CrawledPath struct {
+	Host          string   `json:"host"`
+	Path          string   `json:"path"`
+	Crawler       string   `json:"crawler"`
+	Crawls        int      `json:"crawls"`
+	FirstCrawl    string   `json:"first_crawl"`
+	LastCrawl     string   `json:"last_crawl"`
+	IntervalHours *float64 `json:"interval_hours"`
+}
+
+// UncrawledPath is a page visitors fetch that no crawler did
+type UncrawledPath struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+	Hits int    `json:"hits"`
+}
+
+// GET /_proxy/stats/crawlers?since=30d&until=2024-01-02&host=blog.example.com&crawler=Googlebot&limit=100&tz=Europe/Berlin
+//
+// Search engine crawl coverage: each crawler's totals, every host and path
+// it fetched with how often and when last, and the pages visitors request
+// most that no crawler fetched in the range. format=csv or ndjson exports
+// the paths.
+func (app *App) handleCrawlerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("since") == "" && query.Get("until") == "" {
+		query.Set("since", "30d")
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := exportLimit(r, format, 100, 1000)
+	cond, args, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Beacons repeat the page a browser showed; crawlers don't run scripts
+	cond += " AND category != '" + categoryBeacon + "'"
+	host := app.hostParam(query)
+	if host != "" {
+		cond += " AND host = ?"
+		args = append(args, host)
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	cond += scopeCond
+	args = append(args, scopeArgs...)
+	ownCond, ownArgs, err := app.ownTraffic.Filter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cond += ownCond
+	args = append(args, ownArgs...)
+
+	crawlerExpr, crawlerArgs := app.crawlers.expr()
+	// Crawler rows with their crawler name, as a subquery so the name can be
+	// filtered and grouped on
+	from := ` FROM (SELECT host, path, client_ip, timestamp, ` + crawlerExpr + ` AS crawler
+		FROM connections WHERE 1 = 1` + cond + `) WHERE crawler IS NOT NULL`
+	fromArgs := append(append([]interface{}{}, crawlerArgs...), args...)
+	if crawler := query.Get("crawler"); crawler != "" {
+		from += " AND lower(crawler) = ?"
+		fromArgs = append(fromArgs, strings.ToLower(crawler))
+	}
+
+	readDB := app.readerFor(r, host)
+	paths := []CrawledPath{}
+	rows, err := readDB.Query(`SELECT host, path, crawler, COUNT(*), MIN(timestamp), MAX(timestamp),
+		CASE WHEN COUNT(*) > 1 THEN (julianday(MAX(timestamp)) - julianday(MIN(timestamp))) * 24 / (COUNT(*) - 1) END`+
+		from+` GROUP BY 1, 2, 3 ORDER BY 4 DESC, 6 DESC LIMIT ?`, append(fromArgs, limit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var p CrawledPath
+		if err := rows.Scan(&p.Host, &p.Path, &p.Crawler, &p.Crawls, &p.FirstCrawl, &p.LastCrawl, &p.IntervalHours); err != nil {
+			continue
+		}
+		p.FirstCrawl = formatStoredTime(p.FirstCrawl, loc)
+		p.LastCrawl = formatStoredTime(p.LastCrawl, loc)
+		paths = append(paths, p)
+	}
+	rows.Close()
+	if format != "" {
+		writeList(w, format, "crawled_paths", paths)
+		return
+	}
+
+	crawlers := []CrawlerStats{}
+	rows, err = readDB.Query(`SELECT crawler, COUNT(*), COUNT(DISTINCT host || path), COUNT(DISTINCT client_ip), MAX(timestamp)`+
+		from+` GROUP BY 1 ORDER BY 2 DESC`, fromArgs...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var c CrawlerStats
+		if err := rows.Scan(&c.Crawler, &c.Requests, &c.Paths, &c.IPs, &c.LastCrawl); err == nil {
+			c.LastCrawl = formatStoredTime(c.LastCrawl, loc)
+			crawlers = append(crawlers, c)
+		}
+	}
+	rows.Close()
+
+	// Visitor page fetches of host/paths no crawler asked for, not counting
+	// other crawlers when one is picked
+	uncrawledArgs := append(append([]interface{}{}, args...), crawlerArgs...)
+	uncrawledArgs = append(append(uncrawledArgs, fromArgs...), limit)
+	uncrawled := []UncrawledPath{}
+	rows, err = readDB.Query(`SELECT host, path, COUNT(*) FROM connections
+		WHERE `+serverHitCond+cond+` AND `+crawlerExpr+` IS NULL
+		AND (host, path) NOT IN (SELECT host, path`+from+`)
+		GROUP BY 1, 2 ORDER BY 3 DESC LIMIT ?`, uncrawledArgs...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u UncrawledPath
+		if err := rows.Scan(&u.Host, &u.Path, &u.Hits); err == nil {
+			uncrawled = append(uncrawled, u)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"crawlers":  crawlers,
+		"paths":     paths,
+		"uncrawled": uncrawled,
+	})
+}
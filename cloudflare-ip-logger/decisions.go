@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// What enforcement did with a request, stored as the connection row's
+// decision next to the rule that made it; empty when nothing interfered
+const (
+	decisionBlocked     = "blocked"
+	decisionRateLimited = "rate_limited"
+	decisionObserved    = "observed" // a rule matched but observe mode or DRY_RUN let it through
+)
+
+// Rule IDs for the checks that aren't bans; bans are "ban:" + their ID
+const (
+	ruleClientConcurrency  = "max_concurrent_per_client"
+	ruleBackendConcurrency = "max_concurrent"
+	ruleUnknownHost        = "unknown_host"
+	ruleAPIRateLimit       = "api_rate_limit"
+)
+
+type decisionKey struct{}
+
+type requestDecision struct {
+	decision, rule string
+}
+
+// withDecision marks r with a decision made before the request is logged,
+// for extractClientInfo to copy onto the row
+func withDecision(r *http.Request, decision, rule string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), decisionKey{}, requestDecision{decision, rule}))
+}
+
+func decisionOf(r *http.Request) (decision, rule string) {
+	d, _ := r.Context().Value(decisionKey{}).(requestDecision)
+	return d.decision, d.rule
+}
+
+type loggedConnectionKey struct{}
+
+// withLoggedConnection keeps the row apiLogMiddleware wrote, so the API rate
+// limit further in can mark it
+func withLoggedConnection(r *http.Request, conn ConnectionLog) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggedConnectionKey{}, conn))
+}
+
+// loggedConnection is the row logged for r, zero when API calls aren't logged
+func loggedConnection(r *http.Request) ConnectionLog {
+	conn, _ := r.Context().Value(loggedConnectionKey{}).(ConnectionLog)
+	return conn
+}
+
+// recordDecision sets the decision on a row already logged, for checks made
+// after logging such as the concurrency caps. conn.Seq must be set.
+func (app *App) recordDecision(conn ConnectionLog, decision, rule string) {
+	if app.readOnly || conn.Seq == "" {
+		return
+	}
+	if _, err := app.writerFor(conn.Host).Exec("UPDATE connections SET decision = ?, rule = ? WHERE seq = ?",
+		decision, rule, conn.Seq); err != nil {
+		slog.Error("Error recording decision", "seq", conn.Seq, "err", err)
+	}
+}
+
+// decisionFilter turns ?decision= and ?rule= into conditions starting with
+// " AND". decision is a decision name, "none" for requests nothing
+// interfered with or "any" for the rest; rule matches a prefix ending in
+// ":", so rule=ban: finds every ban.
+func decisionFilter(query url.Values) (string, []interface{}) {
+	var cond string
+	var args []interface{}
+	switch decision := query.Get("decision"); decision {
+	case "":
+	case "none":
+		cond += " AND decision = ''"
+	case "any":
+		cond += " AND decision != ''"
+	default:
+		cond += " AND decision = ?"
+		args = append(args, decision)
+	}
+	if rule := query.Get("rule"); strings.HasSuffix(rule, ":") {
+		cond += ` AND rule LIKE ? ESCAPE '\'`
+		args = append(args, likeEscape(rule)+"%")
+	} else if rule != "" {
+		cond += " AND rule = ?"
+		args = append(args, rule)
+	}
+	return cond, args
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"log/slog"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Rows dropped or replaced because another source already recorded the
+// same request, served at /debug/vars
+var dedupCounts = expvar.NewMap("duplicates")
+
+// findDuplicate looks for a row recording the same request as conn: the same
+// CF-Ray from any source, or, without a ray, the same client IP, method, host
+// and path from a different source within window
+func findDuplicate(db *sql.DB, conn ConnectionLog, window time.Duration) (int64, string, bool, error) {
+	var id int64
+	var source string
+	var err error
+	if conn.CFRay != "" {
+		err = db.QueryRow("SELECT id, source FROM connections WHERE cf_ray = ? LIMIT 1", conn.CFRay).Scan(&id, &source)
+	} else {
+		err = db.QueryRow(`SELECT id, source FROM connections
+			WHERE client_ip = ? AND method = ? AND host = ? AND path = ? AND source != ?
+			AND timestamp BETWEEN ? AND ? LIMIT 1`,
+			conn.ClientIP, conn.Method, conn.Host, conn.Path, conn.Source,
+			store.FormatTime(conn.Timestamp.Add(-window)),
+			store.FormatTime(conn.Timestamp.Add(window))).Scan(&id, &source)
+	}
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	return id, source, err == nil, err
+}
+
+// suppressDuplicate reports whether conn should be skipped because it is
+// already stored. Proxy rows carry more detail (country, user agent, CF
+// headers) than cf-log-parser or agent rows, so a proxy row replaces an
+// earlier one from another source instead of being dropped.
+func (app *App) suppressDuplicate(db *sql.DB, conn ConnectionLog) bool {
+	dbs := []*sql.DB{db}
+	if db != app.db {
+		// cf-log-parser always writes the main file, even when partitioned
+		dbs = append(dbs, app.db)
+	}
+	for _, d := range dbs {
+		id, source, found, err := findDuplicate(d, conn, app.dedupWindow)
+		if err != nil {
+			slog.Error("Duplicate check failed", "err", err)
+			return false
+		}
+		if !found {
+			continue
+		}
+		if conn.Source == sourceProxy && source != sourceProxy {
+			if _, err := d.Exec("DELETE FROM connections WHERE id = ?", id); err != nil {
+				slog.Error("Error replacing duplicate row", "id", id, "err", err)
+				return true
+			}
+			dedupCounts.Add("replaced", 1)
+			return false
+		}
+		dedupCounts.Add("suppressed", 1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Source recorded on synthetic rows, so they can be told apart and removed
+const sourceDemo = "demo"
+
+var (
+	demoHosts = []string{"www.example.com", "www.example.com", "api.example.com", "blog.example.com", "status.example.com"}
+	demoPaths = map[string][]string{
+		"www.example.com":    {"/", "/", "/", "/about", "/pricing", "/pricing", "/contact", "/login", "/signup", "/assets/app.js", "/assets/app.css"},
+		"api.example.com":    {"/v1/items", "/v1/items", "/v1/items/42", "/v1/items/7", "/v1/users/me", "/v1/search?q=widgets", "/v1/health"},
+		"blog.example.com":   {"/", "/feed.xml", "/posts/hello-world", "/posts/scaling-sqlite", "/posts/cloudflare-tunnels", "/tags/go"},
+		"status.example.com": {"/", "/api/status", "/history"},
+	}
+	demoScannerPaths = []string{"/wp-login.php", "/.env", "/.git/config", "/xmlrpc.php", "/phpmyadmin/", "/admin.php", "/vendor/phpunit/phpunit/src/Util/PHP/eval-stdin.php"}
+	demoReferers     = []string{"https://www.google.com/", "https://duckduckgo.com/", "https://news.ycombinator.com/", "https://www.reddit.com/", "https://t.co/"}
+
+	// Countries weighted by how often they appear, with a city and region
+	demoLocations = []struct{ country, city, region string }{
+		{"US", "Ashburn", "Virginia"}, {"US", "San Jose", "California"}, {"US", "Chicago", "Illinois"}, {"US", "New York", "New York"},
+		{"DE", "Frankfurt am Main", "Hesse"}, {"DE", "Berlin", "Berlin"}, {"GB", "London", "England"}, {"FR", "Paris", "Ile-de-France"},
+		{"NL", "Amsterdam", "North Holland"}, {"JP", "Tokyo", "Tokyo"}, {"BR", "Sao Paulo", "Sao Paulo"}, {"IN", "Mumbai", "Maharashtra"},
+		{"CA", "Toronto", "Ontario"}, {"AU", "Sydney", "New South Wales"}, {"SG", "Singapore", ""}, {"PL", "Warsaw", "Mazovia"},
+	}
+	demoColos  = map[string]string{"US": "IAD", "DE": "FRA", "GB": "LHR", "FR": "CDG", "NL": "AMS", "JP": "NRT", "BR": "GRU", "IN": "BOM", "CA": "YYZ", "AU": "SYD", "SG": "SIN", "PL": "WAW"}
+	demoAgents = []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36 Edg/126.0",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Mobile Safari/537.36",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+	}
+	demoBotAgents     = []string{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "curl/8.5.0", "python-requests/2.32.3"}
+	demoMonitorAgents = []string{"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", "Uptime-Kuma/1.23.13"}
+)
+
+type demoClient struct {
+	ip       string
+	location int // index into demoLocations
+	agent    string
+	scanner  bool   // probes for well-known vulnerable paths
+	host     string // monitors keep checking one host
+}
+
+// demoTraffic generates plausible connections: a few hundred visitors of
+// which a handful are far more active than the rest, crawlers, scanners and
+// uptime monitors, busier in the daytime
+type demoTraffic struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	clients []demoClient
+	monitor []demoClient
+}
+
+func newDemoTraffic(seed int64) *demoTraffic {
+	d := &demoTraffic{rng: rand.New(rand.NewSource(seed))}
+	randomIP := func() string {
+		return fmt.Sprintf("%d.%d.%d.%d", 1+d.rng.Intn(222), d.rng.Intn(256), d.rng.Intn(256), 1+d.rng.Intn(254))
+	}
+	for i := 0; i < 400; i++ {
+		c := demoClient{ip: randomIP(), location: d.rng.Intn(len(demoLocations))}
+		switch n := d.rng.Intn(100); {
+		case n < 5:
+			c.scanner = true
+			c.agent = demoBotAgents[2+d.rng.Intn(2)]
+		case n < 12:
+			c.agent = demoBotAgents[d.rng.Intn(2)]
+		default:
+			c.agent = demoAgents[d.rng.Intn(len(demoAgents))]
+		}
+		d.clients = append(d.clients, c)
+	}
+	for _, host := range []string{"www.example.com", "status.example.com"} {
+		d.monitor = append(d.monitor, demoClient{ip: randomIP(), location: 0,
+			agent: demoMonitorAgents[d.rng.Intn(len(demoMonitorAgents))], host: host})
+	}
+	return d
+}
+
+// at returns a synthetic connection at ts
+func (d *demoTraffic) at(ts time.Time) ConnectionLog {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var c demoClient
+	if d.rng.Intn(10) == 0 {
+		c = d.monitor[d.rng.Intn(len(d.monitor))]
+	} else {
+		// Squaring skews the pick towards the first clients
+		c = d.clients[int(float64(len(d.clients))*d.rng.Float64()*d.rng.Float64())]
+	}
+	loc := demoLocations[c.location]
+
+	conn := ConnectionLog{
+		Timestamp: ts,
+		ClientIP:  c.ip,
+		Country:   loc.country,
+		Method:    "GET",
+		Host:      c.host,
+		UserAgent: c.agent,
+		ViaCF:     true,
+		Source:    sourceDemo,
+		CFRay:     fmt.Sprintf("%016x-%s", d.rng.Uint64(), demoColos[loc.country]),
+		CFScheme:  "https",
+		CFCity:    loc.city,
+		CFRegion:  loc.region,
+	}
+	if conn.Host == "" {
+		conn.Host = demoHosts[d.rng.Intn(len(demoHosts))]
+	}
+	paths := demoPaths[conn.Host]
+	switch {
+	case c.host != "":
+		conn.Path = paths[0]
+	case c.scanner:
+		conn.Path = demoScannerPaths[d.rng.Intn(len(demoScannerPaths))]
+	default:
+		conn.Path = paths[d.rng.Intn(len(paths))]
+		if d.rng.Intn(4) == 0 {
+			conn.Referer = demoReferers[d.rng.Intn(len(demoReferers))]
+		}
+		if d.rng.Intn(12) == 0 {
+			conn.Method = "POST"
+		}
+	}
+	return conn
+}
+
+// when picks a time in the span before now, folding most night-time hits
+// into the afternoon so the heatmap shows a daily rhythm
+func (d *demoTraffic) when(now time.Time, span time.Duration) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ts := now.Add(-time.Duration(d.rng.Int63n(int64(span))))
+	if h := ts.Hour(); (h < 7 || h > 22) && d.rng.Intn(3) > 0 {
+		ts = ts.Add(12 * time.Hour)
+		if ts.After(now) {
+			ts = ts.Add(-24 * time.Hour)
+		}
+	}
+	return ts
+}
+
+// seedDemoData inserts n synthetic connections spread over the span before
+// now in a single transaction
+func seedDemoData(db *sql.DB, traffic *demoTraffic, classifier *TrafficClassifier, n int, span time.Duration, now time.Time) error {
+	var seq store.SeqGenerator
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(insertConnectionSQL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := 0; i < n; i++ {
+		conn := traffic.at(traffic.when(now, span))
+		conn.Category = classifier.Classify(conn.ClientIP, conn.UserAgent)
+		conn.Seq = seq.New(conn.Timestamp)
+		if _, err := stmt.Exec(connectionArgs(conn)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// demoTrickle keeps logging a few synthetic connections a second, so live
+// stats and the newest rows move while the demo runs
+func (app *App) demoTrickle(traffic *demoTraffic) {
+	for now := range time.Tick(time.Second) {
+		for i := rand.Intn(4); i > 0; i-- {
+			conn := traffic.at(now)
+			conn.Category = app.classifier.Classify(conn.ClientIP, conn.UserAgent)
+			if err := app.logConnection(conn); err != nil {
+				slog.Error("Error logging demo connection", "err", err)
+			}
+		}
+	}
+}
+
+// runDemo implements `cf-ip-logger demo`: fill a database file with
+// synthetic connections, e.g. for screenshots against a persistent setup
+func runDemo(args []string) {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding connections.db")
+	n := fs.Int("n", 20000, "number of connections to generate")
+	days := fs.Int("days", 30, "spread them over this many days before now")
+	clearDemo := fs.Bool("clear", false, "delete earlier demo rows first")
+	force := fs.Bool("force", false, "write even if the database already holds real traffic")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s demo [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *n <= 0 || *days <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("demo: %v", err)
+	}
+	db, err := store.Open(*dataDir + "/connections.db")
+	if err != nil {
+		log.Fatalf("demo: %v", err)
+	}
+	defer db.Close()
+	if err := store.CreateSchema(db); err != nil {
+		log.Fatalf("demo: %v", err)
+	}
+
+	var real int
+	if err := db.QueryRow("SELECT COUNT(*) FROM connections WHERE source != ?", sourceDemo).Scan(&real); err != nil {
+		log.Fatalf("demo: %v", err)
+	}
+	if real > 0 && !*force {
+		log.Fatalf("demo: %s/connections.db holds %d real connections; use -force to mix demo rows in", *dataDir, real)
+	}
+	if *clearDemo {
+		res, err := db.Exec("DELETE FROM connections WHERE source = ?", sourceDemo)
+		if err != nil {
+			log.Fatalf("demo: %v", err)
+		}
+		removed, _ := res.RowsAffected()
+		log.Printf("Removed %d earlier demo connections", removed)
+	}
+
+	classifier := NewTrafficClassifier(getEnv("MONITORING_USER_AGENTS", defaultMonitoringAgents), getEnv("MONITORING_IPS", ""))
+	now := time.Now()
+	if err := seedDemoData(db, newDemoTraffic(now.UnixNano()), classifier, *n, time.Duration(*days)*24*time.Hour, now); err != nil {
+		log.Fatalf("demo: %v", err)
+	}
+	log.Printf("Generated %d demo connections over %d days in %s/connections.db", *n, *days, *dataDir)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Time allowed for each diagnosis step
+const diagnoseStepTimeout = 5 * time.Second
+
+// Diagnosis step results
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+// DiagnosisStep is one check of a backend diagnosis
+type DiagnosisStep struct {
+	Step     string  `json:"step"`   // dns, tcp, tls or http
+	Status   string  `json:"status"` // ok, failed or skipped
+	Duration float64 `json:"duration_ms"`
+	Detail   string  `json:"detail,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Class    string  `json:"class,omitempty"` // as in /api/errors
+}
+
+// DiagnosisTLS describes the certificate the backend presented
+type DiagnosisTLS struct {
+	Version  string   `json:"version"`
+	Subject  string   `json:"subject"`
+	Issuer   string   `json:"issuer"`
+	NotAfter string   `json:"not_after"`
+	DNSNames []string `json:"dns_names,omitempty"`
+	Verified bool     `json:"verified"` // false with no_tls_verify or pins alone
+}
+
+// Diagnosis is a live check of a host's backend, step by step: resolving
+// its name, connecting, the TLS handshake and an HTTP request. Steps after
+// the first failure are skipped.
+type Diagnosis struct {
+	Host        string          `json:"host"`
+	Backend     string          `json:"backend"`
+	OK          bool            `json:"ok"`
+	Summary     string          `json:"summary"`
+	BackendDown bool            `json:"backend_down"` // whether proxied requests have been failing
+	Maintenance bool            `json:"maintenance"`
+	Addresses   []string        `json:"addresses,omitempty"`
+	Address     string          `json:"address,omitempty"` // the one connected to
+	TLS         *DiagnosisTLS   `json:"tls,omitempty"`
+	HTTPStatus  int             `json:"http_status,omitempty"`
+	Steps       []DiagnosisStep `json:"steps"`
+	CheckedAt   string          `json:"checked_at"`
+}
+
+// step records a check's outcome and reports whether it passed
+func (d *Diagnosis) step(name string, start time.Time, detail string, err error) bool {
+	s := DiagnosisStep{Step: name, Status: stepOK, Detail: detail,
+		Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		s.Status, s.Error, s.Class = stepFailed, err.Error(), classifyProxyError(err)
+	}
+	d.Steps = append(d.Steps, s)
+	return err == nil
+}
+
+func (d *Diagnosis) skip(name, why string) {
+	d.Steps = append(d.Steps, DiagnosisStep{Step: name, Status: stepSkipped, Detail: why})
+}
+
+// diagnoseBackend runs the checks against rt's backend as the proxy would
+// reach it: same dialer, TLS settings and Host header
+func diagnoseBackend(ctx context.Context, host string, rt *route, path string) *Diagnosis {
+	d := &Diagnosis{Host: host, Backend: rt.url.Redacted(), Steps: []DiagnosisStep{}}
+	u := rt.url
+	steps := []string{"dns", "tcp", "tls", "http"}
+	skipRest := func(from int) {
+		for _, name := range steps[from:] {
+			d.skip(name, "an earlier step failed")
+		}
+	}
+
+	// DNS
+	name, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	start := time.Now()
+	stepCtx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+	switch {
+	case rt.pool != nil && rt.pool.kind == "srv":
+		_, records, err := net.DefaultResolver.LookupSRV(stepCtx, "", "", rt.pool.name)
+		for _, rec := range records {
+			d.Addresses = append(d.Addresses, net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))))
+		}
+		if err == nil && len(d.Addresses) == 0 {
+			err = fmt.Errorf("no SRV records for %s", rt.pool.name)
+		}
+		if !d.step("dns", start, "SRV "+rt.pool.name, err) {
+			cancel()
+			d.Summary = "The backend's SRV name " + rt.pool.name + " does not resolve"
+			skipRest(1)
+			return d
+		}
+	case net.ParseIP(name) != nil && rt.pool == nil:
+		d.skip("dns", "the backend is an IP address")
+		d.Addresses = []string{net.JoinHostPort(name, port)}
+	default:
+		if rt.pool != nil {
+			name, port = rt.pool.name, rt.pool.port
+		}
+		addrs, err := net.DefaultResolver.LookupHost(stepCtx, name)
+		for _, addr := range addrs {
+			d.Addresses = append(d.Addresses, net.JoinHostPort(addr, port))
+		}
+		detail := "lookup " + name
+		if err == nil {
+			detail = name + " resolves to " + strings.Join(addrs, ", ")
+		}
+		if !d.step("dns", start, detail, err) {
+			cancel()
+			d.Summary = "The backend's name " + name + " does not resolve"
+			skipRest(1)
+			return d
+		}
+	}
+	cancel()
+	d.Address = d.Addresses[0]
+
+	// TCP
+	start = time.Now()
+	stepCtx, cancel = context.WithTimeout(ctx, diagnoseStepTimeout)
+	conn, err := rt.transport.dialer.DialContext(stepCtx, "tcp", d.Address)
+	cancel()
+	if !d.step("tcp", start, "connect to "+d.Address, err) {
+		switch classifyProxyError(err) {
+		case errClassRefused:
+			d.Summary = "Nothing is listening on " + d.Address
+		case errClassTimeout:
+			d.Summary = "Connecting to " + d.Address + " timed out; is the machine up, or is a firewall dropping it?"
+		default:
+			d.Summary = "Could not connect to " + d.Address
+		}
+		skipRest(2)
+		return d
+	}
+
+	// TLS
+	if u.Scheme != "https" {
+		conn.Close()
+		d.skip("tls", "plain HTTP backend")
+	} else {
+		cfg := rt.transport.tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(d.Address)
+			if rt.pool == nil {
+				cfg.ServerName = u.Hostname()
+			}
+		}
+		start = time.Now()
+		stepCtx, cancel = context.WithTimeout(ctx, diagnoseStepTimeout)
+		tlsConn := tls.Client(conn, cfg)
+		err := tlsConn.HandshakeContext(stepCtx)
+		cancel()
+		conn.Close()
+		detail := "handshake with " + cfg.ServerName
+		if err == nil {
+			cs := tlsConn.ConnectionState()
+			d.TLS = &DiagnosisTLS{Version: tls.VersionName(cs.Version), Verified: !cfg.InsecureSkipVerify}
+			if len(cs.PeerCertificates) > 0 {
+				cert := cs.PeerCertificates[0]
+				d.TLS.Subject, d.TLS.Issuer = cert.Subject.String(), cert.Issuer.String()
+				d.TLS.NotAfter, d.TLS.DNSNames = store.FormatTime(cert.NotAfter), cert.DNSNames
+				if time.Now().After(cert.NotAfter) {
+					detail += ", certificate expired " + d.TLS.NotAfter
+				}
+			}
+		}
+		if !d.step("tls", start, detail, err) {
+			d.Summary = "The TLS handshake with " + d.Address + " failed"
+			skipRest(3)
+			return d
+		}
+	}
+
+	// HTTP, on a fresh connection with the route's transport settings so
+	// nothing is sent down the pool the proxy uses
+	transport := rt.transport.http.Clone()
+	transport.DisableKeepAlives = true
+	defer transport.CloseIdleConnections()
+	target := *u
+	target.Path, target.RawPath, target.RawQuery = strings.TrimSuffix(u.Path, "/")+path, "", ""
+	if rt.pool != nil {
+		target.Host = d.Address
+	}
+	start = time.Now()
+	stepCtx, cancel = context.WithTimeout(ctx, diagnoseStepTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(stepCtx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		d.step("http", start, "", err)
+		d.Summary = "Could not build the probe request"
+		return d
+	}
+	req.Host = host
+	req.Header.Set("User-Agent", "cf-ip-logger-diagnose")
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		d.HTTPStatus = resp.StatusCode
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("backend answered %s", resp.Status)
+		}
+	}
+	detail := "GET " + target.Path
+	if resp != nil {
+		detail += " answered " + resp.Status
+		if server := resp.Header.Get("Server"); server != "" {
+			detail += " (" + server + ")"
+		}
+	}
+	if !d.step("http", start, detail, err) {
+		if d.HTTPStatus != 0 {
+			d.Summary = fmt.Sprintf("The backend is reachable but answers %d", d.HTTPStatus)
+		} else {
+			d.Summary = "The backend accepted the connection but the HTTP request failed"
+		}
+		return d
+	}
+	d.OK = true
+	d.Summary = fmt.Sprintf("The backend is reachable and answered %d", d.HTTPStatus)
+	return d
+}
+
+// GET /_proxy/diagnose/{host}?path=/health
+//
+// Checks the host's backend live: DNS, TCP connect, TLS handshake and an
+// HTTP GET of path (default /) with the host's Host header.
+func (app *App) handleDiagnose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, rt := app.lookupRoute(strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/diagnose"), "/")))
+	if rt == nil || !requestUser(r).CanSee(host) {
+		http.Error(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	if rt.static != nil {
+		http.Error(w, "Host serves static files, it has no backend", http.StatusBadRequest)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
+
+	d := diagnoseBackend(r.Context(), host, rt, path)
+	d.BackendDown = app.backends.isDown(host)
+	_, d.Maintenance = app.maintenance.Get(host)
+	d.CheckedAt = store.FormatTime(time.Now())
+	if !d.OK {
+		slog.Info("Backend diagnosis failed", "host", host, "summary", d.Summary)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+var startTime = time.Now()
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} { return int64(time.Since(startTime).Seconds()) }))
+}
+
+// diagnosticsAddr resolves ADMIN_ADDR: a bare port such as ":6060" binds
+// loopback only. It also reports whether the result is reachable from this
+// machine alone, as heap dumps hold tokens and the share token key and
+// anything wider needs ADMIN_TOKEN.
+func diagnosticsAddr(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Just a port
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	return net.JoinHostPort(host, port), host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// serveDiagnostics runs the admin-only listener with pprof, expvar, a
+// runtime snapshot and Prometheus metrics, on loopback unless ADMIN_TOKEN
+// is set; an admin is required once ADMIN_TOKEN or accounts exist.
+func (app *App) serveDiagnostics(addr string) {
+	expvar.Publish("open_tunnels", expvar.Func(func() interface{} { return app.openTunnels.Load() }))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/snapshot", app.handleSnapshot)
+	mux.HandleFunc("/metrics", app.handleMetrics)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+
+	slog.Info("Diagnostics listening (/debug/pprof, /debug/vars, /debug/snapshot, /metrics)", "addr", addr)
+	ln, err := listenTCP(addr)
+	if err != nil {
+		slog.Error("Diagnostics listener failed", "err", err)
+		return
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.Serve(ln); err != nil {
+		slog.Error("Diagnostics listener failed", "err", err)
+	}
+}
+
+// GET /debug/snapshot - goroutine count, heap and GC figures at a glance;
+// ?gc=1 forces a collection first so growth that survives GC stands out
+func (app *App) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	var lastGC string
+	if m.LastGC > 0 {
+		lastGC = time.Unix(0, int64(m.LastGC)).Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uptime_seconds":  int64(time.Since(startTime).Seconds()),
+		"goroutines":      runtime.NumGoroutine(),
+		"open_tunnels":    app.openTunnels.Load(),
+		"heap_alloc":      m.HeapAlloc,
+		"heap_inuse":      m.HeapInuse,
+		"heap_objects":    m.HeapObjects,
+		"heap_released":   m.HeapReleased,
+		"stack_inuse":     m.StackInuse,
+		"sys":             m.Sys,
+		"num_gc":          m.NumGC,
+		"last_gc":         lastGC,
+		"gc_cpu_fraction": m.GCCPUFraction,
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackendPool is a backend whose addresses come from DNS instead of a fixed
+// host:port. Backends are written as
+//
+//	srv+http://_web._tcp.app.service.consul   - SRV lookup, lowest priority targets
+//	dns+http://app.internal:8080              - every A/AAAA address of the name
+//
+// and are re-resolved periodically. Requests rotate across the current
+// addresses; if a lookup fails the previous set is kept.
+type BackendPool struct {
+	kind string // "srv" or "dns"
+	name string
+	port string // dns only
+
+	mu      sync.RWMutex
+	targets []string
+	next    atomic.Uint32
+	stop    chan struct{}
+}
+
+// parseDiscoveryBackend splits a srv+/dns+ backend into the pool and the
+// plain URL the reverse proxy is built from. Returns a nil pool for ordinary
+// backends.
+func parseDiscoveryBackend(u *url.URL) (*BackendPool, *url.URL, error) {
+	kind, scheme, ok := strings.Cut(u.Scheme, "+")
+	if !ok || (kind != "srv" && kind != "dns") {
+		return nil, u, nil
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	pool := &BackendPool{kind: kind, name: u.Hostname(), stop: make(chan struct{})}
+	if kind == "dns" {
+		pool.port = u.Port()
+		if pool.port == "" {
+			pool.port = "80"
+			if scheme == "https" {
+				pool.port = "443"
+			}
+		}
+	}
+
+	plain := *u
+	plain.Scheme = scheme
+	return pool, &plain, nil
+}
+
+// Resolve refreshes the target list
+func (p *BackendPool) Resolve(ctx context.Context) error {
+	var targets []string
+	switch p.kind {
+	case "srv":
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", p.name)
+		if err != nil {
+			return err
+		}
+		// Records arrive sorted by priority and shuffled by weight; only
+		// fall back to higher priority values when nothing lower exists
+		for _, rec := range records {
+			if rec.Priority != records[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(rec.Target, ".")
+			targets = append(targets, net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+		}
+	case "dns":
+		addrs, err := net.DefaultResolver.LookupHost(ctx, p.name)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			targets = append(targets, net.JoinHostPort(addr, p.port))
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no addresses for %s", p.name)
+	}
+
+	p.mu.Lock()
+	p.targets = targets
+	p.mu.Unlock()
+	return nil
+}
+
+// Pick returns the next address in rotation, or "" if nothing has resolved yet
+func (p *BackendPool) Pick() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.targets) == 0 {
+		return ""
+	}
+	return p.targets[int(p.next.Add(1)-1)%len(p.targets)]
+}
+
+func (p *BackendPool) Targets() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.targets...)
+}
+
+// RefreshLoop re-resolves every interval until Stop is called
+func (p *BackendPool) RefreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := p.Resolve(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("Re-resolving backend failed, keeping the current targets", "backend", p.name, "targets", p.Targets(), "err", err)
+		}
+	}
+}
+
+// Stop ends RefreshLoop once the pool is dropped by a config reload
+func (p *BackendPool) Stop() {
+	close(p.stop)
+}
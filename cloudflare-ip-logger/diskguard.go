@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Rows deleted per statement during emergency pruning, so writers aren't
+// locked out for the whole prune
+const pruneBatchSize = 5000
+
+// Emergency pruning never keeps less than this much history
+const minEmergencyKeep = time.Hour
+
+// DiskGuard watches free space under DATA_DIR. Below the threshold it enters
+// emergency mode: file and access logging are paused, old connections are
+// pruned (halving the kept history on every check that's still low), and an
+// alert is logged and optionally POSTed to a webhook. It leaves emergency
+// mode once free space is 10% above the threshold again.
+type DiskGuard struct {
+	dir          string
+	minBytes     uint64  // absolute threshold, or 0
+	minPercent   float64 // threshold as a share of the filesystem, or 0
+	keep         time.Duration
+	webhook      string
+	databases    func() map[string]*sql.DB
+	setLogPaused func(bool)
+	onEvent      func(Event) // set to add alerts to the events timeline
+
+	mu        sync.Mutex
+	emergency bool
+	keepNow   time.Duration
+	free      uint64
+	total     uint64
+	pruned    int64
+	lastError string
+}
+
+func NewDiskGuard(dir, threshold string, keep time.Duration, webhook string,
+	databases func() map[string]*sql.DB, setLogPaused func(bool)) (*DiskGuard, error) {
+	g := &DiskGuard{dir: dir, keep: keep, webhook: webhook, databases: databases, setLogPaused: setLogPaused}
+	if pct, ok := strings.CutSuffix(threshold, "%"); ok {
+		p, err := strconv.ParseFloat(pct, 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("invalid percentage %q", threshold)
+		}
+		g.minPercent = p
+	} else {
+		n, err := parseByteSize(threshold)
+		if err != nil {
+			return nil, err
+		}
+		g.minBytes = n
+	}
+	return g, nil
+}
+
+// parseByteSize parses 500MB, 2GB, 1.5G or a plain byte count
+func parseByteSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, mult = strings.TrimSuffix(s, unit.suffix), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(n * mult), nil
+}
+
+// Run checks free space every interval
+func (g *DiskGuard) Run(interval time.Duration) {
+	for {
+		g.Check()
+		time.Sleep(interval)
+	}
+}
+
+func (g *DiskGuard) threshold(total uint64) uint64 {
+	if g.minPercent > 0 {
+		return uint64(float64(total) * g.minPercent / 100)
+	}
+	return g.minBytes
+}
+
+func (g *DiskGuard) Check() {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(g.dir, &st); err != nil {
+		slog.Error("Disk guard: statfs failed", "dir", g.dir, "err", err)
+		return
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	total := st.Blocks * uint64(st.Bsize)
+	threshold := g.threshold(total)
+
+	g.mu.Lock()
+	g.free, g.total = free, total
+	wasEmergency := g.emergency
+	switch {
+	case !g.emergency && free < threshold:
+		g.emergency = true
+		g.keepNow = g.keep
+	case g.emergency && free >= threshold+threshold/10:
+		g.emergency = false
+	case g.emergency && free < threshold && g.keepNow/2 >= minEmergencyKeep:
+		// Still low after the last prune: keep less history
+		g.keepNow /= 2
+	}
+	emergency, keep := g.emergency, g.keepNow
+	g.mu.Unlock()
+
+	if emergency != wasEmergency {
+		g.setLogPaused(emergency)
+		if emergency {
+			g.alert(severityCritical, fmt.Sprintf("Disk space low on %s: %s free, threshold %s. Pausing file logging and pruning connections older than %s",
+				g.dir, formatBytes(free), formatBytes(threshold), keep))
+		} else {
+			g.alert(severityInfo, fmt.Sprintf("Disk space recovered on %s: %s free. Resuming file logging", g.dir, formatBytes(free)))
+		}
+	}
+	if emergency {
+		g.prune(keep)
+	}
+}
+
+// prune deletes connections and proxy errors older than keep from every database
+func (g *DiskGuard) prune(keep time.Duration) {
+	cutoff := store.FormatTime(time.Now().Add(-keep))
+	var total int64
+	var errs []string
+	for name, db := range g.databases() {
+		tables := []string{"connections"}
+		if name == "connections" {
+			tables = append(tables, "proxy_errors")
+		}
+		for _, table := range tables {
+			n, err := pruneTable(db, table, cutoff)
+			total += n
+			if err != nil {
+				errs = append(errs, name+"."+table+": "+err.Error())
+			}
+		}
+		// Shrink the WAL so freed pages are reused instead of the WAL growing
+		if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			errs = append(errs, name+": checkpoint: "+err.Error())
+		}
+	}
+	if total > 0 {
+		slog.Info("Disk guard: pruned old rows", "rows", total, "older_than", keep)
+	}
+	g.mu.Lock()
+	g.pruned += total
+	g.lastError = strings.Join(errs, "; ")
+	g.mu.Unlock()
+	if len(errs) > 0 {
+		slog.Error("Disk guard: pruning failed", "err", strings.Join(errs, "; "))
+	}
+}
+
+func pruneTable(db *sql.DB, table, cutoff string) (int64, error) {
+	var total int64
+	for {
+		res, err := db.Exec("DELETE FROM "+table+" WHERE id IN (SELECT id FROM "+table+" WHERE timestamp < ? LIMIT ?)",
+			cutoff, pruneBatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// alert logs msg, adds it to the events timeline and POSTs it to the
+// webhook, if one is configured
+func (g *DiskGuard) alert(severity, msg string) {
+	slog.Warn("ALERT: " + msg)
+	sdNotify("STATUS=" + msg)
+	if g.onEvent != nil {
+		g.onEvent(Event{Kind: "alert", Severity: severity, Message: msg})
+	}
+	if g.webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"text": msg, "source": "cf-ip-logger"})
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(g.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("Disk guard: alert webhook failed", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("Disk guard: alert webhook failed", "status", resp.StatusCode)
+		}
+	}()
+}
+
+func (g *DiskGuard) Emergency() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.emergency
+}
+
+func (g *DiskGuard) Info() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	info := map[string]interface{}{
+		"free_bytes":     g.free,
+		"total_bytes":    g.total,
+		"min_free_bytes": g.threshold(g.total),
+		"emergency":      g.emergency,
+		"pruned_rows":    g.pruned,
+		"error":          g.lastError,
+	}
+	if g.emergency {
+		info["keeping"] = g.keepNow.String()
+	}
+	return info
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%d KB", n>>10)
+}
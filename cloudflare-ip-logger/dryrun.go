@@ -0,0 +1,18 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+)
+
+// Requests an enforcement rule in observe mode let through but would have
+// refused, by rule, served at /debug/vars
+var observedBlocks = expvar.NewMap("observed_blocks")
+
+// observe logs a refusal that DRY_RUN or a rule's observe option turned
+// into a log line
+func (app *App) observe(rule, clientIP string, r *http.Request, detail string) {
+	observedBlocks.Add(rule, 1)
+	slog.Warn("Dry run: would have refused", "rule", rule, "client_ip", clientIP, "host", r.Host, "method", r.Method, "path", requestPath(r), "detail", detail)
+}
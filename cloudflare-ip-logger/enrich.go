@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/enrich"
+	"cf-ip-logger/pkg/store"
+)
+
+// GET  /_proxy/enrich - progress of the last country backfill
+// POST /_proxy/enrich - start one in the background
+func (app *App) handleEnrich(w http.ResponseWriter, r *http.Request) {
+	if app.enrich == nil {
+		http.Error(w, "country backfill is disabled (set GEOIP_DB)", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !app.enrich.Start(app.databases()) {
+			http.Error(w, "a backfill is already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.enrich.Progress())
+}
+
+// runEnrich implements `cf-ip-logger enrich`: fill in countries for rows
+// stored without one, e.g. history imported by cf-log-parser
+func runEnrich(args []string) {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding connections.db (and hosts/*.db)")
+	geoPath := fs.String("geoip", getEnv("GEOIP_DB", ""), "MaxMind-format country or city database (default $GEOIP_DB)")
+	batch := fs.Int("batch", 1000, "rows updated per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s enrich [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *geoPath == "" || *batch <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	geo, err := enrich.OpenGeoIP(*geoPath)
+	if err != nil {
+		log.Fatalf("enrich: %v", err)
+	}
+	defer geo.Close()
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("enrich: %v", err)
+	}
+
+	files := []string{filepath.Join(*dataDir, "connections.db")}
+	partitions, _ := filepath.Glob(filepath.Join(*dataDir, "hosts", "*.db"))
+	sort.Strings(partitions)
+	files = append(files, partitions...)
+
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			log.Fatalf("enrich: %v", err)
+		}
+		db, err := store.Open(file)
+		if err != nil {
+			log.Fatalf("enrich: %v", err)
+		}
+		if err := store.CreateSchema(db); err != nil {
+			log.Fatalf("enrich: %s: %v", file, err)
+		}
+		total, err := enrich.CountMissing(db)
+		if err != nil {
+			log.Fatalf("enrich: %s: %v", file, err)
+		}
+		name := strings.TrimPrefix(file, *dataDir+"/")
+		log.Printf("%s: %d rows without a country", name, total)
+		lastReport := time.Now()
+		err = enrich.Countries(db, geo, *batch, func(processed, updated int) {
+			if processed == total || time.Since(lastReport) >= 2*time.Second {
+				log.Printf("%s: %d/%d rows processed, %d updated", name, processed, total, updated)
+				lastReport = time.Now()
+			}
+		})
+		db.Close()
+		if err != nil {
+			log.Fatalf("enrich: %s: %v", file, err)
+		}
+	}
+}
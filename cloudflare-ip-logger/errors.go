@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Proxy error classes
+const (
+	errClassTimeout  = "timeout"
+	errClassRefused  = "refused"
+	errClassReset    = "reset"
+	errClassDNS      = "dns"
+	errClassTLS      = "tls"
+	errClassDial     = "dial"
+	errClassProtocol = "protocol"
+)
+
+// Per-class counts since startup, also served at /debug/vars
+var proxyErrorCounts = expvar.NewMap("proxy_errors")
+
+type ProxyError struct {
+	ID        int64  `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Host      string `json:"host"`
+	Backend   string `json:"backend"`
+	Class     string `json:"class"`
+	Message   string `json:"message"`
+	ClientIP  string `json:"client_ip"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+}
+
+func createErrorsSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS proxy_errors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		host TEXT NOT NULL,
+		backend TEXT NOT NULL,
+		class TEXT NOT NULL,
+		message TEXT NOT NULL,
+		client_ip TEXT NOT NULL DEFAULT '',
+		method TEXT NOT NULL DEFAULT '',
+		path TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_proxy_errors_timestamp ON proxy_errors(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_proxy_errors_host ON proxy_errors(host);`)
+	return err
+}
+
+// classifyProxyError buckets a transport error by cause
+func classifyProxyError(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var headerErr tls.RecordHeaderError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errClassTimeout
+	case errors.As(err, &dnsErr):
+		return errClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errClassRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return errClassReset
+	case errors.As(err, &certErr), errors.As(err, &headerErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostnameErr), errors.Is(err, errPinMismatch), strings.Contains(err.Error(), "tls:"):
+		return errClassTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return errClassDial
+	}
+	return errClassProtocol
+}
+
+// recordProxyError stores a failed backend request. Errors caused by the
+// client going away aren't backend problems and are skipped.
+func (app *App) recordProxyError(r *http.Request, host, backend string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	class := classifyProxyError(err)
+	proxyErrorCounts.Add(class, 1)
+	slog.Warn("Proxy error", "host", host, "class", class, "err", err)
+	if app.backends.set(host, true) {
+		app.addEvent(Event{Kind: "backend", Severity: severityCritical, Host: host,
+			Message: fmt.Sprintf("Backend %s is failing (%s): %v", backend, class, err)})
+	}
+	if app.readOnly {
+		return
+	}
+
+	_, dbErr := app.db.Exec(`INSERT INTO proxy_errors
+		(timestamp, host, backend, class, message, client_ip, method, path)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		store.FormatTime(time.Now()), host, backend, class, err.Error(),
+		app.ipPolicy.ClientIP(r), r.Method, r.URL.Path)
+	if dbErr != nil {
+		slog.Error("Error recording proxy error", "err", dbErr)
+	}
+}
+
+// GET /_proxy/errors?limit=100&host=example.com&class=timeout&since=24h&tz=Europe/Berlin
+func (app *App) handleErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT id, timestamp, host, backend, class, message, client_ip, method, path FROM proxy_errors WHERE 1=1"
+	var args []interface{}
+	if host := r.URL.Query().Get("host"); host != "" {
+		query += " AND host = ?"
+		args = append(args, host)
+	}
+	if class := r.URL.Query().Get("class"); class != "" {
+		query += " AND class = ?"
+		args = append(args, class)
+	}
+	rangeCond, rangeArgs, err := timeRange(r.URL.Query(), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query += rangeCond
+	args = append(args, rangeArgs...)
+	scopeCond, scopeArgs := hostScope(r, "host")
+	query += scopeCond
+	args = append(args, scopeArgs...)
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []ProxyError{}
+	for rows.Next() {
+		var pe ProxyError
+		if err := rows.Scan(&pe.ID, &pe.Timestamp, &pe.Host, &pe.Backend, &pe.Class, &pe.Message, &pe.ClientIP, &pe.Method, &pe.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pe.Timestamp = formatStoredTime(pe.Timestamp, loc)
+		list = append(list, pe)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Event severities
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// Event is something that happened around the traffic rather than a request:
+// a ban, a config reload, a backend going down, a monitor alert, a failed
+// login reported by a webhook
+type Event struct {
+	ID        int64           `json:"id"`
+	Time      time.Time       `json:"-"`
+	Timestamp string          `json:"timestamp"`
+	Kind      string          `json:"kind"`   // ban, config, backend, alert, maintenance, monitor, auth, ...
+	Source    string          `json:"source"` // who reported it: the logger itself or a webhook sender
+	Severity  string          `json:"severity"`
+	Host      string          `json:"host,omitempty"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Message   string          `json:"message"`
+	Data      json.RawMessage `json:"data,omitempty"` // original payload
+}
+
+// Source recorded on events the logger raises itself
+const sourceLogger = "cf-ip-logger"
+
+func createEventsSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		kind TEXT NOT NULL,
+		source TEXT NOT NULL,
+		severity TEXT NOT NULL,
+		host TEXT NOT NULL DEFAULT '',
+		client_ip TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL,
+		data TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_events_client_ip ON events(client_ip);`)
+	return err
+}
+
+// recordEvent stores e, at the current time if it has none
+func (app *App) recordEvent(e Event) error {
+	if app.readOnly {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Severity == "" {
+		e.Severity = severityInfo
+	}
+	if e.Source == "" {
+		e.Source = sourceLogger
+	}
+	_, err := app.db.Exec(`INSERT INTO events
+		(timestamp, kind, source, severity, host, client_ip, message, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		store.FormatTime(e.Time), e.Kind, e.Source, e.Severity, e.Host, e.ClientIP, e.Message, string(e.Data))
+	return err
+}
+
+// addEvent records an event the logger raised itself; failures are only
+// logged, as they shouldn't fail what caused the event
+func (app *App) addEvent(e Event) {
+	if err := app.recordEvent(e); err != nil {
+		slog.Error("Error recording event", "kind", e.Kind, "err", err)
+	}
+}
+
+// backendStates remembers which hosts' backends are failing, so that only
+// the transitions between up and down become events
+type backendStates struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+// set records host's state and reports whether it changed
+func (b *backendStates) set(host string, down bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down[host] == down {
+		return false
+	}
+	if b.down == nil {
+		b.down = make(map[string]bool)
+	}
+	if down {
+		b.down[host] = true
+	} else {
+		delete(b.down, host)
+	}
+	return true
+}
+
+func (b *backendStates) isDown(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down[host]
+}
+
+// GET /_proxy/events?since=24h&kind=ban&severity=critical&host=example.com&ip=1.2.3.4&limit=100&tz=Europe/Berlin&format=csv
+func (app *App) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT id, timestamp, kind, source, severity, host, client_ip, message, data FROM events WHERE 1=1"
+	var args []interface{}
+	for param, column := range map[string]string{"kind": "kind", "severity": "severity", "host": "host", "ip": "client_ip", "source": "source"} {
+		if v := r.URL.Query().Get(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	rangeCond, rangeArgs, err := timeRange(r.URL.Query(), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query += rangeCond
+	args = append(args, rangeArgs...)
+	scopeCond, scopeArgs := hostScope(r, "host")
+	query += scopeCond
+	args = append(args, scopeArgs...)
+	limit := exportLimit(r, format, 100, 1000)
+	query += " ORDER BY timestamp DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Event{}
+	for rows.Next() {
+		var e Event
+		var data string
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Kind, &e.Source, &e.Severity, &e.Host, &e.ClientIP, &e.Message, &data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e.Timestamp = formatStoredTime(e.Timestamp, loc)
+		if data != "" {
+			e.Data = json.RawMessage(data)
+		}
+		list = append(list, e)
+	}
+
+	writeList(w, format, "events", list)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rows an export returns by default and at most; JSON pages stay capped
+// at their usual limits
+const (
+	defaultExportRows = 10000
+	maxExportRows     = 100000
+)
+
+// exportFormat is a list endpoint's format parameter: "" for JSON, "csv" or
+// "ndjson"
+func exportFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "json":
+		return "", nil
+	case "csv", "ndjson":
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown format %q (expected json, csv or ndjson)", f)
+	}
+}
+
+// exportLimit is the limit parameter for a list that may be exported:
+// capped at max for JSON, and at maxExportRows with a larger default for
+// CSV and NDJSON
+func exportLimit(r *http.Request, format string, def, max int) int {
+	if format != "" {
+		def, max = defaultExportRows, maxExportRows
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > max {
+		return def
+	}
+	return limit
+}
+
+// writeList writes items, a slice of structs, in format: a JSON array, CSV
+// with a header row of the JSON field names, or one JSON object per line.
+// CSV and NDJSON come as a download named after name and today's date.
+func writeList(w http.ResponseWriter, format, name string, items interface{}) {
+	v := reflect.ValueOf(items)
+	if format == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for i := 0; i < v.Len(); i++ {
+			enc.Encode(v.Index(i).Interface())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	fields := csvFields(v.Type().Elem())
+	header := make([]string, len(fields))
+	for i, f := range fields {
+		header[i] = f.name
+	}
+	cw.Write(header)
+	for i := 0; i < v.Len(); i++ {
+		row := make([]string, len(fields))
+		for j, f := range fields {
+			row[j] = csvCell(v.Index(i).Field(f.index))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
+
+type csvField struct {
+	name  string
+	index int
+}
+
+// csvFields lists a struct's JSON-visible fields
+func csvFields(t reflect.Type) []csvField {
+	var fields []csvField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, csvField{name: name, index: i})
+	}
+	return fields
+}
+
+// csvCell formats a value for a CSV cell. Text starting with =, +, -, @ or
+// a control character gets a leading ' so spreadsheets don't run it as a
+// formula: paths, user agents and referers come from anyone on the internet.
+func csvCell(v reflect.Value) string {
+	var s string
+	switch v.Kind() {
+	case reflect.String:
+		s = v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Map:
+		if v.Len() == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(v.Interface())
+		s = string(b)
+	default:
+		if raw, ok := v.Interface().(json.RawMessage); ok {
+			s = string(raw)
+		} else if list, ok := v.Interface().([]string); ok {
+			s = strings.Join(list, ",")
+		} else {
+			b, _ := json.Marshal(v.Interface())
+			s = string(b)
+		}
+	}
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runExportConfig renders the proxy config's routes for another proxy:
+// `export-config -format nginx|caddy [-o FILE]`. It reads the config from
+// the same CONFIG_SOURCE the logger does. Options the other proxy has no
+// equivalent for are named on stderr.
+func runExportConfig(args []string) {
+	fs := flag.NewFlagSet("export-config", flag.ExitOnError)
+	format := fs.String("format", "", "nginx or caddy")
+	source := fs.String("config", getEnv("CONFIG_SOURCE", getEnv("PROXY_CONFIG", getEnv("DATA_DIR", "/data")+"/proxy-config.json")),
+		"config to export: a file, URL, consul:// or etcd:// key, like CONFIG_SOURCE")
+	port := fs.Int("port", 8080, "port the exported servers listen on, so cloudflared can point at them instead")
+	out := fs.String("o", "", "write the config to this file instead of stdout")
+	force := fs.Bool("force", false, "with -o, replace an existing file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export-config -format nginx|caddy [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*format != "nginx" && *format != "caddy") || fs.NArg() != 0 || *port <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src, err := newConfigSource(*source, getEnv("CONFIG_SOURCE_TOKEN", ""))
+	if err != nil {
+		log.Fatalf("export-config: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	data, _, err := src.Fetch(ctx, "")
+	cancel()
+	if err != nil {
+		log.Fatalf("export-config: %s: %v", src, err)
+	}
+	// Neither proxy reads ${VAR} the same way, so references are filled in
+	if data, err = expandConfigEnv(data); err != nil {
+		log.Fatalf("export-config: %v", err)
+	}
+	var configs []ProxyConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		log.Fatalf("export-config: %s: %v", src, err)
+	}
+
+	exp := &configExport{port: *port}
+	var rendered []byte
+	if *format == "nginx" {
+		rendered = exp.nginx(configs, src.String())
+	} else {
+		rendered = exp.caddy(configs, src.String())
+	}
+	for _, w := range exp.warnings {
+		fmt.Fprintln(os.Stderr, "export-config: "+w)
+	}
+	if err := writeOutput(*out, *force, rendered); err != nil {
+		log.Fatalf("export-config: %v", err)
+	}
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "export-config: wrote %d routes to %s\n", exp.routes, *out)
+	}
+}
+
+// configExport renders routes for another proxy, noting what doesn't carry
+// over
+type configExport struct {
+	port     int
+	routes   int
+	warnings []string
+}
+
+func (exp *configExport) warnf(format string, args ...interface{}) {
+	exp.warnings = append(exp.warnings, fmt.Sprintf(format, args...))
+}
+
+// unexported lists cfg's options neither nginx nor Caddy gets: the
+// logger's own limits, maintenance mode, mirroring, rewriting, asset
+// answers, header logging, ETags and transport tuning
+func (exp *configExport) unexported(cfg ProxyConfig, name string) {
+	var opts []string
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{cfg.MaxConcurrent > 0 || cfg.MaxPerClient > 0, "max_concurrent"},
+		{cfg.BytesPerSec > 0 || cfg.BytesPerSecIP > 0, "max_bytes_per_sec"},
+		{cfg.Maintenance, "maintenance"},
+		{cfg.Mirror != "", "mirror"},
+		{len(cfg.Rewrite) > 0, "rewrite"},
+		{cfg.Robots != "" || cfg.Favicon != "", "robots/favicon"},
+		{len(cfg.LogHeaders) > 0 || len(cfg.LogHeaderPresence) > 0, "log_headers"},
+		{cfg.ETag, "etag"},
+		{cfg.Transport != (TransportConfig{}), "transport"},
+	} {
+		if o.set {
+			opts = append(opts, o.name)
+		}
+	}
+	if len(opts) > 0 {
+		exp.warnf("%s: %s not exported", name, strings.Join(opts, ", "))
+	}
+}
+
+// exportBackend splits a route's backend into what both renderers need: a
+// URL without credentials, and the srv/dns lookup kind if any
+func (exp *configExport) exportBackend(cfg ProxyConfig, name string) (*url.URL, string, bool) {
+	u, err := url.Parse(cfg.Backend)
+	if err != nil {
+		exp.warnf("%s: backend %q: %v, skipped", name, cfg.Backend, err)
+		return nil, "", false
+	}
+	kind := ""
+	if k, scheme, ok := strings.Cut(u.Scheme, "+"); ok {
+		kind, u.Scheme = k, scheme
+	}
+	if u.User != nil {
+		exp.warnf("%s: credentials in the backend URL left out", name)
+		u.User = nil
+	}
+	return u, kind, true
+}
+
+func routeName(cfg ProxyConfig) string {
+	if cfg.Host == "" {
+		return "default route"
+	}
+	return cfg.Host
+}
+
+// routeRoot is a static route's directory, given as root or a file:// backend
+func routeRoot(cfg ProxyConfig) string {
+	if cfg.Root == "" && strings.HasPrefix(cfg.Backend, "file://") {
+		return strings.TrimPrefix(cfg.Backend, "file://")
+	}
+	return cfg.Root
+}
+
+// nginx renders a server block per route. The original Host goes to the
+// backend, as the logger sends it, and WebSockets are passed through.
+func (exp *configExport) nginx(configs []ProxyConfig, source string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by cf-ip-logger export-config from %s\n\n", source)
+	b.WriteString("map $http_upgrade $connection_upgrade {\n    default upgrade;\n    ''      close;\n}\n")
+	for _, cfg := range configs {
+		name := routeName(cfg)
+		exp.unexported(cfg, name)
+
+		var body bytes.Buffer
+		if root := routeRoot(cfg); root != "" {
+			fmt.Fprintf(&body, "    root %s;\n", nginxQuote(root))
+			fmt.Fprintf(&body, "    index %s;\n\n", orDefault(cfg.Index, "index.html"))
+			body.WriteString("    location ~ /\\. {\n        deny all;\n    }\n\n")
+			fallback := "=404"
+			if cfg.SPAFallback {
+				fallback = "/" + orDefault(cfg.Index, "index.html")
+			}
+			fmt.Fprintf(&body, "    location / {\n        limit_except GET {\n            deny all;\n        }\n        try_files $uri $uri/ %s;\n    }\n", fallback)
+		} else {
+			u, kind, ok := exp.exportBackend(cfg, name)
+			if !ok {
+				continue
+			}
+			if kind == "srv" {
+				exp.warnf("%s: nginx can't resolve SRV records, skipped", name)
+				continue
+			}
+			if kind == "dns" {
+				exp.warnf("%s: nginx resolves %s once at start, not every BACKEND_DNS_REFRESH", name, u.Hostname())
+			}
+			target := u.Scheme + "://" + u.Host
+			if p := strings.TrimSuffix(u.Path, "/"); p != "" {
+				target += p + "/"
+			}
+			body.WriteString("    location / {\n")
+			fmt.Fprintf(&body, "        proxy_pass %s;\n", target)
+			body.WriteString("        proxy_set_header Host $host;\n")
+			body.WriteString("        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n")
+			body.WriteString("        proxy_set_header X-Forwarded-Proto $scheme;\n")
+			body.WriteString("        proxy_http_version 1.1;\n")
+			body.WriteString("        proxy_set_header Upgrade $http_upgrade;\n")
+			body.WriteString("        proxy_set_header Connection $connection_upgrade;\n")
+			if u.Scheme == "https" {
+				exp.nginxTLS(&body, cfg, name)
+			}
+			body.WriteString("    }\n")
+		}
+
+		b.WriteString("\nserver {\n")
+		if cfg.Default {
+			fmt.Fprintf(&b, "    listen %d default_server;\n", exp.port)
+		} else {
+			fmt.Fprintf(&b, "    listen %d;\n", exp.port)
+		}
+		if names := append([]string{cfg.Host}, cfg.Aliases...); cfg.Host != "" {
+			fmt.Fprintf(&b, "    server_name %s;\n", strings.Join(names, " "))
+		} else {
+			b.WriteString("    server_name _;\n")
+		}
+		b.WriteString("\n")
+		b.Write(body.Bytes())
+		b.WriteString("}\n")
+		exp.routes++
+	}
+	return b.Bytes()
+}
+
+// nginxTLS verifies an https backend the way the logger does: against the
+// system roots or tls_ca_file, by tls_server_name when set. nginx doesn't
+// verify upstreams unless told to.
+func (exp *configExport) nginxTLS(b *bytes.Buffer, cfg ProxyConfig, name string) {
+	b.WriteString("        proxy_ssl_server_name on;\n")
+	if cfg.TLSServerName != "" {
+		fmt.Fprintf(b, "        proxy_ssl_name %s;\n", cfg.TLSServerName)
+	}
+	if cfg.NoTLS || (len(cfg.TLSPins) > 0 && cfg.TLSCAFile == "") {
+		if len(cfg.TLSPins) > 0 {
+			exp.warnf("%s: nginx can't pin keys; certificate verification is off", name)
+		}
+		b.WriteString("        proxy_ssl_verify off;\n")
+		return
+	}
+	if len(cfg.TLSPins) > 0 {
+		exp.warnf("%s: nginx can't pin keys; only the CA is checked", name)
+	}
+	b.WriteString("        proxy_ssl_verify on;\n")
+	fmt.Fprintf(b, "        proxy_ssl_trusted_certificate %s;\n", orDefault(cfg.TLSCAFile, "/etc/ssl/certs/ca-certificates.crt"))
+}
+
+// nginxQuote quotes a value with spaces or special characters
+func nginxQuote(s string) string {
+	if strings.ContainsAny(s, " \t;{}#'\"") {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+	return s
+}
+
+// caddy renders a site block per route, served over plain http on the
+// port since TLS ends at Cloudflare. Caddy passes the original Host and
+// WebSockets through by default.
+func (exp *configExport) caddy(configs []ProxyConfig, source string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by cf-ip-logger export-config from %s\n", source)
+	for _, cfg := range configs {
+		name := routeName(cfg)
+		exp.unexported(cfg, name)
+
+		var body bytes.Buffer
+		if root := routeRoot(cfg); root != "" {
+			fmt.Fprintf(&body, "\troot * %s\n", caddyQuote(root))
+			if cfg.SPAFallback {
+				fmt.Fprintf(&body, "\ttry_files {path} /%s\n", orDefault(cfg.Index, "index.html"))
+			}
+			body.WriteString("\t@hidden path_regexp /\\.\n\terror @hidden 404\n")
+			if cfg.Index != "" {
+				fmt.Fprintf(&body, "\tfile_server {\n\t\tindex %s\n\t}\n", caddyQuote(cfg.Index))
+			} else {
+				body.WriteString("\tfile_server\n")
+			}
+		} else {
+			u, kind, ok := exp.exportBackend(cfg, name)
+			if !ok {
+				continue
+			}
+			if p := strings.TrimSuffix(u.Path, "/"); p != "" {
+				fmt.Fprintf(&body, "\trewrite * %s{uri}\n", p)
+			}
+			var opts []string
+			upstream := u.Scheme + "://" + u.Host
+			switch kind {
+			case "srv":
+				opts = append(opts, "dynamic srv "+u.Hostname())
+				upstream = ""
+			case "dns":
+				port := u.Port()
+				if port == "" {
+					port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+				}
+				opts = append(opts, "dynamic a "+u.Hostname()+" "+port)
+				upstream = ""
+			}
+			if u.Scheme == "https" {
+				if transport := exp.caddyTLS(cfg, name, kind != ""); len(transport) > 0 {
+					opts = append(opts, "transport http {")
+					for _, t := range transport {
+						opts = append(opts, "\t"+t)
+					}
+					opts = append(opts, "}")
+				}
+			}
+			line := "\treverse_proxy"
+			if upstream != "" {
+				line += " " + upstream
+			}
+			if len(opts) == 0 {
+				body.WriteString(line + "\n")
+			} else {
+				body.WriteString(line + " {\n")
+				for _, o := range opts {
+					body.WriteString("\t\t" + o + "\n")
+				}
+				body.WriteString("\t}\n")
+			}
+		}
+
+		var addrs []string
+		if cfg.Host == "" {
+			addrs = []string{fmt.Sprintf("http://:%d", exp.port)}
+		} else {
+			for _, h := range append([]string{cfg.Host}, cfg.Aliases...) {
+				addrs = append(addrs, fmt.Sprintf("http://%s:%d", h, exp.port))
+			}
+		}
+		fmt.Fprintf(&b, "\n%s {\n", strings.Join(addrs, ", "))
+		b.Write(body.Bytes())
+		b.WriteString("}\n")
+		exp.routes++
+	}
+	return b.Bytes()
+}
+
+// caddyTLS is the transport options for an https backend. An https:// URL
+// already makes Caddy use TLS, dynamic upstreams need it said.
+func (exp *configExport) caddyTLS(cfg ProxyConfig, name string, dynamic bool) []string {
+	var opts []string
+	if dynamic {
+		opts = append(opts, "tls")
+	}
+	if cfg.NoTLS || (len(cfg.TLSPins) > 0 && cfg.TLSCAFile == "") {
+		if len(cfg.TLSPins) > 0 {
+			exp.warnf("%s: Caddy can't pin keys; certificate verification is off", name)
+		}
+		opts = append(opts, "tls_insecure_skip_verify")
+	} else if len(cfg.TLSPins) > 0 {
+		exp.warnf("%s: Caddy can't pin keys; only the CA is checked", name)
+	}
+	if cfg.TLSCAFile != "" {
+		opts = append(opts, "tls_trusted_ca_certs "+caddyQuote(cfg.TLSCAFile))
+	}
+	if cfg.TLSServerName != "" {
+		opts = append(opts, "tls_server_name "+cfg.TLSServerName)
+	}
+	return opts
+}
+
+// caddyQuote quotes a token with spaces
+func caddyQuote(s string) string {
+	if strings.ContainsAny(s, " \t\"") {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+	return s
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fsync policies for the plain-text connection log
+const (
+	fsyncNever    = "never"    // leave durability to the OS page cache
+	fsyncInterval = "interval" // fsync after every periodic flush
+	fsyncAlways   = "always"   // flush and fsync after every line
+)
+
+// FileLogger writes connection log lines through a buffered writer owned by a
+// single goroutine, so request handlers never wait on disk I/O. When the queue
+// is full, lines are dropped and counted rather than blocking the proxy.
+type FileLogger struct {
+	file     *os.File
+	writer   *bufio.Writer
+	lines    chan string
+	interval time.Duration
+	fsync    string
+	stop     chan struct{}
+	done     chan struct{}
+	closeMu  sync.Once
+	paused   atomic.Bool // set while the disk is nearly full
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	flushed atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// FileLoggerStats is the counter snapshot exposed on the health endpoint
+type FileLoggerStats struct {
+	Queued  int    `json:"queued"`
+	Written uint64 `json:"written"`
+	Dropped uint64 `json:"dropped"`
+	Flushes uint64 `json:"flushes"`
+	Errors  uint64 `json:"errors"`
+	Fsync   string `json:"fsync"`
+	Paused  bool   `json:"paused"`
+}
+
+func NewFileLogger(path string, bufferSize int, interval time.Duration, fsync string) (*FileLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	switch fsync {
+	case fsyncNever, fsyncInterval, fsyncAlways:
+	default:
+		slog.Warn("Unknown LOG_FSYNC policy", "value", fsync, "using", fsyncNever)
+		fsync = fsyncNever
+	}
+	if bufferSize <= 0 {
+		bufferSize = 4096
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	fl := &FileLogger{
+		file:     file,
+		writer:   bufio.NewWriterSize(file, 64*1024),
+		lines:    make(chan string, bufferSize),
+		interval: interval,
+		fsync:    fsync,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go fl.run()
+	return fl, nil
+}
+
+// Write queues a line without blocking; returns false if the line was dropped
+func (fl *FileLogger) Write(line string) bool {
+	if fl.paused.Load() {
+		fl.dropped.Add(1)
+		return false
+	}
+	select {
+	case fl.lines <- line:
+		return true
+	default:
+		fl.dropped.Add(1)
+		return false
+	}
+}
+
+func (fl *FileLogger) run() {
+	defer close(fl.done)
+
+	ticker := time.NewTicker(fl.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line := <-fl.lines:
+			fl.writeLine(line)
+		case <-ticker.C:
+			if fl.writer.Buffered() > 0 {
+				fl.flush(fl.fsync == fsyncInterval)
+			}
+		case <-fl.stop:
+			// Drain whatever is still queued, then make it durable
+			for {
+				select {
+				case line := <-fl.lines:
+					fl.writeLine(line)
+				default:
+					fl.flush(fl.fsync != fsyncNever)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (fl *FileLogger) writeLine(line string) {
+	if _, err := fl.writer.WriteString(line); err != nil {
+		fl.errors.Add(1)
+		slog.Error("Error writing log file", "err", err)
+		return
+	}
+	fl.written.Add(1)
+	if fl.fsync == fsyncAlways {
+		fl.flush(true)
+	}
+}
+
+func (fl *FileLogger) flush(fsync bool) {
+	if err := fl.writer.Flush(); err != nil {
+		fl.errors.Add(1)
+		slog.Error("Error flushing log file", "err", err)
+		return
+	}
+	if fsync {
+		if err := fl.file.Sync(); err != nil {
+			fl.errors.Add(1)
+			slog.Error("Error syncing log file", "err", err)
+			return
+		}
+	}
+	fl.flushed.Add(1)
+}
+
+// SetPaused stops (or resumes) accepting lines; paused lines count as dropped
+func (fl *FileLogger) SetPaused(paused bool) {
+	fl.paused.Store(paused)
+}
+
+// Close drains queued lines, flushes and closes the file
+func (fl *FileLogger) Close() error {
+	var err error
+	fl.closeMu.Do(func() {
+		close(fl.stop)
+		<-fl.done
+		err = fl.file.Close()
+	})
+	return err
+}
+
+func (fl *FileLogger) Stats() FileLoggerStats {
+	return FileLoggerStats{
+		Queued:  len(fl.lines),
+		Written: fl.written.Load(),
+		Dropped: fl.dropped.Load(),
+		Flushes: fl.flushed.Load(),
+		Errors:  fl.errors.Load(),
+		Fsync:   fl.fsync,
+		Paused:  fl.paused.Load(),
+	}
+}
@@ -2,4 +2,10 @@ module cf-ip-logger
 
 go 1.21
 
-require github.com/mattn/go-sqlite3 v1.14.44
+require (
+	github.com/mattn/go-sqlite3 v1.14.44
+	github.com/mutecomm/go-sqlcipher/v4 v4.4.2
+	github.com/oschwald/maxminddb-golang v1.12.0
+)
+
+require golang.org/x/sys v0.10.0 // indirect
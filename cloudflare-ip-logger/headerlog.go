@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Longest header value logged; longer ones are cut
+const maxLoggedHeaderValue = 256
+
+// Logged instead of the value for log_header_presence headers
+const presentValue = "[present]"
+
+// headerLog picks the extra request headers a route logs with each
+// connection, beyond User-Agent and Referer
+type headerLog struct {
+	values   []string // canonical names logged with their value
+	presence []string // canonical names logged as [present], for secrets
+}
+
+// newHeaderLog builds the list from a route's log_headers and
+// log_header_presence options, or returns nil when neither is set
+func newHeaderLog(cfg ProxyConfig) *headerLog {
+	if len(cfg.LogHeaders) == 0 && len(cfg.LogHeaderPresence) == 0 {
+		return nil
+	}
+	h := &headerLog{}
+	for _, name := range cfg.LogHeaders {
+		if name = strings.TrimSpace(name); name != "" {
+			h.values = append(h.values, http.CanonicalHeaderKey(name))
+		}
+	}
+	for _, name := range cfg.LogHeaderPresence {
+		if name = strings.TrimSpace(name); name != "" {
+			h.presence = append(h.presence, http.CanonicalHeaderKey(name))
+		}
+	}
+	return h
+}
+
+// Extract returns the listed headers r carries, nil when it has none of them
+func (h *headerLog) Extract(r *http.Request) map[string]string {
+	if h == nil {
+		return nil
+	}
+	var found map[string]string
+	set := func(name, value string) {
+		if found == nil {
+			found = make(map[string]string)
+		}
+		found[name] = value
+	}
+	for _, name := range h.values {
+		if v := r.Header.Values(name); len(v) > 0 {
+			value := strings.Join(v, ", ")
+			if len(value) > maxLoggedHeaderValue {
+				value = strings.ToValidUTF8(value[:maxLoggedHeaderValue], "")
+			}
+			set(name, value)
+		}
+	}
+	for _, name := range h.presence {
+		if _, ok := r.Header[name]; ok {
+			set(name, presentValue)
+		}
+	}
+	return found
+}
+
+// encodeHeaders is the headers column's value: a JSON object, or "" for none
+func encodeHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(headers)
+	return string(b)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// What a reload does with a new or changed backend that fails its probe
+// (CONFIG_HEALTH_GATE)
+const (
+	healthGateOff     = "off"     // apply without probing
+	healthGateDegrade = "degrade" // apply, and mark the backend as failing
+	healthGateRefuse  = "refuse"  // keep the previous backend, or leave a new host unrouted
+)
+
+// What happened to a probed route
+const (
+	gateApplied  = "applied"
+	gateDegraded = "degraded"
+	gateRefused  = "refused"
+)
+
+// BackendProbe is the check of one new or changed backend before a config
+// goes live
+type BackendProbe struct {
+	Host      string `json:"host"`
+	Backend   string `json:"backend"`
+	OK        bool   `json:"ok"`
+	Summary   string `json:"summary"`
+	Action    string `json:"action"` // applied, degraded or refused
+	CheckedAt string `json:"checked_at"`
+}
+
+// HealthGate probes the backends a reload adds or changes, so a typo'd
+// address or a service that isn't up yet shows up when the config is
+// applied rather than as 502s
+type HealthGate struct {
+	mode string
+
+	mu       sync.Mutex
+	last     []BackendProbe // from the last reload that probed anything
+	lastTime time.Time
+}
+
+func NewHealthGate(mode string) (*HealthGate, error) {
+	switch mode {
+	case healthGateOff, healthGateDegrade, healthGateRefuse:
+	default:
+		return nil, fmt.Errorf("unknown mode %q (want off, degrade or refuse)", mode)
+	}
+	return &HealthGate{mode: mode}, nil
+}
+
+// action is what the gate does with a probed backend
+func (g *HealthGate) action(ok bool) string {
+	switch {
+	case ok || g.mode == healthGateOff:
+		return gateApplied
+	case g.mode == healthGateRefuse:
+		return gateRefused
+	default:
+		return gateDegraded
+	}
+}
+
+// Info is the outcome of the last probing reload, for /api/health
+func (g *HealthGate) Info() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	info := map[string]interface{}{"mode": g.mode, "probes": g.last}
+	if !g.lastTime.IsZero() {
+		info["last_run"] = store.FormatTime(g.lastTime)
+	}
+	return info
+}
+
+// probeBackend checks rt's backend the way /api/diagnose does, at the
+// route's health_path
+func probeBackend(ctx context.Context, cfg ProxyConfig, rt *route) BackendProbe {
+	path := cfg.HealthPath
+	if path == "" {
+		path = "/"
+	}
+	host := cfg.Host
+	if host == "" {
+		host = rt.url.Host
+	}
+	d := diagnoseBackend(ctx, host, rt, path)
+	return BackendProbe{Host: cfg.routeKey(), Backend: d.Backend, OK: d.OK, Summary: d.Summary,
+		CheckedAt: store.FormatTime(time.Now())}
+}
+
+// probeRoutes probes the backends of routes (one per entry of configs) in
+// parallel. Entries without a route or with a static one get no probe.
+func probeRoutes(ctx context.Context, configs []ProxyConfig, routes []*route) []*BackendProbe {
+	probes := make([]*BackendProbe, len(configs))
+	var wg sync.WaitGroup
+	for i, rt := range routes {
+		if rt == nil || rt.static != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, rt *route) {
+			defer wg.Done()
+			p := probeBackend(ctx, configs[i], rt)
+			probes[i] = &p
+		}(i, rt)
+	}
+	wg.Wait()
+	return probes
+}
+
+// sameBackend reports whether two entries reach their backend the same
+// way, so a reload keeps the route's connections
+func sameBackend(a, b ProxyConfig) bool {
+	return a.Backend == b.Backend && a.Root == b.Root && a.NoTLS == b.NoTLS &&
+		a.Transport == b.Transport && a.tlsKey() == b.tlsKey()
+}
+
+// gateRoutes probes the freshly built routes among built (one per entry of
+// configs, nil where the entry was invalid) in parallel and applies the
+// gate: refused entries fall back to the route and config old had for their
+// host, or to nil. Refused routes are returned by host, for the next
+// reload to retry.
+func (app *App) gateRoutes(ctx context.Context, configs []ProxyConfig, built []*route, old *routeTable) map[string]string {
+	refused := make(map[string]string)
+	if app.healthGate.mode == healthGateOff {
+		return refused
+	}
+	fresh := make([]*route, len(built))
+	for i, rt := range built {
+		if rt != old.routes[configs[i].routeKey()] {
+			fresh[i] = rt
+		}
+	}
+	probes := probeRoutes(ctx, configs, fresh)
+
+	var results []BackendProbe
+	for i, p := range probes {
+		if p == nil {
+			continue
+		}
+		hostKey := configs[i].routeKey()
+		p.Action = app.healthGate.action(p.OK)
+		results = append(results, *p)
+		switch {
+		case p.OK:
+			if old.refused[hostKey] != "" {
+				slog.Info("Refused backend responds, applying it", "host", hostKey, "backend", p.Backend)
+				app.addEvent(Event{Kind: "config", Host: hostKey, Message: "Backend " + p.Backend + " responds now, route applied"})
+			}
+			if app.backends.set(hostKey, false) {
+				app.addEvent(Event{Kind: "backend", Host: hostKey, Message: "Backend " + p.Backend + " is responding again"})
+			}
+		case p.Action == gateDegraded:
+			slog.Warn("New backend is unreachable, applying it anyway", "host", hostKey, "backend", p.Backend, "summary", p.Summary)
+			if app.backends.set(hostKey, true) {
+				app.addEvent(Event{Kind: "backend", Severity: severityCritical, Host: hostKey,
+					Message: fmt.Sprintf("Backend %s is failing (probed on reload): %s", p.Backend, p.Summary)})
+			}
+		default:
+			refused[hostKey] = p.Backend
+			if rt := built[i]; rt.pool != nil {
+				rt.pool.Stop()
+			}
+			built[i].transport.http.CloseIdleConnections()
+			built[i] = old.routes[hostKey]
+			kept := "not routed until it responds"
+			if built[i] != nil {
+				configs[i] = old.configs[hostKey]
+				kept = "keeping " + built[i].url.Redacted()
+			}
+			slog.Warn("New backend is unreachable, refusing it", "host", hostKey, "backend", p.Backend, "summary", p.Summary, "kept", built[i] != nil)
+			if old.refused[hostKey] != p.Backend {
+				app.addEvent(Event{Kind: "config", Severity: severityWarning, Host: hostKey,
+					Message: fmt.Sprintf("Refused backend %s: %s; %s", p.Backend, p.Summary, kept)})
+			}
+		}
+	}
+	if len(results) > 0 {
+		app.healthGate.mu.Lock()
+		app.healthGate.last, app.healthGate.lastTime = results, time.Now()
+		app.healthGate.mu.Unlock()
+	}
+	return refused
+}
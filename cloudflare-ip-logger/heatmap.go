@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// GET /_proxy/stats/heatmap?since=4w&host=example.com&category=all&tz=Europe/Berlin
+//
+// Hits by weekday (0 = Sunday) and hour of day in tz. Rows are counted per
+// UTC hour in SQL and folded into the matrix here, since SQLite knows no
+// time zones besides UTC and the server's own; zones with a half-hour offset
+// are rounded to the UTC hour.
+func (app *App) handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("since") == "" {
+		query.Set("since", "4w")
+	}
+	rangeCond, args, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where := " WHERE 1=1" + rangeCond
+	category := query.Get("category")
+	if category == "" {
+		category = categoryVisitor
+	}
+	if category != "all" {
+		where += " AND category = ?"
+		args = append(args, category)
+	}
+	host := app.hostParam(query)
+	if host != "" {
+		where += " AND host = ?"
+		args = append(args, host)
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	where += scopeCond
+	args = append(args, scopeArgs...)
+	ownCond, ownArgs, err := app.ownTraffic.Filter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	where += ownCond
+	args = append(args, ownArgs...)
+
+	// timestamp is 2006-01-02T15:04:05Z, so the first 13 characters are the UTC hour
+	rows, err := app.readerFor(r, host).Query("SELECT substr(timestamp, 1, 13), COUNT(*) FROM connections"+where+
+		" GROUP BY substr(timestamp, 1, 13)", args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var matrix [7][24]int
+	total, max := 0, 0
+	for rows.Next() {
+		var bucket string
+		var n int
+		if err := rows.Scan(&bucket, &n); err != nil {
+			continue
+		}
+		t, err := time.Parse("2006-01-02T15", bucket)
+		if err != nil {
+			continue
+		}
+		t = t.In(loc)
+		cell := &matrix[t.Weekday()][t.Hour()]
+		*cell += n
+		if *cell > max {
+			max = *cell
+		}
+		total += n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tz":       loc.String(),
+		"category": category,
+		"days":     []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		"matrix":   matrix,
+		"max":      max,
+		"total":    total,
+	})
+}
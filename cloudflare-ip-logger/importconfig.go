@@ -0,0 +1,1117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runImportConfig converts another reverse proxy's config into
+// proxy-config.json entries: `import-config [-from caddy|traefik] [-o FILE] FILE|-`.
+// Only what maps onto a route is taken over (hosts, backends, TLS
+// verification, static roots); anything else is named on stderr.
+func runImportConfig(args []string) {
+	fs := flag.NewFlagSet("import-config", flag.ExitOnError)
+	from := fs.String("from", "", "caddy or traefik (default guessed from the file name: .yml, .yaml and .toml are Traefik)")
+	out := fs.String("o", "", "write the config to this file instead of stdout")
+	force := fs.Bool("force", false, "with -o, replace an existing file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import-config [flags] Caddyfile|traefik.yml|traefik.toml|-\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	name := fs.Arg(0)
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = readAllStdin()
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		log.Fatalf("import-config: %v", err)
+	}
+	kind := *from
+	if kind == "" {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".yml", ".yaml", ".toml":
+			kind = "traefik"
+		default:
+			kind = "caddy"
+		}
+	}
+
+	var imp configImport
+	switch kind {
+	case "caddy":
+		err = imp.caddyfile(data)
+	case "traefik":
+		var tree map[string]interface{}
+		if strings.ToLower(filepath.Ext(name)) == ".toml" || looksLikeTOML(data) {
+			tree, err = parseTOMLSubset(data)
+		} else {
+			tree, err = parseYAMLSubset(data)
+		}
+		if err == nil {
+			imp.traefik(tree)
+		}
+	default:
+		log.Fatalf("import-config: -from must be caddy or traefik, not %q", kind)
+	}
+	if err != nil {
+		log.Fatalf("import-config: %v", err)
+	}
+	for _, w := range imp.warnings {
+		fmt.Fprintln(os.Stderr, "import-config: "+w)
+	}
+	if len(imp.configs) == 0 {
+		log.Fatalf("import-config: no routes found in %s", name)
+	}
+
+	encoded, err := marshalProxyConfigs(imp.configs)
+	if err != nil {
+		log.Fatalf("import-config: %v", err)
+	}
+	if err := writeOutput(*out, *force, encoded); err != nil {
+		log.Fatalf("import-config: %v", err)
+	}
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "import-config: wrote %d routes to %s\n", len(imp.configs), *out)
+	}
+}
+
+// writeOutput writes a generated file to path, or stdout without one. An
+// existing file is only replaced with force.
+func writeOutput(path string, force bool, data []byte) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s exists (-force replaces it)", path)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readAllStdin() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(os.Stdin)
+	return buf.Bytes(), err
+}
+
+// marshalProxyConfigs writes configs the way proxy-config.json.example is
+// laid out, leaving out the empty host, backend and transport fields that
+// have no omitempty
+func marshalProxyConfigs(configs []ProxyConfig) ([]byte, error) {
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	for _, empty := range []string{"\n    \"host\": \"\",", "\n    \"backend\": \"\",", ",\n    \"transport\": {}"} {
+		data = bytes.ReplaceAll(data, []byte(empty), nil)
+	}
+	return append(data, '\n'), nil
+}
+
+// configImport collects the routes taken over from another proxy, and what
+// couldn't be
+type configImport struct {
+	configs  []ProxyConfig
+	hosts    map[string]bool
+	warnings []string
+}
+
+func (imp *configImport) warnf(format string, args ...interface{}) {
+	imp.warnings = append(imp.warnings, fmt.Sprintf(format, args...))
+}
+
+// add keeps cfg unless an earlier route already has its host; aliases
+// taken by earlier routes are dropped
+func (imp *configImport) add(cfg ProxyConfig, origin string) {
+	if imp.hosts == nil {
+		imp.hosts = make(map[string]bool)
+	}
+	key := cfg.Host
+	if cfg.Default {
+		key = "*default*"
+	}
+	if imp.hosts[key] {
+		imp.warnf("%s: %s already has a route, skipped", origin, orDefault(cfg.Host, "the default route"))
+		return
+	}
+	imp.hosts[key] = true
+	var aliases []string
+	for _, a := range cfg.Aliases {
+		if imp.hosts[a] {
+			imp.warnf("%s: alias %s already has a route, dropped", origin, a)
+			continue
+		}
+		imp.hosts[a] = true
+		aliases = append(aliases, a)
+	}
+	cfg.Aliases = aliases
+	imp.configs = append(imp.configs, cfg)
+}
+
+// Caddy's {$VAR} and {env.VAR} placeholders, written as ${VAR} for
+// expandConfigEnv
+var caddyEnvPattern = regexp.MustCompile(`\{(?:\$|env\.)([A-Za-z_][A-Za-z0-9_]*)(?::([^}]*))?\}`)
+
+func caddyEnv(s string) string {
+	return caddyEnvPattern.ReplaceAllStringFunc(s, func(m string) string {
+		groups := caddyEnvPattern.FindStringSubmatch(m)
+		if groups[2] != "" {
+			return "${" + groups[1] + ":-" + groups[2] + "}"
+		}
+		return "${" + groups[1] + "}"
+	})
+}
+
+// caddyNode is a Caddyfile line: its tokens, and the lines of the block it
+// opens, if any
+type caddyNode struct {
+	line  int
+	args  []string
+	block []*caddyNode
+}
+
+// caddyTokens splits a Caddyfile line into tokens, honoring quotes and
+// dropping comments
+func caddyTokens(line string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			return tokens, nil
+		case c == '"':
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, strings.ReplaceAll(line[i+1:j], `\"`, `"`))
+			i = j + 1
+		case c == '`':
+			j := strings.IndexByte(line[i+1:], '`')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated backquote")
+			}
+			tokens = append(tokens, line[i+1:i+1+j])
+			i += j + 2
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' && line[j] != '\r' {
+				j++
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseCaddyfile reads a Caddyfile into its top-level lines. Blocks open
+// with a "{" ending a line and close with a "}" on its own.
+func parseCaddyfile(data []byte) ([]*caddyNode, error) {
+	root := &caddyNode{}
+	stack := []*caddyNode{root}
+	for n, line := range strings.Split(string(data), "\n") {
+		tokens, err := caddyTokens(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		if len(tokens) == 1 && tokens[0] == "}" {
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("line %d: unexpected }", n+1)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		parent := stack[len(stack)-1]
+		node := &caddyNode{line: n + 1, args: tokens}
+		parent.block = append(parent.block, node)
+		if tokens[len(tokens)-1] == "{" {
+			node.args = tokens[:len(tokens)-1]
+			node.block = []*caddyNode{}
+			stack = append(stack, node)
+		}
+	}
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("line %d: block not closed", stack[len(stack)-1].line)
+	}
+	return root.block, nil
+}
+
+// caddyfile converts each site block. A Caddyfile with a single site may
+// leave out its braces.
+func (imp *configImport) caddyfile(data []byte) error {
+	nodes, err := parseCaddyfile(data)
+	if err != nil {
+		return err
+	}
+	// Global options
+	if len(nodes) > 0 && len(nodes[0].args) == 0 {
+		nodes = nodes[1:]
+	}
+	if len(nodes) > 0 && nodes[0].block == nil {
+		nodes = []*caddyNode{{line: nodes[0].line, args: nodes[0].args, block: nodes[1:]}}
+	}
+	for _, node := range nodes {
+		switch {
+		case len(node.args) == 0:
+			imp.warnf("line %d: block without an address, skipped", node.line)
+		case strings.HasPrefix(node.args[0], "("):
+			// Snippets only matter where they're imported
+		case node.block == nil:
+			imp.warnf("line %d: %s outside a site block, skipped", node.line, node.args[0])
+		default:
+			imp.caddySite(node)
+		}
+	}
+	return nil
+}
+
+// caddySite turns one site block into a route
+func (imp *configImport) caddySite(site *caddyNode) {
+	origin := fmt.Sprintf("line %d", site.line)
+	var hosts []string
+	isDefault := false
+	for _, arg := range site.args {
+		for _, addr := range strings.Split(arg, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			host, err := caddySiteHost(addr)
+			switch {
+			case err != nil:
+				imp.warnf("%s: %v, skipped", origin, err)
+			case host == "":
+				isDefault = true
+			default:
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if len(hosts) == 0 && !isDefault {
+		return
+	}
+
+	cfg := ProxyConfig{Default: isDefault && len(hosts) == 0}
+	if len(hosts) > 0 {
+		cfg.Host, cfg.Aliases = hosts[0], hosts[1:]
+	}
+	imp.caddyDirectives(&cfg, site.block, origin)
+	if cfg.Backend == "" && cfg.Root == "" {
+		imp.warnf("%s: %s has no reverse_proxy or file_server, skipped", origin, orDefault(cfg.Host, "site"))
+		return
+	}
+	imp.add(cfg, origin)
+}
+
+// caddySiteHost is the host of a site address, "" for one that matches any
+// host (":8080", "http://")
+func caddySiteHost(addr string) (string, error) {
+	if _, rest, ok := strings.Cut(addr, "://"); ok {
+		addr = rest
+	}
+	addr = strings.TrimSuffix(addr, "/")
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		return "", fmt.Errorf("%s: site addresses with a path aren't supported", addr)
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if strings.Contains(host, "*") {
+		return "", fmt.Errorf("%s: wildcard hosts aren't supported; list the hosts", addr)
+	}
+	if strings.Contains(host, "{") {
+		return "", fmt.Errorf("%s: placeholders in site addresses aren't supported", addr)
+	}
+	return strings.ToLower(host), nil
+}
+
+// caddyDirectives applies a site's (or a catch-all handle block's)
+// directives to cfg
+func (imp *configImport) caddyDirectives(cfg *ProxyConfig, block []*caddyNode, origin string) {
+	for _, d := range block {
+		if len(d.args) == 0 {
+			continue
+		}
+		at := fmt.Sprintf("line %d", d.line)
+		name, args := d.args[0], d.args[1:]
+		matcher := ""
+		if len(args) > 0 && (strings.HasPrefix(args[0], "/") || strings.HasPrefix(args[0], "@") || args[0] == "*") {
+			matcher, args = args[0], args[1:]
+		}
+		catchAll := matcher == "" || matcher == "*" || matcher == "/*"
+
+		switch name {
+		case "reverse_proxy":
+			if !catchAll {
+				imp.warnf("%s: reverse_proxy for %s only; routes can't split by path, skipped", at, matcher)
+				continue
+			}
+			imp.caddyReverseProxy(cfg, args, d.block, at)
+		case "handle", "route":
+			if !catchAll {
+				imp.warnf("%s: %s %s skipped; routes can't split by path", at, name, matcher)
+				continue
+			}
+			imp.caddyDirectives(cfg, d.block, origin)
+		case "handle_path":
+			imp.warnf("%s: handle_path %s skipped; routes can't split by path", at, matcher)
+		case "root":
+			if len(args) == 0 && strings.HasPrefix(matcher, "/") {
+				// "root /srv" is the directory, not a path matcher
+				args, catchAll = []string{matcher}, true
+			}
+			if len(args) == 1 && catchAll {
+				cfg.Root = caddyEnv(args[0])
+			} else {
+				imp.warnf("%s: root with a matcher skipped", at)
+			}
+		case "file_server":
+			if cfg.Root == "" {
+				cfg.Root = "."
+				imp.warnf("%s: file_server without root serves the working directory; set root", at)
+			}
+			for _, sub := range d.block {
+				if len(sub.args) == 2 && sub.args[0] == "index" {
+					cfg.Index = sub.args[1]
+				} else if len(sub.args) > 0 && sub.args[0] == "browse" {
+					imp.warnf("line %d: directory listings aren't served", sub.line)
+				}
+			}
+		case "try_files":
+			if n := len(args); n > 0 && strings.HasSuffix(args[n-1], "index.html") {
+				cfg.SPAFallback = true
+			} else {
+				imp.warnf("%s: try_files only converts as a fallback to index.html", at)
+			}
+		case "tls", "encode", "log", "header":
+			// The edge terminates TLS, compresses and sets headers
+		case "import":
+			imp.warnf("%s: import %s not followed; paste the snippet into the site", at, strings.Join(args, " "))
+		default:
+			imp.warnf("%s: %s not converted", at, name)
+		}
+	}
+	if cfg.Backend != "" && cfg.Root != "" {
+		imp.warnf("%s: both reverse_proxy and file_server; keeping the proxy", origin)
+		cfg.Root, cfg.Index, cfg.SPAFallback = "", "", false
+	}
+}
+
+// caddyReverseProxy takes the backend and its TLS options from a
+// reverse_proxy directive
+func (imp *configImport) caddyReverseProxy(cfg *ProxyConfig, upstreams []string, block []*caddyNode, at string) {
+	useTLS := false
+	dynamic := ""
+	for _, sub := range block {
+		if len(sub.args) == 0 {
+			continue
+		}
+		switch sub.args[0] {
+		case "to":
+			upstreams = append(upstreams, sub.args[1:]...)
+		case "dynamic":
+			// Looked up in DNS, as srv+ and dns+ backends are
+			switch {
+			case len(sub.args) == 3 && sub.args[1] == "srv":
+				dynamic = "srv+%s://" + sub.args[2]
+			case len(sub.args) == 4 && sub.args[1] == "a":
+				dynamic = "dns+%s://" + net.JoinHostPort(sub.args[2], sub.args[3])
+			default:
+				imp.warnf("line %d: dynamic upstreams only convert as \"dynamic srv NAME\" or \"dynamic a NAME PORT\"", sub.line)
+			}
+		case "transport":
+			if len(sub.args) > 1 && sub.args[1] != "http" {
+				imp.warnf("line %d: %s transport not supported", sub.line, sub.args[1])
+				continue
+			}
+			for _, opt := range sub.block {
+				switch {
+				case len(opt.args) == 0:
+				case opt.args[0] == "tls":
+					useTLS = true
+				case opt.args[0] == "tls_insecure_skip_verify":
+					useTLS, cfg.NoTLS = true, true
+				case opt.args[0] == "tls_server_name" && len(opt.args) == 2:
+					useTLS, cfg.TLSServerName = true, opt.args[1]
+				case opt.args[0] == "tls_trusted_ca_certs" && len(opt.args) >= 2:
+					useTLS, cfg.TLSCAFile = true, caddyEnv(opt.args[1])
+					if len(opt.args) > 2 {
+						imp.warnf("line %d: only the first CA file is used; put them in one PEM file", opt.line)
+					}
+				case opt.args[0] == "dial_timeout", opt.args[0] == "read_timeout", opt.args[0] == "write_timeout":
+				default:
+					imp.warnf("line %d: transport option %s not converted", opt.line, opt.args[0])
+				}
+			}
+		case "header_up", "header_down", "lb_policy", "health_uri", "health_interval", "health_timeout", "flush_interval":
+			imp.warnf("line %d: %s not converted", sub.line, sub.args[0])
+		}
+	}
+	if dynamic != "" {
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		upstreams = append([]string{fmt.Sprintf(dynamic, scheme)}, upstreams...)
+	}
+	if len(upstreams) == 0 {
+		imp.warnf("%s: reverse_proxy without an upstream", at)
+		return
+	}
+	if len(upstreams) > 1 {
+		imp.warnf("%s: %d upstreams, using %s; a dns+ backend can spread over several addresses", at, len(upstreams), upstreams[0])
+	}
+	backend, err := caddyUpstream(upstreams[0], useTLS)
+	if err != nil {
+		imp.warnf("%s: %v", at, err)
+		return
+	}
+	if cfg.Backend != "" {
+		imp.warnf("%s: second reverse_proxy for %s ignored", at, orDefault(cfg.Host, "the site"))
+		return
+	}
+	cfg.Backend = backend
+}
+
+// caddyUpstream turns a reverse_proxy upstream into a backend URL. Without a
+// scheme it is http, unless the port is 443 or the transport uses TLS.
+func caddyUpstream(addr string, useTLS bool) (string, error) {
+	addr = caddyEnv(addr)
+	if strings.HasPrefix(addr, "unix/") {
+		return "", fmt.Errorf("unix socket upstream %s not supported", addr)
+	}
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		switch scheme {
+		case "http", "https", "srv+http", "srv+https", "dns+http", "dns+https":
+			return addr, nil
+		case "h2c":
+			return "http://" + rest, nil
+		}
+		return "", fmt.Errorf("upstream %s: scheme %s not supported", addr, scheme)
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	if useTLS || strings.HasSuffix(addr, ":443") {
+		return "https://" + strings.TrimSuffix(addr, ":443"), nil
+	}
+	return "http://" + addr, nil
+}
+
+// Host(`a`, `b`) and Host(`a`) || Host(`b`) in a Traefik rule
+var (
+	traefikHostPattern = regexp.MustCompile(`\bHost\(([^)]*)\)`)
+	traefikNamePattern = regexp.MustCompile("[`\"]([^`\"]+)[`\"]")
+	traefikPathPattern = regexp.MustCompile(`\b(Path|PathPrefix|PathRegexp|Method|Header|HeaderRegexp|Query|ClientIP)\(`)
+)
+
+// traefik converts the HTTP routers of a Traefik dynamic config, with their
+// services' first server and servers transport. Routers matching on more
+// than the host are only taken for hosts no plain Host() router has.
+func (imp *configImport) traefik(tree map[string]interface{}) {
+	if _, ok := tree["tcp"]; ok {
+		imp.warnf("tcp routers not converted")
+	}
+	if _, ok := tree["udp"]; ok {
+		imp.warnf("udp routers not converted")
+	}
+	http := treeMap(tree, "http")
+	routers := treeMap(http, "routers")
+	if len(routers) == 0 {
+		imp.warnf("no http.routers")
+		return
+	}
+	names := make([]string, 0, len(routers))
+	for name := range routers {
+		names = append(names, name)
+	}
+	// Host-only routers first, then by priority and name
+	narrow := func(name string) bool {
+		return traefikPathPattern.MatchString(treeString(treeMap(routers, name), "rule"))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ni, nj := narrow(names[i]), narrow(names[j]); ni != nj {
+			return !ni
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		router := treeMap(routers, name)
+		origin := "router " + name
+		rule := treeString(router, "rule")
+		var hosts []string
+		for _, m := range traefikHostPattern.FindAllStringSubmatch(rule, -1) {
+			for _, h := range traefikNamePattern.FindAllStringSubmatch(m[1], -1) {
+				hosts = append(hosts, strings.ToLower(h[1]))
+			}
+		}
+		if len(hosts) == 0 {
+			imp.warnf("%s: rule %q has no Host(), skipped", origin, rule)
+			continue
+		}
+		if strings.Contains(rule, "HostRegexp(") || strings.Contains(rule, "!") {
+			imp.warnf("%s: only the Host() names of %q are used", origin, rule)
+		}
+		if narrow(name) {
+			if imp.hosts[hosts[0]] {
+				imp.warnf("%s: %q skipped; routes can't split by path and %s has a route", origin, rule, hosts[0])
+				continue
+			}
+			imp.warnf("%s: %q matches more than the host; routes can't split by path, so it gets all of %s", origin, rule, hosts[0])
+		}
+
+		service, _, _ := strings.Cut(treeString(router, "service"), "@")
+		cfg := ProxyConfig{Host: hosts[0], Aliases: hosts[1:]}
+		if !imp.traefikService(&cfg, http, service, origin) {
+			continue
+		}
+		if len(treeList(router, "middlewares")) > 0 {
+			imp.warnf("%s: middlewares not converted", origin)
+		}
+		imp.add(cfg, origin)
+	}
+}
+
+// traefikService sets cfg's backend and TLS options from a load balancer
+// service and its servers transport
+func (imp *configImport) traefikService(cfg *ProxyConfig, http map[string]interface{}, name, origin string) bool {
+	svc := treeMap(treeMap(http, "services"), name)
+	if svc == nil {
+		imp.warnf("%s: service %q not found (only services in the same file are read), skipped", origin, name)
+		return false
+	}
+	lb := treeMap(svc, "loadBalancer")
+	if lb == nil {
+		imp.warnf("%s: service %s isn't a loadBalancer, skipped", origin, name)
+		return false
+	}
+	servers := treeList(lb, "servers")
+	if len(servers) == 0 {
+		imp.warnf("%s: service %s has no servers, skipped", origin, name)
+		return false
+	}
+	if len(servers) > 1 {
+		imp.warnf("%s: service %s has %d servers, using the first; a dns+ backend can spread over several addresses", origin, name, len(servers))
+	}
+	server, _ := servers[0].(map[string]interface{})
+	cfg.Backend = treeString(server, "url")
+	if cfg.Backend == "" {
+		imp.warnf("%s: service %s's server has no url, skipped", origin, name)
+		return false
+	}
+
+	transportName, _, _ := strings.Cut(treeString(lb, "serversTransport"), "@")
+	if transportName == "" {
+		return true
+	}
+	transport := treeMap(treeMap(http, "serversTransports"), transportName)
+	if transport == nil {
+		imp.warnf("%s: servers transport %q not found", origin, transportName)
+		return true
+	}
+	cfg.NoTLS = treeString(transport, "insecureSkipVerify") == "true"
+	cfg.TLSServerName = treeString(transport, "serverName")
+	if cas := treeList(transport, "rootCAs"); len(cas) > 0 {
+		cfg.TLSCAFile, _ = cas[0].(string)
+		if len(cas) > 1 {
+			imp.warnf("%s: only the first of the rootCAs is used; put them in one PEM file", origin)
+		}
+	}
+	return true
+}
+
+func treeMap(m map[string]interface{}, key string) map[string]interface{} {
+	v, _ := m[key].(map[string]interface{})
+	return v
+}
+
+func treeList(m map[string]interface{}, key string) []interface{} {
+	v, _ := m[key].([]interface{})
+	return v
+}
+
+func treeString(m map[string]interface{}, key string) string {
+	v, _ := m[key].(string)
+	return v
+}
+
+// looksLikeTOML reports whether a config starts with a [table] header
+func looksLikeTOML(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(line, "[")
+	}
+	return false
+}
+
+// yamlLine is a YAML line without its comment: how far it's indented and
+// what follows
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+// parseYAMLSubset reads the YAML that Traefik dynamic configs are written
+// in: nested block mappings and sequences, plain and quoted scalars, and
+// one-line [a, b] and {} values. Scalars stay strings ("true" included).
+// Anchors, multi-line strings and multiple documents aren't supported.
+func parseYAMLSubset(data []byte) (map[string]interface{}, error) {
+	var lines []yamlLine
+	for n, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't indent YAML", n+1)
+		}
+		lines = append(lines, yamlLine{n: n + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].n)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping at the top level")
+	}
+	return m, nil
+}
+
+// stripYAMLComment cuts a " #" comment that isn't inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block reads the mapping or sequence whose lines are indented by indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || line.indent == indent && isYAMLItem(line.text) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.n)
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line.n)
+		}
+		p.pos++
+		if rest != "" {
+			v, err := yamlScalar(rest, line.n)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		// A nested block, or a sequence at the key's own indentation
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || next.indent == indent && isYAMLItem(next.text) {
+				v, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+		}
+		m[key] = nil
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	list := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !isYAMLItem(line.text) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", line.n)
+			}
+			break
+		}
+		item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if item == "" {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.block(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			} else {
+				list = append(list, nil)
+			}
+			continue
+		}
+		if _, _, ok := splitYAMLKey(item); ok && !strings.HasPrefix(item, "[") && !strings.HasPrefix(item, "{") {
+			// "- key: value" starts a mapping indented to the key
+			itemIndent := indent + len(line.text) - len(item)
+			p.lines[p.pos] = yamlLine{n: line.n, indent: itemIndent, text: item}
+			v, err := p.mapping(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+		v, err := yamlScalar(item, line.n)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.pos++
+	}
+	return list, nil
+}
+
+// splitYAMLKey splits "key: value" (or "key:") outside quotes
+func splitYAMLKey(text string) (string, string, bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", false
+		}
+		rest := text[end+3:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		return text[1 : end+1], strings.TrimSpace(rest), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i == len(text)-1 || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlScalar reads a value written on the key's line
+func yamlScalar(s string, n int) (interface{}, error) {
+	switch {
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case s == "[]":
+		return []interface{}{}, nil
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		list := []interface{}{}
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			v, err := yamlScalar(item, n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}"):
+		m := make(map[string]interface{})
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			key, value, ok := splitYAMLKey(item)
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key: value in %s", n, s)
+			}
+			v, err := yamlScalar(value, n)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", n, s, err)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: unterminated quote", n)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "|" || s == ">" || strings.HasPrefix(s, "&") || strings.HasPrefix(s, "*"):
+		return nil, fmt.Errorf("line %d: multi-line strings, anchors and aliases aren't supported", n)
+	case s == "~" || s == "null":
+		return nil, nil
+	}
+	return s, nil
+}
+
+// splitFlow splits the inside of [...] or {...} at commas outside quotes
+func splitFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// parseTOMLSubset reads the TOML that Traefik dynamic configs are written
+// in: [tables], [[arrays of tables]], dotted keys, strings, booleans,
+// numbers, arrays (over several lines too) and inline tables. Values stay
+// strings, like parseYAMLSubset's.
+func parseTOMLSubset(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	current := root
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(stripYAMLComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") && strings.HasSuffix(line, "]]") {
+			parent, last, err := tomlTable(root, line[2:len(line)-2], n)
+			if err != nil {
+				return nil, err
+			}
+			list, _ := parent[last].([]interface{})
+			current = make(map[string]interface{})
+			parent[last] = append(list, current)
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			parent, last, err := tomlTable(root, line[1:len(line)-1], n)
+			if err != nil {
+				return nil, err
+			}
+			m, ok := parent[last].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				parent[last] = m
+			}
+			current = m
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		value = strings.TrimSpace(value)
+		// Arrays may go on over several lines
+		for strings.HasPrefix(value, "[") && strings.Count(value, "[") > strings.Count(value, "]") && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripYAMLComment(lines[i]))
+		}
+		parent, last, err := tomlTable(current, strings.TrimSpace(key), n)
+		if err != nil {
+			return nil, err
+		}
+		v, err := tomlValue(value, n)
+		if err != nil {
+			return nil, err
+		}
+		parent[last] = v
+	}
+	return root, nil
+}
+
+// tomlTable walks (creating) the tables of a dotted key below m, returning
+// the innermost one and the last key part. Through an array of tables it
+// takes the last entry.
+func tomlTable(m map[string]interface{}, dotted string, n int) (map[string]interface{}, string, error) {
+	var parts []string
+	for _, part := range splitTOMLKey(dotted) {
+		part = strings.TrimSpace(part)
+		if unquoted, err := strconv.Unquote(part); err == nil {
+			part = unquoted
+		} else if len(part) >= 2 && part[0] == '\'' && part[len(part)-1] == '\'' {
+			part = part[1 : len(part)-1]
+		}
+		if part == "" {
+			return nil, "", fmt.Errorf("line %d: empty key in %q", n, dotted)
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return nil, "", fmt.Errorf("line %d: empty key", n)
+	}
+	for _, part := range parts[:len(parts)-1] {
+		switch v := m[part].(type) {
+		case map[string]interface{}:
+			m = v
+		case []interface{}:
+			last, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, "", fmt.Errorf("line %d: %s isn't a table", n, part)
+			}
+			m = last
+		case nil:
+			next := make(map[string]interface{})
+			m[part] = next
+			m = next
+		default:
+			return nil, "", fmt.Errorf("line %d: %s isn't a table", n, part)
+		}
+	}
+	return m, parts[len(parts)-1], nil
+}
+
+// splitTOMLKey splits a dotted key at dots outside quotes
+func splitTOMLKey(key string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			parts = append(parts, key[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, key[start:])
+}
+
+func tomlValue(s string, n int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return nil, fmt.Errorf("line %d: multi-line strings aren't supported", n)
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", n, s, err)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: unterminated quote", n)
+		}
+		return s[1 : len(s)-1], nil
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		list := []interface{}{}
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			v, err := tomlValue(item, n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}"):
+		m := make(map[string]interface{})
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key = value in %s", n, s)
+			}
+			parent, last, err := tomlTable(m, strings.TrimSpace(key), n)
+			if err != nil {
+				return nil, err
+			}
+			if parent[last], err = tomlValue(strings.TrimSpace(value), n); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return s, nil
+}
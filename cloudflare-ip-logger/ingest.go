@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/clientip"
+)
+
+// Limits for remote ingest batches
+const (
+	maxIngestBody  = 5 << 20
+	maxIngestBatch = 1000
+)
+
+// IngestRecord is one connection submitted by a remote agent
+type IngestRecord struct {
+	Timestamp string `json:"timestamp"` // RFC3339; defaults to receive time
+	ClientIP  string `json:"client_ip"`
+	Country   string `json:"country"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Host      string `json:"host"`
+	UserAgent string `json:"user_agent"`
+	Referer   string `json:"referer"`
+	Source    string `json:"source"` // defaults to "agent"
+	CFRay     string `json:"cf_ray"`
+}
+
+// IngestAuth verifies remote ingest requests. Agents authenticate with a
+// bearer token, or with an HMAC-SHA256 over timestamp, nonce and body:
+//
+//	X-Ingest-Timestamp: <unix seconds>
+//	X-Ingest-Nonce:     <random string, never reused>
+//	X-Ingest-Signature: sha256=<hex(HMAC(secret, timestamp + "\n" + nonce + "\n" + body))>
+//
+// Signed requests outside the allowed clock skew or reusing a nonce are
+// rejected, so a captured request can't be replayed.
+type IngestAuth struct {
+	token       string
+	secret      []byte
+	requireHMAC bool
+	maxSkew     time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // nonce -> expiry
+}
+
+func NewIngestAuth(token, secret string, requireHMAC bool, maxSkew time.Duration) *IngestAuth {
+	return &IngestAuth{
+		token:       token,
+		secret:      []byte(secret),
+		requireHMAC: requireHMAC,
+		maxSkew:     maxSkew,
+		nonces:      make(map[string]time.Time),
+	}
+}
+
+func (ia *IngestAuth) Enabled() bool {
+	return ia.token != "" || len(ia.secret) > 0
+}
+
+// Verify checks the request against the already-read body
+func (ia *IngestAuth) Verify(r *http.Request, body []byte) (string, bool) {
+	if sig := r.Header.Get("X-Ingest-Signature"); sig != "" && len(ia.secret) > 0 {
+		return ia.verifyHMAC(r, body, sig)
+	}
+	if ia.requireHMAC || ia.token == "" {
+		return "signature required", false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(ia.token)) != 1 {
+		return "invalid token", false
+	}
+	return "", true
+}
+
+func (ia *IngestAuth) verifyHMAC(r *http.Request, body []byte, sig string) (string, bool) {
+	tsHeader := r.Header.Get("X-Ingest-Timestamp")
+	nonce := r.Header.Get("X-Ingest-Nonce")
+	if tsHeader == "" || nonce == "" {
+		return "timestamp and nonce required", false
+	}
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return "invalid timestamp", false
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > ia.maxSkew || skew < -ia.maxSkew {
+		return "timestamp outside allowed skew", false
+	}
+
+	mac := hmac.New(sha256.New, ia.secret)
+	mac.Write([]byte(tsHeader + "\n" + nonce + "\n"))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "invalid signature", false
+	}
+
+	// Only remember nonces of valid signatures, for as long as the
+	// timestamp would still be accepted
+	ia.mu.Lock()
+	defer ia.mu.Unlock()
+	now := time.Now()
+	for n, exp := range ia.nonces {
+		if now.After(exp) {
+			delete(ia.nonces, n)
+		}
+	}
+	if _, seen := ia.nonces[nonce]; seen {
+		return "nonce already used", false
+	}
+	ia.nonces[nonce] = time.Unix(ts, 0).Add(ia.maxSkew)
+	return "", true
+}
+
+// POST /_proxy/ingest - batch of IngestRecord from a remote agent, either a
+// bare JSON array or {"connections": [...]}
+func (app *App) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if !app.ingestAuth.Enabled() {
+		http.Error(w, "Ingest disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIngestBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxIngestBody {
+		http.Error(w, "Batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if reason, ok := app.ingestAuth.Verify(r, body); !ok {
+		slog.Warn("Rejected ingest batch", "remote", clientip.RemoteIP(r), "reason", reason)
+		http.Error(w, "Unauthorized: "+reason, http.StatusUnauthorized)
+		return
+	}
+
+	var records []IngestRecord
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &records)
+	} else {
+		var wrapped struct {
+			Connections []IngestRecord `json:"connections"`
+		}
+		err = json.Unmarshal(body, &wrapped)
+		records = wrapped.Connections
+	}
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(records) > maxIngestBatch {
+		http.Error(w, "Too many records in batch", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	accepted, rejected := 0, 0
+	for _, rec := range records {
+		if rec.ClientIP == "" {
+			rejected++
+			continue
+		}
+		ts := time.Now()
+		if rec.Timestamp != "" {
+			parsed, err := time.Parse(time.RFC3339, rec.Timestamp)
+			if err != nil {
+				rejected++
+				continue
+			}
+			ts = parsed.Local()
+		}
+		rec.Country = countryCode(rec.Country)
+		if rec.Source == "" {
+			rec.Source = "agent"
+		}
+		conn := ConnectionLog{
+			Timestamp: ts,
+			ClientIP:  rec.ClientIP,
+			Country:   rec.Country,
+			Method:    rec.Method,
+			Path:      rec.Path,
+			Host:      rec.Host,
+			UserAgent: rec.UserAgent,
+			Referer:   rec.Referer,
+			Category:  app.classifier.Classify(rec.ClientIP, rec.UserAgent),
+			Source:    rec.Source,
+			CFRay:     rec.CFRay,
+		}
+		if err := app.logConnection(conn); err != nil {
+			slog.Error("Error storing ingested connection", "err", err)
+			rejected++
+			continue
+		}
+		accepted++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"accepted": accepted, "rejected": rejected})
+}
@@ -0,0 +1,76 @@
+// Package dashboard is the single-page web UI served at / and under the API
+// prefix. It talks to the proxy only through the JSON API.
+package dashboard
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed index.html
+var page []byte
+
+// Translations of the page's strings, one JSON object per language, keyed
+// by its code (en.json, de.json, ...). en is the fallback for missing keys.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// Locales returns the language codes the dashboard is translated into
+func Locales() []string {
+	entries, _ := localeFiles.ReadDir("locales")
+	codes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		codes = append(codes, strings.TrimSuffix(e.Name(), path.Ext(e.Name())))
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func loadMessages() (map[string]map[string]string, error) {
+	messages := make(map[string]map[string]string)
+	for _, code := range Locales() {
+		data, err := localeFiles.ReadFile("locales/" + code + ".json")
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]string
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("locales/%s.json: %w", code, err)
+		}
+		messages[code] = m
+	}
+	return messages, nil
+}
+
+// Handler serves the dashboard, calling the API under apiPrefix (e.g.
+// /_proxy). locale is the language shown to browsers whose visitor hasn't
+// picked one; "" follows the browser's language.
+func Handler(apiPrefix, locale string) (http.Handler, error) {
+	messages, err := loadMessages()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := messages[locale]; locale != "" && !ok {
+		return nil, fmt.Errorf("unknown dashboard locale %q (available: %s)", locale, strings.Join(Locales(), ", "))
+	}
+	msgJSON, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	localeJSON, _ := json.Marshal(locale)
+
+	body := bytes.ReplaceAll(page, []byte("{{API_PREFIX}}"), []byte(apiPrefix))
+	body = bytes.ReplaceAll(body, []byte("{{MESSAGES}}"), msgJSON)
+	body = bytes.ReplaceAll(body, []byte("{{DEFAULT_LOCALE}}"), localeJSON)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(body)
+	}), nil
+}
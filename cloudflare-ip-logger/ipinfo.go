@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/enrich"
+	"cf-ip-logger/pkg/store"
+)
+
+// Lookups done, failed and dropped per provider, served at /debug/vars
+var enrichCounts = expvar.NewMap("enrichment")
+
+// IPInfo is what the enrichment providers found out about a client IP
+type IPInfo struct {
+	IP         string `json:"ip"`
+	RDNS       string `json:"rdns,omitempty"`
+	ASN        uint   `json:"asn,omitempty"`
+	ASOrg      string `json:"as_org,omitempty"`
+	Country    string `json:"country,omitempty"`
+	Reputation *int   `json:"reputation,omitempty"` // AbuseIPDB confidence, 0-100
+	UpdatedAt  string `json:"updated_at"`
+}
+
+// IPInfoProvider looks up one kind of information about an IP. Lookup
+// returns the ip_info columns to set; an empty map means nothing was found.
+type IPInfoProvider interface {
+	Name() string
+	Lookup(ctx context.Context, ip string) (map[string]interface{}, error)
+}
+
+func initIPInfoSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS ip_info (
+		ip TEXT PRIMARY KEY,
+		rdns TEXT NOT NULL DEFAULT '',
+		asn INTEGER NOT NULL DEFAULT 0,
+		as_org TEXT NOT NULL DEFAULT '',
+		country TEXT NOT NULL DEFAULT '',
+		reputation INTEGER,
+		updated_at DATETIME NOT NULL
+	);`)
+	return err
+}
+
+// lookupIPInfo returns the stored information about ip, or nil if there is
+// none (or no ip_info table, on a read-only copy of a database without one)
+func lookupIPInfo(db *sql.DB, ip string) *IPInfo {
+	info := IPInfo{IP: ip}
+	var reputation sql.NullInt64
+	err := db.QueryRow(`SELECT rdns, asn, as_org, country, reputation, updated_at FROM ip_info WHERE ip = ?`, ip).
+		Scan(&info.RDNS, &info.ASN, &info.ASOrg, &info.Country, &reputation, &info.UpdatedAt)
+	if err != nil {
+		return nil
+	}
+	if reputation.Valid {
+		n := int(reputation.Int64)
+		info.Reputation = &n
+	}
+	return &info
+}
+
+// Enricher looks up every client IP the first time it is seen, off the
+// request path: each provider has its own queue and worker, paced to its
+// rate limit, so a slow or rate-limited provider doesn't hold up the others.
+// IPs already in ip_info aren't looked up again.
+type Enricher struct {
+	db        *sql.DB
+	queueSize int
+
+	mu      sync.Mutex
+	seen    map[string]bool
+	workers []*enrichWorker
+}
+
+type enrichWorker struct {
+	provider IPInfoProvider
+	interval time.Duration // minimum time between lookups; 0 = unpaced
+	queue    chan string
+}
+
+func NewEnricher(db *sql.DB, queueSize int) (*Enricher, error) {
+	if err := initIPInfoSchema(db); err != nil {
+		return nil, err
+	}
+	e := &Enricher{db: db, queueSize: queueSize, seen: make(map[string]bool)}
+	rows, err := db.Query("SELECT ip FROM ip_info")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		e.seen[ip] = true
+	}
+	return e, rows.Err()
+}
+
+// Add registers a provider allowed perSecond lookups (0 = no limit) and
+// starts its worker
+func (e *Enricher) Add(p IPInfoProvider, perSecond float64) {
+	w := &enrichWorker{provider: p, queue: make(chan string, e.queueSize)}
+	if perSecond > 0 {
+		w.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	e.mu.Lock()
+	e.workers = append(e.workers, w)
+	e.mu.Unlock()
+	go e.run(w)
+}
+
+// Providers lists the registered providers by name
+func (e *Enricher) Providers() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, len(e.workers))
+	for i, w := range e.workers {
+		names[i] = w.provider.Name()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enqueue schedules lookups for ip unless it has been seen before. It never
+// blocks: when a provider's queue is full the IP is dropped for it.
+func (e *Enricher) Enqueue(ip string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.seen[ip] {
+		return
+	}
+	e.seen[ip] = true
+	for _, w := range e.workers {
+		select {
+		case w.queue <- ip:
+		default:
+			enrichCounts.Add(w.provider.Name()+".dropped", 1)
+		}
+	}
+}
+
+func (e *Enricher) run(w *enrichWorker) {
+	name := w.provider.Name()
+	var last time.Time
+	for ip := range w.queue {
+		if wait := w.interval - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		fields, err := w.provider.Lookup(ctx, ip)
+		cancel()
+		if err != nil {
+			enrichCounts.Add(name+".failed", 1)
+			slog.Debug("Enrichment lookup failed", "provider", name, "ip", ip, "err", err)
+			continue
+		}
+		if err := e.save(ip, fields); err != nil {
+			slog.Error("Error saving enrichment", "provider", name, "ip", ip, "err", err)
+			continue
+		}
+		enrichCounts.Add(name+".done", 1)
+	}
+}
+
+// save upserts fields (column -> value) into ip's row
+func (e *Enricher) save(ip string, fields map[string]interface{}) error {
+	cols := []string{"ip", "updated_at"}
+	args := []interface{}{ip, store.FormatTime(time.Now())}
+	updates := []string{"updated_at = excluded.updated_at"}
+	for col, v := range fields {
+		cols = append(cols, col)
+		args = append(args, v)
+		updates = append(updates, col+" = excluded."+col)
+	}
+	_, err := e.db.Exec(`INSERT INTO ip_info (`+strings.Join(cols, ", ")+`)
+		VALUES (?`+strings.Repeat(", ?", len(cols)-1)+`)
+		ON CONFLICT(ip) DO UPDATE SET `+strings.Join(updates, ", "), args...)
+	return err
+}
+
+// rdnsProvider resolves the IP's PTR record
+type rdnsProvider struct{}
+
+func (rdnsProvider) Name() string { return "rdns" }
+
+func (rdnsProvider) Lookup(ctx context.Context, ip string) (map[string]interface{}, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	return map[string]interface{}{"rdns": strings.TrimSuffix(names[0], ".")}, nil
+}
+
+// geoIPProvider looks up the country in GEOIP_DB
+type geoIPProvider struct{ geo *enrich.GeoIP }
+
+func (geoIPProvider) Name() string { return "geoip" }
+
+func (p geoIPProvider) Lookup(ctx context.Context, ip string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if country := p.geo.Country(ip); country != "" {
+		fields["country"] = country
+	}
+	return fields, nil
+}
+
+// asnProvider looks up the autonomous system in GEOIP_ASN_DB
+type asnProvider struct{ geo *enrich.GeoIP }
+
+func (asnProvider) Name() string { return "asn" }
+
+func (p asnProvider) Lookup(ctx context.Context, ip string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if asn, org := p.geo.ASN(ip); asn != 0 {
+		fields["asn"], fields["as_org"] = asn, org
+	}
+	return fields, nil
+}
+
+// abuseIPDBProvider fetches the abuse confidence score from AbuseIPDB
+type abuseIPDBProvider struct {
+	key    string
+	client *http.Client
+}
+
+func (abuseIPDBProvider) Name() string { return "abuseipdb" }
+
+func (p abuseIPDBProvider) Lookup(ctx context.Context, ip string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"https://api.abuseipdb.com/api/v2/check?maxAgeInDays=90&ipAddress="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Key", p.key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AbuseIPDB returned %s", resp.Status)
+	}
+	var body struct {
+		Data struct {
+			AbuseConfidenceScore int `json:"abuseConfidenceScore"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"reputation": body.Data.AbuseConfidenceScore}, nil
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Triage tags an IP can be given
+const (
+	tagBenign  = "benign"
+	tagMonitor = "monitor"
+	tagHostile = "hostile"
+)
+
+// Paths only vulnerability scanners ask for; a hit on one (by prefix) makes
+// an untagged IP a triage candidate. SCANNER_PATHS replaces the list.
+const defaultScannerPaths = "/wp-login.php,/xmlrpc.php,/.env,/.git/,/phpmyadmin,/admin.php,/vendor/phpunit/,/cgi-bin/,/boaform/,/HNAP1,/actuator/,/.aws/,/server-status"
+
+// IPTag is the triage verdict on an IP, with the note explaining it
+type IPTag struct {
+	IP        string `json:"ip"`
+	Tag       string `json:"tag"`
+	Note      string `json:"note,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// IPTags holds the tags, cached in memory so rows can be annotated without
+// a join (partition files don't have the table)
+type IPTags struct {
+	db           *sql.DB
+	scannerPaths []string
+
+	mu   sync.RWMutex
+	tags map[string]IPTag
+}
+
+func NewIPTags(db *sql.DB, scannerPaths string) (*IPTags, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS ip_tags (
+		ip TEXT PRIMARY KEY,
+		tag TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		updated_by TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.AddColumnIfMissing(db, "ip_tags", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	t := &IPTags{db: db}
+	for _, p := range strings.Split(scannerPaths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			t.scannerPaths = append(t.scannerPaths, p)
+		}
+	}
+	return t, t.reload()
+}
+
+func (t *IPTags) reload() error {
+	rows, err := t.db.Query("SELECT ip, tag, note, updated_by, updated_at FROM ip_tags")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tags := make(map[string]IPTag)
+	for rows.Next() {
+		var tag IPTag
+		if err := rows.Scan(&tag.IP, &tag.Tag, &tag.Note, &tag.UpdatedBy, &tag.UpdatedAt); err != nil {
+			return err
+		}
+		tags[tag.IP] = tag
+	}
+	t.mu.Lock()
+	t.tags = tags
+	t.mu.Unlock()
+	return rows.Err()
+}
+
+// TagOf returns ip's tag, "" when it has none
+func (t *IPTags) TagOf(ip string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tags[ip].Tag
+}
+
+func (t *IPTags) Get(ip string) (IPTag, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tag, ok := t.tags[ip]
+	return tag, ok
+}
+
+// List returns the tags, all of them for "", newest first
+func (t *IPTags) List(tag string) []IPTag {
+	t.mu.RLock()
+	list := []IPTag{}
+	for _, it := range t.tags {
+		if tag == "" || it.Tag == tag {
+			list = append(list, it)
+		}
+	}
+	t.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt > list[j].UpdatedAt })
+	return list
+}
+
+func (t *IPTags) Set(tag IPTag) error {
+	_, err := t.db.Exec(`INSERT INTO ip_tags (ip, tag, note, updated_by, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(ip) DO UPDATE SET tag = excluded.tag, note = excluded.note,
+		updated_by = excluded.updated_by, updated_at = excluded.updated_at, version = ip_tags.version + 1`,
+		tag.IP, tag.Tag, tag.Note, tag.UpdatedBy, tag.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.tags[tag.IP] = tag
+	t.mu.Unlock()
+	return nil
+}
+
+// Delete removes ip's tag, reporting whether it had one
+func (t *IPTags) Delete(ip string) (bool, error) {
+	res, err := t.db.Exec("DELETE FROM ip_tags WHERE ip = ?", ip)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	delete(t.tags, ip)
+	t.mu.Unlock()
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// validate checks tag is on an IP and one of the triage tags
+func (tag IPTag) validate() error {
+	if net.ParseIP(tag.IP) == nil {
+		return fmt.Errorf("invalid IP %q", tag.IP)
+	}
+	switch tag.Tag {
+	case tagBenign, tagMonitor, tagHostile:
+		return nil
+	}
+	return fmt.Errorf("tag must be %q, %q or %q", tagBenign, tagMonitor, tagHostile)
+}
+
+// event is the triage event recording tag was set
+func (tag IPTag) event() Event {
+	msg := fmt.Sprintf("%s tagged %s", tag.IP, tag.Tag)
+	if tag.Note != "" {
+		msg += ": " + tag.Note
+	}
+	return Event{Kind: "triage", ClientIP: tag.IP, Message: msg}
+}
+
+// TriageCandidate is an untagged IP that looks hostile: it probed scanner
+// paths, or a detector reported it in a warning or critical event
+type TriageCandidate struct {
+	ClientIP string   `json:"client_ip"`
+	Country  string   `json:"country,omitempty"`
+	Hits     int      `json:"hits"` // probe requests plus events
+	Reasons  []string `json:"reasons"`
+	LastSeen string   `json:"last_seen"`
+	Banned   bool     `json:"banned"`
+}
+
+// /_proxy/ip-tags[/{ip}]:
+//
+//	GET    /ip-tags?tag=hostile                 tagged IPs (seen on the user's hosts, for host-scoped users)
+//	GET    /ip-tags/candidates?since=7d&limit=100  untriaged hostile candidates
+//	GET    /ip-tags/{ip}
+//	PUT    /ip-tags/{ip}  {"tag": "hostile", "note": "..."}  (admin)
+//	DELETE /ip-tags/{ip}  (admin)
+func (app *App) handleIPTags(w http.ResponseWriter, r *http.Request) {
+	ip := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ip-tags"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && ip == "":
+		list, err := app.visibleTags(r, app.ipTags.List(r.URL.Query().Get("tag")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case r.Method == http.MethodGet && ip == "candidates":
+		app.handleTriageCandidates(w, r)
+
+	case r.Method == http.MethodGet:
+		tag, ok := app.ipTags.Get(ip)
+		if ok {
+			visible, err := app.visibleTags(r, []IPTag{tag})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ok = len(visible) > 0
+		}
+		if !ok {
+			http.Error(w, "IP not tagged", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tag)
+
+	case r.Method == http.MethodPut && ip != "":
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		var tag IPTag
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&tag); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tag.IP, tag.Note, tag.UpdatedAt = ip, strings.TrimSpace(tag.Note), store.FormatTime(time.Now())
+		if err := tag.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tag.UpdatedBy = ""
+		if u := app.admin.Authenticate(r); u != nil {
+			tag.UpdatedBy = u.Name
+		}
+		if err := app.ipTags.Set(tag); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.addEvent(tag.event())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tag)
+
+	case r.Method == http.MethodDelete && ip != "":
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		found, err := app.ipTags.Delete(ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "IP not tagged", http.StatusNotFound)
+			return
+		}
+		app.addEvent(Event{Kind: "triage", ClientIP: ip, Message: ip + " untagged"})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ipTagData is a tag as the admin API's ip-tags kind holds it, under the IP
+type ipTagData struct {
+	Tag       string `json:"tag"`
+	Note      string `json:"note,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"` // set by the server
+}
+
+// ipTagCollection exposes the ip_tags table as the "ip-tags" admin kind, with
+// the IP as the id
+type ipTagCollection struct {
+	app *App
+}
+
+func (c ipTagCollection) object(tag IPTag, version int64) AdminObject {
+	data, _ := json.Marshal(ipTagData{Tag: tag.Tag, Note: tag.Note, UpdatedBy: tag.UpdatedBy})
+	return AdminObject{ID: tag.IP, Data: data, Version: version, UpdatedAt: tag.UpdatedAt}
+}
+
+func (c ipTagCollection) List() ([]AdminObject, error) {
+	rows, err := c.app.ipTags.db.Query("SELECT ip, tag, note, updated_by, updated_at, version FROM ip_tags ORDER BY ip")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []AdminObject{}
+	for rows.Next() {
+		var tag IPTag
+		var version int64
+		if err := rows.Scan(&tag.IP, &tag.Tag, &tag.Note, &tag.UpdatedBy, &tag.UpdatedAt, &version); err != nil {
+			return nil, err
+		}
+		objects = append(objects, c.object(tag, version))
+	}
+	return objects, rows.Err()
+}
+
+func (c ipTagCollection) Get(id string) (AdminObject, error) {
+	var tag IPTag
+	var version int64
+	err := c.app.ipTags.db.QueryRow("SELECT ip, tag, note, updated_by, updated_at, version FROM ip_tags WHERE ip = ?", id).
+		Scan(&tag.IP, &tag.Tag, &tag.Note, &tag.UpdatedBy, &tag.UpdatedAt, &version)
+	if err == sql.ErrNoRows {
+		return AdminObject{}, errAdminNotFound
+	}
+	if err != nil {
+		return AdminObject{}, err
+	}
+	return c.object(tag, version), nil
+}
+
+func (c ipTagCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	var d ipTagData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+	tag := IPTag{IP: id, Tag: d.Tag, Note: strings.TrimSpace(d.Note), UpdatedAt: store.FormatTime(time.Now())}
+	if err := tag.validate(); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+
+	db := c.app.ipTags.db
+	_, err := c.Get(id)
+	switch {
+	case err == errAdminNotFound:
+		if ifMatch > 0 {
+			return AdminObject{}, errAdminNotFound
+		}
+		if _, err := db.Exec("INSERT INTO ip_tags (ip, tag, note, updated_at) VALUES (?, ?, ?, ?)", tag.IP, tag.Tag, tag.Note, tag.UpdatedAt); err != nil {
+			return AdminObject{}, err
+		}
+	case err != nil:
+		return AdminObject{}, err
+	case ifMatch < 0:
+		return AdminObject{}, errAdminAlreadyExists
+	case ifMatch == 0:
+		return AdminObject{}, errAdminPreconditionNeeded
+	default:
+		res, err := db.Exec(`UPDATE ip_tags SET tag = ?, note = ?, updated_by = '', updated_at = ?, version = version + 1
+			WHERE ip = ? AND version = ?`, tag.Tag, tag.Note, tag.UpdatedAt, tag.IP, ifMatch)
+		if err != nil {
+			return AdminObject{}, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return AdminObject{}, errAdminVersionMismatch
+		}
+	}
+	if err := c.app.ipTags.reload(); err != nil {
+		return AdminObject{}, err
+	}
+	c.app.addEvent(tag.event())
+	return c.Get(id)
+}
+
+func (c ipTagCollection) Delete(id string, ifMatch int64) error {
+	if ifMatch == 0 {
+		return errAdminPreconditionNeeded
+	}
+	res, err := c.app.ipTags.db.Exec("DELETE FROM ip_tags WHERE ip = ? AND version = ?", id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.Get(id); errors.Is(err, errAdminNotFound) {
+			return errAdminNotFound
+		}
+		return errAdminVersionMismatch
+	}
+	c.app.addEvent(Event{Kind: "triage", ClientIP: id, Message: id + " untagged"})
+	return c.app.ipTags.reload()
+}
+
+// visibleTags drops the tags of IPs a host-scoped user hasn't seen on any of
+// their hosts, so the notes on other hosts' visitors stay private
+func (app *App) visibleTags(r *http.Request, tags []IPTag) ([]IPTag, error) {
+	scopeCond, scopeArgs := hostScope(r, "host")
+	if scopeCond == "" || len(tags) == 0 {
+		return tags, nil
+	}
+	seen := make(map[string]bool)
+	const batch = 500
+	for start := 0; start < len(tags); start += batch {
+		chunk := tags[start:min(start+batch, len(tags))]
+		args := make([]interface{}, 0, len(chunk)+len(scopeArgs))
+		for _, t := range chunk {
+			args = append(args, t.IP)
+		}
+		rows, err := app.readerFor(r, "").Query(`SELECT DISTINCT client_ip FROM connections
+			WHERE client_ip IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)`+scopeCond, append(args, scopeArgs...)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var ip string
+			if rows.Scan(&ip) == nil {
+				seen[ip] = true
+			}
+		}
+		rows.Close()
+	}
+	visible := []IPTag{}
+	for _, t := range tags {
+		if seen[t.IP] {
+			visible = append(visible, t)
+		}
+	}
+	return visible, nil
+}
+
+// GET /_proxy/ip-tags/candidates?since=7d&limit=100&tz=Europe/Berlin
+func (app *App) handleTriageCandidates(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("since") == "" {
+		query.Set("since", "7d")
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeCond, rangeArgs, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	rangeCond += scopeCond
+	rangeArgs = append(rangeArgs, scopeArgs...)
+	limit := 100
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	byIP := make(map[string]*TriageCandidate)
+	add := func(ip, country, reason string, hits int, last string) {
+		if ip == "" || app.ipTags.TagOf(ip) != "" {
+			return
+		}
+		c := byIP[ip]
+		if c == nil {
+			c = &TriageCandidate{ClientIP: ip, Banned: app.bans.Banned(ip)}
+			byIP[ip] = c
+		}
+		if c.Country == "" || c.Country == "XX" {
+			c.Country = country
+		}
+		c.Hits += hits
+		c.Reasons = append(c.Reasons, reason)
+		if last > c.LastSeen {
+			c.LastSeen = last
+		}
+	}
+
+	// Scanner probes, per IP and path
+	if len(app.ipTags.scannerPaths) > 0 {
+		var conds []string
+		var args []interface{}
+		for _, p := range app.ipTags.scannerPaths {
+			conds = append(conds, `path LIKE ? ESCAPE '\'`)
+			args = append(args, likeEscape(p)+"%")
+		}
+		rows, err := app.readerFor(r, "").Query(`SELECT client_ip, country, path, COUNT(*), MAX(timestamp) FROM connections
+			WHERE (`+strings.Join(conds, " OR ")+`)`+rangeCond+` GROUP BY client_ip, path`, append(args, rangeArgs...)...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var ip, country, path, last string
+			var n int
+			if rows.Scan(&ip, &country, &path, &n, &last) == nil {
+				add(ip, country, fmt.Sprintf("probed %s (%d×)", path, n), n, last)
+			}
+		}
+		rows.Close()
+	}
+
+	// What detectors reported: webhook senders, failed passkey sign-ins, ...
+	rows, err := app.db.Query(`SELECT client_ip, kind, source, severity, COUNT(*), MAX(timestamp) FROM events
+		WHERE client_ip != '' AND severity IN (?, ?)`+rangeCond+` GROUP BY client_ip, kind, source, severity`,
+		append([]interface{}{severityWarning, severityCritical}, rangeArgs...)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var ip, kind, source, severity, last string
+		var n int
+		if rows.Scan(&ip, &kind, &source, &severity, &n, &last) == nil {
+			add(ip, "", fmt.Sprintf("%s %s event from %s (%d×)", severity, kind, source, n), n, last)
+		}
+	}
+	rows.Close()
+
+	list := make([]TriageCandidate, 0, len(byIP))
+	for _, c := range byIP {
+		c.LastSeen = formatStoredTime(c.LastSeen, loc)
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hits != list[j].Hits {
+			return list[i].Hits > list[j].Hits
+		}
+		return list[i].ClientIP < list[j].ClientIP
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+)
+
+// ConcurrencyLimiter caps simultaneous in-flight proxied requests per backend
+// and per client IP. Backend slots are buffered-channel semaphores; client
+// slots are plain counters since the key space is unbounded.
+type ConcurrencyLimiter struct {
+	cfgMu    sync.RWMutex
+	backends map[string]chan struct{} // host -> semaphore
+	perHost  map[string]int           // host -> per-client limit override
+
+	defaultPerClient int
+
+	mu      sync.Mutex
+	clients map[string]int // host|ip -> in-flight count
+}
+
+func NewConcurrencyLimiter(defaultPerClient int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		backends:         make(map[string]chan struct{}),
+		perHost:          make(map[string]int),
+		defaultPerClient: defaultPerClient,
+		clients:          make(map[string]int),
+	}
+}
+
+// Configure sets the limits for a host; zero means unlimited. It may be
+// called again on config reload while requests are in flight.
+func (cl *ConcurrencyLimiter) Configure(host string, maxConcurrent, maxPerClient int) {
+	cl.cfgMu.Lock()
+	defer cl.cfgMu.Unlock()
+	if maxConcurrent > 0 {
+		if sem, ok := cl.backends[host]; !ok || cap(sem) != maxConcurrent {
+			cl.backends[host] = make(chan struct{}, maxConcurrent)
+		}
+	} else {
+		delete(cl.backends, host)
+	}
+	if maxPerClient > 0 {
+		cl.perHost[host] = maxPerClient
+	} else {
+		delete(cl.perHost, host)
+	}
+}
+
+// Limits returns a host's backend and per-client caps; zero means unlimited
+func (cl *ConcurrencyLimiter) Limits(host string) (maxConcurrent, maxPerClient int) {
+	cl.cfgMu.RLock()
+	defer cl.cfgMu.RUnlock()
+	maxPerClient = cl.defaultPerClient
+	if n, ok := cl.perHost[host]; ok {
+		maxPerClient = n
+	}
+	return cap(cl.backends[host]), maxPerClient
+}
+
+// AcquireBackend takes a backend slot without waiting
+func (cl *ConcurrencyLimiter) AcquireBackend(host string) bool {
+	cl.cfgMu.RLock()
+	sem, ok := cl.backends[host]
+	cl.cfgMu.RUnlock()
+	if !ok {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cl *ConcurrencyLimiter) ReleaseBackend(host string) {
+	cl.cfgMu.RLock()
+	sem, ok := cl.backends[host]
+	cl.cfgMu.RUnlock()
+	if !ok {
+		return
+	}
+	// The semaphore may have been replaced by a reload since this slot was
+	// taken; never block on a release
+	select {
+	case <-sem:
+	default:
+	}
+}
+
+// AcquireClient takes a per-client slot for this host without waiting
+func (cl *ConcurrencyLimiter) AcquireClient(host, ip string) bool {
+	limit := cl.defaultPerClient
+	cl.cfgMu.RLock()
+	if n, ok := cl.perHost[host]; ok {
+		limit = n
+	}
+	cl.cfgMu.RUnlock()
+	if limit <= 0 {
+		return true
+	}
+
+	key := host + "|" + ip
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.clients[key] >= limit {
+		return false
+	}
+	cl.clients[key]++
+	return true
+}
+
+func (cl *ConcurrencyLimiter) ReleaseClient(host, ip string) {
+	key := host + "|" + ip
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if n, ok := cl.clients[key]; ok {
+		if n <= 1 {
+			delete(cl.clients, key)
+		} else {
+			cl.clients[key] = n - 1
+		}
+	}
+}
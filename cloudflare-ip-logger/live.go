@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Minutes kept by the live window, the longest window that can be asked for
+const liveWindowMinutes = 15
+
+// Distinct IPs tracked per minute; hits from further IPs are counted in the
+// totals but not ranked, so a flood of spoofed sources can't grow memory
+const liveMaxIPsPerMinute = 10000
+
+// LiveStats counts recent requests in a ring of per-minute buckets, so the
+// last few minutes can be summarized without touching the database
+type LiveStats struct {
+	mu      sync.Mutex
+	buckets [liveWindowMinutes]liveBucket
+}
+
+type liveBucket struct {
+	minute int64 // Unix minute this bucket holds; stale buckets are reset on use
+	hits   int
+	ips    map[string]int
+	hosts  map[string]int
+}
+
+type liveCount struct {
+	Key  string `json:"key"`
+	Hits int    `json:"hits"`
+}
+
+func NewLiveStats() *LiveStats {
+	return &LiveStats{}
+}
+
+func (ls *LiveStats) Record(ip, host string, t time.Time) {
+	minute := t.Unix() / 60
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	b := &ls.buckets[minute%liveWindowMinutes]
+	if b.minute != minute {
+		*b = liveBucket{minute: minute, ips: make(map[string]int), hosts: make(map[string]int)}
+	}
+	b.hits++
+	if _, ok := b.ips[ip]; ok || len(b.ips) < liveMaxIPsPerMinute {
+		b.ips[ip]++
+	}
+	b.hosts[host]++
+}
+
+// Summary covers the last minutes (including the current, partial one):
+// hits per minute oldest first, and the top IPs and hosts
+func (ls *LiveStats) Summary(minutes, top int, now time.Time) map[string]interface{} {
+	current := now.Unix() / 60
+	perMinute := make([]int, minutes)
+	ips := make(map[string]int)
+	hosts := make(map[string]int)
+	total := 0
+
+	ls.mu.Lock()
+	for i := 0; i < minutes; i++ {
+		minute := current - int64(minutes-1-i)
+		b := &ls.buckets[minute%liveWindowMinutes]
+		if b.minute != minute {
+			continue
+		}
+		perMinute[i] = b.hits
+		total += b.hits
+		for ip, n := range b.ips {
+			ips[ip] += n
+		}
+		for host, n := range b.hosts {
+			hosts[host] += n
+		}
+	}
+	ls.mu.Unlock()
+
+	// The current minute is partial, so the rate is over the elapsed time
+	elapsed := float64(minutes-1) + float64(now.Unix()%60+1)/60
+	return map[string]interface{}{
+		"window_minutes":      minutes,
+		"total":               total,
+		"unique_ips":          len(ips),
+		"requests_per_minute": perMinute,
+		"average_per_minute":  math.Round(float64(total)/elapsed*10) / 10,
+		"top_ips":             topCounts(ips, top),
+		"top_hosts":           topCounts(hosts, top),
+	}
+}
+
+func topCounts(counts map[string]int, n int) []liveCount {
+	list := make([]liveCount, 0, len(counts))
+	for k, v := range counts {
+		list = append(list, liveCount{Key: k, Hits: v})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hits != list[j].Hits {
+			return list[i].Hits > list[j].Hits
+		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// GET /_proxy/stats/live?window=5m&top=10
+//
+// The in-memory counters aren't kept per host, so host-scoped users can't
+// see them.
+func (app *App) handleLiveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if u := requestUser(r); u != nil && len(u.Hosts) > 0 {
+		http.Error(w, "Live stats cover every host", http.StatusForbidden)
+		return
+	}
+
+	window := 5 * time.Minute
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute || d > liveWindowMinutes*time.Minute {
+			http.Error(w, "window must be between 1m and "+strconv.Itoa(liveWindowMinutes)+"m", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	top := 10
+	if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 && n <= 100 {
+		top = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.live.Summary(int(window/time.Minute), top, time.Now()))
+}
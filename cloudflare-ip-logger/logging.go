@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// requestLog carries the one line per logged request, apart from the
+// operational messages: every record has log=request, and LOG_REQUESTS=false
+// drops them
+var requestLog = slog.Default()
+
+// setupLogging installs the server's slog handler: LOG_LEVEL (debug, info,
+// warn, error) and LOG_FORMAT (text or json). The standard log package writes
+// through it too, at info.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := strings.ToLower(getEnv("LOG_FORMAT", "text")); format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json, got %q", format)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+
+	requestLog = logger.With("log", "request")
+	if getEnv("LOG_REQUESTS", "true") != "true" {
+		requestLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return nil
+}
+
+// fatalf logs at error level and exits, log.Fatalf for the server
+func fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/clientip"
+	"cf-ip-logger/pkg/logline"
+)
+
+// Largest syslog message or (reassembled, decompressed) GELF payload accepted
+const maxLogMessage = 1 << 20
+
+// Messages received, stored, ignored (not a request) and invalid per
+// protocol, served at /debug/vars
+var logListenCounts = expvar.NewMap("log_listeners")
+
+// LogListener receives log lines from remote cloudflared and nginx boxes
+// over syslog or GELF and records the requests in them, like cf-log-parser
+// does for a local file
+type LogListener struct {
+	app   *App
+	allow []*net.IPNet // empty = any sender
+
+	gelfMu     sync.Mutex
+	gelfChunks map[string]*gelfChunked
+}
+
+func NewLogListener(app *App, allow string) (*LogListener, error) {
+	l := &LogListener{app: app, gelfChunks: make(map[string]*gelfChunked)}
+	for _, s := range strings.Split(allow, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n := clientip.ParseIPOrCIDR(s)
+		if n == nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		l.allow = append(l.allow, n)
+	}
+	return l, nil
+}
+
+// allowed reports whether addr may send logs
+func (l *LogListener) allowed(addr net.Addr) bool {
+	if len(l.allow) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, n := range l.allow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// record parses line and stores the request in it. sent is the time the
+// message itself carries, used when the line has no timestamp of its own.
+func (l *LogListener) record(source, line string, sent time.Time) {
+	req, err := logline.Parse(line)
+	if err != nil {
+		logListenCounts.Add(source+".invalid", 1)
+		return
+	}
+	if req == nil || req.ClientIP == "" {
+		logListenCounts.Add(source+".ignored", 1)
+		return
+	}
+	ts := req.Time
+	if ts.IsZero() {
+		ts = sent
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	conn := ConnectionLog{
+		Timestamp: ts.Local(),
+		ClientIP:  req.ClientIP,
+		Country:   "XX",
+		Method:    req.Method,
+		Path:      req.Path,
+		Host:      strings.ToLower(req.Host),
+		UserAgent: req.UserAgent,
+		Referer:   req.Referer,
+		Category:  l.app.classifier.Classify(req.ClientIP, req.UserAgent),
+		Source:    source,
+		CFRay:     req.CFRay,
+	}
+	if err := l.app.logConnection(conn); err != nil {
+		slog.Error("Error storing connection", "source", source, "err", err)
+		return
+	}
+	logListenCounts.Add(source+".stored", 1)
+}
+
+// Listen starts UDP and TCP listeners for proto ("syslog" or "gelf") on
+// addr. Only binding can fail; receive errors are logged.
+func (l *LogListener) Listen(proto, addr string) error {
+	udp, err := listenUDP(addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := listenTCP(addr)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	go l.serveUDP(proto, udp)
+	go l.serveTCP(proto, tcp)
+	slog.Info("Accepting log messages (UDP and TCP)", "proto", proto, "addr", addr)
+	return nil
+}
+
+func (l *LogListener) serveUDP(proto string, conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			slog.Error("UDP listener stopped", "proto", proto, "err", err)
+			return
+		}
+		if !l.allowed(addr) {
+			continue
+		}
+		logListenCounts.Add(proto+".received", 1)
+		if proto == "gelf" {
+			l.handleGELFDatagram(buf[:n])
+		} else {
+			l.handleSyslog(buf[:n])
+		}
+	}
+}
+
+func (l *LogListener) serveTCP(proto string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("TCP listener stopped", "proto", proto, "err", err)
+			return
+		}
+		if !l.allowed(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go l.serveTCPConn(proto, conn)
+	}
+}
+
+func (l *LogListener) serveTCPConn(proto string, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var msg []byte
+		var err error
+		if proto == "gelf" {
+			// GELF TCP: uncompressed JSON, null-byte delimited
+			msg, err = readDelimited(r, 0)
+		} else {
+			msg, err = readSyslogFrame(r)
+		}
+		if len(bytes.TrimSpace(msg)) > 0 {
+			logListenCounts.Add(proto+".received", 1)
+			if proto == "gelf" {
+				l.handleGELF(msg)
+			} else {
+				l.handleSyslog(msg)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("Log connection failed", "proto", proto, "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+	}
+}
+
+// readDelimited reads up to and without delim, refusing messages over
+// maxLogMessage
+func readDelimited(r *bufio.Reader, delim byte) ([]byte, error) {
+	var msg []byte
+	for {
+		chunk, err := r.ReadSlice(delim)
+		msg = append(msg, chunk...)
+		if len(msg) > maxLogMessage {
+			return nil, errors.New("message too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == nil {
+			msg = msg[:len(msg)-1]
+		}
+		return msg, err
+	}
+}
+
+// readSyslogFrame reads one message in either TCP framing of RFC 6587:
+// octet counting ("<length> <message>") or newline-terminated
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] < '0' || first[0] > '9' {
+		msg, err := readDelimited(r, '\n')
+		return bytes.TrimSuffix(msg, []byte("\r")), err
+	}
+	lenField, err := r.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(lenField))
+	if err != nil || n <= 0 || n > maxLogMessage {
+		return nil, fmt.Errorf("invalid frame length %q", lenField)
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	return msg, err
+}
+
+func (l *LogListener) handleSyslog(data []byte) {
+	sent, msg, ok := parseSyslog(string(data))
+	if !ok {
+		logListenCounts.Add("syslog.invalid", 1)
+		return
+	}
+	l.record("syslog", msg, sent)
+}
+
+// parseSyslog splits a syslog message into its timestamp and MSG. It reads
+// RFC 5424, and the BSD format (RFC 3164) nginx's syslog: access_log target
+// sends. The timestamp is zero when the message has none.
+func parseSyslog(s string) (time.Time, string, bool) {
+	s = strings.TrimRight(s, "\r\n\x00")
+	if !strings.HasPrefix(s, "<") {
+		return time.Time{}, "", false
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return time.Time{}, "", false
+	}
+	if _, err := strconv.Atoi(s[1:end]); err != nil {
+		return time.Time{}, "", false
+	}
+	s = s[end+1:]
+
+	// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]
+	if strings.HasPrefix(s, "1 ") {
+		fields := strings.SplitN(s[2:], " ", 6)
+		if len(fields) < 6 {
+			return time.Time{}, "", false
+		}
+		var sent time.Time
+		if fields[0] != "-" {
+			t, err := time.Parse(time.RFC3339Nano, fields[0])
+			if err != nil {
+				return time.Time{}, "", false
+			}
+			sent = t
+		}
+		msg, ok := skipStructuredData(fields[5])
+		if !ok {
+			return time.Time{}, "", false
+		}
+		// MSG may start with a UTF-8 byte order mark
+		return sent, strings.TrimPrefix(msg, "\ufeff"), true
+	}
+
+	// RFC 3164: "Mmm dd hh:mm:ss HOSTNAME TAG: MSG"
+	var sent time.Time
+	if len(s) >= 16 && s[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, s[:15], time.Local); err == nil {
+			now := time.Now()
+			sent = t.AddDate(now.Year(), 0, 0)
+			// December messages read in January
+			if sent.After(now.Add(24 * time.Hour)) {
+				sent = sent.AddDate(-1, 0, 0)
+			}
+			s = s[16:]
+			if i := strings.IndexByte(s, ' '); i >= 0 {
+				s = s[i+1:] // hostname
+			}
+		}
+	}
+	if i := strings.Index(s, ": "); i >= 0 && !strings.ContainsAny(s[:i], " {") {
+		s = s[i+2:] // tag
+	}
+	return sent, s, true
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA field
+func skipStructuredData(s string) (string, bool) {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " "), true
+	}
+	for strings.HasPrefix(s, "[") {
+		i, escaped := 1, false
+		for ; i < len(s); i++ {
+			if escaped {
+				escaped = false
+			} else if s[i] == '\\' {
+				escaped = true
+			} else if s[i] == ']' {
+				break
+			}
+		}
+		if i == len(s) {
+			return "", false
+		}
+		s = s[i+1:]
+	}
+	return strings.TrimPrefix(s, " "), true
+}
+
+// gelfMessage is the part of a GELF 1.1 payload used here: the log line is
+// short_message, as Docker's gelf log driver and most shippers send it
+type gelfMessage struct {
+	ShortMessage string   `json:"short_message"`
+	FullMessage  string   `json:"full_message"`
+	Timestamp    *float64 `json:"timestamp"` // seconds since the epoch
+}
+
+func (l *LogListener) handleGELF(payload []byte) {
+	var m gelfMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		logListenCounts.Add("gelf.invalid", 1)
+		return
+	}
+	line := m.ShortMessage
+	if line == "" {
+		line = m.FullMessage
+	}
+	var sent time.Time
+	if m.Timestamp != nil {
+		sec, frac := math.Modf(*m.Timestamp)
+		sent = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	l.record("gelf", line, sent)
+}
+
+// GELF UDP chunking: magic, 8-byte message ID, sequence number and count
+const (
+	gelfChunkHeader    = 12
+	gelfMaxChunks      = 128
+	gelfChunkedTimeout = 5 * time.Second
+)
+
+type gelfChunked struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// handleGELFDatagram reassembles chunked messages and decompresses
+// (gzip or zlib) before handling the payload
+func (l *LogListener) handleGELFDatagram(data []byte) {
+	if len(data) >= 2 && data[0] == 0x1e && data[1] == 0x0f {
+		data = l.addGELFChunk(data)
+		if data == nil {
+			return
+		}
+	}
+	payload, err := decompressGELF(data)
+	if err != nil {
+		logListenCounts.Add("gelf.invalid", 1)
+		return
+	}
+	l.handleGELF(payload)
+}
+
+// addGELFChunk stores one chunk and returns the whole message once all of
+// its chunks have arrived
+func (l *LogListener) addGELFChunk(data []byte) []byte {
+	if len(data) <= gelfChunkHeader {
+		logListenCounts.Add("gelf.invalid", 1)
+		return nil
+	}
+	id := string(data[2:10])
+	seq, count := int(data[10]), int(data[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		logListenCounts.Add("gelf.invalid", 1)
+		return nil
+	}
+
+	l.gelfMu.Lock()
+	defer l.gelfMu.Unlock()
+	now := time.Now()
+	for k, c := range l.gelfChunks {
+		if now.Sub(c.started) > gelfChunkedTimeout {
+			delete(l.gelfChunks, k)
+			logListenCounts.Add("gelf.invalid", 1)
+		}
+	}
+	c := l.gelfChunks[id]
+	if c == nil {
+		c = &gelfChunked{parts: make([][]byte, count), started: now}
+		l.gelfChunks[id] = c
+	}
+	if len(c.parts) != count || c.parts[seq] != nil {
+		return nil
+	}
+	c.parts[seq] = append([]byte(nil), data[gelfChunkHeader:]...)
+	c.received++
+	c.size += len(c.parts[seq])
+	if c.size > maxLogMessage {
+		delete(l.gelfChunks, id)
+		logListenCounts.Add("gelf.invalid", 1)
+		return nil
+	}
+	if c.received < count {
+		return nil
+	}
+	delete(l.gelfChunks, id)
+	return bytes.Join(c.parts, nil)
+}
+
+func decompressGELF(data []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0] == 0x78:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxLogMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxLogMessage {
+		return nil, errors.New("message too long")
+	}
+	return out, nil
+}
@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"cf-ip-logger/internal/dashboard"
+	"cf-ip-logger/pkg/clientip"
+	"cf-ip-logger/pkg/enrich"
+	"cf-ip-logger/pkg/store"
 )
 
 type ConnectionLog struct {
@@ -31,6 +40,55 @@ type ConnectionLog struct {
 	Host         string    `json:"host"`
 	UserAgent    string    `json:"user_agent"`
 	Referer      string    `json:"referer"`
+	Category     string    `json:"category"`
+	ViaCF        bool      `json:"via_cloudflare"`
+	Source       string    `json:"source"`
+	Seq          string    `json:"seq"`
+	CFRay        string    `json:"cf_ray"`
+	CFScheme     string    `json:"cf_visitor_scheme"`
+	CFWorker     string    `json:"cf_worker"`
+	CFCity       string    `json:"cf_city"`
+	CFRegion     string    `json:"cf_region"`
+	Tag          string    `json:"tag,omitempty"` // the client IP's triage tag
+	// Extra request headers the route logs (log_headers, log_header_presence)
+	Headers map[string]string `json:"headers,omitempty"`
+	// Set for requests over the TLS listener (TLS_CERT)
+	TLSVersion    string `json:"tls_version,omitempty"`
+	TLSCipher     string `json:"tls_cipher,omitempty"`
+	TLSServerName string `json:"tls_sni,omitempty"`
+	TLSALPN       string `json:"tls_alpn,omitempty"`
+	TLSJA3        string `json:"tls_ja3,omitempty"` // with TLS_FINGERPRINT
+	// The Host matched no route or alias (it may still have been served by
+	// the default route)
+	Unmatched bool `json:"unmatched,omitempty"`
+	// The KNOWN_NETWORKS entry the client IP is in
+	Network string `json:"network,omitempty"`
+	// What a ban or limit did with the request (blocked, rate_limited or
+	// observed) and the rule that decided it
+	Decision string `json:"decision,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+	// Campaign parameters from the query string (utm_source etc., or the
+	// CAMPAIGN_PARAMS standing in for them)
+	UTMSource   string `json:"utm_source,omitempty"`
+	UTMMedium   string `json:"utm_medium,omitempty"`
+	UTMCampaign string `json:"utm_campaign,omitempty"`
+}
+
+// Source recorded on rows written by the proxy itself
+const sourceProxy = "proxy"
+
+// HostStats is a host's hit count and distinct clients, a top_hosts entry
+type HostStats struct {
+	Host      string `json:"host"`
+	Hits      int    `json:"hits"`
+	UniqueIPs int    `json:"unique_ips"`
+}
+
+// CountryStats is the same for a country, a top_countries entry
+type CountryStats struct {
+	Country   string `json:"country"`
+	Hits      int    `json:"hits"`
+	UniqueIPs int    `json:"unique_ips"`
 }
 
 type IPStats struct {
@@ -39,87 +97,819 @@ type IPStats struct {
 	HitCount  int    `json:"hit_count"`
 	FirstSeen string `json:"first_seen"`
 	LastSeen  string `json:"last_seen"`
+	Tag       string `json:"tag,omitempty"`
+	Addresses int    `json:"addresses,omitempty"` // with ipv6_prefix/ipv4_prefix, how many the prefix had
 }
 
 type ProxyConfig struct {
-	Host    string `json:"host"`
-	Backend string `json:"backend"`
-	NoTLS   bool   `json:"no_tls_verify,omitempty"`
+	Host          string   `json:"host"`
+	Backend       string   `json:"backend"`
+	Root          string   `json:"root,omitempty"` // serve this directory instead of proxying
+	Index         string   `json:"index,omitempty"`
+	SPAFallback   bool     `json:"spa_fallback,omitempty"`
+	Default       bool     `json:"default,omitempty"`
+	Aliases       []string `json:"aliases,omitempty"`
+	NoTLS         bool     `json:"no_tls_verify,omitempty"`
+	TLSCAFile     string   `json:"tls_ca_file,omitempty"`     // PEM CA(s) the backend certificate must chain to
+	TLSPins       []string `json:"tls_pin_sha256,omitempty"`  // base64 SHA-256 of accepted backend public keys
+	TLSServerName string   `json:"tls_server_name,omitempty"` // name to verify instead of the backend host
+	MaxConcurrent int      `json:"max_concurrent,omitempty"`
+	MaxPerClient  int      `json:"max_concurrent_per_client,omitempty"`
+	BytesPerSec   int      `json:"max_bytes_per_sec,omitempty"`
+	BytesPerSecIP int      `json:"max_bytes_per_sec_per_ip,omitempty"`
+	ObserveLimits bool     `json:"observe_limits,omitempty"` // log requests over the concurrency caps instead of refusing them
+
+	Maintenance           bool   `json:"maintenance,omitempty"`
+	MaintenanceRetryAfter int    `json:"maintenance_retry_after,omitempty"`
+	MaintenancePage       string `json:"maintenance_page,omitempty"`
+
+	Mirror        string `json:"mirror,omitempty"`         // shadow backend that gets a copy of each request
+	MirrorPercent int    `json:"mirror_percent,omitempty"` // share of requests mirrored (default 100)
+
+	Rewrite []RewriteRule `json:"rewrite,omitempty"` // response body replacements
+
+	Robots      string `json:"robots,omitempty"`       // "disallow", "allow" or a file served as /robots.txt
+	Favicon     string `json:"favicon,omitempty"`      // "default", "none" or a file served as /favicon.ico
+	QuietAssets bool   `json:"quiet_assets,omitempty"` // don't log /robots.txt and /favicon.ico requests
+
+	LogHeaders        []string `json:"log_headers,omitempty"`         // request headers logged with each connection
+	LogHeaderPresence []string `json:"log_header_presence,omitempty"` // headers logged only as present, never their value
+
+	ETag bool `json:"etag,omitempty"` // add ETags and answer conditional requests with 304
+
+	HealthPath string `json:"health_path,omitempty"` // probed by CONFIG_HEALTH_GATE (default /)
+
+	Transport TransportConfig `json:"transport"`
+}
+
+// routeKey is the key the entry is routed under: its host in lower case,
+// or defaultRouteKey for a default route without one
+func (cfg ProxyConfig) routeKey() string {
+	if cfg.Default && cfg.Host == "" {
+		return defaultRouteKey
+	}
+	return strings.ToLower(cfg.Host)
 }
 
 type App struct {
-	db          *sql.DB
-	logFile     *os.File
-	logMutex    sync.Mutex
-	proxies     map[string]*httputil.ReverseProxy
-	backends    map[string]string
-	backendURLs map[string]*url.URL
-	noTLSHosts  map[string]bool
+	db            *sql.DB
+	readDB        *sql.DB
+	partitions    *PartitionSet
+	fileLog       *FileLogger
+	accessLog     *AccessLog     // nil unless ACCESS_LOG is set
+	replicator    *Replicator    // nil unless REPLICA_URL is set
+	diskGuard     *DiskGuard     // nil unless DISK_MIN_FREE is set
+	retention     *Retention     // nil unless CONNECTION_RETENTION is set
+	archives      *ArchiveStore  // archived days loaded for ?archive= queries
+	tunnel        *TunnelMonitor // nil unless CLOUDFLARED_METRICS or CF_API_TOKEN is set
+	live          *LiveStats
+	active        *ActiveVisitors
+	latency       *LatencyHistograms
+	bans          *BanList
+	ipTags        *IPTags
+	annotations   *Annotations
+	shareLinks    *ShareLinks
+	shareTokens   *ShareTokens
+	reporter      *Reporter // nil unless REPORTS is set
+	capturer      *Capturer // nil unless CAPTURE_HOSTS is set
+	reqDebug      *RequestDebug
+	wsSessions    *WSSessions
+	routes        atomic.Pointer[routeTable] // swapped whole on config reload
+	limiter       *ConcurrencyLimiter
+	classifier    *TrafficClassifier
+	throttler     *Throttler
+	ipPolicy      *clientip.Policy
+	admin         *AdminAPI
+	passkeys      *Passkeys
+	cfRanges      *clientip.CloudflareRanges
+	ingestAuth    *IngestAuth
+	beaconTokens  map[string]string // BEACON_TOKENS: token -> host
+	campaigns     *CampaignParams
+	crawlers      *CrawlerAgents
+	webhookToken  string // WEBHOOK_TOKEN; webhooks are disabled when empty
+	seqGen        store.SeqGenerator
+	tracer        *Tracer
+	maintenance   *Maintenance
+	uptime        *UptimeTracker
+	statusPage    *StatusPage // nil unless STATUS_PAGE_HOSTS is set
+	configSrc     configSource
+	unknownHosts  *unknownHostPolicy
+	networks      *KnownNetworks
+	ownTraffic    *ownTraffic
+	dedupWindow   time.Duration  // 0 disables duplicate suppression
+	mirrorMaxBody int64          // larger request bodies aren't mirrored
+	tunnels       sync.WaitGroup // open WebSocket tunnels, drained on upgrade
+	openTunnels   atomic.Int64
+	dashboard     http.Handler
+	readOnly      bool        // READ_ONLY: serve queries, never write the database
+	dryRun        bool        // DRY_RUN: bans and limits log instead of refusing
+	logAPICalls   bool        // LOG_API_REQUESTS: log API calls as connections too
+	enrich        *enrich.Job // nil unless GEOIP_DB is set
+	enricher      *Enricher   // nil unless ENRICH_IPS is set
+	backends      backendStates
+	healthGate    *HealthGate
+}
+
+// route is one backend mapping from proxy-config.json
+type route struct {
+	backend string // as configured, to detect changes on reload
+	url     *url.URL
+	noTLS   bool
+	pool    *BackendPool // set when the backend is resolved via DNS
+	proxy   *httputil.ReverseProxy
+	static  *staticSite // set instead of proxy for routes with a root
+
+	transportCfg TransportConfig // as configured, to detect changes on reload
+	tlsKey       string
+	transport    *backendTransport
+}
+
+// routeTable is an immutable snapshot of the proxy configuration
+type routeTable struct {
+	routes      map[string]*route
+	aliases     map[string]string // alias -> canonical route key
+	mirrors     map[string]*Mirror
+	hooks       map[string]*responseHooks
+	assets      map[string]*assetPolicy
+	headerLogs  map[string]*headerLog
+	observed    map[string]bool        // hosts whose concurrency caps only log
+	defaultHost string                 // route key used for hosts without their own route
+	configs     map[string]ProxyConfig // entries as applied, to preview changes against
+	refused     map[string]string      // host -> backend the health gate refused, retried on the next poll
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "demo" {
+		runDemo(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "enrich" {
+		runEnrich(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-timestamps" {
+		runMigrateTimestamps(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bans" {
+		runBans(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		runUsers(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		runArchive(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-config" {
+		runImportConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-config" {
+		runExportConfig(os.Args[2:])
+		return
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+
 	dataDir := getEnv("DATA_DIR", "/data")
 	port := getEnv("PORT", "8080")
 	configFile := getEnv("PROXY_CONFIG", dataDir+"/proxy-config.json")
 
 	// Ensure data directory exists
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+		fatalf("Failed to create data directory: %v", err)
 	}
 
 	app := &App{
-		proxies:     make(map[string]*httputil.ReverseProxy),
-		backends:    make(map[string]string),
-		backendURLs: make(map[string]*url.URL),
-		noTLSHosts:  make(map[string]bool),
+		limiter: NewConcurrencyLimiter(getEnvInt("MAX_CONCURRENT_PER_CLIENT", 0)),
+		classifier: NewTrafficClassifier(
+			getEnv("MONITORING_USER_AGENTS", defaultMonitoringAgents),
+			getEnv("MONITORING_IPS", "")),
+		crawlers:    NewCrawlerAgents(getEnv("CRAWLER_USER_AGENTS", defaultCrawlerAgents)),
+		throttler:   NewThrottler(),
+		live:        NewLiveStats(),
+		active:      NewActiveVisitors(max(getEnvDuration("ACTIVE_WINDOW", 15*time.Minute), time.Minute)),
+		latency:     NewLatencyHistograms(),
+		dedupWindow: getEnvDuration("DEDUP_WINDOW", 2*time.Second),
+		cfRanges:    clientip.NewCloudflareRanges(dataDir + "/cloudflare-ips.txt"),
+		ingestAuth: NewIngestAuth(
+			getEnv("INGEST_TOKEN", ""),
+			getEnv("INGEST_HMAC_SECRET", ""),
+			getEnv("INGEST_REQUIRE_HMAC", "false") == "true",
+			getEnvDuration("INGEST_MAX_SKEW", 5*time.Minute)),
+		webhookToken: getEnv("WEBHOOK_TOKEN", ""),
+	}
+	app.tracer = NewTracer(
+		getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		getEnv("OTEL_EXPORTER_OTLP_HEADERS", ""),
+		getEnv("OTEL_SERVICE_NAME", "cf-ip-logger"),
+		parseSampleRate(getEnv("TRACING_SAMPLE_RATE", "1")))
+	app.ipPolicy = clientip.NewPolicy(
+		getEnv("CLIENT_IP_HEADERS", clientip.DefaultHeaders),
+		getEnv("TRUSTED_PROXIES", ""),
+		app.cfRanges)
+	mirrorMaxBody, err := parseByteSize(getEnv("MIRROR_MAX_BODY", "1MB"))
+	if err != nil {
+		fatalf("Invalid MIRROR_MAX_BODY: %v", err)
+	}
+	app.mirrorMaxBody = int64(mirrorMaxBody)
+	app.healthGate, err = NewHealthGate(getEnv("CONFIG_HEALTH_GATE", healthGateOff))
+	if err != nil {
+		fatalf("Invalid CONFIG_HEALTH_GATE: %v", err)
+	}
+	app.unknownHosts, err = newUnknownHostPolicy(getEnv("UNKNOWN_HOST_POLICY", unknownHostInfo), getEnv("UNKNOWN_HOST_REDIRECT", ""))
+	if err != nil {
+		fatalf("Invalid UNKNOWN_HOST_POLICY: %v", err)
+	}
+	app.networks, err = NewKnownNetworks(getEnv("KNOWN_NETWORKS", ""))
+	if err != nil {
+		fatalf("Invalid KNOWN_NETWORKS: %v", err)
+	}
+	app.campaigns, err = NewCampaignParams(getEnv("CAMPAIGN_PARAMS", ""))
+	if err != nil {
+		fatalf("Invalid CAMPAIGN_PARAMS: %v", err)
+	}
+
+	// Keep Cloudflare's published ranges current (0 disables fetching)
+	if interval := getEnvDuration("CLOUDFLARE_IPS_REFRESH", 24*time.Hour); interval > 0 {
+		go app.cfRanges.RefreshLoop(interval)
 	}
 
 	// Initialize database
+	if err := store.LoadKey(); err != nil {
+		fatalf("Failed to load database key: %v", err)
+	}
 	dbPath := dataDir + "/connections.db"
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL")
+	var db *sql.DB
+	// DEMO_MODE runs on synthetic traffic only, never touching a real database
+	demoMode := getEnv("DEMO_MODE", "false") == "true"
+	defaultStorage := "sqlite"
+	if demoMode {
+		defaultStorage = "memory"
+	}
+	// READ_ONLY serves the dashboard and queries from a database another
+	// instance writes, e.g. a replicated copy
+	app.readOnly = getEnv("READ_ONLY", "false") == "true"
+	// DRY_RUN lets through what bans and limits would refuse and logs it
+	// instead, to try rules out against live traffic
+	if app.dryRun = getEnv("DRY_RUN", "false") == "true"; app.dryRun {
+		slog.Warn("DRY_RUN: bans and limits are logged, not enforced")
+	}
+	switch storage := getEnv("STORAGE", defaultStorage); storage {
+	case "sqlite":
+		if app.readOnly {
+			db, err = store.OpenReadOnly(dbPath)
+		} else {
+			db, err = store.Open(dbPath)
+		}
+	case "memory":
+		if app.readOnly {
+			fatalf("READ_ONLY needs STORAGE=sqlite and an existing database")
+		}
+		// The database never touches disk; for tests and demos
+		dbPath = ":memory:"
+		db, err = store.OpenMemory("connections")
+	default:
+		fatalf("Unknown STORAGE %q (expected sqlite or memory)", storage)
+	}
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		fatalf("Failed to open database: %v", err)
 	}
 	app.db = db
 	defer db.Close()
+	if app.readOnly {
+		// Features that write to the database can't run here
+		for _, key := range []string{"CAPTURE_HOSTS", "DISK_MIN_FREE", "REPLICA_URL", "DEMO_CONNECTIONS", "SYSLOG_ADDR", "GELF_ADDR", "BAN_LISTS", "CONNECTION_RETENTION"} {
+			if getEnv(key, "") != "" {
+				fatalf("%s can't be used with READ_ONLY", key)
+			}
+		}
+		if getEnv("DB_PARTITION", "none") != "none" {
+			fatalf("DB_PARTITION can't be used with READ_ONLY")
+		}
+	}
 
 	if err := app.initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		if app.readOnly {
+			fatalf("Failed to initialize database: %v (READ_ONLY needs a database already brought up to date by a writable instance)", err)
+		}
+		fatalf("Failed to initialize database: %v", err)
+	}
+
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	admin, err := NewAdminAPI(db, adminToken)
+	if err != nil {
+		fatalf("Failed to initialize admin API: %v", err)
+	}
+	admin.onEvent = app.addEvent
+	admin.open = getEnv("ADMIN_UNAUTHENTICATED", "false") == "true"
+	app.admin = admin
+	if adminToken == "" && !admin.users.Any() {
+		if admin.open {
+			slog.Warn("ADMIN_TOKEN not set, no users and ADMIN_UNAUTHENTICATED set: the admin API is open to anyone")
+		} else {
+			slog.Warn("ADMIN_TOKEN not set and no users, the admin API is disabled until one is configured (see the users add command)")
+		}
+	}
+	app.passkeys = NewPasskeys(db, getEnv("WEBAUTHN_RP_ID", ""), getEnv("WEBAUTHN_ORIGINS", ""),
+		getEnvDuration("PASSKEY_SESSION_TTL", 12*time.Hour))
+
+	bans, err := NewBanList(db)
+	if err != nil {
+		fatalf("Failed to initialize bans table: %v", err)
+	}
+	bans.onEvent = app.addEvent
+	app.bans = bans
+	admin.Register("bans", banCollection{bans})
+
+	app.shareLinks, err = NewShareLinks(db)
+	if err != nil {
+		fatalf("Failed to load share links: %v", err)
+	}
+	admin.Register("share-links", shareLinkCollection{app.shareLinks})
+	go bans.RefreshLoop(time.Minute)
+	app.beaconTokens, err = parseBeaconTokens(getEnv("BEACON_TOKENS", ""))
+	if err != nil {
+		fatalf("Invalid BEACON_TOKENS: %v", err)
+	}
+
+	feeds, err := parseBanFeeds(getEnv("BAN_LISTS", ""))
+	if err != nil {
+		fatalf("Invalid BAN_LISTS: %v", err)
+	}
+	if len(feeds) > 0 {
+		go bans.FeedLoop(feeds, getEnvDuration("BAN_LIST_INTERVAL", 24*time.Hour))
 	}
 
-	// Initialize log file
+	app.ipTags, err = NewIPTags(db, getEnv("SCANNER_PATHS", defaultScannerPaths))
+	if err != nil {
+		fatalf("Failed to initialize ip_tags table: %v", err)
+	}
+	admin.Register("ip-tags", ipTagCollection{app})
+	app.annotations, err = NewAnnotations(db)
+	if err != nil {
+		fatalf("Failed to initialize annotations table: %v", err)
+	}
+	admin.Register("annotations", annotationCollection{app.annotations})
+	app.shareTokens, err = NewShareTokens(db, os.Getenv("SHARE_TOKEN_SECRET"), dataDir+"/share-token.key")
+	if err != nil {
+		fatalf("Failed to initialize share tokens: %v", err)
+	}
+	admin.Register("share-tokens", shareTokenCollection{app})
+
+	wsSessions, err := NewWSSessions(db)
+	if err != nil {
+		fatalf("Failed to initialize ws_sessions table: %v", err)
+	}
+	app.wsSessions = wsSessions
+
+	// Record full requests for debugging (headers and bodies; off by default)
+	redact := getEnv("CAPTURE_REDACT_HEADERS", "Authorization,Cookie,Proxy-Authorization,Set-Cookie")
+	app.reqDebug = NewRequestDebug(redact)
+	if hosts := getEnv("CAPTURE_HOSTS", ""); hosts != "" {
+		maxBody, err := parseByteSize(getEnv("CAPTURE_MAX_BODY", "1MB"))
+		if err != nil {
+			fatalf("Invalid CAPTURE_MAX_BODY: %v", err)
+		}
+		capturer, err := NewCapturer(db, hosts, getEnvInt("CAPTURE_MAX", 1000), int64(maxBody), redact)
+		if err != nil {
+			fatalf("Failed to initialize captures table: %v", err)
+		}
+		app.capturer = capturer
+		slog.Info("Capturing requests", "hosts", hosts, "keep", capturer.max)
+	}
+
+	// Country backfill for rows stored without one
+	var geo *enrich.GeoIP
+	if path := getEnv("GEOIP_DB", ""); path != "" {
+		geo, err = enrich.OpenGeoIP(path)
+		if err != nil {
+			fatalf("Failed to open GEOIP_DB: %v", err)
+		}
+		defer geo.Close()
+		app.enrich = enrich.NewJob(geo)
+		slog.Info("GeoIP database", "path", path)
+	}
+
+	// Look up new client IPs in the background (rDNS, ASN, country, reputation)
+	if getEnv("ENRICH_IPS", "false") == "true" {
+		if app.readOnly {
+			fatalf("ENRICH_IPS can't be used with READ_ONLY")
+		}
+		enricher, err := NewEnricher(db, getEnvInt("ENRICH_QUEUE_SIZE", 10000))
+		if err != nil {
+			fatalf("Failed to initialize ip_info table: %v", err)
+		}
+		if rate := getEnvInt("ENRICH_RDNS_RATE", 10); rate > 0 {
+			enricher.Add(rdnsProvider{}, float64(rate))
+		}
+		if geo != nil {
+			enricher.Add(geoIPProvider{geo}, 0)
+		}
+		if path := getEnv("GEOIP_ASN_DB", ""); path != "" {
+			asnDB, err := enrich.OpenGeoIP(path)
+			if err != nil {
+				fatalf("Failed to open GEOIP_ASN_DB: %v", err)
+			}
+			defer asnDB.Close()
+			enricher.Add(asnProvider{asnDB}, 0)
+		}
+		if key := getEnv("ABUSEIPDB_KEY", ""); key != "" {
+			daily := getEnvInt("ABUSEIPDB_DAILY_LIMIT", 1000)
+			enricher.Add(abuseIPDBProvider{key: key, client: &http.Client{Timeout: 10 * time.Second}}, float64(daily)/86400)
+		}
+		app.enricher = enricher
+		slog.Info("IP enrichment", "providers", strings.Join(enricher.Providers(), ","))
+	}
+
+	maintenance, err := NewMaintenance(db, getEnv("MAINTENANCE_PAGE", ""))
+	if err != nil {
+		fatalf("Failed to initialize maintenance table: %v", err)
+	}
+	app.maintenance = maintenance
+	admin.Register("maintenance", maintenanceCollection{app})
+
+	uptime, err := NewUptimeTracker(db, float64(getEnvInt("UPTIME_ERROR_PERCENT", 50))/100, app.readOnly)
+	if err != nil {
+		fatalf("Failed to initialize host_uptime table: %v", err)
+	}
+	app.uptime = uptime
+	if !app.readOnly {
+		go uptime.Run(time.Minute)
+	}
+	if hosts := getEnv("STATUS_PAGE_HOSTS", ""); hosts != "" {
+		app.statusPage = NewStatusPage(hosts, getEnv("STATUS_PAGE_TITLE", "Service Status"))
+	}
+
+	// Optionally give each proxied host its own database file
+	app.readDB = db
+	switch partitionMode := getEnv("DB_PARTITION", "none"); partitionMode {
+	case "none":
+	case "host":
+		if dbPath == ":memory:" {
+			fatalf("DB_PARTITION=host needs STORAGE=sqlite")
+		}
+		partitions, err := NewPartitionSet(dataDir, db)
+		if err != nil {
+			fatalf("Failed to open partitions: %v", err)
+		}
+		app.partitions = partitions
+		defer partitions.Close()
+
+		readDB, err := openPartitionedReader(dbPath, partitions)
+		if err != nil {
+			fatalf("Failed to open partitioned reader: %v", err)
+		}
+		app.readDB = readDB
+		defer readDB.Close()
+		slog.Info("Database partitioning: one file per host", "dir", partitions.dir)
+	default:
+		fatalf("Unknown DB_PARTITION mode %q (expected none or host)", partitionMode)
+	}
+
+	// Synthetic traffic so the dashboard has something to show
+	defaultDemoConnections := 0
+	if demoMode {
+		defaultDemoConnections = 20000
+	}
+	if n := getEnvInt("DEMO_CONNECTIONS", defaultDemoConnections); n > 0 || demoMode {
+		if dbPath != ":memory:" {
+			fatalf("DEMO_MODE and DEMO_CONNECTIONS need STORAGE=memory; use the demo subcommand to fill a database file")
+		}
+		traffic := newDemoTraffic(time.Now().UnixNano())
+		if err := seedDemoData(db, traffic, app.classifier, n, 30*24*time.Hour, time.Now()); err != nil {
+			fatalf("Failed to generate demo data: %v", err)
+		}
+		slog.Info("Generated demo connections", "count", n)
+		if demoMode {
+			go app.demoTrickle(traffic)
+		}
+	}
+
+	// Optionally ship snapshots of the databases to a replica
+	if replicaURL := getEnv("REPLICA_URL", ""); replicaURL != "" {
+		store, err := newReplicaStore(replicaURL)
+		if err != nil {
+			fatalf("Invalid REPLICA_URL: %v", err)
+		}
+		app.replicator = NewReplicator(store, dataDir, getEnvDuration("REPLICA_RETENTION", 7*24*time.Hour),
+			getEnvDuration("REPLICA_FULL_INTERVAL", time.Hour), app.databases)
+		go app.replicator.Run(getEnvDuration("REPLICA_INTERVAL", 5*time.Minute))
+		slog.Info("Replicating databases", "replica", replicaURL)
+	}
+
+	// Initialize buffered log file
 	logPath := dataDir + "/connections.log"
-	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	fileLog, err := NewFileLogger(logPath,
+		getEnvInt("LOG_BUFFER_SIZE", 4096),
+		getEnvDuration("LOG_FLUSH_INTERVAL", time.Second),
+		getEnv("LOG_FSYNC", fsyncNever))
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		fatalf("Failed to open log file: %v", err)
+	}
+	app.fileLog = fileLog
+	defer fileLog.Close()
+
+	// Optional Combined Log Format access log for GoAccess/AWStats
+	if accessPath := getEnv("ACCESS_LOG", ""); accessPath != "" {
+		openLog := func(path string) (*FileLogger, error) {
+			return NewFileLogger(path,
+				getEnvInt("LOG_BUFFER_SIZE", 4096),
+				getEnvDuration("LOG_FLUSH_INTERVAL", time.Second),
+				getEnv("LOG_FSYNC", fsyncNever))
+		}
+		accessLog, err := NewAccessLog(accessPath, getEnv("ACCESS_LOG_PER_HOST", "false") == "true", openLog)
+		if err != nil {
+			fatalf("Failed to open access log: %v", err)
+		}
+		app.accessLog = accessLog
+		defer accessLog.Close()
 	}
-	app.logFile = logFile
-	defer logFile.Close()
 
-	// Load proxy config
-	if err := app.loadProxyConfig(configFile); err != nil {
-		log.Printf("Warning: Could not load proxy config from %s: %v", configFile, err)
-		log.Println("Running in dashboard-only mode. Create proxy-config.json to enable reverse proxy.")
+	// Keep a nearly full disk from breaking inserts
+	if minFree := getEnv("DISK_MIN_FREE", ""); minFree != "" {
+		guard, err := NewDiskGuard(dataDir, minFree,
+			getEnvDuration("DISK_EMERGENCY_KEEP", 7*24*time.Hour),
+			getEnv("ALERT_WEBHOOK", ""),
+			app.databases,
+			func(paused bool) {
+				app.fileLog.SetPaused(paused)
+				app.accessLog.SetPaused(paused)
+			})
+		if err != nil {
+			fatalf("Invalid DISK_MIN_FREE: %v", err)
+		}
+		guard.onEvent = app.addEvent
+		app.diskGuard = guard
+		go guard.Run(getEnvDuration("DISK_CHECK_INTERVAL", 30*time.Second))
 	}
 
-	// API routes (these take priority) - using /_proxy/ to avoid conflicts with backend apps
-	http.HandleFunc("/_proxy/connections", app.handleConnections)
-	http.HandleFunc("/_proxy/stats", app.handleStats)
-	http.HandleFunc("/_proxy/stats/ip/", app.handleIPStats)
-	http.HandleFunc("/_proxy/health", app.handleHealth)
-	http.HandleFunc("/_proxy/config", app.handleConfig)
+	// Drop (or archive, then drop) connections past the retention window
+	if v := getEnv("CONNECTION_RETENTION", ""); v != "" {
+		keep, ok := parseRelative(v)
+		if !ok {
+			fatalf("Invalid CONNECTION_RETENTION: %q (expected e.g. 90d or 12w)", v)
+		}
+		var archiveDir string
+		if getEnv("ARCHIVE_CONNECTIONS", "false") == "true" {
+			archiveDir = dataDir + "/archive"
+		}
+		retention, err := NewRetention(keep, archiveDir, app.databases, func(row interface{ Scan(...interface{}) error }) (ConnectionLog, error) {
+			return app.scanConnection(row, time.UTC)
+		})
+		if err != nil {
+			fatalf("Failed to create archive directory: %v", err)
+		}
+		app.retention = retention
+		go retention.Run(retentionInterval)
+	}
 
-	// Catch-all handler for dashboard and proxy
-	http.HandleFunc("/", app.handleRequest)
+	app.archives = NewArchiveStore(dataDir + "/archive")
+	go app.archives.Run()
 
-	log.Printf("CF IP Logger starting on :%s", port)
-	log.Printf("Database: %s", dbPath)
-	log.Printf("Log file: %s", logPath)
-	log.Printf("Proxy backends configured: %d", len(app.proxies))
-	for host, backend := range app.backends {
-		log.Printf("  %s -> %s", host, backend)
+	// Watch the tunnel the traffic arrives through
+	if metricsURL, apiToken := getEnv("CLOUDFLARED_METRICS", ""), getEnv("CF_API_TOKEN", ""); metricsURL != "" || apiToken != "" {
+		tunnel, err := NewTunnelMonitor(metricsURL, apiToken, getEnv("CF_ACCOUNT_ID", ""), getEnv("CF_TUNNEL_ID", ""))
+		if err != nil {
+			fatalf("Invalid tunnel status settings: %v", err)
+		}
+		tunnel.onEvent = app.addEvent
+		app.tunnel = tunnel
+		go tunnel.Run(getEnvDuration("TUNNEL_CHECK_INTERVAL", 30*time.Second))
+	}
+
+	// Flush buffered log lines before exiting on SIGINT/SIGTERM
+	exit := func() {
+		slog.Info("Shutting down, flushing log file")
+		fileLog.Close()
+		app.accessLog.Close()
+		db.Close()
+		os.Exit(0)
+	}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		sdNotify("STOPPING=1")
+		exit()
+	}()
+
+	// Load proxy config, then keep following changes to it
+	app.routes.Store(&routeTable{routes: map[string]*route{}, aliases: map[string]string{},
+		mirrors: map[string]*Mirror{}, hooks: map[string]*responseHooks{}, assets: map[string]*assetPolicy{},
+		headerLogs: map[string]*headerLog{}, observed: map[string]bool{}, configs: map[string]ProxyConfig{}})
+	configSrc, err := newConfigSource(getEnv("CONFIG_SOURCE", configFile), getEnv("CONFIG_SOURCE_TOKEN", ""))
+	if err != nil {
+		fatalf("Invalid CONFIG_SOURCE: %v", err)
 	}
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	app.configSrc = configSrc
+	version, err := app.loadProxyConfig(context.Background(), "")
+	if err != nil {
+		slog.Warn("Could not load proxy config, running in dashboard-only mode. Create proxy-config.json to enable reverse proxy", "source", configSrc, "err", err)
+	}
+	if interval := getEnvDuration("CONFIG_POLL_INTERVAL", 30*time.Second); interval > 0 {
+		go app.watchConfig(version, interval)
+	}
+	if err := app.maintenance.LoadOverrides(); err != nil {
+		slog.Warn("Could not load maintenance state", "err", err)
+	}
+
+	// The API lives under API_PREFIX on the hosts in API_HOSTS (all when
+	// unset); other requests, including prefixed paths the API doesn't
+	// serve, go to the proxy. Handlers that register themselves on
+	// http.DefaultServeMux (pprof, expvar) never reach the public port.
+	router, err := NewRouter(getEnv("API_PREFIX", "/_proxy"), strings.Split(getEnv("API_HOSTS", ""), ","), http.HandlerFunc(app.handleRequest))
+	if err != nil {
+		fatalf("Invalid API_PREFIX: %v", err)
+	}
+	app.dashboard, err = dashboard.Handler(router.prefix, getEnv("DASHBOARD_LOCALE", ""))
+	if err != nil {
+		fatalf("Invalid DASHBOARD_LOCALE: %v", err)
+	}
+	app.ownTraffic = &ownTraffic{exclude: getEnv("EXCLUDE_OWN_TRAFFIC", "false") == "true", apiPrefix: router.prefix}
+	app.logAPICalls = getEnv("LOG_API_REQUESTS", "false") == "true"
+
+	reportKinds, err := parseReportKinds(getEnv("REPORTS", ""))
+	if err != nil {
+		fatalf("Invalid REPORTS: %v", err)
+	}
+	if len(reportKinds) > 0 {
+		loc, err := time.LoadLocation(getEnv("REPORT_TZ", "UTC"))
+		if err != nil {
+			fatalf("Invalid REPORT_TZ: %v", err)
+		}
+		var retention time.Duration
+		if v := getEnv("REPORT_RETENTION", ""); v != "" {
+			var ok bool
+			if retention, ok = parseRelative(v); !ok {
+				fatalf("Invalid REPORT_RETENTION: %q (expected e.g. 90d or 12w)", v)
+			}
+		}
+		own, ownArgs, _ := app.ownTraffic.Filter(nil)
+		app.reporter, err = NewReporter(app.readDB, dataDir+"/reports", reportKinds, loc, own, ownArgs, retention)
+		if err != nil {
+			fatalf("Failed to create reports directory: %v", err)
+		}
+		go app.reporter.Run()
+	}
+	router.Use(app.apiLogMiddleware)
+	if limit := getEnvInt("API_RATE_LIMIT", 0); limit > 0 {
+		router.Use(app.rateLimitMiddleware(NewRateLimiter(limit)))
+	}
+	if app.readOnly {
+		router.Use(readOnlyMiddleware)
+	}
+	app.registerAPI(router)
+
+	slog.Info("CF IP Logger starting", "port", port, "database", dbPath, "read_only", app.readOnly, "log_file", logPath)
+	routes := app.routes.Load().routes
+	slog.Info("Proxy backends configured", "count", len(routes))
+	for host, rt := range routes {
+		slog.Debug("Proxy backend", "host", host, "backend", rt.url.Redacted())
+	}
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           chain(router, recoverMiddleware, app.accessLogMiddleware, app.banMiddleware),
+		ReadHeaderTimeout: getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("READ_TIMEOUT", 0),
+		WriteTimeout:      getEnvDuration("WRITE_TIMEOUT", 0),
+		IdleTimeout:       getEnvDuration("IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    getEnvInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+	}
+	slog.Info("Server timeouts", "read_header", server.ReadHeaderTimeout, "read", server.ReadTimeout, "write", server.WriteTimeout,
+		"idle", server.IdleTimeout, "max_header_bytes", server.MaxHeaderBytes)
+
+	if addr := getEnv("ADMIN_ADDR", ""); addr != "" {
+		addr, loopback := diagnosticsAddr(addr)
+		if !loopback && adminToken == "" {
+			fatalf("ADMIN_ADDR %s is reachable from other machines: set ADMIN_TOKEN, or bind it to 127.0.0.1", addr)
+		}
+		go app.serveDiagnostics(addr)
+	}
+
+	// Receive cloudflared/nginx logs from other machines (off by default)
+	syslogAddr, gelfAddr := getEnv("SYSLOG_ADDR", ""), getEnv("GELF_ADDR", "")
+	if syslogAddr != "" || gelfAddr != "" {
+		listener, err := NewLogListener(app, getEnv("LOG_LISTEN_ALLOW", ""))
+		if err != nil {
+			fatalf("Invalid LOG_LISTEN_ALLOW: %v", err)
+		}
+		if syslogAddr != "" {
+			if err := listener.Listen("syslog", syslogAddr); err != nil {
+				fatalf("Failed to listen for syslog on %s: %v", syslogAddr, err)
+			}
+		}
+		if gelfAddr != "" {
+			if err := listener.Listen("gelf", gelfAddr); err != nil {
+				fatalf("Failed to listen for GELF on %s: %v", gelfAddr, err)
+			}
+		}
+	}
+
+	ln, err := listen(server.Addr, getEnv("REUSE_PORT", "false") == "true")
+	if err != nil {
+		fatalf("Failed to listen on %s: %v", server.Addr, err)
+	}
+	go app.handleUpgrades(server, ln, getEnvDuration("UPGRADE_DRAIN_TIMEOUT", 0), exit)
+	notifyReady(getEnv("PID_FILE", ""))
+	go sdWatchdogLoop(func() bool { return db.Ping() == nil })
+
+	// Serve HTTPS directly, e.g. without cloudflared in front (off by default)
+	if certFile := getEnv("TLS_CERT", ""); certFile != "" {
+		certs, err := newCertReloader(certFile, getEnv("TLS_KEY", ""))
+		if err != nil {
+			fatalf("Failed to load TLS_CERT/TLS_KEY: %v", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		server.ConnContext = tlsConnContext
+		tlsLn := ln
+		if getEnv("TLS_FINGERPRINT", "false") == "true" {
+			tlsLn = helloListener{ln}
+		}
+		slog.Info("Serving TLS", "cert", certFile)
+		err = server.ServeTLS(tlsLn, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		fatalf("%v", err)
+	}
+	// Shut down for an upgrade; handleUpgrades exits once tunnels drain
+	select {}
+}
+
+// registerAPI adds the API endpoints to router, each behind the access check
+// it needs
+func (app *App) registerAPI(router *Router) {
+	router.HandleFunc("/connections", app.handleConnections, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/connections/", app.handleConnectionDetail, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats", app.handleStats, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/ip/", app.handleIPStats, app.requireViewer)
+	router.HandleFunc("/search", app.handleSearch, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/compare", app.handleStatsCompare, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/heatmap", app.handleHeatmap, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/tls", app.handleTLSStats, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/live", app.handleLiveStats, app.requireViewer)
+	router.HandleFunc("/stats/active", app.handleActiveVisitors, app.requireViewer)
+	router.HandleFunc("/stats/beacons", app.handleBeaconStats, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/campaigns", app.handleCampaignStats, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/stats/crawlers", app.handleCrawlerStats, app.requireViewer, app.archiveReader)
+	router.HandleFunc("/health", app.handleHealth)
+	router.HandleFunc("/tunnel", app.handleTunnel, app.requireViewer)
+	router.HandleFunc("/uptime", app.handleUptime, app.requireViewer)
+	router.HandleFunc("/diagnose/", app.handleDiagnose, app.requireViewer)
+	router.HandleFunc("/status", app.handleStatusPage)
+	router.HandleFunc("/status.json", app.handleStatusPage)
+	router.HandleFunc("/public/", app.handlePublicStats)
+	router.HandleFunc("/config", app.handleConfig, app.requireViewer)
+	router.HandleFunc("/config/preview", app.handleConfigPreview, app.requireAdmin)
+	router.HandleFunc("/reports", app.handleReports, app.requireViewer)
+	router.HandleFunc("/reports/", app.handleReports, app.requireViewer)
+	router.HandleFunc("/dashboard", app.handleDashboard)
+	router.HandleFunc("/ingest", app.handleIngest)
+	router.HandleFunc("/beacon", app.handleBeacon)
+	router.HandleFunc("/beacon.js", app.handleBeaconScript)
+	router.HandleFunc("/webhook/", app.handleWebhook)
+	router.HandleFunc("/errors", app.handleErrors, app.requireViewer)
+	router.HandleFunc("/events", app.handleEvents, app.requireViewer)
+	router.HandleFunc("/annotations", app.handleAnnotations, app.requireViewer)
+	router.HandleFunc("/annotations/", app.handleAnnotations, app.requireViewer)
+	router.HandleFunc("/ip-tags", app.handleIPTags, app.requireViewer)
+	router.HandleFunc("/ip-tags/", app.handleIPTags, app.requireViewer)
+	router.HandleFunc("/passkeys", app.handlePasskeys)
+	router.HandleFunc("/passkeys/", app.handlePasskeys)
+	router.HandleFunc("/bans", app.handleBans, app.requireAdmin)
+	router.HandleFunc("/bans/", app.handleBans, app.requireAdmin)
+	router.HandleFunc("/bans/import", app.handleBanImport, app.requireAdmin)
+	router.HandleFunc("/bans/export", app.handleBanExport, app.requireAdmin)
+	router.HandleFunc("/share-tokens", app.handleShareTokens, app.requireAdmin)
+	router.HandleFunc("/share-tokens/", app.handleShareTokens, app.requireAdmin)
+	router.HandleFunc("/captures", app.handleCaptures, app.requireAdmin)
+	router.HandleFunc("/captures/", app.handleCaptures, app.requireAdmin)
+	router.HandleFunc("/request-debug", app.handleRequestDebug, app.requireAdmin)
+	router.HandleFunc("/request-debug/", app.handleRequestDebug, app.requireAdmin)
+	router.HandleFunc("/enrich", app.handleEnrich, app.requireAdmin)
+	router.HandleFunc("/archive", app.handleArchive, app.requireAdmin)
+	router.HandleFunc("/archive/", app.handleArchive, app.requireAdmin)
+	router.HandleFunc("/ws-sessions", app.handleWSSessions, app.requireViewer)
+	router.HandleFunc("/maintenance", app.handleMaintenance, app.requireViewer)
+	router.HandleFunc("/maintenance/", app.handleMaintenance, app.requireViewer)
+	router.HandleFunc("/policy/test", app.handlePolicyTest, app.requireViewer)
+	router.Handle("/admin", app.admin, app.refuseShared)
+	router.Handle("/admin/", app.admin, app.refuseShared)
 }
 
 func getEnv(key, fallback string) string {
@@ -129,115 +919,466 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func (app *App) loadProxyConfig(configFile string) error {
-	data, err := os.ReadFile(configFile)
+func getEnvInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		slog.Warn("Invalid integer, using the default", "env", key, "value", value, "default", fallback)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		slog.Warn("Invalid duration, using the default", "env", key, "value", value, "default", fallback)
+	}
+	return fallback
+}
+
+// Route key for a default route that doesn't name a host of its own
+const defaultRouteKey = "*"
+
+// loadProxyConfig fetches the config from app.configSrc and swaps it in if
+// its version differs from last. Returns the version now in effect.
+func (app *App) loadProxyConfig(ctx context.Context, last string) (string, error) {
+	data, version, err := app.configSrc.Fetch(ctx, last)
 	if err != nil {
-		return err
+		return last, err
+	}
+	if version == last {
+		return last, nil
+	}
+	if data, err = expandConfigEnv(data); err != nil {
+		return last, err
 	}
 
 	var configs []ProxyConfig
 	if err := json.Unmarshal(data, &configs); err != nil {
-		return err
+		return last, err
+	}
+	dnsRefresh := getEnvDuration("BACKEND_DNS_REFRESH", 30*time.Second)
+
+	old := app.routes.Load()
+	built := make([]*route, len(configs))
+	for i, cfg := range configs {
+		// Keep unchanged backends, so their connection pools and DNS
+		// lookups carry over
+		rt := old.routes[cfg.routeKey()]
+		// Static routes are cheap to build and always rebuilt, picking up
+		// changed options
+		if rt == nil || rt.backend != cfg.Backend || rt.noTLS != cfg.NoTLS || rt.transportCfg != cfg.Transport || rt.tlsKey != cfg.tlsKey() || rt.static != nil || cfg.Root != "" {
+			if rt, err = app.newRoute(cfg, dnsRefresh); err != nil {
+				slog.Error("Invalid backend", "host", cfg.Host, "err", err)
+				continue
+			}
+		}
+		built[i] = rt
+	}
+	// Probe new backends before any traffic goes their way
+	refused := app.gateRoutes(ctx, configs, built, old)
+
+	table := &routeTable{routes: make(map[string]*route), aliases: make(map[string]string),
+		mirrors: make(map[string]*Mirror), hooks: make(map[string]*responseHooks), assets: make(map[string]*assetPolicy),
+		headerLogs: make(map[string]*headerLog), observed: make(map[string]bool), configs: make(map[string]ProxyConfig),
+		refused: refused}
+	for i, cfg := range configs {
+		rt := built[i]
+		if rt == nil {
+			continue
+		}
+		hostKey := cfg.routeKey()
+
+		if cfg.Default {
+			if table.defaultHost != "" {
+				slog.Warn("Multiple default routes", "host", hostKey, "replaces", table.defaultHost)
+			}
+			table.defaultHost = hostKey
+		}
+		table.routes[hostKey] = rt
+		table.configs[hostKey] = cfg
+		if cfg.Mirror != "" {
+			m := old.mirrors[hostKey]
+			if m == nil || !m.sameAs(cfg) {
+				if m, err = newMirror(cfg, app.mirrorMaxBody); err != nil {
+					slog.Error("Invalid mirror URL", "host", cfg.Host, "err", err)
+				}
+			}
+			if m != nil {
+				table.mirrors[hostKey] = m
+				slog.Info("Mirroring requests", "host", hostKey, "percent", m.percent, "mirror", m.url.Redacted())
+			}
+		}
+		hooks := &responseHooks{etag: cfg.ETag}
+		if len(cfg.Rewrite) > 0 {
+			if rw, err := NewRewriter(cfg.Rewrite); err != nil {
+				slog.Error("Invalid rewrite rules, not rewriting", "host", cfg.Host, "err", err)
+			} else {
+				hooks.rewriter = rw
+				slog.Info("Response rewrite rules", "host", hostKey, "count", len(rw.rules))
+			}
+		}
+		if hooks.rewriter != nil || hooks.etag {
+			table.hooks[hostKey] = hooks
+		}
+		if assets, err := newAssetPolicy(cfg); err != nil {
+			slog.Error("Invalid robots/favicon options, passing them through", "host", cfg.Host, "err", err)
+		} else if assets != nil {
+			table.assets[hostKey] = assets
+		}
+		if hl := newHeaderLog(cfg); hl != nil {
+			table.headerLogs[hostKey] = hl
+		}
+		app.limiter.Configure(hostKey, cfg.MaxConcurrent, cfg.MaxPerClient)
+		if cfg.ObserveLimits {
+			table.observed[hostKey] = true
+		}
+		app.throttler.Configure(hostKey, cfg.BytesPerSec, cfg.BytesPerSecIP)
+		app.maintenance.Configure(hostKey, cfg)
+		for _, alias := range cfg.Aliases {
+			table.aliases[strings.ToLower(alias)] = hostKey
+		}
+		slog.Info("Configured proxy", "host", hostKey, "backend", rt.url.Redacted(), "no_tls", cfg.NoTLS, "default", cfg.Default)
+		if len(cfg.Aliases) > 0 {
+			slog.Info("Host aliases", "host", hostKey, "aliases", strings.Join(cfg.Aliases, ","))
+		}
+		if rt.pool != nil {
+			slog.Info("Backend lookup", "host", hostKey, "kind", rt.pool.kind, "name", rt.pool.name, "targets", rt.pool.Targets())
+		}
 	}
 
-	for _, cfg := range configs {
-		backendURL, err := url.Parse(cfg.Backend)
+	app.routes.Store(table)
+	go app.foldAliases(table.aliases)
+	for host, rt := range old.routes {
+		if rt.pool != nil && table.routes[host] != rt {
+			rt.pool.Stop()
+		}
+	}
+	return version, nil
+}
+
+func (app *App) newRoute(cfg ProxyConfig, dnsRefresh time.Duration) (*route, error) {
+	if cfg.Root == "" && strings.HasPrefix(cfg.Backend, "file://") {
+		cfg.Root = strings.TrimPrefix(cfg.Backend, "file://")
+	}
+	if cfg.Root != "" {
+		site, err := newStaticSite(cfg.Root, cfg.Index, cfg.SPAFallback)
 		if err != nil {
-			log.Printf("Invalid backend URL for %s: %v", cfg.Host, err)
-			continue
+			return nil, err
+		}
+		return &route{backend: cfg.Backend, url: &url.URL{Scheme: "file", Path: cfg.Root}, static: site}, nil
+	}
+
+	backendURL, err := url.Parse(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	pool, backendURL, err := parseDiscoveryBackend(backendURL)
+	if err != nil {
+		return nil, err
+	}
+	if pool != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := pool.Resolve(ctx); err != nil {
+			slog.Warn("Could not resolve backend yet", "host", cfg.Host, "err", err)
 		}
+		cancel()
+		go pool.RefreshLoop(dnsRefresh)
+	}
 
-		proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
 
-		// Customize the director to preserve the original Host header
-		originalDirector := proxy.Director
-		proxy.Director = func(req *http.Request) {
-			originalHost := req.Host // Save original host (e.g., grafana.jbik.net)
-			originalDirector(req)
-			req.Host = originalHost // Restore it after director changes it
+	// Customize the director to preserve the original Host header
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalHost := req.Host // Save original host (e.g., grafana.jbik.net)
+		originalDirector(req)
+		req.Host = originalHost // Restore it after director changes it
+		if pool != nil {
+			req.URL.Host = pool.Pick()
 		}
+	}
+
+	// Record backend failures instead of only logging them
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		backend := (&url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}).String()
+		app.recordProxyError(req, strings.ToLower(strings.Split(req.Host, ":")[0]), backend, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
 
-		// Handle TLS verification
-		if cfg.NoTLS {
-			proxy.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	// Apply the host's rewrite rules and ETags, passed along by handleRequest
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if host := strings.ToLower(strings.Split(resp.Request.Host, ":")[0]); app.backends.set(host, false) {
+			slog.Info("Backend is responding again", "host", host)
+			app.addEvent(Event{Kind: "backend", Host: host, Message: "Backend " + backendURL.Redacted() + " is responding again"})
+		}
+		if hooks, ok := resp.Request.Context().Value(responseHooksKey{}).(*responseHooks); ok {
+			return hooks.modify(resp)
+		}
+		return nil
+	}
+
+	// Each backend gets its own connection pool and TLS settings
+	serverName := ""
+	if pool != nil && pool.kind == "dns" && backendURL.Scheme == "https" {
+		// Dialing resolved IPs; verify the certificate against the name
+		serverName = pool.name
+	}
+	transport, err := newBackendTransport(cfg, serverName)
+	if err != nil {
+		if pool != nil {
+			pool.Stop()
+		}
+		return nil, err
+	}
+	proxy.Transport = transport.http
+
+	return &route{backend: cfg.Backend, url: backendURL, noTLS: cfg.NoTLS, pool: pool, proxy: proxy,
+		transportCfg: cfg.Transport, tlsKey: cfg.tlsKey(), transport: transport}, nil
+}
+
+// watchConfig applies config changes as they appear at the source
+func (app *App) watchConfig(version string, interval time.Duration) {
+	for {
+		// Routes the health gate refused are retried by applying the
+		// config again, their backends may be up by now
+		retry := len(app.routes.Load().refused) > 0
+		if !app.configSrc.Blocking() || retry {
+			time.Sleep(interval)
+		}
+		last := version
+		if retry {
+			last = ""
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		newVersion, err := app.loadProxyConfig(ctx, last)
+		cancel()
+		if err != nil {
+			slog.Error("Reloading proxy config failed, keeping current config", "source", app.configSrc, "err", err)
+			if app.configSrc.Blocking() {
+				time.Sleep(interval)
 			}
+			continue
 		}
+		if newVersion != version {
+			slog.Info("Proxy config reloaded", "source", app.configSrc, "version", newVersion)
+			app.addEvent(Event{Kind: "config", Message: fmt.Sprintf("Proxy config reloaded from %s (version %s)", app.configSrc, newVersion)})
+			if err := app.maintenance.LoadOverrides(); err != nil {
+				slog.Warn("Could not load maintenance state", "err", err)
+			}
+			version = newVersion
+		}
+	}
+}
 
-		hostKey := strings.ToLower(cfg.Host)
-		app.proxies[hostKey] = proxy
-		app.backends[hostKey] = cfg.Backend
-		app.backendURLs[hostKey] = backendURL
-		app.noTLSHosts[hostKey] = cfg.NoTLS
-		log.Printf("Configured proxy: %s -> %s (noTLS: %v)", cfg.Host, cfg.Backend, cfg.NoTLS)
+// lookupRoute finds the route configured for host or one of its aliases,
+// returning its canonical key
+func (app *App) lookupRoute(host string) (string, *route) {
+	table := app.routes.Load()
+	if canonical, ok := table.aliases[host]; ok {
+		host = canonical
 	}
+	return host, table.routes[host]
+}
 
-	return nil
+// hostKey is the host a request is logged under, and the one user and share
+// token scopes name: lower-cased, without the port, an alias folded into its
+// route's host
+func (app *App) hostKey(host string) string {
+	key, _ := app.lookupRoute(store.HostKey(host))
+	return key
 }
 
-func (app *App) initDB() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS connections (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-		client_ip TEXT NOT NULL,
-		country TEXT,
-		method TEXT,
-		path TEXT,
-		host TEXT,
-		user_agent TEXT,
-		referer TEXT
-	);
-	CREATE INDEX IF NOT EXISTS idx_timestamp ON connections(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_client_ip ON connections(client_ip);
-	CREATE INDEX IF NOT EXISTS idx_country ON connections(country);
-	CREATE INDEX IF NOT EXISTS idx_host ON connections(host);
-	`
-	_, err := app.db.Exec(schema)
-	return err
+// hostParam is the host query parameter as a host key, "" when it's unset
+func (app *App) hostParam(query url.Values) string {
+	if host := query.Get("host"); host != "" {
+		return app.hostKey(host)
+	}
+	return ""
 }
 
-func (app *App) extractClientInfo(r *http.Request) ConnectionLog {
-	clientIP := r.Header.Get("CF-Connecting-IP")
-	if clientIP == "" {
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			clientIP = strings.TrimSpace(strings.Split(xff, ",")[0])
-		} else {
-			clientIP = strings.Split(r.RemoteAddr, ":")[0]
+// foldAliases moves connections logged under a name that is now an alias to
+// the route's host, in the main database and the host's partition
+func (app *App) foldAliases(aliases map[string]string) {
+	if app.readOnly {
+		return
+	}
+	for alias, host := range aliases {
+		dbs := []*sql.DB{app.db}
+		if db := app.writerFor(host); db != app.db {
+			dbs = append(dbs, db)
+		}
+		for _, db := range dbs {
+			n, err := store.FoldHost(db, alias, host)
+			if err != nil {
+				slog.Error("Error moving an alias's connections to its host", "alias", alias, "host", host, "err", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("Moved connections logged under an alias to its host", "alias", alias, "host", host, "rows", n)
+			}
 		}
 	}
+}
+
+func (app *App) initDB() error {
+	if err := store.CreateSchema(app.db); err != nil {
+		return err
+	}
+	if err := createErrorsSchema(app.db); err != nil {
+		return err
+	}
+	return createEventsSchema(app.db)
+}
 
-	country := r.Header.Get("CF-IPCountry")
-	if country == "" {
-		country = "XX"
+// readerFor returns the database to query: a loaded archived day when the
+// request asked for one with ?archive=, else the live data. With
+// DB_PARTITION=host, a query about one partitioned host (the host filter,
+// else the user's only host) reads just that host's file and the main
+// database.
+func (app *App) readerFor(r *http.Request, host string) *sql.DB {
+	if db, ok := r.Context().Value(archiveDBKey{}).(*sql.DB); ok {
+		return db
+	}
+	if app.partitions == nil {
+		return app.readDB
+	}
+	if u := requestUser(r); host == "" && u != nil && len(u.Hosts) == 1 {
+		host = u.Hosts[0]
+	}
+	host, rt := app.lookupRoute(strings.ToLower(strings.Split(host, ":")[0]))
+	if rt == nil {
+		return app.readDB
 	}
+	if db := app.partitions.Reader(host); db != nil {
+		return db
+	}
+	return app.readDB
+}
 
-	return ConnectionLog{
+// writerFor returns the database a host's connections are written to
+func (app *App) writerFor(host string) *sql.DB {
+	if app.partitions == nil {
+		return app.db
+	}
+	// Only configured hosts get a partition, so random Host headers from
+	// scanners can't create files
+	host, rt := app.lookupRoute(strings.ToLower(strings.Split(host, ":")[0]))
+	if rt == nil {
+		return app.db
+	}
+	db, err := app.partitions.Get(host)
+	if err == errPartitionsFull {
+		return app.db
+	}
+	if err != nil {
+		slog.Error("Error opening partition, using main database", "host", host, "err", err)
+		return app.db
+	}
+	return db
+}
+
+// countryPattern is what Cloudflare sends in CF-IPCountry: an ISO 3166
+// code, or T1 for Tor
+var countryPattern = regexp.MustCompile(`^([A-Z]{2}|T1)$`)
+
+// countryCode returns code if it looks like a country code, else "XX". The
+// header comes from whoever reaches the proxy, and the dashboard shows it.
+func countryCode(code string) string {
+	code = strings.ToUpper(code)
+	if !countryPattern.MatchString(code) {
+		return "XX"
+	}
+	return code
+}
+
+func (app *App) extractClientInfo(r *http.Request) ConnectionLog {
+	clientIP := app.ipPolicy.ClientIP(r)
+
+	country := countryCode(r.Header.Get("CF-IPCountry"))
+
+	// CF-Visitor is a small JSON object: {"scheme":"https"}
+	var visitor struct {
+		Scheme string `json:"scheme"`
+	}
+	if v := r.Header.Get("CF-Visitor"); v != "" {
+		json.Unmarshal([]byte(v), &visitor)
+	}
+
+	conn := ConnectionLog{
 		Timestamp: time.Now(),
 		ClientIP:  clientIP,
 		Country:   country,
 		Method:    r.Method,
-		Path:      r.URL.Path,
+		Path:      requestPath(r),
 		Host:      r.Host,
 		UserAgent: r.Header.Get("User-Agent"),
 		Referer:   r.Header.Get("Referer"),
+		Category:  app.classifier.Classify(clientIP, r.Header.Get("User-Agent")),
+		ViaCF:     app.ipPolicy.ViaCloudflare(r),
+		Source:    sourceProxy,
+		CFRay:     r.Header.Get("CF-Ray"),
+		CFScheme:  visitor.Scheme,
+		CFWorker:  r.Header.Get("CF-Worker"),
+		// Only sent when the "Add visitor location headers" managed
+		// transform is enabled in the Cloudflare dashboard
+		CFCity:   r.Header.Get("CF-IPCity"),
+		CFRegion: r.Header.Get("CF-Region"),
 	}
+	setTLSInfo(&conn, r)
+	conn.Decision, conn.Rule = decisionOf(r)
+	app.campaigns.Set(&conn, r.URL.RawQuery)
+	return conn
+}
+
+const insertConnectionSQL = `
+	INSERT INTO connections (timestamp, client_ip, country, method, path, host, user_agent, referer, category, via_cloudflare, source, seq,
+		cf_ray, cf_visitor_scheme, cf_worker, cf_city, cf_region, headers, tls_version, tls_cipher, tls_sni, tls_alpn, tls_ja3, unmatched, network,
+		decision, rule, utm_source, utm_medium, utm_campaign)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// connectionArgs lists conn's values in insertConnectionSQL's column order
+func connectionArgs(conn ConnectionLog) []interface{} {
+	return []interface{}{store.FormatTime(conn.Timestamp), conn.ClientIP, conn.Country, conn.Method, conn.Path, conn.Host, conn.UserAgent, conn.Referer, conn.Category, conn.ViaCF, conn.Source, conn.Seq,
+		conn.CFRay, conn.CFScheme, conn.CFWorker, conn.CFCity, conn.CFRegion, encodeHeaders(conn.Headers),
+		conn.TLSVersion, conn.TLSCipher, conn.TLSServerName, conn.TLSALPN, conn.TLSJA3, conn.Unmatched, conn.Network,
+		conn.Decision, conn.Rule, conn.UTMSource, conn.UTMMedium, conn.UTMCampaign}
 }
 
 func (app *App) logConnection(conn ConnectionLog) error {
-	// Log to database - store timestamp as formatted string
-	_, err := app.db.Exec(`
-		INSERT INTO connections (timestamp, client_ip, country, method, path, host, user_agent, referer)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		conn.Timestamp.Format("2006-01-02 15:04:05"), conn.ClientIP, conn.Country, conn.Method, conn.Path, conn.Host, conn.UserAgent, conn.Referer)
-	if err != nil {
-		return err
+	if app.readOnly {
+		return nil
+	}
+	conn.Host = app.hostKey(conn.Host)
+	if conn.Seq == "" {
+		conn.Seq = app.seqGen.New(conn.Timestamp)
+	}
+	if conn.Network == "" {
+		conn.Network = app.networks.Label(conn.ClientIP)
+	}
+	db := app.writerFor(conn.Host)
+	if app.dedupWindow > 0 && app.suppressDuplicate(db, conn) {
+		return nil
+	}
+	if !app.ownTraffic.Hidden(conn) {
+		app.live.Record(conn.ClientIP, conn.Host, conn.Timestamp)
+		if conn.Category == categoryVisitor {
+			app.active.Record(conn.ClientIP, conn.Host, conn.Timestamp)
+		}
 	}
 
-	// Log to file
-	app.logMutex.Lock()
-	defer app.logMutex.Unlock()
+	// Log to database - store timestamp as a UTC string
+	if _, err := db.Exec(insertConnectionSQL, connectionArgs(conn)...); err != nil {
+		return err
+	}
+	if app.enricher != nil {
+		app.enricher.Enqueue(conn.ClientIP)
+	}
 
+	// Log to file (buffered, never blocks the request)
 	logLine := fmt.Sprintf("%s | %s | %s | %s %s | %s | %s\n",
 		conn.Timestamp.Format("2006-01-02 15:04:05"),
 		conn.ClientIP,
@@ -247,33 +1388,145 @@ func (app *App) logConnection(conn ConnectionLog) error {
 		conn.Host,
 		conn.UserAgent)
 
-	_, err = app.logFile.WriteString(logLine)
-	return err
+	app.fileLog.Write(logLine)
+	return nil
 }
 
 // Main request handler - routes to proxy or dashboard
 func (app *App) handleRequest(w http.ResponseWriter, r *http.Request) {
-	host := strings.ToLower(strings.Split(r.Host, ":")[0])
+	host, rt := app.lookupRoute(strings.ToLower(strings.Split(r.Host, ":")[0]))
+	unmatched := rt == nil
+
+	// Unknown hosts go to the default route, if one is configured; Host
+	// headers that aren't a hostname at all don't
+	if rt == nil && validHostname(r.Host) {
+		host, rt = app.lookupRoute(app.routes.Load().defaultHost)
+	}
+	var assets *assetPolicy
+	var headers *headerLog
+	if rt != nil {
+		assets = app.routes.Load().assets[host]
+		headers = app.routes.Load().headerLogs[host]
+	}
 
 	// Log the connection
 	conn := app.extractClientInfo(r)
-	if err := app.logConnection(conn); err != nil {
-		log.Printf("Error logging connection: %v", err)
+	conn.Headers = headers.Extract(r)
+	conn.Unmatched = unmatched
+	// Set now so the concurrency caps below can mark the row
+	conn.Seq = app.seqGen.New(conn.Timestamp)
+	if rt == nil && conn.Decision == "" {
+		if verdict, _ := app.unknownHosts.Verdict(); verdict != "" {
+			conn.Decision, conn.Rule = decisionBlocked, ruleUnknownHost
+		}
+	}
+	if !assets.Quiet(r.URL.Path) {
+		if err := app.logConnection(conn); err != nil {
+			slog.Error("Error logging connection", "err", err)
+		}
+		requestLog.Info("Request", "client_ip", conn.ClientIP, "country", conn.Country, "host", conn.Host, "method", conn.Method, "path", conn.Path)
 	}
-	log.Printf("%s (%s) -> %s %s %s", conn.ClientIP, conn.Country, conn.Host, conn.Method, conn.Path)
 
 	// Check if we have a proxy for this host
-	if _, ok := app.proxies[host]; ok {
+	if rt != nil {
+		// robots.txt and favicon answered here, even during maintenance
+		if assets.Serve(w, r) {
+			return
+		}
+
+		// Serve the maintenance page instead of forwarding
+		if st, on := app.maintenance.Get(host); on {
+			app.maintenance.Serve(w, host, st)
+			return
+		}
+
 		// Check if this is a WebSocket upgrade request
-		if isWebSocketRequest(r) {
-			app.handleWebSocket(w, r, host)
+		if isWebSocketRequest(r) && rt.static == nil {
+			app.handleWebSocket(w, r, rt, conn.ClientIP)
 			return
 		}
-		app.proxies[host].ServeHTTP(w, r)
+
+		// Concurrency caps (WebSocket tunnels are long-lived and not counted)
+		observeLimits := app.dryRun || app.routes.Load().observed[host]
+		if app.limiter.AcquireClient(host, conn.ClientIP) {
+			defer app.limiter.ReleaseClient(host, conn.ClientIP)
+		} else if observeLimits {
+			app.observe("client_concurrency", conn.ClientIP, r, ruleClientConcurrency)
+			app.recordDecision(conn, decisionObserved, ruleClientConcurrency)
+		} else {
+			app.recordDecision(conn, decisionRateLimited, ruleClientConcurrency)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		if app.limiter.AcquireBackend(host) {
+			defer app.limiter.ReleaseBackend(host)
+		} else if observeLimits {
+			app.observe("backend_concurrency", conn.ClientIP, r, ruleBackendConcurrency)
+			app.recordDecision(conn, decisionObserved, ruleBackendConcurrency)
+		} else {
+			app.recordDecision(conn, decisionRateLimited, ruleBackendConcurrency)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Backend busy", http.StatusServiceUnavailable)
+			return
+		}
+
+		span := app.tracer.Start(r, r.Method+" "+host)
+		span.SetString("http.request.method", r.Method)
+		span.SetString("server.address", host)
+		span.SetString("url.path", r.URL.Path)
+		span.SetString("client.address", conn.ClientIP)
+		span.SetString("client.geo.country_iso_code", conn.Country)
+		span.SetString("cf.backend", rt.url.Redacted())
+
+		var capture *Capture
+		if app.capturer != nil && app.capturer.Wants(host) {
+			capture = app.capturer.Begin(r, conn.ClientIP)
+		}
+		if m := app.routes.Load().mirrors[host]; m != nil {
+			m.Send(r)
+		}
+		if hooks := app.routes.Load().hooks[host]; hooks != nil {
+			r = r.WithContext(context.WithValue(r.Context(), responseHooksKey{}, hooks))
+			if hooks.rewriter != nil {
+				// Rewriting needs the body as plain text; Cloudflare still
+				// compresses it for the visitor
+				r.Header.Del("Accept-Encoding")
+			}
+		}
+
+		rec := newStatusRecorder(app.throttler.Wrap(w, r, host, conn.ClientIP))
+		if rt.static != nil {
+			rt.static.ServeHTTP(rec, r)
+		} else {
+			var timing *requestTiming
+			if app.reqDebug.Wants(host) {
+				timing = newRequestTiming()
+				r = r.WithContext(httptrace.WithClientTrace(r.Context(), timing.clientTrace()))
+			}
+			start := time.Now()
+			rt.proxy.ServeHTTP(rec, r)
+			app.latency.Observe(host, rec.Status(), time.Since(start))
+			if timing != nil {
+				app.reqDebug.Log(host, r, timing, rec.Status(), rec.Header())
+			}
+		}
+		app.uptime.Record(host, rec.Status())
+		if capture != nil {
+			if err := app.capturer.Save(capture, rec.Status()); err != nil {
+				slog.Error("Error saving capture", "err", err)
+			}
+		}
+
+		span.SetInt("http.response.status_code", rec.Status())
+		span.End(rec.Status())
 		return
 	}
 
-	// No proxy configured - show dashboard or IP info
+	// No proxy configured - refuse, or show dashboard or IP info
+	if app.unknownHosts.Serve(w, r) {
+		return
+	}
 	if r.URL.Path == "/" || r.URL.Path == "/dashboard" {
 		app.handleDashboard(w, r)
 		return
@@ -288,32 +1541,18 @@ func isWebSocketRequest(r *http.Request) bool {
 	return strings.ToLower(r.Header.Get("Upgrade")) == "websocket"
 }
 
-func (app *App) handleWebSocket(w http.ResponseWriter, r *http.Request, host string) {
-	backendURL := app.backendURLs[host]
-	if backendURL == nil {
-		http.Error(w, "Backend not found", http.StatusBadGateway)
-		return
-	}
-
+func (app *App) handleWebSocket(w http.ResponseWriter, r *http.Request, rt *route, clientIP string) {
 	// Determine backend address
-	backendHost := backendURL.Host
-	scheme := backendURL.Scheme
-
-	// Dial the backend
-	var backendConn net.Conn
-	var err error
-
-	if scheme == "https" {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: app.noTLSHosts[host],
-		}
-		backendConn, err = tls.Dial("tcp", backendHost, tlsConfig)
-	} else {
-		backendConn, err = net.Dial("tcp", backendHost)
+	backendHost := rt.url.Host
+	scheme := rt.url.Scheme
+	if pool := rt.pool; pool != nil {
+		backendHost = pool.Pick()
 	}
 
+	// Dial the backend with the route's source address and TLS settings
+	backendConn, err := rt.transport.dial(scheme, backendHost)
 	if err != nil {
-		log.Printf("WebSocket backend dial error: %v", err)
+		app.recordProxyError(r, strings.ToLower(strings.Split(r.Host, ":")[0]), scheme+"://"+backendHost, err)
 		http.Error(w, "Backend connection failed", http.StatusBadGateway)
 		return
 	}
@@ -328,11 +1567,21 @@ func (app *App) handleWebSocket(w http.ResponseWriter, r *http.Request, host str
 
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
-		log.Printf("Hijack error: %v", err)
+		slog.Error("Hijack error", "err", err)
 		http.Error(w, "Hijack failed", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
+	app.tunnels.Add(1)
+	app.openTunnels.Add(1)
+	defer app.tunnels.Done()
+	defer app.openTunnels.Add(-1)
+	session := app.wsSessions.Start(strings.ToLower(strings.Split(r.Host, ":")[0]), clientIP, r.URL.Path, scheme+"://"+backendHost)
+	defer app.wsSessions.End(session)
+
+	// The server's read/write timeouts still apply to the hijacked conn;
+	// clear them so long-lived WebSocket sessions aren't cut off
+	clientConn.SetDeadline(time.Time{})
 
 	// Forward the original request to the backend
 	// Keep original Host header, just change the URL
@@ -345,43 +1594,45 @@ func (app *App) handleWebSocket(w http.ResponseWriter, r *http.Request, host str
 	done := make(chan struct{})
 
 	go func() {
-		io.Copy(backendConn, clientConn)
+		io.Copy(countingWriter{backendConn, &session.fromClient}, clientConn)
 		done <- struct{}{}
 	}()
 
 	go func() {
-		io.Copy(clientConn, backendConn)
+		io.Copy(countingWriter{clientConn, &session.toClient}, backendConn)
 		done <- struct{}{}
 	}()
 
 	<-done
 }
 
-// GET /_proxy/connections?limit=100&offset=0&ip=x.x.x.x&country=US&since=2024-01-01&host=example.com
+// GET /_proxy/connections?limit=100&offset=0&ip=x.x.x.x&country=US&since=24h&until=2024-01-02&host=example.com&category=visitor&via_cloudflare=true&source=proxy&ray=8a1b2c3d4e5f6789-AMS&unmatched=true&network=none&decision=blocked&rule=ban:&utm_source=newsletter&tz=Europe/Berlin
 func (app *App) handleConnections(w http.ResponseWriter, r *http.Request) {
-	// Log this request too
-	conn := app.extractClientInfo(r)
-	app.logConnection(conn)
-
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	query := r.URL.Query()
-	limit, _ := strconv.Atoi(query.Get("limit"))
-	if limit <= 0 || limit > 1000 {
-		limit = 100
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	limit := exportLimit(r, format, 100, 1000)
 	offset, _ := strconv.Atoi(query.Get("offset"))
 
 	filterIP := query.Get("ip")
 	filterCountry := query.Get("country")
 	filterHost := query.Get("host")
-	since := query.Get("since")
+	filterCategory := query.Get("category")
 
-	sqlQuery := `SELECT id, timestamp, client_ip, country, method, path, host, user_agent, referer 
-		FROM connections WHERE 1=1`
+	sqlQuery := "SELECT " + connectionColumns + " FROM connections WHERE 1=1"
 	args := []interface{}{}
 
 	if filterIP != "" {
@@ -392,19 +1643,73 @@ func (app *App) handleConnections(w http.ResponseWriter, r *http.Request) {
 		sqlQuery += " AND country = ?"
 		args = append(args, filterCountry)
 	}
+	readHost := ""
 	if filterHost != "" {
-		sqlQuery += " AND host LIKE ?"
-		args = append(args, "%"+filterHost+"%")
+		// A configured host or alias is matched exactly, anything else as a
+		// substring
+		if key, rt := app.lookupRoute(store.HostKey(filterHost)); rt != nil {
+			sqlQuery += " AND host = ?"
+			args = append(args, key)
+			readHost = key
+		} else {
+			sqlQuery += " AND host LIKE ?"
+			args = append(args, "%"+filterHost+"%")
+		}
 	}
-	if since != "" {
-		sqlQuery += " AND timestamp >= ?"
-		args = append(args, since)
+	if filterCategory != "" {
+		sqlQuery += " AND category = ?"
+		args = append(args, filterCategory)
 	}
-
-	sqlQuery += " ORDER BY timestamp DESC LIMIT ? OFFSET ?"
+	if path := query.Get("path"); path != "" {
+		sqlQuery += " AND path = ?"
+		args = append(args, path)
+	}
+	if ray := query.Get("ray"); ray != "" {
+		sqlQuery += " AND cf_ray = ?"
+		args = append(args, ray)
+	}
+	if ja3 := query.Get("ja3"); ja3 != "" {
+		sqlQuery += " AND tls_ja3 = ?"
+		args = append(args, ja3)
+	}
+	if source := query.Get("source"); source != "" {
+		sqlQuery += " AND source = ?"
+		args = append(args, source)
+	}
+	if via := query.Get("via_cloudflare"); via != "" {
+		sqlQuery += " AND via_cloudflare = ?"
+		args = append(args, via == "true" || via == "1")
+	}
+	if unmatched := query.Get("unmatched"); unmatched != "" {
+		sqlQuery += " AND unmatched = ?"
+		args = append(args, unmatched == "true" || unmatched == "1")
+	}
+	networkCond, networkArgs := networkFilter(query)
+	sqlQuery += networkCond
+	args = append(args, networkArgs...)
+	decisionCond, decisionArgs := decisionFilter(query)
+	sqlQuery += decisionCond
+	args = append(args, decisionArgs...)
+	utmCond, utmArgs := campaignFilter(query)
+	sqlQuery += utmCond
+	args = append(args, utmArgs...)
+	rangeCond, rangeArgs, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sqlQuery += rangeCond
+	args = append(args, rangeArgs...)
+	scopeCond, scopeArgs := hostScope(r, "host")
+	sqlQuery += scopeCond
+	args = append(args, scopeArgs...)
+
+	// seq is time-ordered to the millisecond and monotonic per writer, so rows
+	// from different sources sharing a second still come back in a stable order
+	sqlQuery += " ORDER BY seq DESC LIMIT ? OFFSET ?"
 	args = append(args, limit, offset)
 
-	rows, err := app.db.Query(sqlQuery, args...)
+	rows, err := app.readerFor(r, readHost).Query(sqlQuery, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -413,106 +1718,287 @@ func (app *App) handleConnections(w http.ResponseWriter, r *http.Request) {
 
 	var connections []ConnectionLog
 	for rows.Next() {
-		var c ConnectionLog
-		err := rows.Scan(&c.ID, &c.TimestampStr, &c.ClientIP, &c.Country, &c.Method, &c.Path, &c.Host, &c.UserAgent, &c.Referer)
+		c, err := app.scanConnection(rows, loc)
 		if err != nil {
 			continue
 		}
 		connections = append(connections, c)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(connections)
+	writeList(w, format, "connections", connections)
 }
 
-// GET /_proxy/stats?since=2024-01-01
+// GET /_proxy/stats?since=7d&until=2024-01-02&category=visitor&host_limit=20&ipv6_prefix=64&network=none&tz=Europe/Berlin
+//
+// Monitoring-agent hits are excluded unless category=monitoring (or all) is
+// given. since/until apply to every figure in the response. ipv6_prefix and
+// ipv4_prefix count and list clients by prefix instead of by address. With
+// format=csv or ndjson only one list is returned: table=top_ips (default),
+// top_hosts or top_countries.
 func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
-	// Log this request too
-	conn := app.extractClientInfo(r)
-	app.logConnection(conn)
-
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	since := r.URL.Query().Get("since")
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeCond, rangeArgs, err := timeRange(r.URL.Query(), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	table := r.URL.Query().Get("table")
+	if table != "" && table != "top_ips" && table != "top_hosts" && table != "top_countries" {
+		http.Error(w, "table must be top_ips, top_hosts or top_countries", http.StatusBadRequest)
+		return
+	}
+	// Exports aren't cut at the dashboard's top 100 IPs, 20 hosts and 50
+	// countries
+	ipLimit, hostLimit, countryLimit := 100, 20, 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("host_limit")); err == nil && l > 0 && l <= 1000 {
+		hostLimit = l
+	}
+	group, err := parseIPGrouping(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format != "" {
+		ipLimit = exportLimit(r, format, 0, 0)
+		hostLimit, countryLimit = ipLimit, ipLimit
+	}
+	host := app.hostParam(r.URL.Query())
+	if host != "" {
+		rangeCond += " AND host = ?"
+		rangeArgs = append(rangeArgs, host)
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	rangeCond += scopeCond
+	rangeArgs = append(rangeArgs, scopeArgs...)
+	networkCond, networkArgs := networkFilter(r.URL.Query())
+	rangeCond += networkCond
+	rangeArgs = append(rangeArgs, networkArgs...)
+	ownCond, ownArgs, err := app.ownTraffic.Filter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeCond += ownCond
+	rangeArgs = append(rangeArgs, ownArgs...)
+	category := r.URL.Query().Get("category")
+	if category == "" {
+		category = categoryVisitor
+	}
 
-	sqlQuery := `SELECT client_ip, country, COUNT(*) as hit_count, 
-		MIN(timestamp) as first_seen, MAX(timestamp) as last_seen 
-		FROM connections`
-	args := []interface{}{}
+	readDB := app.readerFor(r, host)
+	categoryWhere := " WHERE category = ?" + rangeCond
+	categoryArgs := append([]interface{}{category}, rangeArgs...)
+	if category == "all" {
+		categoryWhere = " WHERE 1=1" + rangeCond
+		categoryArgs = rangeArgs
+	}
 
-	if since != "" {
-		sqlQuery += " WHERE timestamp >= ?"
-		args = append(args, since)
+	var stats []IPStats
+	if group.Enabled() {
+		stats, err = group.topPrefixes(readDB, categoryWhere, categoryArgs, ipLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		sqlQuery := `SELECT client_ip, country, COUNT(*) as hit_count,
+		MIN(timestamp) as first_seen, MAX(timestamp) as last_seen
+		FROM connections` + categoryWhere
+		args := append([]interface{}{}, categoryArgs...)
+
+		sqlQuery += " GROUP BY client_ip ORDER BY hit_count DESC LIMIT ?"
+		args = append(args, ipLimit)
+
+		rows, err := readDB.Query(sqlQuery, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var s IPStats
+			err := rows.Scan(&s.ClientIP, &s.Country, &s.HitCount, &s.FirstSeen, &s.LastSeen)
+			if err != nil {
+				continue
+			}
+			stats = append(stats, s)
+		}
+	}
+	for i := range stats {
+		s := &stats[i]
+		s.FirstSeen = formatStoredTime(s.FirstSeen, loc)
+		s.LastSeen = formatStoredTime(s.LastSeen, loc)
+		s.Tag = app.ipTags.TagOf(s.ClientIP)
 	}
 
-	sqlQuery += " GROUP BY client_ip ORDER BY hit_count DESC LIMIT 100"
+	// Get totals; XX and rows without a country (cf-log-parser) aren't a
+	// country
+	var totalConnections int
+	var uniqueIPs, uniqueHosts, uniqueCountries int
+	readDB.QueryRow("SELECT COUNT(*), COUNT(DISTINCT client_ip), COUNT(DISTINCT host), COUNT(DISTINCT CASE WHEN country NOT IN ('', 'XX') THEN country END) FROM connections"+categoryWhere,
+		categoryArgs...).Scan(&totalConnections, &uniqueIPs, &uniqueHosts, &uniqueCountries)
+
+	// Monitoring agents get their own aggregate
+	var monitoringHits, monitoringIPs int
+	readDB.QueryRow("SELECT COUNT(*), COUNT(DISTINCT client_ip) FROM connections WHERE category = ?"+rangeCond,
+		append([]interface{}{categoryMonitoring}, rangeArgs...)...).Scan(&monitoringHits, &monitoringIPs)
+
+	// Get host stats, busiest first
+	hostRows, err := readDB.Query("SELECT COALESCE(host, ''), COUNT(*) AS hits, COUNT(DISTINCT client_ip) FROM connections"+categoryWhere+
+		" GROUP BY COALESCE(host, '') ORDER BY hits DESC, 1 LIMIT ?", append(categoryArgs, hostLimit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer hostRows.Close()
+	hostList := []HostStats{}
+	for hostRows.Next() {
+		var h HostStats
+		if hostRows.Scan(&h.Host, &h.Hits, &h.UniqueIPs) == nil {
+			hostList = append(hostList, h)
+		}
+	}
 
-	rows, err := app.db.Query(sqlQuery, args...)
+	// Get country stats over the whole range, not just the top IPs
+	countryRows, err := readDB.Query("SELECT COALESCE(country, ''), COUNT(*) AS hits, COUNT(DISTINCT client_ip) FROM connections"+categoryWhere+
+		" GROUP BY COALESCE(country, '') ORDER BY hits DESC LIMIT ?", append(categoryArgs, countryLimit)...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	defer countryRows.Close()
+	countryList := []CountryStats{}
+	for countryRows.Next() {
+		var c CountryStats
+		if countryRows.Scan(&c.Country, &c.Hits, &c.UniqueIPs) == nil {
+			countryList = append(countryList, c)
+		}
+	}
 
-	var stats []IPStats
-	for rows.Next() {
-		var s IPStats
-		err := rows.Scan(&s.ClientIP, &s.Country, &s.HitCount, &s.FirstSeen, &s.LastSeen)
+	// Recount the unique IPs by prefix
+	if group.Enabled() {
+		pairs := " client_ip FROM connections" + categoryWhere + " GROUP BY 1, 2"
+		total, err := group.countDistinct(readDB, "SELECT '',"+pairs, categoryArgs...)
+		if err == nil {
+			uniqueIPs = total[""]
+			total, err = group.countDistinct(readDB, "SELECT '', client_ip FROM connections WHERE category = ?"+rangeCond+" GROUP BY 1, 2",
+				append([]interface{}{categoryMonitoring}, rangeArgs...)...)
+			monitoringIPs = total[""]
+		}
+		var byHost, byCountry map[string]int
+		if err == nil {
+			byHost, err = group.countDistinct(readDB, "SELECT COALESCE(host, ''),"+pairs, categoryArgs...)
+		}
+		if err == nil {
+			byCountry, err = group.countDistinct(readDB, "SELECT COALESCE(country, ''),"+pairs, categoryArgs...)
+		}
 		if err != nil {
-			continue
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range hostList {
+			hostList[i].UniqueIPs = byHost[hostList[i].Host]
+		}
+		for i := range countryList {
+			countryList[i].UniqueIPs = byCountry[countryList[i].Country]
 		}
-		stats = append(stats, s)
 	}
 
-	// Get totals
-	var totalConnections int
-	var uniqueIPs int
-	app.db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT client_ip) FROM connections").Scan(&totalConnections, &uniqueIPs)
-
-	// Get host stats
-	hostRows, _ := app.db.Query("SELECT host, COUNT(*) as hits FROM connections GROUP BY host ORDER BY hits DESC LIMIT 20")
-	defer hostRows.Close()
+	if table == "top_hosts" {
+		writeList(w, format, "top-hosts", hostList)
+		return
+	}
+	if table == "top_countries" {
+		writeList(w, format, "top-countries", countryList)
+		return
+	}
+	if format != "" {
+		writeList(w, format, "top-ips", stats)
+		return
+	}
 
-	hostStats := make(map[string]int)
-	for hostRows.Next() {
-		var host string
-		var hits int
-		hostRows.Scan(&host, &hits)
-		hostStats[host] = hits
+	// Reads vs writes on each of the top hosts
+	methods, err := hostMethodStats(readDB, hostList, categoryWhere, categoryArgs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	response := map[string]interface{}{
 		"total_connections": totalConnections,
 		"unique_ips":        uniqueIPs,
 		"top_ips":           stats,
-		"top_hosts":         hostStats,
+		"unique_hosts":      uniqueHosts,
+		"top_hosts":         hostList,
+		"unique_countries":  uniqueCountries,
+		"top_countries":     countryList,
+		"methods":           methods,
+		"category":          category,
+		"ip_grouping":       group,
+		"own_excluded":      ownCond != "",
+		"monitoring": map[string]int{
+			"total_connections": monitoringHits,
+			"unique_ips":        monitoringIPs,
+		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// GET /_proxy/stats/ip/{ip}
+// GET /_proxy/stats/ip/{ip}?since=30d
 func (app *App) handleIPStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	ip := strings.TrimPrefix(r.URL.Path, "/_proxy/stats/ip/")
+	ip := strings.TrimPrefix(r.URL.Path, "/stats/ip/")
 	if ip == "" {
 		http.Error(w, "IP required", http.StatusBadRequest)
 		return
 	}
 
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeCond, rangeArgs, err := timeRange(r.URL.Query(), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := app.hostParam(r.URL.Query())
+	if host != "" {
+		rangeCond += " AND host = ?"
+		rangeArgs = append(rangeArgs, host)
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	rangeCond += scopeCond
+	args := append(append([]interface{}{ip}, rangeArgs...), scopeArgs...)
+	readDB := app.readerFor(r, host)
+
 	var stats IPStats
-	err := app.db.QueryRow(`
+	err = readDB.QueryRow(`
 		SELECT client_ip, country, COUNT(*) as hit_count, 
 		MIN(timestamp) as first_seen, MAX(timestamp) as last_seen 
-		FROM connections WHERE client_ip = ? GROUP BY client_ip`, ip).
+		FROM connections WHERE client_ip = ?`+rangeCond+` GROUP BY client_ip`, args...).
 		Scan(&stats.ClientIP, &stats.Country, &stats.HitCount, &stats.FirstSeen, &stats.LastSeen)
 
 	if err == sql.ErrNoRows {
@@ -522,9 +2008,12 @@ func (app *App) handleIPStats(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	stats.FirstSeen = formatStoredTime(stats.FirstSeen, loc)
+	stats.LastSeen = formatStoredTime(stats.LastSeen, loc)
+	stats.Tag = app.ipTags.TagOf(ip)
 
 	// Get recent paths
-	rows, _ := app.db.Query(`SELECT DISTINCT path, host FROM connections WHERE client_ip = ? ORDER BY timestamp DESC LIMIT 20`, ip)
+	rows, _ := readDB.Query(`SELECT DISTINCT path, host FROM connections WHERE client_ip = ?`+rangeCond+` ORDER BY timestamp DESC LIMIT 20`, args...)
 	defer rows.Close()
 
 	type PathHost struct {
@@ -542,6 +2031,12 @@ func (app *App) handleIPStats(w http.ResponseWriter, r *http.Request) {
 		"stats":        stats,
 		"recent_paths": paths,
 	}
+	if info := lookupIPInfo(app.db, ip); info != nil {
+		response["info"] = info
+	}
+	if tag, ok := app.ipTags.Get(ip); ok {
+		response["tag"] = tag
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -549,144 +2044,51 @@ func (app *App) handleIPStats(w http.ResponseWriter, r *http.Request) {
 
 // GET /_proxy/health
 func (app *App) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := map[string]interface{}{
+		"status":            "ok",
+		"file_log":          app.fileLog.Stats(),
+		"cloudflare_ranges": app.cfRanges.Info(),
+		"read_only":         app.readOnly,
+	}
+	if app.replicator != nil {
+		health["replication"] = app.replicator.Info()
+	}
+	if app.diskGuard != nil {
+		health["disk"] = app.diskGuard.Info()
+		if app.diskGuard.Emergency() {
+			health["status"] = "degraded"
+		}
+	}
+	if app.retention != nil {
+		health["retention"] = app.retention.Info()
+	}
+	if app.healthGate.mode != healthGateOff {
+		health["config_gate"] = app.healthGate.Info()
+	}
+	if app.tunnel != nil {
+		health["tunnel"] = app.tunnel.Info()
+		if app.tunnel.Down() {
+			health["status"] = "degraded"
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(health)
 }
 
 // GET /_proxy/config - show current proxy configuration
 func (app *App) handleConfig(w http.ResponseWriter, r *http.Request) {
+	backends := make(map[string]string)
+	user := requestUser(r)
+	for host, rt := range app.routes.Load().routes {
+		if user.CanSee(host) {
+			backends[host] = rt.url.Redacted()
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(app.backends)
+	json.NewEncoder(w).Encode(backends)
 }
 
 // GET / - Dashboard
 func (app *App) handleDashboard(w http.ResponseWriter, r *http.Request) {
-	html := `<!DOCTYPE html>
-<html>
-<head>
-    <title>CF IP Logger Dashboard</title>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <style>
-        * { box-sizing: border-box; }
-        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; margin: 0; padding: 20px; background: #1a1a2e; color: #eee; }
-        h1 { color: #00d4ff; margin-bottom: 20px; }
-        .stats-grid { display: grid; grid-template-columns: repeat(auto-fit, minmax(200px, 1fr)); gap: 20px; margin-bottom: 30px; }
-        .stat-card { background: #16213e; padding: 20px; border-radius: 10px; text-align: center; }
-        .stat-value { font-size: 2.5em; font-weight: bold; color: #00d4ff; }
-        .stat-label { color: #888; margin-top: 5px; }
-        table { width: 100%; border-collapse: collapse; background: #16213e; border-radius: 10px; overflow: hidden; }
-        th, td { padding: 12px 15px; text-align: left; border-bottom: 1px solid #0f3460; }
-        th { background: #0f3460; color: #00d4ff; }
-        tr:hover { background: #1a1a4e; }
-        .refresh-btn { background: #00d4ff; color: #1a1a2e; border: none; padding: 10px 20px; border-radius: 5px; cursor: pointer; margin-bottom: 20px; }
-        .refresh-btn:hover { background: #00a8cc; }
-        .country-flag { margin-right: 8px; }
-        .section { margin-bottom: 30px; }
-        h2 { color: #00d4ff; border-bottom: 2px solid #0f3460; padding-bottom: 10px; }
-        .host-tag { background: #0f3460; padding: 2px 8px; border-radius: 4px; font-size: 0.85em; }
-    </style>
-</head>
-<body>
-    <h1>🌐 CF IP Logger Dashboard</h1>
-    <button class="refresh-btn" onclick="loadData()">↻ Refresh</button>
-    
-    <div class="stats-grid">
-        <div class="stat-card">
-            <div class="stat-value" id="total-connections">-</div>
-            <div class="stat-label">Total Connections</div>
-        </div>
-        <div class="stat-card">
-            <div class="stat-value" id="unique-ips">-</div>
-            <div class="stat-label">Unique IPs</div>
-        </div>
-        <div class="stat-card">
-            <div class="stat-value" id="countries">-</div>
-            <div class="stat-label">Countries</div>
-        </div>
-        <div class="stat-card">
-            <div class="stat-value" id="hosts">-</div>
-            <div class="stat-label">Services</div>
-        </div>
-    </div>
-
-    <div class="section">
-        <h2>Top IPs</h2>
-        <table>
-            <thead><tr><th>IP Address</th><th>Country</th><th>Hits</th><th>First Seen</th><th>Last Seen</th></tr></thead>
-            <tbody id="top-ips"></tbody>
-        </table>
-    </div>
-
-    <div class="section">
-        <h2>Top Services</h2>
-        <table>
-            <thead><tr><th>Host</th><th>Hits</th></tr></thead>
-            <tbody id="top-hosts"></tbody>
-        </table>
-    </div>
-
-    <div class="section">
-        <h2>Recent Connections</h2>
-        <table>
-            <thead><tr><th>Time</th><th>IP</th><th>Country</th><th>Host</th><th>Method</th><th>Path</th></tr></thead>
-            <tbody id="recent-connections"></tbody>
-        </table>
-    </div>
-
-    <script>
-        function countryFlag(code) {
-            if (!code || code === 'XX') return '🌍';
-            return code.toUpperCase().replace(/./g, c => String.fromCodePoint(127397 + c.charCodeAt()));
-        }
-
-        async function loadData() {
-            try {
-                const [statsRes, connectionsRes] = await Promise.all([
-                    fetch('/_proxy/stats'),
-                    fetch('/_proxy/connections?limit=50')
-                ]);
-                
-                const stats = await statsRes.json();
-                const connections = await connectionsRes.json();
-
-                document.getElementById('total-connections').textContent = stats.total_connections.toLocaleString();
-                document.getElementById('unique-ips').textContent = stats.unique_ips.toLocaleString();
-                
-                const countries = new Set(stats.top_ips?.map(s => s.country) || []);
-                document.getElementById('countries').textContent = countries.size;
-
-                const hostCount = Object.keys(stats.top_hosts || {}).length;
-                document.getElementById('hosts').textContent = hostCount;
-
-                const topIpsHtml = (stats.top_ips || []).slice(0, 20).map(ip => 
-                    '<tr><td>' + ip.client_ip + '</td><td>' + countryFlag(ip.country) + ' ' + ip.country + 
-                    '</td><td>' + ip.hit_count + '</td><td>' + ip.first_seen + '</td><td>' + ip.last_seen + '</td></tr>'
-                ).join('');
-                document.getElementById('top-ips').innerHTML = topIpsHtml || '<tr><td colspan="5">No data</td></tr>';
-
-                const topHostsHtml = Object.entries(stats.top_hosts || {}).map(([host, hits]) =>
-                    '<tr><td><span class="host-tag">' + host + '</span></td><td>' + hits + '</td></tr>'
-                ).join('');
-                document.getElementById('top-hosts').innerHTML = topHostsHtml || '<tr><td colspan="2">No data</td></tr>';
-
-                const connectionsHtml = (connections || []).map(c => 
-                    '<tr><td>' + c.timestamp + '</td><td>' + c.client_ip + 
-                    '</td><td>' + countryFlag(c.country) + ' ' + c.country + '</td><td><span class="host-tag">' + (c.host || '-') + '</span>' +
-                    '</td><td>' + c.method + '</td><td>' + c.path + '</td></tr>'
-                ).join('');
-                document.getElementById('recent-connections').innerHTML = connectionsHtml || '<tr><td colspan="6">No data</td></tr>';
-            } catch (err) {
-                console.error('Error loading data:', err);
-            }
-        }
-
-        loadData();
-        setInterval(loadData, 30000);
-    </script>
-</body>
-</html>`
-
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
+	app.dashboard.ServeHTTP(w, r)
 }
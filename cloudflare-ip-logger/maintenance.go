@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// MaintenanceState is one host's maintenance switch
+type MaintenanceState struct {
+	Host       string `json:"host"`
+	Enabled    bool   `json:"enabled"`
+	RetryAfter int    `json:"retry_after"` // seconds
+	Message    string `json:"message,omitempty"`
+	UpdatedAt  string `json:"updated_at,omitempty"`
+}
+
+// Maintenance tracks which hosts are in maintenance. State starts from
+// proxy-config.json and is overridden by API toggles, which are persisted so
+// a restart doesn't silently put a host back in service.
+type Maintenance struct {
+	db       *sql.DB
+	pagePath string
+
+	mu    sync.RWMutex
+	hosts map[string]MaintenanceState
+	pages map[string]string // host -> custom page file
+}
+
+func NewMaintenance(db *sql.DB, pagePath string) (*Maintenance, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS maintenance (
+		host TEXT PRIMARY KEY,
+		enabled INTEGER NOT NULL,
+		retry_after INTEGER NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.AddColumnIfMissing(db, "maintenance", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	return &Maintenance{
+		db:       db,
+		pagePath: pagePath,
+		hosts:    make(map[string]MaintenanceState),
+		pages:    make(map[string]string),
+	}, nil
+}
+
+// Configure applies the config-file defaults for a host
+func (m *Maintenance) Configure(host string, cfg ProxyConfig) {
+	retryAfter := cfg.MaintenanceRetryAfter
+	if retryAfter == 0 {
+		retryAfter = 300
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[host] = MaintenanceState{Host: host, Enabled: cfg.Maintenance, RetryAfter: retryAfter}
+	if cfg.MaintenancePage != "" {
+		m.pages[host] = cfg.MaintenancePage
+	} else {
+		delete(m.pages, host)
+	}
+}
+
+// LoadOverrides applies toggles saved through the API; call after Configure
+func (m *Maintenance) LoadOverrides() error {
+	rows, err := m.db.Query("SELECT host, enabled, retry_after, message, updated_at FROM maintenance")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for rows.Next() {
+		var st MaintenanceState
+		if err := rows.Scan(&st.Host, &st.Enabled, &st.RetryAfter, &st.Message, &st.UpdatedAt); err != nil {
+			return err
+		}
+		m.hosts[st.Host] = st
+		if st.Enabled {
+			slog.Info("Host is in maintenance (set via API)", "host", st.Host, "since", st.UpdatedAt)
+		}
+	}
+	return rows.Err()
+}
+
+func (m *Maintenance) Get(host string) (MaintenanceState, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st, ok := m.hosts[host]
+	return st, ok && st.Enabled
+}
+
+func (m *Maintenance) Set(st MaintenanceState) error {
+	st.UpdatedAt = store.FormatTime(time.Now())
+	_, err := m.db.Exec(`INSERT INTO maintenance (host, enabled, retry_after, message, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(host) DO UPDATE SET enabled = excluded.enabled, retry_after = excluded.retry_after,
+			message = excluded.message, updated_at = excluded.updated_at, version = maintenance.version + 1`,
+		st.Host, st.Enabled, st.RetryAfter, st.Message, st.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	m.apply(st)
+	return nil
+}
+
+// apply puts st in effect without saving it
+func (m *Maintenance) apply(st MaintenanceState) {
+	m.mu.Lock()
+	m.hosts[st.Host] = st
+	m.mu.Unlock()
+}
+
+// remove forgets a host no longer in the config
+func (m *Maintenance) remove(host string) {
+	m.mu.Lock()
+	delete(m.hosts, host)
+	delete(m.pages, host)
+	m.mu.Unlock()
+}
+
+// event is the maintenance event for st being switched on or off
+func (st MaintenanceState) event() Event {
+	if st.Enabled {
+		return Event{Kind: "maintenance", Severity: severityWarning, Host: st.Host, Message: "Maintenance started"}
+	}
+	return Event{Kind: "maintenance", Host: st.Host, Message: "Maintenance ended"}
+}
+
+func (m *Maintenance) List() []MaintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]MaintenanceState, 0, len(m.hosts))
+	for _, st := range m.hosts {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>Down for maintenance</title>
+<style>body{font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#1a1a2e;color:#eee;display:flex;align-items:center;justify-content:center;height:100vh;margin:0}
+.box{text-align:center}h1{color:#00d4ff}</style></head>
+<body><div class="box"><h1>🔧 Down for maintenance</h1><p>{{message}}</p></div></body>
+</html>`
+
+// Serve writes the 503 maintenance response. The page is the host's
+// maintenance_page, else MAINTENANCE_PAGE, else the built-in one; {{host}}
+// and {{message}} placeholders are substituted.
+func (m *Maintenance) Serve(w http.ResponseWriter, host string, st MaintenanceState) {
+	m.mu.RLock()
+	pagePath := m.pages[host]
+	m.mu.RUnlock()
+	if pagePath == "" {
+		pagePath = m.pagePath
+	}
+
+	page := defaultMaintenancePage
+	if pagePath != "" {
+		if data, err := os.ReadFile(pagePath); err == nil {
+			page = string(data)
+		} else {
+			slog.Error("Could not read maintenance page", "path", pagePath, "err", err)
+		}
+	}
+
+	message := st.Message
+	if message == "" {
+		message = "This service is temporarily unavailable. Please try again shortly."
+	}
+	page = strings.ReplaceAll(page, "{{host}}", html.EscapeString(host))
+	page = strings.ReplaceAll(page, "{{message}}", html.EscapeString(message))
+
+	if st.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(st.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(page))
+}
+
+// GET  /_proxy/maintenance        - list hosts and their state
+// POST /_proxy/maintenance/{host} - {"enabled": true, "retry_after": 600, "message": "..."}
+func (app *App) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	host, rt := app.lookupRoute(strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/maintenance"), "/")))
+
+	switch {
+	case r.Method == http.MethodGet && host == "":
+		user := requestUser(r)
+		list := []MaintenanceState{}
+		for _, st := range app.maintenance.List() {
+			if user.CanSee(st.Host) {
+				list = append(list, st)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && host != "":
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		if rt == nil || !requestUser(r).CanSee(host) {
+			http.Error(w, "Unknown host", http.StatusNotFound)
+			return
+		}
+		st := MaintenanceState{Host: host, Enabled: true, RetryAfter: 300}
+		if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st.Host = host
+		if err := app.maintenance.Set(st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Maintenance set via API", "host", host, "enabled", st.Enabled)
+		e := st.event()
+		if u := requestUser(r); u != nil {
+			e.Message += " by " + u.Name
+		}
+		app.addEvent(e)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maintenanceData is a host's override as the admin API's maintenance kind
+// holds it, under the host
+type maintenanceData struct {
+	Enabled    bool   `json:"enabled"`
+	RetryAfter int    `json:"retry_after"`
+	Message    string `json:"message,omitempty"`
+}
+
+// maintenanceCollection exposes the overrides saved in the maintenance table
+// as the "maintenance" admin kind. Deleting one puts the host back on its
+// proxy-config.json setting.
+type maintenanceCollection struct {
+	app *App
+}
+
+func (c maintenanceCollection) object(st MaintenanceState, version int64) AdminObject {
+	data, _ := json.Marshal(maintenanceData{Enabled: st.Enabled, RetryAfter: st.RetryAfter, Message: st.Message})
+	return AdminObject{ID: st.Host, Data: data, Version: version, UpdatedAt: st.UpdatedAt}
+}
+
+func (c maintenanceCollection) List() ([]AdminObject, error) {
+	rows, err := c.app.maintenance.db.Query("SELECT host, enabled, retry_after, message, updated_at, version FROM maintenance ORDER BY host")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []AdminObject{}
+	for rows.Next() {
+		var st MaintenanceState
+		var version int64
+		if err := rows.Scan(&st.Host, &st.Enabled, &st.RetryAfter, &st.Message, &st.UpdatedAt, &version); err != nil {
+			return nil, err
+		}
+		objects = append(objects, c.object(st, version))
+	}
+	return objects, rows.Err()
+}
+
+func (c maintenanceCollection) Get(id string) (AdminObject, error) {
+	var st MaintenanceState
+	var version int64
+	err := c.app.maintenance.db.QueryRow("SELECT host, enabled, retry_after, message, updated_at, version FROM maintenance WHERE host = ?", id).
+		Scan(&st.Host, &st.Enabled, &st.RetryAfter, &st.Message, &st.UpdatedAt, &version)
+	if err == sql.ErrNoRows {
+		return AdminObject{}, errAdminNotFound
+	}
+	if err != nil {
+		return AdminObject{}, err
+	}
+	return c.object(st, version), nil
+}
+
+func (c maintenanceCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	d := maintenanceData{Enabled: true, RetryAfter: 300}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+	if host, rt := c.app.lookupRoute(id); rt == nil || host != id {
+		return AdminObject{}, fmt.Errorf("%w: %s is not a configured host", errAdminInvalid, id)
+	}
+	if d.RetryAfter < 0 {
+		return AdminObject{}, fmt.Errorf("%w: retry_after can't be negative", errAdminInvalid)
+	}
+	st := MaintenanceState{Host: id, Enabled: d.Enabled, RetryAfter: d.RetryAfter, Message: d.Message, UpdatedAt: store.FormatTime(time.Now())}
+
+	db := c.app.maintenance.db
+	_, err := c.Get(id)
+	switch {
+	case err == errAdminNotFound:
+		if ifMatch > 0 {
+			return AdminObject{}, errAdminNotFound
+		}
+		_, err := db.Exec("INSERT INTO maintenance (host, enabled, retry_after, message, updated_at) VALUES (?, ?, ?, ?, ?)",
+			st.Host, st.Enabled, st.RetryAfter, st.Message, st.UpdatedAt)
+		if err != nil {
+			return AdminObject{}, err
+		}
+	case err != nil:
+		return AdminObject{}, err
+	case ifMatch < 0:
+		return AdminObject{}, errAdminAlreadyExists
+	case ifMatch == 0:
+		return AdminObject{}, errAdminPreconditionNeeded
+	default:
+		res, err := db.Exec(`UPDATE maintenance SET enabled = ?, retry_after = ?, message = ?, updated_at = ?, version = version + 1
+			WHERE host = ? AND version = ?`, st.Enabled, st.RetryAfter, st.Message, st.UpdatedAt, st.Host, ifMatch)
+		if err != nil {
+			return AdminObject{}, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return AdminObject{}, errAdminVersionMismatch
+		}
+	}
+	c.app.maintenance.apply(st)
+	slog.Info("Maintenance set via admin API", "host", st.Host, "enabled", st.Enabled)
+	c.app.addEvent(st.event())
+	return c.Get(id)
+}
+
+func (c maintenanceCollection) Delete(id string, ifMatch int64) error {
+	if ifMatch == 0 {
+		return errAdminPreconditionNeeded
+	}
+	res, err := c.app.maintenance.db.Exec("DELETE FROM maintenance WHERE host = ? AND version = ?", id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.Get(id); errors.Is(err, errAdminNotFound) {
+			return errAdminNotFound
+		}
+		return errAdminVersionMismatch
+	}
+	if cfg, ok := c.app.routes.Load().configs[id]; ok {
+		c.app.maintenance.Configure(id, cfg)
+	} else {
+		c.app.maintenance.remove(id)
+	}
+	st, _ := c.app.maintenance.Get(id)
+	st.Host = id
+	slog.Info("Maintenance override removed via admin API", "host", id, "enabled", st.Enabled)
+	c.app.addEvent(st.event())
+	return nil
+}
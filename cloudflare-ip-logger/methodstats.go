@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Methods that only read; everything else counts as a write
+var readMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+// How many of a host's most written-to paths are reported
+const topWritePaths = 5
+
+// HostMethods is how a host's requests split by HTTP method
+type HostMethods struct {
+	Host       string         `json:"host"`
+	Reads      int            `json:"reads"`
+	Writes     int            `json:"writes"`
+	WriteRatio float64        `json:"write_ratio"` // writes / (reads + writes), 0 without either
+	Methods    map[string]int `json:"methods"`
+	WritePaths []PathHits     `json:"write_paths"` // most writes first
+}
+
+// PathHits is a path and how often it was requested
+type PathHits struct {
+	Path string `json:"path"`
+	Hits int    `json:"hits"`
+}
+
+// hostMethodStats breaks down the requests matching where/args to each of
+// hosts by method, in the order of hosts. Rows without a method (from access
+// logs that don't record one) count toward neither reads nor writes.
+func hostMethodStats(db *sql.DB, hosts []HostStats, where string, args []interface{}) ([]HostMethods, error) {
+	list := make([]HostMethods, 0, len(hosts))
+	if len(hosts) == 0 {
+		return list, nil
+	}
+	byHost := make(map[string]*HostMethods, len(hosts))
+	hostArgs := make([]interface{}, len(hosts))
+	for i, h := range hosts {
+		list = append(list, HostMethods{Host: h.Host, Methods: map[string]int{}, WritePaths: []PathHits{}})
+		hostArgs[i] = h.Host
+	}
+	for i := range list {
+		byHost[list[i].Host] = &list[i]
+	}
+	hostCond := " AND COALESCE(host, '') IN (?" + strings.Repeat(", ?", len(hosts)-1) + ")"
+
+	rows, err := db.Query("SELECT COALESCE(host, ''), UPPER(COALESCE(method, '')), COUNT(*) FROM connections"+where+hostCond+
+		" GROUP BY 1, 2", append(append([]interface{}{}, args...), hostArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var host, method string
+		var hits int
+		if rows.Scan(&host, &method, &hits) != nil {
+			continue
+		}
+		h := byHost[host]
+		if h == nil || method == "" {
+			continue
+		}
+		h.Methods[method] += hits
+		if isReadMethod(method) {
+			h.Reads += hits
+		} else {
+			h.Writes += hits
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	writeCond := " AND UPPER(COALESCE(method, '')) NOT IN ('', '" + strings.Join(readMethods, "', '") + "')"
+	for i := range list {
+		h := &list[i]
+		if total := h.Reads + h.Writes; total > 0 {
+			h.WriteRatio = float64(h.Writes) / float64(total)
+		}
+		if h.Writes == 0 {
+			continue
+		}
+		rows, err := db.Query("SELECT COALESCE(path, ''), COUNT(*) AS hits FROM connections"+where+writeCond+" AND COALESCE(host, '') = ?"+
+			" GROUP BY 1 ORDER BY hits DESC, 1 LIMIT ?", append(append([]interface{}{}, args...), h.Host, topWritePaths)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p PathHits
+			if rows.Scan(&p.Path, &p.Hits) == nil {
+				h.WritePaths = append(h.WritePaths, p)
+			}
+		}
+		rows.Close()
+	}
+	return list, nil
+}
+
+func isReadMethod(method string) bool {
+	for _, m := range readMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
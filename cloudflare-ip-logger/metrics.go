@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds, the Prometheus client defaults plus a long tail
+// for slow backends
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// LatencyHistograms records how long proxied requests take, per host and
+// status class, as cumulative Prometheus histograms
+type LatencyHistograms struct {
+	mu     sync.Mutex
+	series map[latencyKey]*histogram
+}
+
+type latencyKey struct {
+	host, class string
+}
+
+type histogram struct {
+	buckets []uint64 // per bound, not yet cumulative
+	count   uint64
+	sum     float64
+}
+
+func NewLatencyHistograms() *LatencyHistograms {
+	return &LatencyHistograms{series: make(map[latencyKey]*histogram)}
+}
+
+func (lh *LatencyHistograms) Observe(host string, status int, d time.Duration) {
+	key := latencyKey{host, strconv.Itoa(status/100) + "xx"}
+	secs := d.Seconds()
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	h := lh.series[key]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		lh.series[key] = h
+	}
+	if i := sort.SearchFloat64s(latencyBuckets, secs); i < len(latencyBuckets) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += secs
+}
+
+// WritePrometheus writes the histograms in the Prometheus text format
+func (lh *LatencyHistograms) WritePrometheus(w io.Writer) {
+	const name = "cf_ip_logger_upstream_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time to proxy a request to its backend, by host and status class.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	lh.mu.Lock()
+	defer lh.mu.Unlock()
+	keys := make([]latencyKey, 0, len(lh.series))
+	for k := range lh.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].host != keys[j].host {
+			return keys[i].host < keys[j].host
+		}
+		return keys[i].class < keys[j].class
+	})
+
+	for _, k := range keys {
+		h := lh.series[k]
+		labels := fmt.Sprintf(`host="%s",status_class="%s"`, escapeLabel(k.host), k.class)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// GET /metrics on the diagnostics listener
+func (app *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	app.latency.WritePrometheus(w)
+
+	const name = "cf_ip_logger_api_requests_total"
+	fmt.Fprintf(w, "# HELP %s API requests by endpoint, logged as connections or not.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	apiRequests.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%s{endpoint=\"%s\"} %s\n", name, escapeLabel(kv.Key), kv.Value)
+	})
+}
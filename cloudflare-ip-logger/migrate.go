@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// runMigrateTimestamps implements `cf-ip-logger migrate-timestamps`: it
+// converts local-time timestamps written by older versions to UTC in
+// batches, reading them in a zone of the user's choosing. Opening an old
+// database converts it too, but in the process's zone.
+func runMigrateTimestamps(args []string) {
+	fs := flag.NewFlagSet("migrate-timestamps", flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding connections.db (and hosts/*.db)")
+	tz := fs.String("tz", "Local", "time zone the old timestamps were written in, e.g. Europe/Berlin (default $TZ or the system zone)")
+	batch := fs.Int("batch", 5000, "rows converted per transaction")
+	dryRun := fs.Bool("dry-run", false, "only count the timestamps that would be converted")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate-timestamps [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *batch <= 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		log.Fatalf("migrate-timestamps: %v", err)
+	}
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("migrate-timestamps: %v", err)
+	}
+
+	files := []string{filepath.Join(*dataDir, "connections.db")}
+	partitions, _ := filepath.Glob(filepath.Join(*dataDir, "hosts", "*.db"))
+	sort.Strings(partitions)
+	files = append(files, partitions...)
+
+	log.Printf("Reading old timestamps as %s", loc)
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			log.Fatalf("migrate-timestamps: %v", err)
+		}
+		// Not through CreateSchema, which would convert everything at once
+		db, err := store.Open(file)
+		if err != nil {
+			log.Fatalf("migrate-timestamps: %v", err)
+		}
+		err = migrateTimestamps(db, strings.TrimPrefix(file, *dataDir+"/"), loc, *batch, *dryRun)
+		db.Close()
+		if err != nil {
+			log.Fatalf("migrate-timestamps: %s: %v", file, err)
+		}
+	}
+	if *dryRun {
+		log.Printf("Dry run, nothing was changed")
+	}
+}
+
+func migrateTimestamps(db *sql.DB, name string, loc *time.Location, batch int, dryRun bool) error {
+	for _, c := range store.LegacyTimeColumns {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", c.Table).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		var pending int64
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + c.Table + ` WHERE ` + c.Column + ` NOT LIKE '%Z'`).Scan(&pending); err != nil {
+			return err
+		}
+		log.Printf("%s: %s.%s: %d timestamps to convert", name, c.Table, c.Column, pending)
+		if pending == 0 || dryRun {
+			continue
+		}
+		lastReport := time.Now()
+		converted, skipped, err := store.ConvertToUTCInBatches(db, c.Table, c.Column, loc, batch, func(converted, skipped int64) {
+			if time.Since(lastReport) >= 2*time.Second {
+				log.Printf("%s: %s.%s: %d/%d converted", name, c.Table, c.Column, converted+skipped, pending)
+				lastReport = time.Now()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("%s: %s.%s: %d converted, %d left as they were (not a timestamp)", name, c.Table, c.Column, converted, skipped)
+	}
+	if dryRun {
+		return nil
+	}
+	return store.MarkUTC(db)
+}
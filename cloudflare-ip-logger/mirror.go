@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Counts of mirrored requests: sent, failed (no response from the shadow
+// backend), dropped (too many in flight) and skipped (body too large)
+var mirrorCounts = expvar.NewMap("mirror")
+
+const (
+	mirrorTimeout     = 30 * time.Second
+	mirrorMaxInFlight = 100
+)
+
+// Mirror replays copies of proxied requests to a shadow backend. Copies are
+// fire-and-forget: responses are discarded, and a slow or failing shadow
+// never delays or changes the answer the client gets.
+type Mirror struct {
+	target   string // as configured, to detect changes on reload
+	url      *url.URL
+	noTLS    bool
+	percent  int // share of requests mirrored, 1-100
+	maxBody  int64
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+func newMirror(cfg ProxyConfig, maxBody int64) (*Mirror, error) {
+	u, err := url.Parse(cfg.Mirror)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("mirror %q: scheme must be http or https", cfg.Mirror)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.NoTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Mirror{
+		target:   cfg.Mirror,
+		url:      u,
+		noTLS:    cfg.NoTLS,
+		percent:  mirrorPercent(cfg),
+		maxBody:  maxBody,
+		inFlight: make(chan struct{}, mirrorMaxInFlight),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   mirrorTimeout,
+			// Redirects are the shadow's answer, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}, nil
+}
+
+// sameAs reports whether m already mirrors as cfg asks, so it can be kept
+// across a config reload
+func (m *Mirror) sameAs(cfg ProxyConfig) bool {
+	return m.target == cfg.Mirror && m.noTLS == cfg.NoTLS && m.percent == mirrorPercent(cfg)
+}
+
+func mirrorPercent(cfg ProxyConfig) int {
+	if cfg.MirrorPercent <= 0 || cfg.MirrorPercent > 100 {
+		return 100
+	}
+	return cfg.MirrorPercent
+}
+
+// Send copies r to the shadow backend in the background
+func (m *Mirror) Send(r *http.Request) {
+	if m.percent < 100 && rand.Intn(100) >= m.percent {
+		return
+	}
+
+	body, complete := bufferBody(r, m.maxBody)
+	if !complete {
+		mirrorCounts.Add("skipped", 1)
+		return
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		mirrorCounts.Add("dropped", 1)
+		return
+	}
+
+	target := *m.url
+	target.Path = strings.TrimSuffix(m.url.Path, "/") + r.URL.Path
+	target.RawPath = ""
+	target.RawQuery = r.URL.RawQuery
+
+	header := r.Header.Clone()
+	header.Del("Connection")
+	header.Del("Keep-Alive")
+	header.Del("Te")
+	header.Del("Trailer")
+	header.Del("Transfer-Encoding")
+	header.Set("X-Mirrored-From", r.Host)
+	host := r.Host
+
+	go func() {
+		defer func() { <-m.inFlight }()
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, r.Method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			mirrorCounts.Add("failed", 1)
+			return
+		}
+		req.Header = header
+		req.Host = host
+		resp, err := m.client.Do(req)
+		if err != nil {
+			mirrorCounts.Add("failed", 1)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mirrorCounts.Add("sent", 1)
+	}()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferBody reads r's body into memory, up to max bytes, and puts an
+// equivalent reader back so the proxy still forwards all of it. complete is
+// false when the body is longer than max (or failed to read); buf then holds
+// only what was read.
+func bufferBody(r *http.Request, max int64) (buf []byte, complete bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if int64(len(buf)) > max || err != nil {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if int64(len(buf)) > max {
+			buf = buf[:max]
+		}
+		return buf, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	return buf, true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+
+	"cf-ip-logger/pkg/clientip"
+)
+
+// Traffic categories stored in connections.category
+const (
+	categoryVisitor    = "visitor"
+	categoryMonitoring = "monitoring"
+)
+
+// Default User-Agent substrings of common uptime/monitoring agents
+const defaultMonitoringAgents = "UptimeRobot,Uptime-Kuma,Pingdom,StatusCake,Better Uptime,Site24x7," +
+	"Blackbox Exporter,Prometheus,kube-probe,GoogleHC,Zabbix,Nagios,check_http,Healthchecks.io,Gatus,Checkly"
+
+// TrafficClassifier tags hits from monitoring agents at insert time, matched
+// by User-Agent substring (case-insensitive) or source IP/CIDR
+type TrafficClassifier struct {
+	agents []string
+	nets   []*net.IPNet
+}
+
+func NewTrafficClassifier(agents, ips string) *TrafficClassifier {
+	tc := &TrafficClassifier{}
+	for _, a := range strings.Split(agents, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			tc.agents = append(tc.agents, strings.ToLower(a))
+		}
+	}
+	for _, entry := range strings.Split(ips, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ipNet := clientip.ParseIPOrCIDR(entry); ipNet != nil {
+			tc.nets = append(tc.nets, ipNet)
+		} else {
+			slog.Warn("Invalid monitoring IP/CIDR", "value", entry)
+		}
+	}
+	return tc
+}
+
+func (tc *TrafficClassifier) Classify(clientIP, userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	for _, agent := range tc.agents {
+		if strings.Contains(ua, agent) {
+			return categoryMonitoring
+		}
+	}
+	if len(tc.nets) > 0 {
+		if ip := net.ParseIP(clientIP); ip != nil {
+			for _, n := range tc.nets {
+				if n.Contains(ip) {
+					return categoryMonitoring
+				}
+			}
+		}
+	}
+	return categoryVisitor
+}
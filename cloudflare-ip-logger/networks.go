@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"cf-ip-logger/pkg/clientip"
+)
+
+// Values of the network filter that aren't a network's name
+const (
+	networkNone = "none" // requests from outside every known network
+	networkAny  = "any"  // requests from any of them
+)
+
+// KnownNetworks names the operator's own networks (KNOWN_NETWORKS), so
+// requests from them are labeled when logged
+type KnownNetworks struct {
+	nets []knownNetwork
+}
+
+type knownNetwork struct {
+	name string
+	net  *net.IPNet
+}
+
+// NewKnownNetworks parses "home LAN=192.168.1.0/24,work VPN=10.8.0.0/16";
+// a name may be listed more than once to give it several ranges
+func NewKnownNetworks(spec string) (*KnownNetworks, error) {
+	k := &KnownNetworks{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, cidr, ok := strings.Cut(entry, "=")
+		name, cidr = strings.TrimSpace(name), strings.TrimSpace(cidr)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q: expected name=CIDR", entry)
+		}
+		if name == networkNone || name == networkAny {
+			return nil, fmt.Errorf("%q: %q is reserved", entry, name)
+		}
+		ipNet := clientip.ParseIPOrCIDR(cidr)
+		if ipNet == nil {
+			return nil, fmt.Errorf("%q: invalid IP or CIDR", entry)
+		}
+		k.nets = append(k.nets, knownNetwork{name: name, net: ipNet})
+	}
+	return k, nil
+}
+
+// Label is the name of the narrowest known network containing ip, or ""
+func (k *KnownNetworks) Label(ip string) string {
+	if k == nil || len(k.nets) == 0 {
+		return ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	label, best := "", -1
+	for _, n := range k.nets {
+		if ones, _ := n.net.Mask.Size(); ones > best && n.net.Contains(parsed) {
+			label, best = n.name, ones
+		}
+	}
+	return label
+}
+
+// networkFilter turns the network query parameter into a condition on
+// connections.network: a network's name, none or any
+func networkFilter(query url.Values) (string, []interface{}) {
+	switch network := query.Get("network"); network {
+	case "":
+		return "", nil
+	case networkNone:
+		return " AND network = ''", nil
+	case networkAny:
+		return " AND network != ''", nil
+	default:
+		return " AND network = ?", []interface{}{network}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ownTraffic leaves the operator's own requests out of the statistics:
+// those from KNOWN_NETWORKS and the API calls the dashboard polls with,
+// which would otherwise inflate the counters on every refresh
+type ownTraffic struct {
+	exclude   bool   // EXCLUDE_OWN_TRAFFIC: the default when a request doesn't say
+	apiPrefix string // API_PREFIX, as logged in connections.path
+}
+
+// Filter is the condition a stats query adds for own=exclude or
+// own=include, or for the default without the parameter
+func (o *ownTraffic) Filter(query url.Values) (string, []interface{}, error) {
+	exclude := o.exclude
+	switch own := query.Get("own"); own {
+	case "":
+	case "exclude":
+		exclude = true
+	case "include":
+		exclude = false
+	default:
+		return "", nil, fmt.Errorf("own must be exclude or include, got %q", own)
+	}
+	if !exclude {
+		return "", nil, nil
+	}
+	cond, args := o.condition()
+	return cond, args, nil
+}
+
+// condition matches rows that aren't own traffic; paths are compared with a
+// trailing slash so both the prefix and everything under it are caught
+func (o *ownTraffic) condition() (string, []interface{}) {
+	prefix := o.apiPrefix + "/"
+	return " AND network = '' AND substr(path || '/', 1, ?) != ?", []interface{}{len(prefix), prefix}
+}
+
+// Hidden reports whether conn is own traffic the statistics leave out by
+// default, for the counters kept in memory
+func (o *ownTraffic) Hidden(conn ConnectionLog) bool {
+	return o.exclude && (conn.Network != "" || strings.HasPrefix(conn.Path+"/", o.apiPrefix+"/"))
+}
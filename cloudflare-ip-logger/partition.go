@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// SQLite refuses more than 10 attached databases per connection, so that is
+// also how many partitions are created; further hosts write connections.db
+const maxAttachedPartitions = 10
+
+// errPartitionsFull is returned by Get for a new host once every partition
+// slot is taken
+var errPartitionsFull = errors.New("all partition slots are taken")
+
+// Ids repeat across partition files, so the cross-host view adds the
+// partition's number times this to them; connections.db is number 0 and
+// keeps its ids
+const partitionIDStride = 1 << 40
+
+// PartitionSet holds one SQLite file per proxied host under DATA_DIR/hosts
+// (DB_PARTITION=host). Writes go straight to the host's file; reads go through
+// a separate connection pool whose connections attach every partition and
+// expose a TEMP view named "connections" that shadows the main table, so the
+// existing queries see all hosts without modification. Queries about a
+// single host use a pool attaching only that host's file.
+type PartitionSet struct {
+	dir      string
+	mainPath string
+	main     *sql.DB
+	columns  []string // of the connections table, for the view
+
+	mu      sync.Mutex
+	dbs     map[string]*sql.DB // host -> partition db
+	nums    map[string]int64   // host -> partition number, see partitionIDStride
+	readers map[string]*sql.DB // host -> pool over the main db and its partition
+	full    map[string]bool    // hosts turned away by errPartitionsFull, logged once
+}
+
+func NewPartitionSet(dataDir string, mainDB *sql.DB) (*PartitionSet, error) {
+	dir := filepath.Join(dataDir, "hosts")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ps := &PartitionSet{dir: dir, mainPath: filepath.Join(dataDir, "connections.db"), main: mainDB,
+		dbs: make(map[string]*sql.DB), nums: make(map[string]int64),
+		readers: make(map[string]*sql.DB), full: make(map[string]bool)}
+
+	// Partition numbers are kept in the main database so ids stay the same
+	// when partitions are added
+	if _, err := mainDB.Exec(`CREATE TABLE IF NOT EXISTS host_partitions (
+		host TEXT PRIMARY KEY,
+		num INTEGER NOT NULL UNIQUE
+	)`); err != nil {
+		return nil, err
+	}
+	rows, err := mainDB.Query("SELECT name FROM pragma_table_info('connections') ORDER BY cid")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		ps.columns = append(ps.columns, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	files := ps.Files()
+	if len(files) > maxAttachedPartitions {
+		return nil, fmt.Errorf("%d partition files in %s, at most %d can be queried together; merge some into connections.db",
+			len(files), dir, maxAttachedPartitions)
+	}
+	// Open existing partitions up front so schema migrations run on all of
+	// them before the reader attaches them side by side
+	for _, file := range files {
+		host := strings.TrimSuffix(filepath.Base(file), ".db")
+		if _, err := ps.Get(host); err != nil {
+			return nil, fmt.Errorf("open partition %s: %w", file, err)
+		}
+	}
+	return ps, nil
+}
+
+// partitionFileName maps a hostname to a safe file name
+func partitionFileName(host string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(host) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String() + ".db"
+}
+
+// Get returns the partition for host, creating the file on first use. Past
+// maxAttachedPartitions it returns errPartitionsFull for new hosts.
+func (ps *PartitionSet) Get(host string) (*sql.DB, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if db, ok := ps.dbs[host]; ok {
+		return db, nil
+	}
+	if len(ps.dbs) >= maxAttachedPartitions {
+		if !ps.full[host] {
+			ps.full[host] = true
+			slog.Warn("All partitions are taken, writing host to connections.db", "host", host, "partitions", len(ps.dbs))
+		}
+		return nil, errPartitionsFull
+	}
+
+	num, err := ps.number(host)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(ps.dir, partitionFileName(host))
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CreateSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	ps.dbs[host] = db
+	ps.nums[host] = num
+	slog.Info("Opened database partition", "host", host, "path", path)
+	return db, nil
+}
+
+// number returns host's partition number, assigning the next free one to a
+// new host
+func (ps *PartitionSet) number(host string) (int64, error) {
+	var num int64
+	err := ps.main.QueryRow("SELECT num FROM host_partitions WHERE host = ?", host).Scan(&num)
+	if err == sql.ErrNoRows {
+		err = ps.main.QueryRow(`INSERT INTO host_partitions (host, num)
+			SELECT ?, COALESCE(MAX(num), 0) + 1 FROM host_partitions RETURNING num`, host).Scan(&num)
+	}
+	return num, err
+}
+
+// Lookup returns the partition holding a qualified connection id and the
+// id within it; nil for ids in connections.db
+func (ps *PartitionSet) Lookup(id int64) (*sql.DB, int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for host, num := range ps.nums {
+		if id/partitionIDStride == num {
+			return ps.dbs[host], id % partitionIDStride
+		}
+	}
+	return nil, id
+}
+
+// attached lists the open partitions as the read pools attach them
+func (ps *PartitionSet) attached(hosts ...string) []attachedPartition {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if hosts == nil {
+		for host := range ps.nums {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+	}
+	var list []attachedPartition
+	for _, host := range hosts {
+		if num, ok := ps.nums[host]; ok {
+			list = append(list, attachedPartition{file: filepath.Join(ps.dir, partitionFileName(host)), num: num})
+		}
+	}
+	return list
+}
+
+// Files lists partition files on disk, including ones not written this run
+func (ps *PartitionSet) Files() []string {
+	files, _ := filepath.Glob(filepath.Join(ps.dir, "*.db"))
+	sort.Strings(files)
+	return files
+}
+
+// Reader returns a read pool that sees the main database and host's partition
+// only, so a query about a quiet host never scans a busy one's file. It is nil
+// when host has no partition file yet.
+func (ps *PartitionSet) Reader(host string) *sql.DB {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if db, ok := ps.readers[host]; ok {
+		return db
+	}
+	if _, ok := ps.nums[host]; !ok {
+		return nil
+	}
+	db := openAttachedReader(ps.mainPath, ps.columns, func() []attachedPartition {
+		return ps.attached(host)
+	})
+	ps.readers[host] = db
+	return db
+}
+
+func (ps *PartitionSet) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, db := range ps.dbs {
+		db.Close()
+	}
+	for _, db := range ps.readers {
+		db.Close()
+	}
+}
+
+// openPartitionedReader opens the read pool used for cross-host queries. Each
+// new connection attaches the partitions present at that time; connections are
+// recycled periodically so partitions created later get picked up.
+func openPartitionedReader(dbPath string, ps *PartitionSet) (*sql.DB, error) {
+	db := openAttachedReader(dbPath, ps.columns, func() []attachedPartition { return ps.attached() })
+	db.SetConnMaxLifetime(time.Minute)
+	return db, nil
+}
+
+// attachedPartition is a partition file and its number
+type attachedPartition struct {
+	file string
+	num  int64
+}
+
+// openAttachedReader opens a pool on dbPath whose connections attach the
+// partitions listed when they connect
+func openAttachedReader(dbPath string, columns []string, parts func() []attachedPartition) *sql.DB {
+	drv := &store.Driver{
+		ConnectHook: func(c *store.Conn) error {
+			return attachPartitions(c, columns, parts())
+		},
+	}
+	return sql.OpenDB(attachConnector{dsn: store.DSN(dbPath), drv: drv})
+}
+
+// attachConnector opens connections through a driver with a ConnectHook
+// without registering it globally
+type attachConnector struct {
+	dsn string
+	drv *store.Driver
+}
+
+func (c attachConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.drv.Open(c.dsn)
+}
+
+func (c attachConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+// attachPartitions attaches parts and creates the view over them, with each
+// partition's ids offset by its number
+func attachPartitions(c *store.Conn, columns []string, parts []attachedPartition) error {
+	if len(parts) > maxAttachedPartitions {
+		return fmt.Errorf("%d partitions, at most %d can be attached", len(parts), maxAttachedPartitions)
+	}
+
+	selects := []string{"SELECT * FROM main.connections"}
+	for i, p := range parts {
+		alias := fmt.Sprintf("p%d", i)
+		// Encrypted partitions share the main database's key
+		if _, err := c.Exec("ATTACH DATABASE ? AS "+alias+" KEY ?", []driver.Value{p.file, store.Key()}); err != nil {
+			return fmt.Errorf("attach %s: %w", p.file, err)
+		}
+		cols := make([]string, len(columns))
+		for j, col := range columns {
+			cols[j] = col
+			if col == "id" {
+				cols[j] = fmt.Sprintf("id + %d AS id", p.num*partitionIDStride)
+			}
+		}
+		selects = append(selects, "SELECT "+strings.Join(cols, ", ")+" FROM "+alias+".connections")
+	}
+
+	view := "CREATE TEMP VIEW connections AS " + strings.Join(selects, " UNION ALL ")
+	_, err := c.Exec(view, nil)
+	return err
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/clientip"
+	"cf-ip-logger/pkg/store"
+	"cf-ip-logger/pkg/webauthn"
+)
+
+// How long the browser has to answer a registration or sign-in challenge
+const passkeyChallengeTTL = 5 * time.Minute
+
+// Unanswered challenges kept at most, as anyone can ask for a sign-in one
+const maxPasskeyChallenges = 1000
+
+func createPasskeysSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS passkeys (
+		id TEXT PRIMARY KEY,
+		user_name TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		public_key BLOB NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS idx_passkeys_user ON passkeys(user_name);`)
+	return err
+}
+
+// Passkey is a registered WebAuthn credential as the API lists it; id is
+// the credential ID (base64url)
+type Passkey struct {
+	ID         string `json:"id"`
+	User       string `json:"user"`
+	Name       string `json:"name"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at,omitempty"`
+}
+
+// passkeyChallenge is a challenge waiting for the browser's answer
+type passkeyChallenge struct {
+	register bool
+	user     string // who registers, or who signs in ("" = whoever's passkey it is)
+	rp       webauthn.RelyingParty
+	expires  time.Time
+}
+
+// Passkeys lets users sign in with WebAuthn credentials instead of, or on
+// top of, their token
+type Passkeys struct {
+	db         *sql.DB
+	rpID       string   // WEBAUTHN_RP_ID; the request's host when empty
+	origins    []string // WEBAUTHN_ORIGINS
+	sessionTTL time.Duration
+
+	mu      sync.Mutex
+	pending map[string]passkeyChallenge
+}
+
+func NewPasskeys(db *sql.DB, rpID, origins string, sessionTTL time.Duration) *Passkeys {
+	p := &Passkeys{db: db, rpID: rpID, sessionTTL: sessionTTL, pending: make(map[string]passkeyChallenge)}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			p.origins = append(p.origins, o)
+		}
+	}
+	return p
+}
+
+// relyingParty is the site passkeys made through r belong to
+func (p *Passkeys) relyingParty(r *http.Request) webauthn.RelyingParty {
+	id := p.rpID
+	if id == "" {
+		id = r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			id = host
+		}
+	}
+	return webauthn.RelyingParty{ID: strings.ToLower(id), Origins: p.origins}
+}
+
+// challenge stores a new challenge and returns it
+func (p *Passkeys) challenge(c passkeyChallenge) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if len(p.pending) >= maxPasskeyChallenges {
+		for k, pc := range p.pending {
+			if now.After(pc.expires) {
+				delete(p.pending, k)
+			}
+		}
+		if len(p.pending) >= maxPasskeyChallenges {
+			return nil, errors.New("too many passkey requests in progress, try again later")
+		}
+	}
+	b := webauthn.NewChallenge()
+	c.expires = now.Add(passkeyChallengeTTL)
+	p.pending[webauthn.Encode(b)] = c
+	return b, nil
+}
+
+// takeChallenge removes and returns the challenge clientDataJSON answers;
+// each can only be used once
+func (p *Passkeys) takeChallenge(clientDataJSON []byte, register bool) ([]byte, passkeyChallenge, error) {
+	var cd struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, passkeyChallenge{}, fmt.Errorf("invalid clientDataJSON: %w", err)
+	}
+	p.mu.Lock()
+	c, ok := p.pending[cd.Challenge]
+	delete(p.pending, cd.Challenge)
+	p.mu.Unlock()
+	if !ok || c.register != register || time.Now().After(c.expires) {
+		return nil, c, errors.New("unknown or expired challenge")
+	}
+	b, err := webauthn.Decode(cd.Challenge)
+	return b, c, err
+}
+
+// List returns user's passkeys, everyone's for ""
+func (p *Passkeys) List(user string) ([]Passkey, error) {
+	query := "SELECT id, user_name, name, created_at, COALESCE(last_used_at, '') FROM passkeys"
+	var args []interface{}
+	if user != "" {
+		query += " WHERE user_name = ?"
+		args = append(args, user)
+	}
+	rows, err := p.db.Query(query+" ORDER BY created_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Passkey{}
+	for rows.Next() {
+		var k Passkey
+		if err := rows.Scan(&k.ID, &k.User, &k.Name, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	return list, rows.Err()
+}
+
+// credential loads a passkey for verifying a sign-in
+func (p *Passkeys) credential(id string) (string, string, webauthn.Credential, error) {
+	var user, name string
+	var cred webauthn.Credential
+	err := p.db.QueryRow("SELECT user_name, name, public_key, sign_count FROM passkeys WHERE id = ?", id).
+		Scan(&user, &name, &cred.PublicKey, &cred.SignCount)
+	return user, name, cred, err
+}
+
+// userID is the WebAuthn user handle for an account: stable, and not the
+// name itself, which authenticators may show
+func userID(name string) []byte {
+	sum := sha256.Sum256([]byte("cf-ip-logger user " + name))
+	return sum[:16]
+}
+
+// passkeyAssertion is the browser's PublicKeyCredential, binary fields
+// base64url-encoded
+type passkeyAssertion struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"` // registration only: what to call the passkey
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+func decodeFields(fields ...*string) ([][]byte, error) {
+	out := make([][]byte, len(fields))
+	for i, f := range fields {
+		b, err := webauthn.Decode(*f)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("missing or invalid base64url field")
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+// /_proxy/passkeys[/...]:
+//
+//	GET    /passkeys                  the caller's passkeys (all for admins, ?user= to pick one)
+//	DELETE /passkeys/{id}
+//	POST   /passkeys/register/begin   options for navigator.credentials.create()
+//	POST   /passkeys/register/finish  {name, id, response}
+//	POST   /passkeys/login/begin      {user} (optional) -> options for navigator.credentials.get()
+//	POST   /passkeys/login/finish     {id, response} -> {token, user, role, expires_at}
+func (app *App) handlePasskeys(w http.ResponseWriter, r *http.Request) {
+	if !app.admin.users.Any() {
+		http.Error(w, "passkeys need user accounts (see /admin/users)", http.StatusNotFound)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/passkeys"), "/")
+	switch {
+	case rest == "login/begin" || rest == "login/finish" || rest == "register/begin" || rest == "register/finish":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+		switch rest {
+		case "login/begin":
+			app.passkeyLoginBegin(w, r)
+		case "login/finish":
+			app.passkeyLoginFinish(w, r)
+		case "register/begin":
+			app.passkeyRegisterBegin(w, r)
+		default:
+			app.passkeyRegisterFinish(w, r)
+		}
+		return
+	}
+
+	user := app.admin.Authenticate(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		owner := user.Name
+		if user.Role == roleAdmin {
+			owner = r.URL.Query().Get("user")
+		}
+		list, err := app.passkeys.List(owner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case rest != "" && !strings.Contains(rest, "/") && r.Method == http.MethodDelete:
+		owner, name, _, err := app.passkeys.credential(rest)
+		if err == sql.ErrNoRows || (err == nil && owner != user.Name && user.Role != roleAdmin) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := app.db.Exec("DELETE FROM passkeys WHERE id = ?", rest); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.addEvent(Event{Kind: "auth", ClientIP: clientip.RemoteIP(r),
+			Message: fmt.Sprintf("passkey %q of %s removed by %s", name, owner, user.Name)})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// registeringUser is who may add a passkey: a signed-in user, or one
+// presenting their token. A user who needs a passkey to sign in can use the
+// token alone only to register their first one.
+func (app *App) registeringUser(r *http.Request) (*User, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if u := app.admin.users.Lookup(token); u != nil {
+		return u, nil
+	}
+	u := app.admin.users.TokenUser(token)
+	if u == nil {
+		return nil, errors.New("sign in to add a passkey (ADMIN_TOKEN can't have one)")
+	}
+	existing, err := app.passkeys.List(u.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, errors.New("sign in with a passkey to add another one")
+	}
+	return u, nil
+}
+
+// POST /_proxy/passkeys/register/begin
+func (app *App) passkeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user, err := app.registeringUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	existing, err := app.passkeys.List(user.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rp := app.passkeys.relyingParty(r)
+	challenge, err := app.passkeys.challenge(passkeyChallenge{register: true, user: user.Name, rp: rp})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	params := make([]map[string]interface{}, len(webauthn.Algorithms))
+	for i, alg := range webauthn.Algorithms {
+		params[i] = map[string]interface{}{"type": "public-key", "alg": alg}
+	}
+	exclude := make([]map[string]string, len(existing))
+	for i, k := range existing {
+		exclude[i] = map[string]string{"type": "public-key", "id": k.ID}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge":          webauthn.Encode(challenge),
+		"rp":                 map[string]string{"id": rp.ID, "name": "CF IP Logger"},
+		"user":               map[string]string{"id": webauthn.Encode(userID(user.Name)), "name": user.Name, "displayName": user.Name},
+		"pubKeyCredParams":   params,
+		"excludeCredentials": exclude,
+		"timeout":            passkeyChallengeTTL.Milliseconds(),
+		"attestation":        "none",
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	}})
+}
+
+// POST /_proxy/passkeys/register/finish
+func (app *App) passkeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	user, err := app.registeringUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var a passkeyAssertion
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields, err := decodeFields(&a.Response.ClientDataJSON, &a.Response.AttestationObject)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	challenge, c, err := app.passkeys.takeChallenge(fields[0], true)
+	if err == nil && c.user != user.Name {
+		err = errors.New("challenge was issued to another user")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cred, err := c.rp.VerifyRegistration(challenge, fields[0], fields[1])
+	if err != nil {
+		http.Error(w, "Passkey rejected: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(a.Name)
+	if name == "" {
+		name = "passkey"
+	}
+	id := webauthn.Encode(cred.ID)
+	_, err = app.db.Exec(`INSERT INTO passkeys (id, user_name, name, public_key, sign_count, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, user.Name, name, cred.PublicKey, cred.SignCount, store.FormatTime(time.Now()))
+	if err != nil {
+		http.Error(w, "Failed to store passkey: "+err.Error(), http.StatusConflict)
+		return
+	}
+	slog.Info("Passkey registered", "passkey", name, "user", user.Name)
+	app.addEvent(Event{Kind: "auth", ClientIP: clientip.RemoteIP(r),
+		Message: fmt.Sprintf("passkey %q registered for %s", name, user.Name)})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Passkey{ID: id, User: user.Name, Name: name, CreatedAt: store.FormatTime(time.Now())})
+}
+
+// POST /_proxy/passkeys/login/begin
+func (app *App) passkeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Without a user the browser offers whichever passkeys it has for the site
+	allow := []map[string]string{}
+	if req.User != "" {
+		existing, err := app.passkeys.List(req.User)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, k := range existing {
+			allow = append(allow, map[string]string{"type": "public-key", "id": k.ID})
+		}
+	}
+	rp := app.passkeys.relyingParty(r)
+	challenge, err := app.passkeys.challenge(passkeyChallenge{user: req.User, rp: rp})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": map[string]interface{}{
+		"challenge":        webauthn.Encode(challenge),
+		"rpId":             rp.ID,
+		"allowCredentials": allow,
+		"timeout":          passkeyChallengeTTL.Milliseconds(),
+		"userVerification": "preferred",
+	}})
+}
+
+// POST /_proxy/passkeys/login/finish
+func (app *App) passkeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	var a passkeyAssertion
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields, err := decodeFields(&a.Response.ClientDataJSON, &a.Response.AuthenticatorData, &a.Response.Signature)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	challenge, c, err := app.passkeys.takeChallenge(fields[0], false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Failures don't say whether the passkey or the user exists
+	fail := func(reason string) {
+		slog.Warn("Passkey sign-in failed", "remote", clientip.RemoteIP(r), "reason", reason)
+		app.addEvent(Event{Kind: "auth", Severity: severityWarning, ClientIP: clientip.RemoteIP(r),
+			Message: "passkey sign-in failed: " + reason})
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+	owner, name, cred, err := app.passkeys.credential(a.ID)
+	if err == sql.ErrNoRows {
+		fail("unknown passkey")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if c.user != "" && c.user != owner {
+		fail(fmt.Sprintf("passkey %q belongs to %s, not %s", name, owner, c.user))
+		return
+	}
+	count, err := c.rp.VerifyAssertion(challenge, cred, fields[0], fields[1], fields[2])
+	if err != nil {
+		fail(fmt.Sprintf("passkey %q of %s: %v", name, owner, err))
+		return
+	}
+	user := app.admin.users.Get(owner)
+	if user == nil {
+		fail(fmt.Sprintf("passkey %q belongs to deleted user %s", name, owner))
+		return
+	}
+	if user.PasskeyRequired {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if u := app.admin.users.TokenUser(token); u == nil || u.Name != owner {
+			fail(fmt.Sprintf("%s signed in with passkey %q but without their token", owner, name))
+			return
+		}
+	}
+	if _, err := app.db.Exec("UPDATE passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?",
+		count, store.FormatTime(time.Now()), a.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, expires := app.admin.users.StartSession(owner, app.passkeys.sessionTTL)
+	app.addEvent(Event{Kind: "auth", ClientIP: clientip.RemoteIP(r),
+		Message: fmt.Sprintf("%s signed in with passkey %q", owner, name)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":      token,
+		"user":       owner,
+		"role":       user.Role,
+		"expires_at": store.FormatTime(expires),
+	})
+}
@@ -0,0 +1,145 @@
+package clientip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Published Cloudflare edge ranges
+const (
+	cloudflareIPv4URL = "https://www.cloudflare.com/ips-v4"
+	cloudflareIPv6URL = "https://www.cloudflare.com/ips-v6"
+)
+
+// Built-in copy used when neither the network nor the disk cache is available
+var builtinCloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+// CloudflareRanges keeps the current set of Cloudflare edge networks,
+// refreshed from cloudflare.com and cached on disk for offline starts
+type CloudflareRanges struct {
+	cachePath string
+	nets      atomic.Pointer[[]*net.IPNet]
+	updated   atomic.Pointer[time.Time]
+	source    atomic.Pointer[string]
+}
+
+func NewCloudflareRanges(cachePath string) *CloudflareRanges {
+	cr := &CloudflareRanges{cachePath: cachePath}
+
+	if data, err := os.ReadFile(cachePath); err == nil {
+		if nets := parseCIDRList(string(data)); len(nets) > 0 {
+			info, _ := os.Stat(cachePath)
+			cr.set(nets, "cache", info.ModTime())
+			return cr
+		}
+	}
+	cr.set(parseCIDRList(strings.Join(builtinCloudflareRanges, "\n")), "builtin", time.Time{})
+	return cr
+}
+
+func (cr *CloudflareRanges) set(nets []*net.IPNet, source string, updated time.Time) {
+	cr.nets.Store(&nets)
+	cr.source.Store(&source)
+	cr.updated.Store(&updated)
+}
+
+func (cr *CloudflareRanges) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range *cr.nets.Load() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Info describes the loaded ranges for the health endpoint
+func (cr *CloudflareRanges) Info() map[string]interface{} {
+	info := map[string]interface{}{
+		"ranges": len(*cr.nets.Load()),
+		"source": *cr.source.Load(),
+	}
+	if updated := *cr.updated.Load(); !updated.IsZero() {
+		info["updated"] = updated.Format(time.RFC3339)
+	}
+	return info
+}
+
+// Refresh downloads both lists and, if they parse, swaps them in and rewrites
+// the disk cache
+func (cr *CloudflareRanges) Refresh() error {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var lines []string
+	for _, u := range []string{cloudflareIPv4URL, cloudflareIPv6URL} {
+		resp, err := client.Get(u)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: HTTP %d", u, resp.StatusCode)
+		}
+		lines = append(lines, strings.TrimSpace(string(body)))
+	}
+
+	text := strings.Join(lines, "\n") + "\n"
+	nets := parseCIDRList(text)
+	if len(nets) == 0 {
+		return fmt.Errorf("no ranges in response")
+	}
+
+	cr.set(nets, "cloudflare.com", time.Now())
+	if err := os.WriteFile(cr.cachePath, []byte(text), 0644); err != nil {
+		slog.Warn("Could not write Cloudflare range cache", "err", err)
+	}
+	return nil
+}
+
+// RefreshLoop refreshes immediately and then every interval
+func (cr *CloudflareRanges) RefreshLoop(interval time.Duration) {
+	for {
+		if err := cr.Refresh(); err != nil {
+			slog.Warn("Cloudflare IP range refresh failed, keeping the current list", "list", *cr.source.Load(), "err", err)
+		} else {
+			slog.Info("Cloudflare IP ranges refreshed", "networks", len(*cr.nets.Load()))
+		}
+		time.Sleep(interval)
+	}
+}
+
+func parseCIDRList(text string) []*net.IPNet {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, n, err := net.ParseCIDR(line); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,208 @@
+// Package clientip finds the real client address of a request that reached
+// us through Cloudflare or other reverse proxies, trusting forwarding headers
+// only from known peers.
+package clientip
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Default header order, matching the original hardcoded behavior
+const DefaultHeaders = "CF-Connecting-IP,X-Forwarded-For"
+
+// Policy decides which request headers are trusted to carry the real
+// client IP, in what order, and from which peers. Headers are only honored
+// when the direct peer (RemoteAddr) is inside one of the trusted ranges; with
+// no ranges configured every peer is trusted, as before. The keyword
+// "cloudflare" in the trusted list stands for the live Cloudflare edge ranges.
+type Policy struct {
+	headers         []string
+	trusted         []*net.IPNet
+	trustCloudflare bool
+	cloudflare      *CloudflareRanges
+}
+
+func NewPolicy(headers, trustedProxies string, cloudflare *CloudflareRanges) *Policy {
+	p := &Policy{cloudflare: cloudflare}
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			p.headers = append(p.headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	for _, entry := range strings.Split(trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.EqualFold(entry, "cloudflare") {
+			p.trustCloudflare = true
+			continue
+		}
+		if ipNet := ParseIPOrCIDR(entry); ipNet != nil {
+			p.trusted = append(p.trusted, ipNet)
+		} else {
+			slog.Warn("Invalid trusted proxy IP/CIDR", "value", entry)
+		}
+	}
+	return p
+}
+
+// RemoteIP strips the port from RemoteAddr, handling IPv6 brackets
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// restricted reports whether any trusted ranges are configured at all
+func (p *Policy) restricted() bool {
+	return len(p.trusted) > 0 || p.trustCloudflare
+}
+
+func (p *Policy) isTrusted(ip string) bool {
+	if !p.restricted() {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if p.trustCloudflare && p.cloudflare.Contains(parsed) {
+		return true
+	}
+	for _, n := range p.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ViaCloudflare reports whether the request came through Cloudflare: either
+// the peer is a Cloudflare edge address (orange-cloud DNS straight to us), or
+// a trusted peer such as cloudflared forwarded it with a CF-Ray header
+func (p *Policy) ViaCloudflare(r *http.Request) bool {
+	peer := RemoteIP(r)
+	if p.cloudflare.Contains(net.ParseIP(peer)) {
+		return true
+	}
+	return r.Header.Get("CF-Ray") != "" && p.isTrusted(peer)
+}
+
+// ClientIP returns the first valid client IP found in the configured headers,
+// falling back to the peer address
+func (p *Policy) ClientIP(r *http.Request) string {
+	peer := RemoteIP(r)
+	if !p.isTrusted(peer) {
+		return peer
+	}
+
+	for _, header := range p.headers {
+		values := r.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		var ip string
+		switch header {
+		case "X-Forwarded-For":
+			ip = p.pickFromChain(splitList(values))
+		case "Forwarded":
+			ip = p.pickFromChain(parseForwardedFor(values))
+		default:
+			ip = strings.TrimSpace(values[0])
+			if net.ParseIP(ip) == nil {
+				ip = ""
+			}
+		}
+		if ip != "" {
+			return ip
+		}
+	}
+	return peer
+}
+
+// pickFromChain selects the client from a proxy chain (client first, nearest
+// proxy last). With trusted ranges configured, it walks from the right and
+// skips our own proxies so a client can't spoof the leftmost entry; otherwise
+// it takes the leftmost entry as the original code did.
+func (p *Policy) pickFromChain(chain []string) string {
+	var valid []string
+	for _, ip := range chain {
+		if net.ParseIP(ip) != nil {
+			valid = append(valid, ip)
+		}
+	}
+	if len(valid) == 0 {
+		return ""
+	}
+	if !p.restricted() {
+		return valid[0]
+	}
+	for i := len(valid) - 1; i >= 0; i-- {
+		if !p.isTrusted(valid[i]) {
+			return valid[i]
+		}
+	}
+	return valid[0]
+}
+
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			out = append(out, strings.TrimSpace(part))
+		}
+	}
+	return out
+}
+
+// parseForwardedFor extracts the for= node of each RFC 7239 Forwarded element,
+// e.g. `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`. Obfuscated
+// and "unknown" nodes come back as-is and are discarded by the caller.
+func parseForwardedFor(values []string) []string {
+	var out []string
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(key, "for") {
+				continue
+			}
+			value = strings.Trim(value, `"`)
+			if strings.HasPrefix(value, "[") {
+				// [IPv6] or [IPv6]:port
+				if end := strings.Index(value, "]"); end != -1 {
+					value = value[1:end]
+				}
+			} else if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+			out = append(out, value)
+		}
+	}
+	return out
+}
+
+// ParseIPOrCIDR accepts "1.2.3.4", "2001:db8::1" or "10.0.0.0/8"
+func ParseIPOrCIDR(s string) *net.IPNet {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	return ipNet
+}
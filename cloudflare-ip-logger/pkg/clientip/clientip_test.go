@@ -0,0 +1,104 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	ranges := NewCloudflareRanges(filepath.Join(t.TempDir(), "none"))
+	tests := []struct {
+		name    string
+		headers string
+		trusted string
+		peer    string
+		header  map[string]string
+		want    string
+	}{
+		{"no headers", DefaultHeaders, "", "198.51.100.1:1234", nil, "198.51.100.1"},
+		{"cf-connecting-ip from any peer", DefaultHeaders, "", "198.51.100.1:1234",
+			map[string]string{"CF-Connecting-IP": "203.0.113.5"}, "203.0.113.5"},
+		{"invalid header falls through", DefaultHeaders, "", "198.51.100.1:1234",
+			map[string]string{"CF-Connecting-IP": "nope", "X-Forwarded-For": "203.0.113.6"}, "203.0.113.6"},
+		{"xff leftmost when unrestricted", DefaultHeaders, "", "198.51.100.1:1234",
+			map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		{"untrusted peer ignores headers", DefaultHeaders, "10.0.0.0/8", "198.51.100.1:1234",
+			map[string]string{"CF-Connecting-IP": "203.0.113.5"}, "198.51.100.1"},
+		{"trusted peer", DefaultHeaders, "10.0.0.0/8", "10.1.2.3:1234",
+			map[string]string{"CF-Connecting-IP": "203.0.113.5"}, "203.0.113.5"},
+		{"xff skips trusted proxies from the right", "X-Forwarded-For", "10.0.0.0/8", "10.1.2.3:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.8, 10.0.0.2"}, "203.0.113.8"},
+		{"cloudflare keyword", DefaultHeaders, "cloudflare", "173.245.48.1:443",
+			map[string]string{"CF-Connecting-IP": "203.0.113.9"}, "203.0.113.9"},
+		{"cloudflare keyword, other peer", DefaultHeaders, "cloudflare", "198.51.100.1:443",
+			map[string]string{"CF-Connecting-IP": "203.0.113.9"}, "198.51.100.1"},
+		{"forwarded ipv6 with port", "Forwarded", "", "[::1]:80",
+			map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https`}, "2001:db8:cafe::17"},
+		{"forwarded unknown falls back to peer", "Forwarded", "", "[::1]:80",
+			map[string]string{"Forwarded": "for=unknown"}, "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPolicy(tt.headers, tt.trusted, ranges)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := p.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestViaCloudflare(t *testing.T) {
+	ranges := NewCloudflareRanges(filepath.Join(t.TempDir(), "none"))
+	tests := []struct {
+		name    string
+		trusted string
+		peer    string
+		ray     string
+		want    bool
+	}{
+		{"edge peer", "", "104.16.0.1:443", "", true},
+		{"cloudflared with ray", "", "127.0.0.1:1234", "8a1b2c3d4e5f-AMS", true},
+		{"untrusted peer with ray", "10.0.0.0/8", "198.51.100.1:1234", "8a1b2c3d4e5f-AMS", false},
+		{"direct", "", "198.51.100.1:1234", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPolicy(DefaultHeaders, tt.trusted, ranges)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			if tt.ray != "" {
+				r.Header.Set("CF-Ray", tt.ray)
+			}
+			if got := p.ViaCloudflare(r); got != tt.want {
+				t.Errorf("ViaCloudflare() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIPOrCIDR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" for nil
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"not-an-ip", ""},
+		{"10.0.0.0/33", ""},
+	}
+	for _, tt := range tests {
+		got := ParseIPOrCIDR(tt.in)
+		if (got == nil) != (tt.want == "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("ParseIPOrCIDR(%q) = %v, want %q", tt.in, got, tt.want)
+		}
+	}
+}
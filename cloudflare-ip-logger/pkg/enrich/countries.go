@@ -0,0 +1,194 @@
+package enrich
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Rows without a country: cf-log-parser imports and requests that arrived
+// without CF-IPCountry
+const missingCountry = "country IN ('', 'XX')"
+
+// CountMissing counts the rows a backfill would look at
+func CountMissing(db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM connections WHERE " + missingCountry).Scan(&n)
+	return n, err
+}
+
+// CountryLookup resolves an IP to an ISO country code, "" when unknown;
+// *GeoIP is one
+type CountryLookup interface {
+	Country(ip string) string
+}
+
+// Countries resolves rows without a country through geo and updates
+// them, batch rows per transaction, calling progress after every batch with
+// the rows looked at and updated so far. Rows the database doesn't know are
+// left as they are.
+func Countries(db *sql.DB, geo CountryLookup, batch int, progress func(processed, updated int)) error {
+	var lastID int64
+	processed, updated := 0, 0
+	for {
+		rows, err := db.Query("SELECT id, client_ip FROM connections WHERE "+missingCountry+
+			" AND id > ? ORDER BY id LIMIT ?", lastID, batch)
+		if err != nil {
+			return err
+		}
+		// Resolve each IP once per batch; history is dominated by repeat visitors
+		countries := make(map[string]string)
+		byCountry := make(map[string][]int64)
+		n := 0
+		for rows.Next() {
+			var id int64
+			var ip string
+			if err := rows.Scan(&id, &ip); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			lastID = id
+			country, ok := countries[ip]
+			if !ok {
+				country = geo.Country(ip)
+				countries[ip] = country
+			}
+			if country != "" {
+				byCountry[country] = append(byCountry[country], id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare("UPDATE connections SET country = ? WHERE id = ?")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for country, ids := range byCountry {
+			for _, id := range ids {
+				if _, err := stmt.Exec(country, id); err != nil {
+					tx.Rollback()
+					return err
+				}
+				updated++
+			}
+		}
+		stmt.Close()
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		processed += n
+		progress(processed, updated)
+	}
+}
+
+// Progress is the state of the last country backfill started through a Job
+type Progress struct {
+	Running    bool   `json:"running"`
+	Database   string `json:"database,omitempty"` // the one being worked on
+	Total      int    `json:"total"`              // rows without a country at the start
+	Processed  int    `json:"processed"`
+	Updated    int    `json:"updated"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Job runs at most one backfill at a time in the background
+type Job struct {
+	geo CountryLookup
+
+	mu    sync.Mutex
+	state Progress
+}
+
+func NewJob(geo CountryLookup) *Job {
+	return &Job{geo: geo}
+}
+
+func (j *Job) Progress() Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state
+}
+
+// Start begins a backfill over dbs unless one is running, and reports
+// whether it did
+func (j *Job) Start(dbs map[string]*sql.DB) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state.Running {
+		return false
+	}
+	j.state = Progress{Running: true, StartedAt: store.FormatTime(time.Now())}
+	go j.run(dbs)
+	return true
+}
+
+func (j *Job) run(dbs map[string]*sql.DB) {
+	names := make([]string, 0, len(dbs))
+	total := 0
+	for name, db := range dbs {
+		n, err := CountMissing(db)
+		if err != nil {
+			j.finish(fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		names = append(names, name)
+		total += n
+	}
+	sort.Strings(names)
+	j.mu.Lock()
+	j.state.Total = total
+	j.mu.Unlock()
+	slog.Info("Country backfill started", "rows", total)
+
+	var doneProcessed, doneUpdated int
+	for _, name := range names {
+		j.mu.Lock()
+		j.state.Database = name
+		j.mu.Unlock()
+		err := Countries(dbs[name], j.geo, 1000, func(processed, updated int) {
+			j.mu.Lock()
+			j.state.Processed, j.state.Updated = doneProcessed+processed, doneUpdated+updated
+			j.mu.Unlock()
+		})
+		if err != nil {
+			j.finish(fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		p := j.Progress()
+		doneProcessed, doneUpdated = p.Processed, p.Updated
+	}
+	j.finish(nil)
+}
+
+func (j *Job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state.Running = false
+	j.state.Database = ""
+	j.state.FinishedAt = store.FormatTime(time.Now())
+	if err != nil {
+		j.state.Error = err.Error()
+		slog.Error("Country backfill failed", "err", err)
+		return
+	}
+	slog.Info("Country backfill finished", "resolved", j.state.Updated, "rows", j.state.Processed)
+}
@@ -0,0 +1,61 @@
+package enrich
+
+import (
+	"path/filepath"
+	"testing"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// countries is a CountryLookup backed by a map
+type countries map[string]string
+
+func (c countries) Country(ip string) string { return c[ip] }
+
+func TestCountries(t *testing.T) {
+	db, err := store.Open(filepath.Join(t.TempDir(), "connections.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := store.CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	geo := countries{"192.0.2.1": "DE", "192.0.2.2": "NL"}
+	tests := []struct {
+		ip, country, want string
+	}{
+		{"192.0.2.1", "", "DE"},
+		{"192.0.2.1", "XX", "DE"},
+		{"192.0.2.2", "XX", "NL"},
+		{"192.0.2.2", "US", "US"}, // Cloudflare's answer is kept
+		{"192.0.2.3", "XX", "XX"}, // unknown to the database
+		{"192.0.2.1", "", "DE"},
+	}
+	for _, tt := range tests {
+		if _, err := db.Exec("INSERT INTO connections (client_ip, country) VALUES (?, ?)", tt.ip, tt.country); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	missing, err := CountMissing(db)
+	if err != nil || missing != 5 {
+		t.Fatalf("CountMissing() = %d, %v; want 5", missing, err)
+	}
+	var processed, updated int
+	// Batches of 2 so the id cursor crosses batch boundaries
+	err = Countries(db, geo, 2, func(p, u int) { processed, updated = p, u })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed != 5 || updated != 4 {
+		t.Errorf("processed %d, updated %d; want 5, 4", processed, updated)
+	}
+	for i, tt := range tests {
+		var got string
+		db.QueryRow("SELECT country FROM connections WHERE id = ?", i+1).Scan(&got)
+		if got != tt.want {
+			t.Errorf("row %d (%s, %q): country %q, want %q", i+1, tt.ip, tt.country, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package enrich fills in what incoming requests didn't carry, such as the
+// country of rows stored without CF-IPCountry, from a MaxMind-format
+// database.
+package enrich
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP resolves client IPs to countries from a MaxMind-format database
+// (GeoLite2-Country, GeoLite2-City, DB-IP Lite and compatible .mmdb files),
+// for rows recorded without a CF-IPCountry header
+type GeoIP struct {
+	db *maxminddb.Reader
+}
+
+// OpenGeoIP opens a .mmdb file
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{db: db}, nil
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Country returns the ISO code for ip as Cloudflare reports it, or "" when
+// the database doesn't know it
+func (g *GeoIP) Country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	var rec geoIPRecord
+	if err := g.db.Lookup(parsed, &rec); err != nil {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	// Anycast and some hosting ranges only have the registrant's country
+	return rec.RegisteredCountry.ISOCode
+}
+
+// ASN returns the autonomous system for ip from an ASN database
+// (GeoLite2-ASN); 0 when unknown
+func (g *GeoIP) ASN(ip string) (uint, string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, ""
+	}
+	var rec struct {
+		Number       uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
+	if err := g.db.Lookup(parsed, &rec); err != nil {
+		return 0, ""
+	}
+	return rec.Number, rec.Organization
+}
+
+func (g *GeoIP) Close() error {
+	return g.db.Close()
+}
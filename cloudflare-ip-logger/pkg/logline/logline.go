@@ -0,0 +1,232 @@
+// Package logline turns cloudflared and nginx log lines into requests. It is
+// shared by cf-log-parser, which tails files, and the proxy's syslog and
+// GELF listeners, which receive the same lines over the network.
+package logline
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Request is a client request found in a log line. Fields the line doesn't
+// carry are left empty; Time is zero when the line has no timestamp.
+type Request struct {
+	Time      time.Time
+	ClientIP  string
+	Method    string
+	Path      string
+	Host      string
+	UserAgent string
+	Referer   string
+	CFRay     string
+}
+
+// CloudflaredLogEntry represents a JSON log line from cloudflared
+type CloudflaredLogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	Msg       string `json:"msg"`
+	Origin    string `json:"originURL"`
+	ClientIP  string `json:"clientIP"`
+	CFRay     string `json:"cfRay"`
+	IP        string `json:"ip"`
+	Location  string `json:"location"`
+	FlowID    string `json:"flowId"`
+	Dest      string `json:"dest"`
+	Rule      int    `json:"ingressRule"`
+	Hostname  string `json:"hostname"`
+	Error     string `json:"error"`
+	ConnIndex int    `json:"connIndex"`
+	TraceID   string `json:"traceId"`
+	Status    int    `json:"status"`
+	Duration  int64  `json:"duration"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	RuleName  string `json:"ruleName"`
+}
+
+// Regex patterns for non-JSON logs
+var (
+	// Pattern: time="2024-01-15T10:30:00Z" level=info msg="Request" ip=1.2.3.4 host=example.com
+	logfmtPattern = regexp.MustCompile(`(?:ip|clientIP|client_ip)=["']?([0-9a-fA-F.:]+)["']?`)
+	hostPattern   = regexp.MustCompile(`(?:host|hostname)=["']?([a-zA-Z0-9.-]+)["']?`)
+	pathPattern   = regexp.MustCompile(`(?:path|uri|url)=["']?([^\s"']+)["']?`)
+	methodPattern = regexp.MustCompile(`(?:method)=["']?([A-Z]+)["']?`)
+	rayPattern    = regexp.MustCompile(`(?:cfRay|cf_ray|ray)=["']?([0-9a-fA-F]+(?:-[A-Z]{3})?)["']?`)
+
+	// nginx/Apache combined format, optionally with the virtual host in
+	// front (Apache's vhost_combined, or nginx with "$host " prepended):
+	// [example.com[:443] ]1.2.3.4 - - [15/Jan/2024:10:30:00 +0000] "GET / HTTP/1.1" 200 512 "-" "curl/8.0"
+	combinedPattern = regexp.MustCompile(`^(?:([a-zA-Z0-9.-]+)(?::\d+)? )?([0-9a-fA-F.:]+) \S+ \S+ \[([^\]]+)\] "([A-Z]+) (\S+)[^"]*" \d{3} \S+(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+)
+
+// Combined log format %t timestamp layout
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Parse extracts the request from a cloudflared JSON or logfmt line or an
+// nginx combined log line. It returns nil for lines that aren't about a
+// request (startup and tunnel messages), and an error for malformed JSON.
+func Parse(line string) (*Request, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+
+	// Try JSON first
+	if strings.HasPrefix(line, "{") {
+		return parseJSON(line)
+	}
+	if req := parseCombined(line); req != nil {
+		return req, nil
+	}
+
+	// Fall back to regex parsing
+	return parseLogfmt(line), nil
+}
+
+func parseJSON(line string) (*Request, error) {
+	var entry CloudflaredLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil, err
+	}
+
+	// Extract client IP from various possible fields
+	clientIP := entry.ClientIP
+	if clientIP == "" {
+		clientIP = entry.IP
+	}
+
+	msg := entry.Message
+	if msg == "" {
+		msg = entry.Msg
+	}
+
+	// Skip if no useful request info
+	if clientIP == "" && entry.Hostname == "" {
+		// Check if it's a request-related message
+		if !strings.Contains(strings.ToLower(msg), "request") &&
+			!strings.Contains(strings.ToLower(msg), "http") {
+			return nil, nil
+		}
+	}
+
+	// Skip internal/infrastructure messages
+	if strings.Contains(msg, "Registered tunnel connection") ||
+		strings.Contains(msg, "Initial protocol") ||
+		strings.Contains(msg, "Connection established") {
+		return nil, nil
+	}
+
+	// Only log if we have at least an IP or hostname
+	if clientIP == "" && entry.Hostname == "" && entry.Origin == "" {
+		return nil, nil
+	}
+
+	req := &Request{ClientIP: clientIP, Host: entry.Hostname, Path: entry.Path, Method: entry.Method, CFRay: entry.CFRay}
+	if entry.Time != "" {
+		if t, err := time.Parse(time.RFC3339, entry.Time); err == nil {
+			req.Time = t
+		}
+	}
+
+	// Extract hostname and path from origin URL if not set
+	if req.Host == "" && entry.Origin != "" {
+		req.Host = extractHostFromURL(entry.Origin)
+	}
+	if req.Path == "" && entry.Origin != "" {
+		req.Path = extractPathFromURL(entry.Origin)
+	}
+	if req.Method == "" {
+		req.Method = "GET"
+	}
+	return req, nil
+}
+
+func parseLogfmt(line string) *Request {
+	// Extract fields using regex
+	req := &Request{}
+	if matches := logfmtPattern.FindStringSubmatch(line); len(matches) > 1 {
+		req.ClientIP = matches[1]
+	}
+	if matches := hostPattern.FindStringSubmatch(line); len(matches) > 1 {
+		req.Host = matches[1]
+	}
+	if matches := pathPattern.FindStringSubmatch(line); len(matches) > 1 {
+		req.Path = matches[1]
+	}
+	if matches := methodPattern.FindStringSubmatch(line); len(matches) > 1 {
+		req.Method = matches[1]
+	}
+
+	// Skip if no useful info
+	if req.ClientIP == "" && req.Host == "" {
+		return nil
+	}
+
+	if req.Method == "" {
+		req.Method = "GET"
+	}
+	if matches := rayPattern.FindStringSubmatch(line); len(matches) > 1 {
+		req.CFRay = matches[1]
+	}
+	return req
+}
+
+// parseCombined reads an nginx/Apache combined (or common) log line; nil if
+// line isn't one
+func parseCombined(line string) *Request {
+	m := combinedPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	t, err := time.Parse(clfTimeLayout, m[3])
+	if err != nil {
+		return nil
+	}
+	return &Request{
+		Time:      t,
+		Host:      strings.ToLower(m[1]),
+		ClientIP:  m[2],
+		Method:    m[4],
+		Path:      m[5],
+		Referer:   unescapeCombined(m[6]),
+		UserAgent: unescapeCombined(m[7]),
+	}
+}
+
+// unescapeCombined undoes the \" and \\ escaping in quoted fields and maps
+// "-" (no value) to ""
+func unescapeCombined(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+func extractHostFromURL(url string) string {
+	// Remove protocol
+	url = strings.TrimPrefix(url, "http://")
+	url = strings.TrimPrefix(url, "https://")
+	// Get host part
+	if idx := strings.Index(url, "/"); idx != -1 {
+		url = url[:idx]
+	}
+	if idx := strings.Index(url, ":"); idx != -1 {
+		url = url[:idx]
+	}
+	return url
+}
+
+func extractPathFromURL(url string) string {
+	// Remove protocol
+	url = strings.TrimPrefix(url, "http://")
+	url = strings.TrimPrefix(url, "https://")
+	// Get path part
+	if idx := strings.Index(url, "/"); idx != -1 {
+		return url[idx:]
+	}
+	return "/"
+}
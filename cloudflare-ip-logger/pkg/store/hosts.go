@@ -0,0 +1,79 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// PRAGMA user_version once connections.host holds HostKey values
+const schemaVersionHostKeys = 3
+
+// HostKey is how a Host header is stored: lower-cased, without the port
+func HostKey(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// migrateHostKeys rewrites hosts stored as raw Host headers (mixed case, with
+// a port) to their HostKey, once per database file. Read-only databases are
+// left for a writable instance to convert.
+func migrateHostKeys(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= schemaVersionHostKeys || IsReadOnly(db) {
+		return nil
+	}
+	rows, err := db.Query("SELECT DISTINCT host FROM connections WHERE host GLOB '*[A-Z:]*'")
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	for rows.Next() {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			rows.Close()
+			return err
+		}
+		hosts = append(hosts, host)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var rewritten int64
+	for _, host := range hosts {
+		key := HostKey(host)
+		if key == host {
+			continue
+		}
+		res, err := db.Exec("UPDATE connections SET host = ? WHERE host = ?", key, host)
+		if err != nil {
+			return fmt.Errorf("rewrite host %q: %w", host, err)
+		}
+		n, _ := res.RowsAffected()
+		rewritten += n
+	}
+	if rewritten > 0 {
+		log.Printf("Rewrote %d connections.host values to lower case without the port", rewritten)
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersionHostKeys))
+	return err
+}
+
+// FoldHost moves rows stored under alias to host, for aliases added after
+// their traffic was logged
+func FoldHost(db *sql.DB, alias, host string) (int64, error) {
+	res, err := db.Exec("UPDATE connections SET host = ? WHERE host = ?", host, alias)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
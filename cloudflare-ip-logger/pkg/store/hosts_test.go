@@ -0,0 +1,81 @@
+package store
+
+import "testing"
+
+func TestHostKey(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"blog.example.com", "blog.example.com"},
+		{"Blog.Example.com", "blog.example.com"},
+		{"blog.example.com:443", "blog.example.com"},
+		{"BLOG.example.com:8080", "blog.example.com"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := HostKey(tt.in); got != tt.want {
+			t.Errorf("HostKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCreateSchemaRewritesHostKeys(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(originalConnections); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"blog.example.com", "Blog.example.com", "blog.example.com:443", "shop.example.com"} {
+		db.Exec("INSERT INTO connections (timestamp, client_ip, host) VALUES ('2024-01-01T12:00:00Z', '192.0.2.1', ?)", host)
+	}
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	rows, err := db.Query("SELECT host, COUNT(*) FROM connections GROUP BY host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var host string
+		var n int
+		rows.Scan(&host, &n)
+		counts[host] = n
+	}
+	if len(counts) != 2 || counts["blog.example.com"] != 3 || counts["shop.example.com"] != 1 {
+		t.Errorf("hosts after CreateSchema = %v", counts)
+	}
+
+	// Done once: raw hosts written later are left to the writer
+	db.Exec("INSERT INTO connections (timestamp, client_ip, host) VALUES ('2024-01-01T12:00:00Z', '192.0.2.1', 'Blog.example.com')")
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	var raw int
+	db.QueryRow("SELECT COUNT(*) FROM connections WHERE host = 'Blog.example.com'").Scan(&raw)
+	if raw != 1 {
+		t.Errorf("second CreateSchema rewrote hosts again")
+	}
+}
+
+func TestFoldHost(t *testing.T) {
+	db := openTestDB(t)
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"www.example.com", "www.example.com", "example.com", "other.example.com"} {
+		db.Exec("INSERT INTO connections (client_ip, host) VALUES ('192.0.2.1', ?)", host)
+	}
+	n, err := FoldHost(db, "www.example.com", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("FoldHost moved %d rows, want 2", n)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM connections WHERE host = 'example.com'").Scan(&left)
+	if left != 3 {
+		t.Errorf("example.com has %d rows, want 3", left)
+	}
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// key is the SQLCipher passphrase for every database file this process
+// opens; empty means unencrypted. Set once at startup by LoadKey.
+var key string
+
+// LoadKey reads the key from DB_KEY or the file named by DB_KEY_FILE
+func LoadKey() error {
+	k := os.Getenv("DB_KEY")
+	if path := os.Getenv("DB_KEY_FILE"); path != "" && k == "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		k = strings.TrimRight(string(data), "\r\n")
+	}
+	if k != "" && !SQLCipher {
+		return errors.New("DB_KEY is set but this binary was built without -tags sqlcipher")
+	}
+	key = k
+	return nil
+}
+
+// Key returns the loaded passphrase, for attaching further database files
+func Key() string {
+	return key
+}
+
+// DSN returns the connection string for a database file, keyed when
+// encryption is on
+func DSN(path string) string {
+	dsn := path + "?_journal_mode=WAL"
+	if key != "" {
+		dsn = path + "?_pragma_key=" + url.QueryEscape(key) + "&_pragma_cipher_page_size=4096&_journal_mode=WAL"
+	}
+	return dsn
+}
+
+// Open opens a database file with the loaded key
+func Open(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", DSN(path))
+}
+
+// OpenReadOnly opens an existing database file for queries only; statements
+// that would change it fail, so a replicated copy is never written to
+func OpenReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	dsn := path + "?_query_only=true"
+	if key != "" {
+		dsn += "&_pragma_key=" + url.QueryEscape(key) + "&_pragma_cipher_page_size=4096"
+	}
+	return sql.Open("sqlite3", dsn)
+}
+
+// IsReadOnly reports whether db was opened with OpenReadOnly
+func IsReadOnly(db *sql.DB) bool {
+	var on bool
+	db.QueryRow("PRAGMA query_only").Scan(&on)
+	return on
+}
+
+// OpenMemory opens a database that lives only in this process's memory,
+// shared by every connection in the pool under the same name. It uses
+// SQLite's memdb VFS, so locking and busy timeouts behave as they do on disk.
+// The database is gone once the last connection closes.
+func OpenMemory(name string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:/"+url.PathEscape(name)+"?vfs=memdb&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// Idle connections are what keep the data alive
+	db.SetMaxIdleConns(4)
+	db.SetConnMaxIdleTime(0)
+	db.SetConnMaxLifetime(0)
+	return db, nil
+}
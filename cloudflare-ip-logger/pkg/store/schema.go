@@ -0,0 +1,185 @@
+// Package store holds the SQLite connection log shared by the proxy and
+// cf-log-parser: the schema and its migrations, UTC timestamps, sequence IDs
+// and opening (optionally SQLCipher-encrypted) database files.
+package store
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// CreateSchema creates the connections table and brings databases written by
+// older versions up to date: UTC timestamps, added columns, sequence IDs and
+// host keys
+func CreateSchema(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS connections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ', 'now')),
+		client_ip TEXT NOT NULL,
+		country TEXT,
+		method TEXT,
+		path TEXT,
+		host TEXT,
+		user_agent TEXT,
+		referer TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_timestamp ON connections(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_client_ip ON connections(client_ip);
+	CREATE INDEX IF NOT EXISTS idx_country ON connections(country);
+	CREATE INDEX IF NOT EXISTS idx_host ON connections(host);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	if err := migrateToUTC(db); err != nil {
+		return err
+	}
+
+	// Columns added after the original schema
+	if _, err := AddColumnIfMissing(db, "connections", "category", "TEXT NOT NULL DEFAULT 'visitor'"); err != nil {
+		return err
+	}
+	if _, err := AddColumnIfMissing(db, "connections", "via_cloudflare", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	added, err := AddColumnIfMissing(db, "connections", "source", "TEXT NOT NULL DEFAULT 'proxy'")
+	if err != nil {
+		return err
+	}
+	if added {
+		// Rows written by older cf-log-parser versions never had a country
+		if _, err := db.Exec("UPDATE connections SET source = 'logparser' WHERE country = ''"); err != nil {
+			return err
+		}
+	}
+	if _, err := AddColumnIfMissing(db, "connections", "seq", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := backfillSeq(db); err != nil {
+		return err
+	}
+	for _, col := range []string{"cf_ray", "cf_visitor_scheme", "cf_worker", "cf_city", "cf_region"} {
+		if _, err := AddColumnIfMissing(db, "connections", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	// Extra request headers as a JSON object, for routes that log them
+	if _, err := AddColumnIfMissing(db, "connections", "headers", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Set on requests over the proxy's own TLS listener
+	for _, col := range []string{"tls_version", "tls_cipher", "tls_sni", "tls_alpn", "tls_ja3"} {
+		if _, err := AddColumnIfMissing(db, "connections", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+
+	// Set on requests whose Host matched no route, scanner noise mostly
+	if _, err := AddColumnIfMissing(db, "connections", "unmatched", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Name of the known network (KNOWN_NETWORKS) the client was in
+	if _, err := AddColumnIfMissing(db, "connections", "network", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// What a ban or limit did with the request, and which one
+	for _, col := range []string{"decision", "rule"} {
+		if _, err := AddColumnIfMissing(db, "connections", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	// Campaign parameters from the request's query string
+	for _, col := range []string{"utm_source", "utm_medium", "utm_campaign"} {
+		if _, err := AddColumnIfMissing(db, "connections", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_category ON connections(category);
+	CREATE INDEX IF NOT EXISTS idx_seq ON connections(seq);
+	CREATE INDEX IF NOT EXISTS idx_cf_ray ON connections(cf_ray);
+	CREATE INDEX IF NOT EXISTS idx_decision ON connections(decision) WHERE decision != '';
+	CREATE INDEX IF NOT EXISTS idx_campaign ON connections(timestamp) WHERE utm_source != '' OR utm_medium != '' OR utm_campaign != '';
+	`)
+	if err != nil {
+		return err
+	}
+	return migrateHostKeys(db)
+}
+
+// AddColumnIfMissing adds a column unless the table already has it, and
+// reports whether it did
+func AddColumnIfMissing(db *sql.DB, table, column, decl string) (bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err == nil, err
+}
+
+// backfillSeq assigns sequence IDs to rows written before the seq column
+// existed, in batches, deriving them from timestamp and row id
+func backfillSeq(db *sql.DB) error {
+	total := 0
+	for {
+		rows, err := db.Query("SELECT id, timestamp FROM connections WHERE seq = '' ORDER BY id LIMIT 1000")
+		if err != nil {
+			return err
+		}
+		type pending struct {
+			id int64
+			ts time.Time
+		}
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.ts); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			break
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if _, err := tx.Exec("UPDATE connections SET seq = ? WHERE id = ?", SeqFromID(p.ts, p.id), p.id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		total += len(batch)
+	}
+	if total > 0 {
+		log.Printf("Assigned sequence IDs to %d existing connections", total)
+	}
+	return nil
+}
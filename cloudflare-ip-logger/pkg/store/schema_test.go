@@ -0,0 +1,66 @@
+package store
+
+import "testing"
+
+// The original connections schema, before category, seq and the other columns
+const originalConnections = `CREATE TABLE connections (id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp DATETIME, client_ip TEXT NOT NULL, country TEXT, method TEXT, path TEXT,
+	host TEXT, user_agent TEXT, referer TEXT)`
+
+func TestAddColumnIfMissing(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		column    string
+		wantAdded bool
+	}{
+		{"name", false},
+		{"note", true},
+		{"note", false},
+	}
+	for _, tt := range tests {
+		added, err := AddColumnIfMissing(db, "t", tt.column, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != tt.wantAdded {
+			t.Errorf("AddColumnIfMissing(%q) = %v, want %v", tt.column, added, tt.wantAdded)
+		}
+	}
+}
+
+func TestCreateSchemaBackfillsSeq(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(originalConnections); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		db.Exec("INSERT INTO connections (timestamp, client_ip) VALUES ('2024-01-01T12:00:00Z', ?)", ip)
+	}
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	// Idempotent
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT seq, category FROM connections ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var last string
+	for rows.Next() {
+		var seq, category string
+		rows.Scan(&seq, &category)
+		if len(seq) != 26 || seq <= last {
+			t.Errorf("seq %q after %q", seq, last)
+		}
+		if category != "visitor" {
+			t.Errorf("category = %q, want the default", category)
+		}
+		last = seq
+	}
+}
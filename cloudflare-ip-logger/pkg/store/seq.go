@@ -0,0 +1,75 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Crockford base32, as used by ULID
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// SeqGenerator produces lexically sortable 26-character IDs: 48 bits of
+// millisecond time followed by 80 bits of entropy. IDs generated within the
+// same millisecond increment the entropy instead of re-randomizing, so the
+// sequence stays strictly monotonic even when timestamps tie.
+type SeqGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+func (g *SeqGenerator) New(t time.Time) string {
+	ms := uint64(t.UnixMilli())
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ms == g.lastMs {
+		incrementEntropy(&g.entropy)
+	} else {
+		rand.Read(g.entropy[:])
+		g.lastMs = ms
+	}
+	return encodeULID(ms, g.entropy)
+}
+
+// SeqFromID builds a deterministic ULID for an existing row, using its
+// autoincrement id as entropy so rows sharing a timestamp keep insert order
+func SeqFromID(t time.Time, id int64) string {
+	var entropy [10]byte
+	binary.BigEndian.PutUint64(entropy[2:], uint64(id))
+	return encodeULID(uint64(t.UnixMilli()), entropy)
+}
+
+func incrementEntropy(e *[10]byte) {
+	for i := len(e) - 1; i >= 0; i-- {
+		e[i]++
+		if e[i] != 0 {
+			return
+		}
+	}
+}
+
+func encodeULID(ms uint64, entropy [10]byte) string {
+	var id [16]byte
+	id[0] = byte(ms >> 40)
+	id[1] = byte(ms >> 32)
+	id[2] = byte(ms >> 24)
+	id[3] = byte(ms >> 16)
+	id[4] = byte(ms >> 8)
+	id[5] = byte(ms)
+	copy(id[6:], entropy[:])
+
+	// 128 bits -> 26 base32 characters (the first carries only 3 bits)
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
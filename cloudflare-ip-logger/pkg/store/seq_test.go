@@ -0,0 +1,60 @@
+package store
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSeqGeneratorIsMonotonic(t *testing.T) {
+	var g SeqGenerator
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		base,
+		base, // same millisecond: entropy is incremented
+		base,
+		base.Add(time.Millisecond),
+		base.Add(time.Second),
+	}
+	var ids []string
+	for _, at := range times {
+		ids = append(ids, g.New(at))
+	}
+	for i, id := range ids {
+		if len(id) != 26 {
+			t.Errorf("id %q has length %d", id, len(id))
+		}
+		if i > 0 && id <= ids[i-1] {
+			t.Errorf("id %d %q doesn't sort after %q", i, id, ids[i-1])
+		}
+	}
+}
+
+func TestSeqFromID(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at time.Time
+		id int64
+	}{
+		{base, 1},
+		{base, 2},
+		{base, 256},
+		{base.Add(time.Millisecond), 3},
+		{base.Add(time.Hour), 1},
+	}
+	var seqs []string
+	for _, tt := range tests {
+		seq := SeqFromID(tt.at, tt.id)
+		if seq != SeqFromID(tt.at, tt.id) {
+			t.Errorf("SeqFromID(%v, %d) isn't deterministic", tt.at, tt.id)
+		}
+		seqs = append(seqs, seq)
+	}
+	if !sort.StringsAreSorted(seqs) {
+		t.Errorf("seqs don't sort by time, then id: %v", seqs)
+	}
+	// The first character carries the top 3 bits of the time
+	if got := SeqFromID(time.UnixMilli(0), 0); got != "00000000000000000000000000" {
+		t.Errorf("SeqFromID(0, 0) = %q", got)
+	}
+}
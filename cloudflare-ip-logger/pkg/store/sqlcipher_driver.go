@@ -0,0 +1,14 @@
+//go:build sqlcipher
+
+package store
+
+import (
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+// SQLCipher build: databases are encrypted with DB_KEY. The driver is a fork
+// of go-sqlite3 and registers itself under the same "sqlite3" name.
+const SQLCipher = true
+
+type Driver = sqlite3.SQLiteDriver
+type Conn = sqlite3.SQLiteConn
@@ -0,0 +1,13 @@
+//go:build !sqlcipher
+
+package store
+
+import (
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Plain SQLite build; `go build -tags sqlcipher` swaps in SQLCipher
+const SQLCipher = false
+
+type Driver = sqlite3.SQLiteDriver
+type Conn = sqlite3.SQLiteConn
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Timestamps are stored in UTC as RFC 3339 with second precision. The layout
+// sorts lexically, so range filters compare the text column directly.
+const TimeLayout = "2006-01-02T15:04:05Z"
+
+// Layout timestamps were stored in before UTC: local wall-clock time
+const LegacyTimeLayout = "2006-01-02 15:04:05"
+
+// PRAGMA user_version once connections.timestamp holds UTC, and once every
+// column in LegacyTimeColumns does
+const (
+	schemaVersionUTC    = 1
+	schemaVersionAllUTC = 2
+)
+
+// LegacyTimeColumns held local time before timestamps were stored in UTC
+var LegacyTimeColumns = []struct{ Table, Column string }{
+	{"connections", "timestamp"},
+	{"proxy_errors", "timestamp"},
+	{"admin_objects", "updated_at"},
+	{"maintenance", "updated_at"},
+}
+
+// Rows converted per transaction when a database is opened
+const convertBatch = 5000
+
+// FormatTime renders t in the stored layout
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
+
+// migrateToUTC converts the legacy time columns once per database file,
+// tracked with PRAGMA user_version, in batches and in the host's current
+// zone. Tables that don't exist yet are created by code writing UTC.
+func migrateToUTC(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= schemaVersionAllUTC {
+		return nil
+	}
+	for _, c := range LegacyTimeColumns {
+		if c.Table == "connections" && version >= schemaVersionUTC {
+			continue
+		}
+		// Checked first so converted databases also open read-only
+		pending, err := hasLegacyTimes(db, c.Table, c.Column)
+		if err != nil {
+			return err
+		}
+		if !pending {
+			continue
+		}
+		lastReport := time.Now()
+		converted, _, err := ConvertToUTCInBatches(db, c.Table, c.Column, time.Local, convertBatch, func(converted, skipped int64) {
+			if time.Since(lastReport) >= 5*time.Second {
+				log.Printf("Converting %s.%s to UTC: %d done", c.Table, c.Column, converted)
+				lastReport = time.Now()
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("convert %s.%s to UTC: %w", c.Table, c.Column, err)
+		}
+		log.Printf("Converted %d %s.%s values from local time to UTC", converted, c.Table, c.Column)
+	}
+	if IsReadOnly(db) {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersionAllUTC))
+	return err
+}
+
+// hasLegacyTimes reports whether table exists and has local-time values in
+// column
+func hasLegacyTimes(db *sql.DB, table, column string) (bool, error) {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists); err != nil || !exists {
+		return false, err
+	}
+	var pending bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ` + table + ` WHERE ` + column + ` NOT LIKE '%Z' AND strftime('%s', ` + column + `) IS NOT NULL)`).Scan(&pending)
+	return pending, err
+}
+
+// ConvertToUTCInBatches rewrites legacy local-time values in table.column to
+// UTC: they are read as wall-clock time in loc and rewritten batch rows per transaction,
+// in rowid order. Converted values end in Z and are skipped, so an
+// interrupted run resumes where it stopped. Values that don't parse are left
+// alone and counted as skipped. progress, if set, is called after each batch.
+func ConvertToUTCInBatches(db *sql.DB, table, column string, loc *time.Location, batch int, progress func(converted, skipped int64)) (converted, skipped int64, err error) {
+	var last int64
+	for {
+		// As text: the driver would parse DATETIME columns itself, as UTC
+		rows, err := db.Query(`SELECT rowid, CAST(`+column+` AS TEXT) FROM `+table+` WHERE rowid > ? AND `+column+` NOT LIKE '%Z'
+			ORDER BY rowid LIMIT ?`, last, batch)
+		if err != nil {
+			return converted, skipped, err
+		}
+		type update struct {
+			rowid int64
+			value string
+		}
+		var updates []update
+		n := 0
+		for rows.Next() {
+			var rowid int64
+			var value sql.NullString
+			if err := rows.Scan(&rowid, &value); err != nil {
+				rows.Close()
+				return converted, skipped, err
+			}
+			n++
+			last = rowid
+			t, err := time.ParseInLocation(LegacyTimeLayout, value.String, loc)
+			if err != nil {
+				skipped++
+				continue
+			}
+			updates = append(updates, update{rowid, FormatTime(t)})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return converted, skipped, err
+		}
+		if n == 0 {
+			return converted, skipped, nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return converted, skipped, err
+		}
+		stmt, err := tx.Prepare(`UPDATE ` + table + ` SET ` + column + ` = ? WHERE rowid = ?`)
+		if err != nil {
+			tx.Rollback()
+			return converted, skipped, err
+		}
+		for _, u := range updates {
+			if _, err := stmt.Exec(u.value, u.rowid); err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return converted, skipped, err
+			}
+		}
+		stmt.Close()
+		if err := tx.Commit(); err != nil {
+			return converted, skipped, err
+		}
+		converted += int64(len(updates))
+		if progress != nil {
+			progress(converted, skipped)
+		}
+	}
+}
+
+// MarkUTC records that the legacy time columns hold UTC, so opening the
+// database doesn't convert them again
+func MarkUTC(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= schemaVersionAllUTC {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersionAllUTC))
+	return err
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "connections.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestFormatTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		in   time.Time
+		want string
+	}{
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), "2024-01-01T12:00:00Z"},
+		{time.Date(2024, 1, 1, 12, 0, 0, 999999999, time.UTC), "2024-01-01T12:00:00Z"},
+		{time.Date(2024, 1, 1, 0, 30, 0, 0, berlin), "2023-12-31T23:30:00Z"},
+		{time.Date(2024, 7, 1, 12, 0, 0, 0, berlin), "2024-07-01T10:00:00Z"},
+	}
+	for _, tt := range tests {
+		if got := FormatTime(tt.in); got != tt.want {
+			t.Errorf("FormatTime(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConvertToUTCInBatches(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"2024-01-01 12:00:00", "2024-01-01T11:00:00Z"},
+		{"2024-07-01 12:00:00", "2024-07-01T10:00:00Z"},  // summer time
+		{"2024-01-01T09:00:00Z", "2024-01-01T09:00:00Z"}, // already UTC
+		{"garbage", "garbage"},
+	}
+	db := openTestDB(t)
+	if _, err := db.Exec("CREATE TABLE events (id INTEGER PRIMARY KEY, at TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		db.Exec("INSERT INTO events (at) VALUES (?)", tt.in)
+	}
+
+	// A batch of 1 checks that the rowid cursor moves past skipped rows
+	converted, skipped, err := ConvertToUTCInBatches(db, "events", "at", berlin, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted != 2 || skipped != 1 {
+		t.Errorf("converted %d, skipped %d; want 2, 1", converted, skipped)
+	}
+	for i, tt := range tests {
+		var got string
+		db.QueryRow("SELECT at FROM events WHERE id = ?", i+1).Scan(&got)
+		if got != tt.want {
+			t.Errorf("%q became %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCreateSchemaConvertsLegacyTimesOnce(t *testing.T) {
+	tests := []struct {
+		table, column, create string
+	}{
+		{"connections", "timestamp", originalConnections},
+		{"proxy_errors", "timestamp", "CREATE TABLE proxy_errors (id INTEGER PRIMARY KEY, timestamp DATETIME)"},
+		{"admin_objects", "updated_at", "CREATE TABLE admin_objects (id TEXT, updated_at DATETIME)"},
+		{"maintenance", "updated_at", "CREATE TABLE maintenance (host TEXT, updated_at DATETIME)"},
+	}
+	db := openTestDB(t)
+	for _, tt := range tests {
+		if _, err := db.Exec(tt.create); err != nil {
+			t.Fatal(err)
+		}
+		if tt.table == "connections" {
+			db.Exec("INSERT INTO connections (timestamp, client_ip) VALUES ('2024-01-01 12:00:00', '192.0.2.1')")
+		} else {
+			db.Exec("INSERT INTO " + tt.table + " (" + tt.column + ") VALUES ('2024-01-01 12:00:00')")
+		}
+	}
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	want := FormatTime(time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local))
+	for _, tt := range tests {
+		var got string
+		db.QueryRow("SELECT CAST(" + tt.column + " AS TEXT) FROM " + tt.table).Scan(&got)
+		if got != want {
+			t.Errorf("%s.%s = %q, want %q", tt.table, tt.column, got, want)
+		}
+	}
+	var version int
+	db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version < schemaVersionAllUTC {
+		t.Errorf("user_version = %d, want at least %d", version, schemaVersionAllUTC)
+	}
+
+	// Once marked, legacy values written later are left alone
+	db.Exec("INSERT INTO proxy_errors (timestamp) VALUES ('2024-01-02 12:00:00')")
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	var legacy int
+	db.QueryRow("SELECT COUNT(*) FROM proxy_errors WHERE timestamp NOT LIKE '%Z'").Scan(&legacy)
+	if legacy != 1 {
+		t.Errorf("second CreateSchema converted again")
+	}
+}
@@ -0,0 +1,133 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errTruncated = errors.New("cbor: truncated data")
+
+// Nesting limit, well above anything an authenticator sends
+const maxCBORDepth = 16
+
+// decodeCBOR reads the first CBOR item in data, returning it and the number
+// of bytes it took. Only what WebAuthn uses is supported: definite-length
+// integers, byte and text strings, arrays, maps and simple values. Integers
+// decode to int64, maps to map[interface{}]interface{}.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > maxCBORDepth {
+		return nil, 0, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, 0, errTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	n := 1
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(data) < 2 {
+			return nil, 0, errTruncated
+		}
+		arg, n = uint64(data[1]), 2
+	case info == 25:
+		if len(data) < 3 {
+			return nil, 0, errTruncated
+		}
+		arg, n = uint64(binary.BigEndian.Uint16(data[1:])), 3
+	case info == 26:
+		if len(data) < 5 {
+			return nil, 0, errTruncated
+		}
+		arg, n = uint64(binary.BigEndian.Uint32(data[1:])), 5
+	case info == 27:
+		if len(data) < 9 {
+			return nil, 0, errTruncated
+		}
+		arg, n = binary.BigEndian.Uint64(data[1:]), 9
+	default:
+		return nil, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0, 1:
+		if arg > 1<<63-1 {
+			return nil, 0, errors.New("cbor: integer overflows int64")
+		}
+		if major == 1 {
+			return -1 - int64(arg), n, nil
+		}
+		return int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, errTruncated
+		}
+		b := data[n : n+int(arg)]
+		if major == 3 {
+			return string(b), n + int(arg), nil
+		}
+		return append([]byte(nil), b...), n + int(arg), nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errTruncated
+		}
+		list := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, v)
+			n += used
+		}
+		return list, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errTruncated
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += used
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errors.New("cbor: unsupported map key type")
+			}
+			v, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += used
+			m[k] = v
+		}
+		return m, n, nil
+	case 6:
+		// Tags carry no meaning here; decode what they wrap
+		v, used, err := decodeCBORItem(data[n:], depth+1)
+		return v, n + used, err
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		case 25, 26, 27:
+			// Floats are skipped over, nothing in WebAuthn uses them
+			return nil, n, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("cbor: unsupported item 0x%02x", data[0])
+}
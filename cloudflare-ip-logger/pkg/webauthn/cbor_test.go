@@ -0,0 +1,114 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string // hex
+		want interface{}
+	}{
+		{"small uint", "17", int64(23)},
+		{"uint8", "1818", int64(24)},
+		{"uint16", "190100", int64(256)},
+		{"uint32", "1a000f4240", int64(1000000)},
+		{"negative", "26", int64(-7)},
+		{"negative uint16", "390100", int64(-257)},
+		{"bytes", "43010203", []byte{1, 2, 3}},
+		{"text", "6461757468", "auth"},
+		{"array", "820102", []interface{}{int64(1), int64(2)}},
+		{"map", "a2036161200a", map[interface{}]interface{}{int64(3): "a", int64(-1): int64(10)}},
+		{"tag", "c24101", []byte{1}},
+		{"false", "f4", false},
+		{"true", "f5", true},
+		{"null", "f6", nil},
+		{"float skipped", "f93c00", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.in)
+			// Trailing bytes belong to the next item and are left alone
+			got, n, err := decodeCBOR(append(data, 0xff))
+			if err != nil {
+				t.Fatalf("decodeCBOR(%s) error = %v", tt.in, err)
+			}
+			if n != len(data) {
+				t.Errorf("decodeCBOR(%s) used %d bytes, want %d", tt.in, n, len(data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCBOR(%s) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORAttestationObject(t *testing.T) {
+	data := mustDecode(t, titanAttestation)
+	v, n, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("used %d of %d bytes", n, len(data))
+	}
+	att := v.(map[interface{}]interface{})
+	if att["fmt"] != "none" {
+		t.Errorf("fmt = %v, want none", att["fmt"])
+	}
+	if authData, _ := att["authData"].([]byte); len(authData) != 196 {
+		t.Errorf("authData is %d bytes, want 196", len(authData))
+	}
+}
+
+func TestDecodeCBORTruncated(t *testing.T) {
+	for _, fixture := range []string{titanAttestation, touchIDAttestation} {
+		data := mustDecode(t, fixture)
+		for i := 0; i < len(data); i++ {
+			if _, _, err := decodeCBOR(data[:i]); !errors.Is(err, errTruncated) {
+				t.Fatalf("decodeCBOR of %d of %d bytes: error = %v, want %v", i, len(data), err, errTruncated)
+			}
+		}
+	}
+	// Lengths that claim more than is there, without allocating for them
+	for _, in := range []string{"5bffffffffffffffff", "9bffffffffffffffff", "bbffffffffffffffff", "1b00"} {
+		data, _ := hex.DecodeString(in)
+		if _, _, err := decodeCBOR(data); !errors.Is(err, errTruncated) {
+			t.Errorf("decodeCBOR(%s) error = %v, want %v", in, err, errTruncated)
+		}
+	}
+}
+
+func TestDecodeCBORRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr string
+	}{
+		{"nested too deeply", append(bytes.Repeat([]byte{0x81}, maxCBORDepth+1), 0x01), "nested too deeply"},
+		{"map nested too deeply", append(bytes.Repeat([]byte{0xa1, 0x01}, maxCBORDepth+1), 0x01), "nested too deeply"},
+		{"tags nested too deeply", append(bytes.Repeat([]byte{0xc0}, maxCBORDepth+1), 0x01), "nested too deeply"},
+		{"indefinite length", []byte{0x9f, 0x01, 0xff}, "unsupported additional info 31"},
+		{"reserved additional info", []byte{0x1c}, "unsupported additional info 28"},
+		{"integer overflow", []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "overflows int64"},
+		{"byte string map key", []byte{0xa1, 0x41, 0x00, 0x01}, "unsupported map key type"},
+		{"undefined simple value", []byte{0xe0}, "unsupported item 0xe0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeCBOR(tt.in); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("decodeCBOR(%x) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+		})
+	}
+	// The deepest nesting allowed still decodes
+	if _, _, err := decodeCBOR(append(bytes.Repeat([]byte{0x81}, maxCBORDepth), 0x01)); err != nil {
+		t.Errorf("nesting at the limit: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Package webauthn checks passkey (WebAuthn) registrations and sign-ins on
+// the server side. It verifies what the browser's navigator.credentials
+// calls return against the challenge that was sent: the origin, the relying
+// party, the user-presence flag and, for sign-ins, the signature made with
+// the key stored at registration. Attestation statements are not checked;
+// any authenticator the user owns is accepted, as with "none" attestation.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+// COSE algorithms the relying party accepts, in order of preference
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms lists the COSE algorithms to offer in pubKeyCredParams
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// RelyingParty is the site passkeys are registered for. ID is its domain
+// (passkeys work on it and its subdomains); Origins are the exact origins
+// the browser may report, e.g. https://iplog.example.com. With no Origins,
+// https on ID or any subdomain of it is accepted, and http for localhost.
+type RelyingParty struct {
+	ID      string
+	Origins []string
+}
+
+// Credential is a registered passkey
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key, as the authenticator sent it
+	SignCount uint32
+}
+
+// NewChallenge returns a random challenge for a registration or sign-in
+func NewChallenge() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// Encode is the base64url form binary values take in JSON to and from the
+// browser
+func Encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decode accepts base64url with or without padding
+func Decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// checkClientData verifies the browser's clientDataJSON
+func (rp RelyingParty) checkClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("invalid clientDataJSON: %w", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("clientDataJSON type is %q, expected %q", cd.Type, typ)
+	}
+	got, err := Decode(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if !rp.originAllowed(cd.Origin) {
+		return fmt.Errorf("origin %q not allowed for %s", cd.Origin, rp.ID)
+	}
+	return nil
+}
+
+func (rp RelyingParty) originAllowed(origin string) bool {
+	if len(rp.Origins) > 0 {
+		for _, o := range rp.Origins {
+			if strings.TrimSuffix(o, "/") == origin {
+				return true
+			}
+		}
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host != rp.ID && !strings.HasSuffix(host, "."+rp.ID) {
+		return false
+	}
+	return u.Scheme == "https" || (u.Scheme == "http" && rp.ID == "localhost")
+}
+
+// authData is the parsed authenticator data
+type authData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	credID    []byte
+	publicKey []byte
+}
+
+func parseAuthData(b []byte) (*authData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authData{rpIDHash: b[:32], flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+	// aaguid (16), credential ID length (2), credential ID, COSE key
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("credential ID truncated")
+	}
+	ad.credID, rest = rest[:idLen], rest[idLen:]
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("credential public key: %w", err)
+	}
+	ad.publicKey = rest[:n]
+	return ad, nil
+}
+
+func (rp RelyingParty) checkAuthData(ad *authData) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, want[:]) {
+		return fmt.Errorf("passkey is for a different site than %s", rp.ID)
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return errors.New("user presence not confirmed")
+	}
+	return nil
+}
+
+// VerifyRegistration checks the response to navigator.credentials.create()
+// for challenge and returns the new credential to store
+func (rp RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("attestation object: %w", err)
+	}
+	att, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+	raw, ok := att["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object has no authData")
+	}
+	ad, err := parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthData(ad); err != nil {
+		return nil, err
+	}
+	if ad.credID == nil {
+		return nil, errors.New("no attested credential data")
+	}
+	if _, err := parsePublicKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:        ad.credID,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks the response to navigator.credentials.get() for
+// challenge against cred, and returns cred's new signature counter. A
+// counter that didn't increase, when the authenticator keeps one, means the
+// passkey may have been cloned and the sign-in is refused.
+func (rp RelyingParty) VerifyAssertion(challenge []byte, cred Credential, clientDataJSON, authenticatorData, signature []byte) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthData(ad); err != nil {
+		return 0, err
+	}
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), hash[:]...)
+	if err := key.verify(signed, signature); err != nil {
+		return 0, err
+	}
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, fmt.Errorf("signature counter went from %d to %d; the passkey may have been cloned", cred.SignCount, ad.signCount)
+	}
+	return ad.signCount, nil
+}
+
+// publicKey is a parsed COSE_Key
+type publicKey struct {
+	key crypto.PublicKey
+}
+
+func (k publicKey) verify(data, sig []byte) error {
+	ok := false
+	switch pub := k.key.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(pub, sum[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// COSE_Key map labels
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // n for RSA
+	coseX   = -2 // e for RSA
+	coseY   = -3
+)
+
+func parsePublicKey(raw []byte) (publicKey, error) {
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return publicKey{}, fmt.Errorf("public key: %w", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return publicKey{}, errors.New("public key is not a COSE_Key map")
+	}
+	alg, _ := m[int64(coseAlg)].(int64)
+	kty, _ := m[int64(coseKty)].(int64)
+	bytesAt := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+	switch {
+	case alg == AlgES256 && kty == 2:
+		x, y := bytesAt(coseX), bytesAt(coseY)
+		if crv, _ := m[int64(coseCrv)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return publicKey{}, errors.New("ES256 key is not a P-256 point")
+		}
+		// Refuses points not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return publicKey{}, fmt.Errorf("ES256 key: %w", err)
+		}
+		return publicKey{&ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}}, nil
+	case alg == AlgEdDSA && kty == 1:
+		x := bytesAt(coseX)
+		if crv, _ := m[int64(coseCrv)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("EdDSA key is not an Ed25519 key")
+		}
+		return publicKey{ed25519.PublicKey(x)}, nil
+	case alg == AlgRS256 && kty == 3:
+		n, e := bytesAt(coseCrv), bytesAt(coseX)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return publicKey{}, errors.New("RS256 key is invalid or shorter than 2048 bits")
+		}
+		return publicKey{&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	}
+	return publicKey{}, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
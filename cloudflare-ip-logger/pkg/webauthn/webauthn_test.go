@@ -0,0 +1,160 @@
+package webauthn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Responses recorded from real authenticators, as published with the
+// go-webauthn test suite: a Titan key registered on webauthn.io with "none"
+// attestation, a MacBook's Touch ID registered on localhost with packed self
+// attestation, and the same Touch ID signing in on webauthn.io.
+const (
+	titanChallenge    = "sVt4ScceMzqFSnfAq8hgLzblvo3fa4_aFVEcIESHIJ0"
+	titanClientData   = "eyJjaGFsbGVuZ2UiOiJzVnQ0U2NjZU16cUZTbmZBcThoZ0x6Ymx2bzNmYTRfYUZWRWNJRVNISUowIiwib3JpZ2luIjoiaHR0cHM6Ly93ZWJhdXRobi5pbyIsInR5cGUiOiJ3ZWJhdXRobi5jcmVhdGUifQ"
+	titanAttestation  = "o2NmbXRkbm9uZWdhdHRTdG10oGhhdXRoRGF0YVjEdKbqkhPJnC90siSSsyDPQCYqlMGpUKA5fyklC2CEHvBBAAAAAAAAAAAAAAAAAAAAAAAAAAAAQOia8u9zP1lVg6Fy7BsUbAVVR6T1g6TctRExl1BLyS3UwJ-RMOpwxlOlvIjt2ZHCxKq_ggcL8dKdlgMc7fEYsEGlAQIDJiABIVgg--n_QvZithDycYmnifk6vMHiwBP6kugn2PlsnvkrcSgiWCBAlBYm2B-rMtQlp5MxGTLoGDHoktxb0p364Hy2BH9U2Q"
+	titanCredentialID = "6Jry73M_WVWDoXLsGxRsBVVHpPWDpNy1ETGXUEvJLdTAn5Ew6nDGU6W8iO3ZkcLEqr-CBwvx0p2WAxzt8RiwQQ"
+
+	touchIDChallenge    = "rWiex8xDOPfiCgyFu4BLW6vVOmXKgPwHrlMCgEs9SBA"
+	touchIDClientData   = "eyJjaGFsbGVuZ2UiOiJyV2lleDh4RE9QZmlDZ3lGdTRCTFc2dlZPbVhLZ1B3SHJsTUNnRXM5U0JBIiwib3JpZ2luIjoiaHR0cDovL2xvY2FsaG9zdDo5MDA1IiwidHlwZSI6IndlYmF1dGhuLmNyZWF0ZSJ9"
+	touchIDAttestation  = "o2NmbXRmcGFja2VkZ2F0dFN0bXSiY2FsZyZjc2lnWEcwRQIhAJgdgw5x8JzE4JfR6x1RBO8eCHNE8eW_L1VTV03zpyL5AiBv8eUzua3XSS3bPYC7m8eXzJhcaRyeGe7UcuqIrDSvC2hhdXRoRGF0YVi3SZYN5YgOjGh0NBcPZHZgW4_krrmihjLHmVzzuoMdl2NFXJE5zK3OAAI1vMYKZIsLJfHwVQMAMwDserxRhiE7ZcI4ahRbwJCZgc0s38BNXQWtX1Ufy7auS9-RSUTXYJF3vOL9_tExFTQkqaUBAgMmIAEhWCCm9OYidwiIoH9SwVQqUAnH8Gj5ZJ2_qr8gjbg41q4M1SJYIA07XKpHSgS1mE7R1MjotVIQqyHi9WAxGwHQsCteVK2V"
+	touchIDCredentialID = "AOx6vFGGITtlwjhqFFvAkJmBzSzfwE1dBa1fVR_Ltq5L35FJRNdgkXe84v3-0TEVNCSp"
+
+	// The sign-in's authenticator data still carries the attested key, which
+	// is what the signature verifies against
+	assertionChallenge  = "E4PTcIH_HfX1pC6Sigk1SC9NAlgeztN0439vi8z_c9k"
+	assertionClientData = "eyJjaGFsbGVuZ2UiOiJFNFBUY0lIX0hmWDFwQzZTaWdrMVNDOU5BbGdlenROMDQzOXZpOHpfYzlrIiwibmV3X2tleXNfbWF5X2JlX2FkZGVkX2hlcmUiOiJkbyBub3QgY29tcGFyZSBjbGllbnREYXRhSlNPTiBhZ2FpbnN0IGEgdGVtcGxhdGUuIFNlZSBodHRwczovL2dvby5nbC95YWJQZXgiLCJvcmlnaW4iOiJodHRwczovL3dlYmF1dGhuLmlvIiwidHlwZSI6IndlYmF1dGhuLmdldCJ9"
+	assertionAuthData   = "dKbqkhPJnC90siSSsyDPQCYqlMGpUKA5fyklC2CEHvBFXJJiGa3OAAI1vMYKZIsLJfHwVQMANwCOw-atj9C0vhWpfWU-whzNjeQS21Lpxfdk_G-omAtffWztpGoErlNOfuXWRqm9Uj9ANJck1p6lAQIDJiABIVggKAhfsdHcBIc0KPgAcRyAIK_-Vi-nCXHkRHPNaCMBZ-4iWCBxB8fGYQSBONi9uvq0gv95dGWlhJrBwCsj_a4LJQKVHQ"
+	assertionSignature  = "MEUCIBtIVOQxzFYdyWQyxaLR0tik1TnuPhGVhXVSNgFwLmN5AiEAnxXdCq0UeAVGWxOaFcjBZ_mEZoXqNboY5IkQDdlWZYc"
+	assertionSignCount  = 1553097241
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := Decode(s)
+	if err != nil {
+		t.Fatalf("Decode(%q): %v", s, err)
+	}
+	return b
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	webauthnIO := RelyingParty{ID: "webauthn.io"}
+	tests := []struct {
+		name        string
+		rp          RelyingParty
+		challenge   string
+		clientData  string
+		attestation string
+		wantID      string
+		wantCount   uint32
+		wantErr     string
+	}{
+		{"titan, none attestation", webauthnIO, titanChallenge, titanClientData, titanAttestation,
+			titanCredentialID, 0, ""},
+		{"touch id, packed self attestation", RelyingParty{ID: "localhost"}, touchIDChallenge, touchIDClientData, touchIDAttestation,
+			touchIDCredentialID, 1553021388, ""},
+		{"listed origin", RelyingParty{ID: "webauthn.io", Origins: []string{"https://webauthn.io"}}, titanChallenge, titanClientData, titanAttestation,
+			titanCredentialID, 0, ""},
+		{"wrong challenge", webauthnIO, touchIDChallenge, titanClientData, titanAttestation,
+			"", 0, "challenge mismatch"},
+		{"origin not listed", RelyingParty{ID: "webauthn.io", Origins: []string{"https://iplog.webauthn.io"}}, titanChallenge, titanClientData, titanAttestation,
+			"", 0, `origin "https://webauthn.io" not allowed`},
+		{"origin outside rp id", RelyingParty{ID: "example.com"}, titanChallenge, titanClientData, titanAttestation,
+			"", 0, "not allowed for example.com"},
+		{"rp id hash of another site", RelyingParty{ID: "example.com", Origins: []string{"https://webauthn.io"}}, titanChallenge, titanClientData, titanAttestation,
+			"", 0, "different site than example.com"},
+		{"sign-in response", webauthnIO, assertionChallenge, assertionClientData, titanAttestation,
+			"", 0, `type is "webauthn.get"`},
+		{"truncated attestation object", webauthnIO, titanChallenge, titanClientData, titanAttestation[:200],
+			"", 0, "truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := tt.rp.VerifyRegistration(mustDecode(t, tt.challenge), mustDecode(t, tt.clientData), mustDecode(t, tt.attestation))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("VerifyRegistration() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyRegistration() error = %v", err)
+			}
+			if !bytes.Equal(cred.ID, mustDecode(t, tt.wantID)) {
+				t.Errorf("credential ID = %s, want %s", Encode(cred.ID), tt.wantID)
+			}
+			if cred.SignCount != tt.wantCount {
+				t.Errorf("SignCount = %d, want %d", cred.SignCount, tt.wantCount)
+			}
+			if _, err := parsePublicKey(cred.PublicKey); err != nil {
+				t.Errorf("stored public key: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	ad, err := parseAuthData(mustDecode(t, assertionAuthData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := Credential{ID: ad.credID, PublicKey: ad.publicKey}
+	titan, err := RelyingParty{ID: "webauthn.io"}.VerifyRegistration(mustDecode(t, titanChallenge), mustDecode(t, titanClientData), mustDecode(t, titanAttestation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := mustDecode(t, assertionSignature)
+	tampered[10] ^= 0x01
+
+	webauthnIO := RelyingParty{ID: "webauthn.io"}
+	tests := []struct {
+		name       string
+		rp         RelyingParty
+		cred       Credential
+		challenge  string
+		clientData string
+		authData   string
+		signature  []byte
+		wantErr    string
+	}{
+		{"touch id", webauthnIO, cred, assertionChallenge, assertionClientData, assertionAuthData, nil, ""},
+		{"counter increased", webauthnIO, Credential{PublicKey: cred.PublicKey, SignCount: assertionSignCount - 1}, assertionChallenge, assertionClientData, assertionAuthData, nil, ""},
+		{"counter repeated", webauthnIO, Credential{PublicKey: cred.PublicKey, SignCount: assertionSignCount}, assertionChallenge, assertionClientData, assertionAuthData, nil,
+			"may have been cloned"},
+		{"counter went back", webauthnIO, Credential{PublicKey: cred.PublicKey, SignCount: assertionSignCount + 1}, assertionChallenge, assertionClientData, assertionAuthData, nil,
+			"may have been cloned"},
+		{"wrong challenge", webauthnIO, cred, titanChallenge, assertionClientData, assertionAuthData, nil, "challenge mismatch"},
+		{"origin not listed", RelyingParty{ID: "webauthn.io", Origins: []string{"https://iplog.webauthn.io"}}, cred, assertionChallenge, assertionClientData, assertionAuthData, nil,
+			"not allowed"},
+		{"rp id hash of another site", RelyingParty{ID: "example.com", Origins: []string{"https://webauthn.io"}}, cred, assertionChallenge, assertionClientData, assertionAuthData, nil,
+			"different site than example.com"},
+		{"registration response", webauthnIO, cred, titanChallenge, titanClientData, assertionAuthData, nil, `type is "webauthn.create"`},
+		{"tampered signature", webauthnIO, cred, assertionChallenge, assertionClientData, assertionAuthData, tampered, "invalid signature"},
+		{"another passkey's key", webauthnIO, *titan, assertionChallenge, assertionClientData, assertionAuthData, nil,
+			"invalid signature"},
+		{"truncated authenticator data", webauthnIO, cred, assertionChallenge, assertionClientData, assertionAuthData[:40], nil, "too short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := tt.signature
+			if sig == nil {
+				sig = mustDecode(t, assertionSignature)
+			}
+			count, err := tt.rp.VerifyAssertion(mustDecode(t, tt.challenge), tt.cred, mustDecode(t, tt.clientData), mustDecode(t, tt.authData), sig)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("VerifyAssertion() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyAssertion() error = %v", err)
+			}
+			if count != assertionSignCount {
+				t.Errorf("sign count = %d, want %d", count, assertionSignCount)
+			}
+		})
+	}
+}
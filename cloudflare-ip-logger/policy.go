@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PolicyTestRequest describes a request to try against the proxy's rules
+// without sending it
+type PolicyTestRequest struct {
+	IP         string            `json:"ip,omitempty"`          // client IP as resolved; derived from remote_addr and headers when empty
+	RemoteAddr string            `json:"remote_addr,omitempty"` // the connecting peer, e.g. a Cloudflare edge address
+	Country    string            `json:"country,omitempty"`     // sent as CF-IPCountry
+	Method     string            `json:"method,omitempty"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// PolicyRule is one check the request passes through, in the order the
+// proxy applies them
+type PolicyRule struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	Action  string `json:"action,omitempty"` // what a match does
+	Detail  string `json:"detail,omitempty"`
+}
+
+// PolicyTestResult is what the proxy would do with the request
+type PolicyTestResult struct {
+	ClientIP      string       `json:"client_ip"`
+	ViaCloudflare bool         `json:"via_cloudflare"`
+	Country       string       `json:"country"`
+	Route         string       `json:"route,omitempty"` // the configured host that would serve it
+	Unmatched     bool         `json:"unmatched"`       // the host has no route of its own
+	Category      string       `json:"category"`
+	Network       string       `json:"network,omitempty"` // the KNOWN_NETWORKS entry it would be labeled with
+	Logged        bool         `json:"logged"`
+	Verdict       string       `json:"verdict"`          // deny, asset, maintenance, websocket, proxy, static, misdirected, redirect, drop, dashboard or ip_info
+	Status        int          `json:"status,omitempty"` // when answered by the proxy itself
+	Rules         []PolicyRule `json:"rules"`
+}
+
+// POST /_proxy/policy/test - {"ip": "1.2.3.4", "host": "example.com", "path": "/robots.txt", "headers": {"User-Agent": "..."}}
+//
+// Runs the checks handleRequest would, without logging or forwarding
+// anything. Limits are reported as configured; whether a cap is full
+// depends on the traffic at the time.
+func (app *App) handlePolicyTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PolicyTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Host = strings.ToLower(strings.Split(req.Host, ":")[0])
+	if req.Host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+	if !requestUser(r).CanSee(req.Host) {
+		http.Error(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	if req.IP == "" && req.RemoteAddr == "" {
+		http.Error(w, "ip or remote_addr is required", http.StatusBadRequest)
+		return
+	}
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		http.Error(w, "Invalid ip", http.StatusBadRequest)
+		return
+	}
+	synthetic, err := req.httpRequest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.testPolicy(req, synthetic))
+}
+
+// httpRequest builds the request the proxy would have received
+func (req PolicyTestRequest) httpRequest() (*http.Request, error) {
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := req.Path
+	if path == "" {
+		path = "/"
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	r := &http.Request{Method: method, URL: u, RequestURI: path, Host: req.Host, Header: http.Header{}}
+	for name, value := range req.Headers {
+		r.Header.Set(name, value)
+	}
+	if req.Country != "" {
+		r.Header.Set("CF-IPCountry", strings.ToUpper(req.Country))
+	}
+	remote := req.RemoteAddr
+	if remote == "" {
+		remote = req.IP
+	}
+	if _, _, err := net.SplitHostPort(remote); err != nil {
+		remote = net.JoinHostPort(remote, "0")
+	}
+	r.RemoteAddr = remote
+	return r, nil
+}
+
+// testPolicy walks r through handleRequest's checks in order; the verdict
+// is the first rule that answers the request itself
+func (app *App) testPolicy(req PolicyTestRequest, r *http.Request) PolicyTestResult {
+	res := PolicyTestResult{Rules: []PolicyRule{}, Logged: true}
+	res.ClientIP = req.IP
+	if res.ClientIP == "" {
+		res.ClientIP = app.ipPolicy.ClientIP(r)
+	}
+	res.ViaCloudflare = app.ipPolicy.ViaCloudflare(r)
+	if res.Country = r.Header.Get("CF-IPCountry"); res.Country == "" {
+		res.Country = "XX"
+	}
+	res.Category = app.classifier.Classify(res.ClientIP, r.Header.Get("User-Agent"))
+	res.Network = app.networks.Label(res.ClientIP)
+
+	add := func(rule PolicyRule, verdict string, status int) {
+		res.Rules = append(res.Rules, rule)
+		if rule.Matched && verdict != "" && res.Verdict == "" {
+			res.Verdict, res.Status = verdict, status
+		}
+	}
+
+	// Bans are checked before anything is logged; observe-only bans and
+	// DRY_RUN just log the match
+	ban := PolicyRule{Rule: "ban", Action: "deny"}
+	banVerdict := "deny"
+	if b := app.bans.Match(res.ClientIP); b != nil {
+		ban.Matched = true
+		ban.Detail = b.CIDR
+		if b.Reason != "" {
+			ban.Detail += " (" + b.Reason + ")"
+		}
+		if b.ExpiresAt != "" {
+			ban.Detail += " until " + b.ExpiresAt
+		}
+		if b.Observe || app.dryRun {
+			ban.Action, banVerdict = "observe", ""
+		} else {
+			res.Logged = false
+		}
+	}
+	add(ban, banVerdict, http.StatusForbidden)
+
+	host, rt := app.lookupRoute(req.Host)
+	route := PolicyRule{Rule: "route", Action: "proxy"}
+	res.Unmatched = rt == nil
+	if rt == nil && validHostname(req.Host) {
+		host, rt = app.lookupRoute(app.routes.Load().defaultHost)
+		if rt != nil {
+			route.Detail = "default route; " + req.Host + " isn't configured"
+		}
+	} else if rt != nil && host != req.Host {
+		route.Detail = "alias of " + host
+	}
+	if rt == nil {
+		route.Detail = "no route for " + req.Host
+		add(route, "", 0)
+		if res.Verdict == "" {
+			res.Verdict, res.Status = app.unknownHosts.Verdict()
+		}
+		if res.Verdict == "" {
+			if r.URL.Path == "/" || r.URL.Path == "/dashboard" {
+				res.Verdict = "dashboard"
+			} else {
+				res.Verdict = "ip_info"
+			}
+			res.Status = http.StatusOK
+		}
+		return res
+	}
+	res.Route = host
+	route.Matched = true
+	if rt.static != nil {
+		route.Action = "static"
+	}
+	if route.Detail == "" {
+		route.Detail = host
+	}
+	add(route, "", 0)
+
+	table := app.routes.Load()
+	assets := table.assets[host]
+	asset := PolicyRule{Rule: "asset", Action: "serve"}
+	if rec := newPolicyRecorder(); assets.Serve(rec, r) {
+		asset.Matched = true
+		asset.Detail = r.URL.Path + " answered by the proxy"
+		add(asset, "asset", rec.status)
+	} else {
+		add(asset, "", 0)
+	}
+	if res.Verdict != "deny" && assets.Quiet(r.URL.Path) {
+		res.Logged = false
+	}
+
+	maint := PolicyRule{Rule: "maintenance", Action: "maintenance_page"}
+	if st, on := app.maintenance.Get(host); on {
+		maint.Matched = true
+		maint.Detail = fmt.Sprintf("retry after %ds", st.RetryAfter)
+	}
+	add(maint, "maintenance", http.StatusServiceUnavailable)
+
+	ws := PolicyRule{Rule: "websocket", Action: "tunnel", Matched: isWebSocketRequest(r) && rt.static == nil}
+	add(ws, "websocket", 0)
+
+	maxConcurrent, maxPerClient := app.limiter.Limits(host)
+	perClient := PolicyRule{Rule: "client_concurrency", Action: "429 when full", Matched: maxPerClient > 0}
+	backend := PolicyRule{Rule: "backend_concurrency", Action: "503 when full", Matched: maxConcurrent > 0}
+	if app.dryRun || table.observed[host] {
+		perClient.Action, backend.Action = "observe when full", "observe when full"
+	}
+	if perClient.Matched {
+		perClient.Detail = fmt.Sprintf("%d in flight per client", maxPerClient)
+	}
+	add(perClient, "", 0)
+	if backend.Matched {
+		backend.Detail = fmt.Sprintf("%d in flight", maxConcurrent)
+	}
+	add(backend, "", 0)
+
+	perConn, perIP := app.throttler.Limits(host)
+	bandwidth := PolicyRule{Rule: "bandwidth", Action: "throttle", Matched: perConn > 0 || perIP > 0}
+	if bandwidth.Matched {
+		bandwidth.Detail = fmt.Sprintf("%d B/s per response, %d B/s per IP (0 = unlimited)", perConn, perIP)
+	}
+	add(bandwidth, "", 0)
+
+	add(PolicyRule{Rule: "capture", Action: "record", Matched: app.capturer != nil && app.capturer.Wants(host)}, "", 0)
+	add(PolicyRule{Rule: "mirror", Action: "copy", Matched: table.mirrors[host] != nil}, "", 0)
+
+	if res.Verdict == "" {
+		res.Verdict = route.Action
+	}
+	return res
+}
+
+// policyRecorder takes the status of a response the proxy would answer
+// itself, discarding the body
+type policyRecorder struct {
+	header http.Header
+	status int
+}
+
+func newPolicyRecorder() *policyRecorder {
+	return &policyRecorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (p *policyRecorder) Header() http.Header         { return p.header }
+func (p *policyRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (p *policyRecorder) WriteHeader(status int)      { p.status = status }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// ipGrouping counts clients by network prefix instead of by address, so a
+// visitor whose IPv6 address rotates inside its /64 counts once. A length of
+// 0 keeps that family's addresses apart.
+type ipGrouping struct {
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+// parseIPGrouping reads ipv6_prefix (e.g. 64) and ipv4_prefix (e.g. 24)
+func parseIPGrouping(query url.Values) (ipGrouping, error) {
+	var g ipGrouping
+	for _, p := range []struct {
+		name string
+		bits int
+		dst  *int
+	}{{"ipv4_prefix", 32, &g.IPv4Prefix}, {"ipv6_prefix", 128, &g.IPv6Prefix}} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > p.bits {
+			return g, fmt.Errorf("%s must be between 1 and %d", p.name, p.bits)
+		}
+		if n < p.bits {
+			*p.dst = n
+		}
+	}
+	return g, nil
+}
+
+func (g ipGrouping) Enabled() bool {
+	return g.IPv4Prefix > 0 || g.IPv6Prefix > 0
+}
+
+// Key is the prefix ip belongs to in CIDR notation, or ip itself when its
+// family isn't grouped
+func (g ipGrouping) Key(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		if g.IPv4Prefix == 0 {
+			return ip
+		}
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(g.IPv4Prefix, 32)), Mask: net.CIDRMask(g.IPv4Prefix, 32)}).String()
+	}
+	if g.IPv6Prefix == 0 {
+		return ip
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(g.IPv6Prefix, 128)), Mask: net.CIDRMask(g.IPv6Prefix, 128)}).String()
+}
+
+// countDistinct runs a query returning (label, client_ip) pairs and counts
+// the distinct prefixes under each label
+func (g ipGrouping) countDistinct(db *sql.DB, query string, args ...interface{}) (map[string]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[string]map[string]bool)
+	for rows.Next() {
+		var label, ip string
+		if rows.Scan(&label, &ip) != nil {
+			continue
+		}
+		if seen[label] == nil {
+			seen[label] = make(map[string]bool)
+		}
+		seen[label][g.Key(ip)] = true
+	}
+	counts := make(map[string]int, len(seen))
+	for label, keys := range seen {
+		counts[label] = len(keys)
+	}
+	return counts, rows.Err()
+}
+
+// topPrefixes is /stats's top_ips by prefix: the busiest prefixes among the
+// requests matching where/args, with the country of their busiest address
+func (g ipGrouping) topPrefixes(db *sql.DB, where string, args []interface{}, limit int) ([]IPStats, error) {
+	rows, err := db.Query("SELECT client_ip, country, COUNT(*) AS hits, MIN(timestamp), MAX(timestamp) FROM connections"+where+
+		" GROUP BY client_ip ORDER BY hits DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make(map[string]*IPStats)
+	var order []*IPStats
+	for rows.Next() {
+		var ip, country, first, last string
+		var hits int
+		if rows.Scan(&ip, &country, &hits, &first, &last) != nil {
+			continue
+		}
+		key := g.Key(ip)
+		s := groups[key]
+		if s == nil {
+			// Rows come busiest first, so the first address sets the country
+			s = &IPStats{ClientIP: key, Country: country, FirstSeen: first, LastSeen: last}
+			groups[key] = s
+			order = append(order, s)
+		}
+		s.HitCount += hits
+		s.Addresses++
+		if first < s.FirstSeen {
+			s.FirstSeen = first
+		}
+		if last > s.LastSeen {
+			s.LastSeen = last
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].HitCount > order[j].HitCount })
+	if len(order) > limit {
+		order = order[:limit]
+	}
+	list := make([]IPStats, len(order))
+	for i, s := range order {
+		list[i] = *s
+	}
+	return list, nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Longest history a share link can show
+const maxShareDays = 365
+
+// shareLinkData is a share link as stored: like user tokens, the token only
+// as its SHA-256
+type shareLinkData struct {
+	Host        string `json:"host"`
+	Title       string `json:"title,omitempty"`
+	TZ          string `json:"tz,omitempty"`   // days are counted in this zone; UTC when empty
+	Days        int    `json:"days,omitempty"` // history shown, default 30
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	Token       string `json:"token,omitempty"` // on writes; returned once, never stored
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+}
+
+// ShareLinks are the tokenized URLs that show one host's traffic publicly
+type ShareLinks struct {
+	coll *sqlAdminCollection
+
+	mu      sync.RWMutex
+	byToken map[string]shareLinkData // by token hash
+}
+
+func NewShareLinks(db *sql.DB) (*ShareLinks, error) {
+	l := &ShareLinks{coll: &sqlAdminCollection{db: db, kind: "share-links"}}
+	return l, l.reload()
+}
+
+func (l *ShareLinks) reload() error {
+	objects, err := l.coll.List()
+	if err != nil {
+		return err
+	}
+	byToken := make(map[string]shareLinkData)
+	for _, o := range objects {
+		var d shareLinkData
+		if err := json.Unmarshal(o.Data, &d); err != nil || d.TokenSHA256 == "" {
+			slog.Warn("Skipping invalid share link", "id", o.ID, "err", err)
+			continue
+		}
+		byToken[d.TokenSHA256] = d
+	}
+	l.mu.Lock()
+	l.byToken = byToken
+	l.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the unexpired link token opens
+func (l *ShareLinks) Lookup(token string) (shareLinkData, bool) {
+	if token == "" {
+		return shareLinkData{}, false
+	}
+	l.mu.RLock()
+	d, ok := l.byToken[hashToken(token)]
+	l.mu.RUnlock()
+	if !ok {
+		return d, false
+	}
+	if d.ExpiresAt != "" && d.ExpiresAt <= store.FormatTime(time.Now()) {
+		return d, false
+	}
+	return d, true
+}
+
+// shareLinkCollection is the admin API's share-links kind: the token is
+// generated on create and returned in that response only
+type shareLinkCollection struct {
+	links *ShareLinks
+}
+
+func (c shareLinkCollection) public(o AdminObject, token string) AdminObject {
+	var d shareLinkData
+	json.Unmarshal(o.Data, &d)
+	d.TokenSHA256, d.Token = "", token
+	o.Data, _ = json.Marshal(d)
+	return o
+}
+
+func (c shareLinkCollection) List() ([]AdminObject, error) {
+	objects, err := c.links.coll.List()
+	for i := range objects {
+		objects[i] = c.public(objects[i], "")
+	}
+	return objects, err
+}
+
+func (c shareLinkCollection) Get(id string) (AdminObject, error) {
+	o, err := c.links.coll.Get(id)
+	if err != nil {
+		return o, err
+	}
+	return c.public(o, ""), nil
+}
+
+func (c shareLinkCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	var d shareLinkData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+	d.Host = strings.ToLower(strings.TrimSpace(d.Host))
+	if d.Host == "" {
+		return AdminObject{}, fmt.Errorf("%w: host required", errAdminInvalid)
+	}
+	if d.TZ != "" {
+		if _, err := time.LoadLocation(d.TZ); err != nil {
+			return AdminObject{}, fmt.Errorf("%w: unknown time zone %q", errAdminInvalid, d.TZ)
+		}
+	}
+	if d.Days < 0 || d.Days > maxShareDays {
+		return AdminObject{}, fmt.Errorf("%w: days must be at most %d", errAdminInvalid, maxShareDays)
+	}
+	if d.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, d.ExpiresAt)
+		if err != nil {
+			return AdminObject{}, fmt.Errorf("%w: expires_at: %v", errAdminInvalid, err)
+		}
+		d.ExpiresAt = store.FormatTime(t)
+	}
+
+	token := d.Token
+	if token == "" {
+		existing, err := c.links.coll.Get(id)
+		switch {
+		case err == nil:
+			var old shareLinkData
+			json.Unmarshal(existing.Data, &old)
+			d.TokenSHA256 = old.TokenSHA256
+		case err == errAdminNotFound:
+			b := make([]byte, 24)
+			rand.Read(b)
+			token = base64.RawURLEncoding.EncodeToString(b)
+		default:
+			return AdminObject{}, err
+		}
+	}
+	if token != "" {
+		d.TokenSHA256 = hashToken(token)
+	}
+	d.Token = ""
+
+	stored, _ := json.Marshal(d)
+	o, err := c.links.coll.Put(id, stored, ifMatch)
+	if err != nil {
+		return o, err
+	}
+	if err := c.links.reload(); err != nil {
+		return o, err
+	}
+	return c.public(o, token), nil
+}
+
+func (c shareLinkCollection) Delete(id string, ifMatch int64) error {
+	if err := c.links.coll.Delete(id, ifMatch); err != nil {
+		return err
+	}
+	return c.links.reload()
+}
+
+// PublicStats is what a share link shows: visitor hits per day and by
+// country, no IPs, paths or user agents, and the incidents and maintenance
+// that explain dips
+type PublicStats struct {
+	Host        string         `json:"host"`
+	Title       string         `json:"title"`
+	TZ          string         `json:"tz"`
+	Days        int            `json:"days"`
+	TotalHits   int            `json:"total_hits"`
+	Daily       []DailyHits    `json:"daily"`
+	Countries   []CountryCount `json:"countries"`
+	Annotations []Annotation   `json:"annotations"`
+}
+
+type DailyHits struct {
+	Date string `json:"date"`
+	Hits int    `json:"hits"`
+}
+
+type CountryCount struct {
+	Country string `json:"country"`
+	Hits    int    `json:"hits"`
+}
+
+// publicStats counts the link's host's visitor traffic over its last days in
+// loc; own, from ownTraffic, leaves out the operator's own requests
+func publicStats(db *sql.DB, link shareLinkData, days int, loc *time.Location, own string, ownArgs []interface{}) (*PublicStats, error) {
+	now := time.Now().In(loc)
+	first := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, loc)
+	since := store.FormatTime(first)
+
+	stats := &PublicStats{Host: link.Host, Title: link.Title, TZ: loc.String(), Days: days, Daily: []DailyHits{}, Countries: []CountryCount{}, Annotations: []Annotation{}}
+	if stats.Title == "" {
+		stats.Title = link.Host
+	}
+
+	// Counted per UTC hour and folded into days in loc, as for the heatmap
+	rows, err := db.Query(`SELECT substr(timestamp, 1, 13), COUNT(*) FROM connections
+		WHERE host = ? AND category = ? AND timestamp >= ?`+own+` GROUP BY substr(timestamp, 1, 13)`,
+		append([]interface{}{link.Host, categoryVisitor, since}, ownArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	perDay := make(map[string]int)
+	for rows.Next() {
+		var bucket string
+		var n int
+		if rows.Scan(&bucket, &n) != nil {
+			continue
+		}
+		t, err := time.Parse("2006-01-02T15", bucket)
+		if err != nil {
+			continue
+		}
+		perDay[t.In(loc).Format("2006-01-02")] += n
+		stats.TotalHits += n
+	}
+	rows.Close()
+	for d := first; !d.After(now); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		stats.Daily = append(stats.Daily, DailyHits{Date: date, Hits: perDay[date]})
+	}
+
+	rows, err = db.Query(`SELECT COALESCE(NULLIF(country, ''), 'XX'), COUNT(*) AS hits FROM connections
+		WHERE host = ? AND category = ? AND timestamp >= ?`+own+` GROUP BY 1 ORDER BY hits DESC LIMIT 20`,
+		append([]interface{}{link.Host, categoryVisitor, since}, ownArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CountryCount
+		if rows.Scan(&c.Country, &c.Hits) == nil {
+			stats.Countries = append(stats.Countries, c)
+		}
+	}
+	return stats, rows.Err()
+}
+
+// GET /_proxy/public/{token} (HTML) and /_proxy/public/{token}.json?days=7,
+// and the embeddable /_proxy/public/{token}/widget[.json], without
+// authentication: the token is the access
+func (app *App) handlePublicStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/public/")
+	token, asJSON := strings.CutSuffix(token, ".json")
+	token, sub, _ := strings.Cut(token, "/")
+	link, ok := app.shareLinks.Lookup(token)
+	if !ok || sub != "" && sub != "widget" {
+		http.NotFound(w, r)
+		return
+	}
+	if sub == "widget" {
+		app.serveWidget(w, r, link, asJSON)
+		return
+	}
+	loc := time.UTC
+	if link.TZ != "" {
+		if l, err := time.LoadLocation(link.TZ); err == nil {
+			loc = l
+		}
+	}
+	maxDays := link.Days
+	if maxDays == 0 {
+		maxDays = 30
+	}
+	days := maxDays
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 && d < maxDays {
+		days = d
+	}
+	// Visitors of a share link can't choose; EXCLUDE_OWN_TRAFFIC decides
+	own, ownArgs, _ := app.ownTraffic.Filter(nil)
+	stats, err := publicStats(app.readerFor(r, link.Host), link, days, loc, own, ownArgs)
+	if err != nil {
+		slog.Error("Public stats", "host", link.Host, "err", err)
+		http.Error(w, "Stats unavailable", http.StatusInternalServerError)
+		return
+	}
+	if len(stats.Daily) > 0 {
+		first, _ := time.ParseInLocation("2006-01-02", stats.Daily[0].Date, loc)
+		stats.Annotations = app.publicAnnotations(store.FormatTime(first), store.FormatTime(time.Now()), []string{link.Host})
+	}
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(renderPublicStats(stats, maxDays)))
+}
+
+// renderPublicStats draws the share page: a bar per day and a country table
+func renderPublicStats(s *PublicStats, maxDays int) string {
+	var b strings.Builder
+	title := html.EscapeString(s.Title)
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>%s - traffic</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 900px; margin: 40px auto; padding: 0 20px; color: #1a1a2e; background: #f4f6fa; }
+h1 { font-size: 1.6em; margin-bottom: 4px; }
+.sub { color: #666; margin-bottom: 24px; }
+.sub a { color: #0077aa; margin-left: 8px; }
+.chart { display: flex; align-items: flex-end; gap: 2px; height: 180px; background: #fff; border-radius: 8px; padding: 12px; }
+.bar { flex: 1; background: #0077aa; min-height: 1px; border-radius: 2px 2px 0 0; }
+.bar.incident { background: #c62828; } .bar.maintenance { background: #b26a00; }
+.axis { display: flex; justify-content: space-between; color: #888; font-size: 0.8em; margin: 4px 12px 24px; }
+ul.annotations { background: #fff; border-radius: 8px; padding: 10px 10px 10px 30px; margin: 0 0 24px; }
+ul.annotations li.incident b { color: #c62828; } ul.annotations li.maintenance b { color: #b26a00; }
+ul.annotations small { color: #888; }
+table { width: 100%%; border-collapse: collapse; background: #fff; border-radius: 8px; overflow: hidden; }
+th, td { padding: 8px 14px; text-align: left; border-bottom: 1px solid #e3e8f0; }
+th { color: #666; font-weight: normal; font-size: 0.9em; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<div class="sub">%d visits in the last %d days`, title, title, s.TotalHits, s.Days)
+	for _, d := range []int{7, 30, 90, 365} {
+		if d <= maxDays && d != s.Days {
+			fmt.Fprintf(&b, `<a href="?days=%d">%d days</a>`, d, d)
+		}
+	}
+	b.WriteString("</div>\n<div class=\"chart\">")
+	peak := 1
+	for _, d := range s.Daily {
+		if d.Hits > peak {
+			peak = d.Hits
+		}
+	}
+	loc, err := time.LoadLocation(s.TZ)
+	if err != nil {
+		loc = time.UTC
+	}
+	for _, d := range s.Daily {
+		// Days an incident or maintenance touched are marked, with its note
+		class, title := "bar", fmt.Sprintf("%s: %d", d.Date, d.Hits)
+		if day, err := time.ParseInLocation("2006-01-02", d.Date, loc); err == nil {
+			from, until := store.FormatTime(day), store.FormatTime(day.AddDate(0, 0, 1))
+			for _, a := range s.Annotations {
+				if a.StartsAt < until && (a.EndsAt == "" || a.EndsAt > from) {
+					class = "bar " + a.Kind
+					title += "\n" + a.Kind + ": " + a.Note
+				}
+			}
+		}
+		fmt.Fprintf(&b, `<div class="%s" style="height:%.1f%%" title="%s"></div>`, class, 100*float64(d.Hits)/float64(peak), html.EscapeString(title))
+	}
+	b.WriteString("</div>\n")
+	if len(s.Daily) > 0 {
+		fmt.Fprintf(&b, "<div class=\"axis\"><span>%s</span><span>%s</span></div>\n", s.Daily[0].Date, s.Daily[len(s.Daily)-1].Date)
+	}
+	if len(s.Annotations) > 0 {
+		b.WriteString("<ul class=\"annotations\">\n")
+		for _, a := range s.Annotations {
+			fmt.Fprintf(&b, "<li class=\"%s\"><b>%s</b> <small>%s</small> %s</li>\n", a.Kind, a.Kind, annotationSpan(a), html.EscapeString(a.Note))
+		}
+		b.WriteString("</ul>\n")
+	}
+	b.WriteString("<table>\n<tr><th>Country</th><th class=\"n\">Visits</th></tr>\n")
+	for _, c := range s.Countries {
+		fmt.Fprintf(&b, "<tr><td>%s %s</td><td class=\"n\">%d</td></tr>\n", countryFlagEmoji(c.Country), html.EscapeString(c.Country), c.Hits)
+	}
+	if len(s.Countries) == 0 {
+		b.WriteString("<tr><td colspan=\"2\">No visits yet</td></tr>\n")
+	}
+	fmt.Fprintf(&b, "</table>\n<div class=\"sub\">Days in %s. Monitoring traffic is not counted.</div>\n</body>\n</html>\n", html.EscapeString(s.TZ))
+	return b.String()
+}
+
+// countryFlagEmoji turns a two-letter country code into its flag
+func countryFlagEmoji(code string) string {
+	if len(code) != 2 || code == "XX" || code == "T1" {
+		return ""
+	}
+	var flag []rune
+	for _, c := range strings.ToUpper(code) {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+		flag = append(flag, 0x1F1E6+c-'A')
+	}
+	return string(flag)
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Snapshot keys are <db>/<timestamp>.db.gz, where <db> is the database path
+// relative to DATA_DIR without .db (connections, hosts/example.com).
+// Increments, the connections added since the previous run, are
+// <db>/<timestamp>.inc.db.gz.
+const snapshotStampLayout = "20060102T150405Z"
+
+// Every snapshot and increment of the last day is kept; older ones are
+// thinned to the last full snapshot of each day
+const replicaKeepAllFor = 24 * time.Hour
+
+// replicaStore is where snapshots are shipped: a directory or an S3 bucket
+type replicaStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// newReplicaStore parses REPLICA_URL: s3://bucket/prefix, file:///path or a
+// plain path. S3 credentials and endpoint come from the usual AWS variables;
+// set S3_ENDPOINT for R2 or MinIO.
+func newReplicaStore(spec string) (replicaStore, error) {
+	switch {
+	case strings.HasPrefix(spec, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("missing bucket in %q", spec)
+		}
+		region := getEnv("AWS_REGION", "us-east-1")
+		client := &s3Client{
+			endpoint:  strings.TrimSuffix(getEnv("S3_ENDPOINT", "https://s3."+region+".amazonaws.com"), "/"),
+			region:    region,
+			bucket:    bucket,
+			accessKey: getEnv("AWS_ACCESS_KEY_ID", ""),
+			secretKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
+			client:    &http.Client{Timeout: 5 * time.Minute},
+		}
+		if client.accessKey == "" || client.secretKey == "" {
+			return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for s3:// replicas")
+		}
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			return prefixStore{client, prefix + "/"}, nil
+		}
+		return client, nil
+	case strings.HasPrefix(spec, "file://"):
+		return fileStore(strings.TrimPrefix(spec, "file://")), nil
+	case strings.Contains(spec, "://"):
+		return nil, fmt.Errorf("unsupported replica URL %q (expected s3://, file:// or a path)", spec)
+	}
+	return fileStore(spec), nil
+}
+
+// fileStore keeps snapshots under a local directory, e.g. a second disk or
+// an NFS mount
+type fileStore string
+
+func (d fileStore) Put(key string, r io.Reader) error {
+	dst := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (d fileStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(key)))
+}
+
+func (d fileStore) Delete(key string) error {
+	return os.Remove(filepath.Join(string(d), filepath.FromSlash(key)))
+}
+
+func (d fileStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(string(d), func(p string, e os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if e.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(string(d), p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// prefixStore roots another store at a key prefix
+type prefixStore struct {
+	replicaStore
+	prefix string
+}
+
+func (p prefixStore) Put(key string, r io.Reader) error {
+	return p.replicaStore.Put(p.prefix+key, r)
+}
+func (p prefixStore) Get(key string) (io.ReadCloser, error) {
+	return p.replicaStore.Get(p.prefix + key)
+}
+func (p prefixStore) Delete(key string) error { return p.replicaStore.Delete(p.prefix + key) }
+
+func (p prefixStore) List(prefix string) ([]string, error) {
+	keys, err := p.replicaStore.List(p.prefix + prefix)
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], p.prefix)
+	}
+	return keys, err
+}
+
+// Replicator periodically ships a consistent snapshot (VACUUM INTO) of each
+// database to a replica store every fullInterval, and in between an
+// increment holding the connections added since the previous run. Databases
+// that haven't changed since the last run are skipped. Old snapshots are
+// thinned out (see prune).
+type Replicator struct {
+	store        replicaStore
+	dataDir      string
+	retention    time.Duration
+	fullInterval time.Duration
+	databases    func() map[string]*sql.DB // name -> handle
+
+	mu         sync.Mutex
+	fileState  map[string]string    // name -> size/mtime of db+wal at last run
+	lastFull   map[string]time.Time // name -> time of the last full snapshot
+	lastID     map[string]int64     // name -> highest connection id shipped
+	lastRun    time.Time
+	lastError  string
+	snapshots  int
+	increments int
+}
+
+func NewReplicator(store replicaStore, dataDir string, retention, fullInterval time.Duration, databases func() map[string]*sql.DB) *Replicator {
+	return &Replicator{
+		store:        store,
+		dataDir:      dataDir,
+		retention:    retention,
+		fullInterval: fullInterval,
+		databases:    databases,
+		fileState:    make(map[string]string),
+		lastFull:     make(map[string]time.Time),
+		lastID:       make(map[string]int64),
+	}
+}
+
+// Run replicates every interval, starting immediately
+func (r *Replicator) Run(interval time.Duration) {
+	for {
+		r.SnapshotAll()
+		time.Sleep(interval)
+	}
+}
+
+func (r *Replicator) SnapshotAll() {
+	var errs []string
+	for name, db := range r.databases() {
+		if err := r.snapshot(name, db); err != nil {
+			slog.Error("Replication failed", "database", name, "err", err)
+			errs = append(errs, name+": "+err.Error())
+		}
+	}
+	r.mu.Lock()
+	r.lastRun = time.Now()
+	r.lastError = strings.Join(errs, "; ")
+	r.mu.Unlock()
+}
+
+// snapshot ships a full snapshot of name when the last one is older than
+// fullInterval (or this process hasn't taken one yet), and otherwise the
+// connections added since the last run
+func (r *Replicator) snapshot(name string, db *sql.DB) error {
+	dbFile := filepath.Join(r.dataDir, filepath.FromSlash(name)+".db")
+	state := fileState(dbFile) + "|" + fileState(dbFile+"-wal")
+	r.mu.Lock()
+	unchanged := r.fileState[name] == state
+	from, started := r.lastID[name]
+	full := !started || time.Since(r.lastFull[name]) >= r.fullInterval
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	// Read before the snapshot, so rows added meanwhile go into the next
+	// increment as well; restore skips the ones it already has
+	var maxID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM connections").Scan(&maxID); err != nil {
+		return err
+	}
+	if !full && maxID <= from {
+		// Only other tables changed: they go out with the next full
+		// snapshot, so the state isn't recorded until then
+		return nil
+	}
+
+	now := time.Now()
+	tmp := filepath.Join(r.dataDir, fmt.Sprintf(".replica-%d.db", now.UnixNano()))
+	defer os.Remove(tmp)
+	key := name + "/" + now.UTC().Format(snapshotStampLayout)
+	if full {
+		if _, err := db.Exec("VACUUM INTO ?", tmp); err != nil {
+			return fmt.Errorf("vacuum into: %w", err)
+		}
+		key += ".db.gz"
+	} else {
+		if err := exportIncrement(db, tmp, from, maxID); err != nil {
+			return fmt.Errorf("export increment: %w", err)
+		}
+		key += ".inc.db.gz"
+	}
+	if err := r.upload(key, tmp); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.fileState[name] = state
+	if full {
+		r.lastFull[name] = now
+		r.snapshots++
+	} else {
+		r.increments++
+	}
+	// A full snapshot doesn't move the increments on: the next one also has
+	// the rows since the previous increment, so a restore from an older
+	// snapshot after this one is thinned out has no gap
+	if !started || !full {
+		r.lastID[name] = maxID
+	}
+	r.mu.Unlock()
+
+	return r.prune(name)
+}
+
+// exportIncrement writes the connections with ids in (from, to] to a new
+// database at path, with the same key as the others
+func exportIncrement(db *sql.DB, path string, from, to int64) error {
+	ctx := context.Background()
+	// ATTACH only applies to the connection it runs on
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS increment KEY ?", path, store.Key()); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE increment")
+	_, err = conn.ExecContext(ctx, "CREATE TABLE increment.connections AS SELECT * FROM main.connections WHERE id > ? AND id <= ?", from, to)
+	return err
+}
+
+// upload gzips the file at path into the store as it is read, so neither the
+// file nor the compressed copy is held in memory
+func (r *Replicator) upload(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, f)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err = r.store.Put(key, pr)
+	// Unblocks the compressor if the store gave up early
+	pr.CloseWithError(errors.New("upload ended"))
+	<-done
+	return err
+}
+
+// prune thins out name's snapshots. Everything from the last
+// replicaKeepAllFor (or the retention window, if shorter) is kept, from the
+// last full snapshot before that on, so every point in it can be restored.
+// Before that only the last full snapshot of each UTC day is kept, until the
+// retention window ends. The newest full snapshot is always kept.
+func (r *Replicator) prune(name string) error {
+	keys, err := r.store.List(name + "/")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	keepAll := replicaKeepAllFor
+	if r.retention > 0 && r.retention < keepAll {
+		keepAll = r.retention
+	}
+	snaps := snapshotsOf(keys)[name]
+
+	recent := now.Add(-keepAll)
+	newestFull := -1
+	lastOfDay := make(map[string]int)
+	for i, s := range snaps {
+		if s.incremental {
+			continue
+		}
+		newestFull = i
+		lastOfDay[s.at.UTC().Format("2006-01-02")] = i
+		if s.at.Before(now.Add(-keepAll)) {
+			recent = s.at
+		}
+	}
+
+	for i, s := range snaps {
+		switch {
+		case !s.at.Before(recent), i >= newestFull:
+			continue
+		case !s.incremental && lastOfDay[s.at.UTC().Format("2006-01-02")] == i &&
+			(r.retention <= 0 || !s.at.Before(now.Add(-r.retention))):
+			continue
+		}
+		if err := r.store.Delete(s.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) Info() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := map[string]interface{}{
+		"snapshots":  r.snapshots,
+		"increments": r.increments,
+		"error":      r.lastError,
+	}
+	if !r.lastRun.IsZero() {
+		info["last_run"] = r.lastRun.Format(time.RFC3339)
+	}
+	return info
+}
+
+func fileState(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// databases lists every database file this process writes
+func (app *App) databases() map[string]*sql.DB {
+	dbs := map[string]*sql.DB{"connections": app.db}
+	if app.partitions != nil {
+		for _, file := range app.partitions.Files() {
+			host := strings.TrimSuffix(filepath.Base(file), ".db")
+			if db, err := app.partitions.Get(host); err == nil {
+				dbs["hosts/"+host] = db
+			}
+		}
+	}
+	return dbs
+}
+
+type snapshotRef struct {
+	key         string
+	at          time.Time
+	incremental bool
+}
+
+// snapshotsOf groups snapshot and increment keys by database name, oldest
+// first
+func snapshotsOf(keys []string) map[string][]snapshotRef {
+	byName := make(map[string][]snapshotRef)
+	for _, key := range keys {
+		name, file := path.Split(key)
+		stamp, incremental := strings.CutSuffix(strings.TrimSuffix(file, ".db.gz"), ".inc")
+		at, err := time.Parse(snapshotStampLayout, stamp)
+		if name == "" || err != nil {
+			continue
+		}
+		name = strings.TrimSuffix(name, "/")
+		byName[name] = append(byName[name], snapshotRef{key: key, at: at, incremental: incremental})
+	}
+	for _, snaps := range byName {
+		sort.Slice(snaps, func(i, j int) bool { return snaps[i].at.Before(snaps[j].at) })
+	}
+	return byName
+}
+
+// runRestore implements `cf-ip-logger restore`: it writes the newest snapshot
+// of every database taken at or before -time into the data directory, with
+// the increments after it up to -time applied. Each snapshot is checked and
+// its connections table migrated to the current schema first. The logger
+// must not be running.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	replica := fs.String("replica", getEnv("REPLICA_URL", ""), "replica to restore from (default $REPLICA_URL)")
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory to restore into")
+	at := fs.String("time", "", "restore the state as of this RFC 3339 time (default: latest)")
+	var opts restoreOptions
+	fs.BoolVar(&opts.force, "force", false, "overwrite existing database files")
+	fs.BoolVar(&opts.merge, "merge", false, "add the snapshots' connections to existing database files instead of replacing them")
+	fs.BoolVar(&opts.check, "check", false, "download and validate the snapshots, then exit without writing")
+	list := fs.Bool("list", false, "list available snapshots and exit")
+	fs.Parse(args)
+
+	if *replica == "" {
+		log.Fatal("restore: no replica given (-replica or REPLICA_URL)")
+	}
+	if opts.force && opts.merge {
+		log.Fatal("restore: -force and -merge exclude each other")
+	}
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	rs, err := newReplicaStore(*replica)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	target := time.Now()
+	if *at != "" {
+		if target, err = time.Parse(time.RFC3339, *at); err != nil {
+			log.Fatalf("restore: invalid -time: %v", err)
+		}
+	}
+
+	keys, err := rs.List("")
+	if err != nil {
+		log.Fatalf("restore: listing snapshots: %v", err)
+	}
+	byName := snapshotsOf(keys)
+	if len(byName) == 0 {
+		log.Fatalf("restore: no snapshots found in %s", *replica)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if *list {
+		for _, name := range names {
+			for _, s := range byName[name] {
+				kind := "full"
+				if s.incremental {
+					kind = "increment"
+				}
+				fmt.Printf("%s\t%s\t%s\n", name, s.at.Format(time.RFC3339), kind)
+			}
+		}
+		return
+	}
+
+	restored := 0
+	for _, name := range names {
+		var pick *snapshotRef
+		var increments []string
+		for i, s := range byName[name] {
+			switch {
+			case s.at.After(target):
+			case !s.incremental:
+				pick = &byName[name][i]
+				increments = nil
+			case pick != nil:
+				increments = append(increments, s.key)
+			}
+		}
+		if pick == nil {
+			log.Printf("restore: %s has no snapshot at or before %s, skipping", name, target.Format(time.RFC3339))
+			continue
+		}
+		dst := filepath.Join(*dataDir, filepath.FromSlash(name)+".db")
+		if err := restoreSnapshot(rs, pick.key, increments, dst, opts); err != nil {
+			log.Fatalf("restore: %s: %v", name, err)
+		}
+		restored++
+	}
+	switch {
+	case opts.check:
+		log.Printf("Checked %d snapshot(s), all valid", restored)
+	default:
+		log.Printf("Restored %d database(s) into %s", restored, *dataDir)
+	}
+}
+
+// restoreOptions are the restore flags that decide what happens to each
+// database file
+type restoreOptions struct {
+	force bool // replace existing files
+	merge bool // add rows to existing files instead of replacing them
+	check bool // validate only
+}
+
+func restoreSnapshot(rs replicaStore, key string, increments []string, dst string, opts restoreOptions) error {
+	_, statErr := os.Stat(dst)
+	exists := statErr == nil
+	if exists && !opts.force && !opts.merge && !opts.check {
+		return fmt.Errorf("%s exists (use -force to overwrite or -merge to add to it)", dst)
+	}
+	tmp := dst + ".restore"
+	if opts.check {
+		f, err := os.CreateTemp("", "cf-ip-logger-restore-*.db")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		tmp = f.Name()
+	} else if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	defer func() {
+		os.Remove(tmp)
+		os.Remove(tmp + "-wal")
+		os.Remove(tmp + "-shm")
+	}()
+	if err := fetchSnapshot(rs, key, tmp); err != nil {
+		return err
+	}
+	rows, err := migrateSnapshot(tmp)
+	if err != nil {
+		return fmt.Errorf("snapshot %s is unusable: %w", key, err)
+	}
+	for _, inc := range increments {
+		added, err := applyIncrement(rs, inc, tmp)
+		if err != nil {
+			return fmt.Errorf("increment %s: %w", inc, err)
+		}
+		rows += added
+	}
+
+	switch {
+	case opts.check:
+		log.Printf("Snapshot %s is valid: %d connection(s)", key, rows)
+		return nil
+	case opts.merge && exists:
+		added, err := mergeSnapshot(tmp, dst)
+		if err != nil {
+			return err
+		}
+		log.Printf("Merged %s into %s: %d new connection(s), %d already present", key, dst, added, rows-added)
+		return nil
+	}
+	// A leftover WAL from the old database must not be replayed onto the snapshot
+	os.Remove(dst + "-wal")
+	os.Remove(dst + "-shm")
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	log.Printf("Restored %s from snapshot %s: %d connection(s)", dst, key, rows)
+	return nil
+}
+
+// fetchSnapshot downloads and unpacks a snapshot into path
+func fetchSnapshot(rs replicaStore, key, path string) error {
+	body, err := rs.Get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, zr)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// applyIncrement adds the connections of an increment to the database at
+// path and returns how many it didn't have yet
+func applyIncrement(rs replicaStore, key, path string) (int64, error) {
+	incPath := path + ".inc"
+	defer os.Remove(incPath)
+	if err := fetchSnapshot(rs, key, incPath); err != nil {
+		return 0, err
+	}
+	db, err := store.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	// ATTACH only applies to the connection it runs on
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("ATTACH DATABASE ? AS increment KEY ?", incPath, store.Key()); err != nil {
+		return 0, err
+	}
+	defer db.Exec("DETACH DATABASE increment")
+
+	// Increments from an older version lack the newer columns
+	rows, err := db.Query("SELECT name FROM pragma_table_info('connections', 'increment') ORDER BY cid")
+	if err != nil {
+		return 0, err
+	}
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		columns = append(columns, name)
+	}
+	rows.Close()
+	if len(columns) == 0 {
+		return 0, errors.New("no connections table")
+	}
+	list := strings.Join(columns, ", ")
+	res, err := db.Exec("INSERT OR IGNORE INTO main.connections (" + list + ") SELECT " + list + " FROM increment.connections ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// migrateSnapshot checks that path is an intact database (opened with
+// DB_KEY, if set) with a connections table, brings that table up to the
+// current schema and returns its row count
+func migrateSnapshot(path string) (int64, error) {
+	db, err := store.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, err
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("integrity check failed: %s", result)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'connections'").Scan(&tables); err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		return 0, errors.New("no connections table")
+	}
+	if err := store.CreateSchema(db); err != nil {
+		return 0, fmt.Errorf("migrating: %w", err)
+	}
+	var rows int64
+	err = db.QueryRow("SELECT COUNT(*) FROM connections").Scan(&rows)
+	return rows, err
+}
+
+// mergeSnapshot copies the connections in the database at src that dst
+// doesn't have yet, and returns how many it added. A row is already there
+// when dst has its seq, its CF-Ray, or the same time, client, method, host,
+// path and user agent. Other tables in dst are left as they are.
+func mergeSnapshot(src, dst string) (int64, error) {
+	db, err := store.Open(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	// ATTACH only applies to the connection it runs on
+	db.SetMaxOpenConns(1)
+	if err := store.CreateSchema(db); err != nil {
+		return 0, fmt.Errorf("migrating %s: %w", dst, err)
+	}
+	if _, err := db.Exec("ATTACH DATABASE ? AS snapshot KEY ?", src, store.Key()); err != nil {
+		return 0, err
+	}
+	defer db.Exec("DETACH DATABASE snapshot")
+
+	rows, err := db.Query("PRAGMA main.table_info(connections)")
+	if err != nil {
+		return 0, err
+	}
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if name != "id" {
+			columns = append(columns, name)
+		}
+	}
+	rows.Close()
+	list := strings.Join(columns, ", ")
+
+	res, err := db.Exec(`INSERT INTO main.connections (` + list + `)
+		SELECT ` + list + ` FROM snapshot.connections s
+		WHERE NOT EXISTS (SELECT 1 FROM main.connections c WHERE c.seq = s.seq)
+			AND (s.cf_ray = '' OR NOT EXISTS (SELECT 1 FROM main.connections c WHERE c.cf_ray = s.cf_ray))
+			AND NOT EXISTS (SELECT 1 FROM main.connections c WHERE c.timestamp = s.timestamp AND c.client_ip = s.client_ip
+				AND c.method IS s.method AND c.host IS s.host AND c.path IS s.path AND c.user_agent IS s.user_agent)
+		ORDER BY s.timestamp, s.id`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Report kinds REPORTS can list
+const (
+	reportDaily  = "daily"
+	reportWeekly = "weekly"
+)
+
+const (
+	maxReportHosts = 50 // busiest hosts a report covers
+	reportTopN     = 10 // clients and paths listed per host
+	// A bucket with this many times the host's average, and at least
+	// spikeMinHits requests, is reported as a spike
+	spikeFactor  = 3
+	spikeMinHits = 20
+)
+
+// Report file names: daily-2026-10-15.html, weekly-2026-W41.html
+var reportNamePattern = regexp.MustCompile(`^(daily-\d{4}-\d{2}-\d{2}|weekly-\d{4}-W\d{2})\.html$`)
+
+// Reporter renders traffic reports for finished days and weeks into
+// DATA_DIR/reports, so there is an archive without mail delivery
+type Reporter struct {
+	db        *sql.DB
+	dir       string
+	kinds     []string
+	loc       *time.Location // days and weeks are counted in this zone
+	own       string         // ownTraffic condition and args, as for stats
+	ownArgs   []interface{}
+	retention time.Duration // 0 keeps reports forever
+}
+
+// ReportFile is a rendered report, as GET /reports lists it
+type ReportFile struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Period    string `json:"period"`
+	From      string `json:"from"`
+	Until     string `json:"until"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at"`
+}
+
+// parseReportKinds reads REPORTS, e.g. "daily,weekly"
+func parseReportKinds(spec string) ([]string, error) {
+	var kinds []string
+	for _, k := range strings.Split(spec, ",") {
+		switch k = strings.TrimSpace(k); k {
+		case "":
+		case reportDaily, reportWeekly:
+			kinds = append(kinds, k)
+		default:
+			return nil, fmt.Errorf("unknown report %q (expected daily or weekly)", k)
+		}
+	}
+	return kinds, nil
+}
+
+func NewReporter(db *sql.DB, dir string, kinds []string, loc *time.Location, own string, ownArgs []interface{}, retention time.Duration) (*Reporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Reporter{db: db, dir: dir, kinds: kinds, loc: loc, own: own, ownArgs: ownArgs, retention: retention}, nil
+}
+
+// reportPeriod returns the day or ISO week containing t in loc, with the
+// report's name and the period as shown
+func reportPeriod(kind string, t time.Time, loc *time.Location) (name, period string, from, until time.Time) {
+	t = t.In(loc)
+	from = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if kind == reportWeekly {
+		from = from.AddDate(0, 0, -(int(from.Weekday())+6)%7)
+		year, week := from.ISOWeek()
+		period = fmt.Sprintf("%d-W%02d", year, week)
+		return "weekly-" + period + ".html", period, from, from.AddDate(0, 0, 7)
+	}
+	period = from.Format("2006-01-02")
+	return "daily-" + period + ".html", period, from, from.AddDate(0, 0, 1)
+}
+
+// Run renders each kind's last finished period once it is over, catching up
+// on the one missed while the logger was down, and prunes old reports
+func (rp *Reporter) Run() {
+	for {
+		now := time.Now()
+		for _, kind := range rp.kinds {
+			// The period before the one now is in
+			_, _, current, _ := reportPeriod(kind, now, rp.loc)
+			name, _, _, _ := reportPeriod(kind, current.Add(-time.Second), rp.loc)
+			if _, err := os.Stat(filepath.Join(rp.dir, name)); err == nil {
+				continue
+			}
+			if _, err := rp.Generate(kind, current.Add(-time.Second)); err != nil {
+				slog.Error("Report failed", "report", name, "err", err)
+			}
+		}
+		if rp.retention > 0 {
+			rp.prune(now.Add(-rp.retention))
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (rp *Reporter) prune(before time.Time) {
+	files, err := rp.List()
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if until, err := time.Parse(time.RFC3339, f.Until); err == nil && until.Before(before) {
+			if err := os.Remove(filepath.Join(rp.dir, f.Name)); err == nil {
+				slog.Info("Removed report", "report", f.Name)
+			}
+		}
+	}
+}
+
+// Generate renders the report for the period containing t, replacing an
+// earlier rendering
+func (rp *Reporter) Generate(kind string, t time.Time) (ReportFile, error) {
+	name, period, from, until := reportPeriod(kind, t, rp.loc)
+	report, err := rp.build(kind, period, from, until)
+	if err != nil {
+		return ReportFile{}, err
+	}
+	path := filepath.Join(rp.dir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(renderReport(report)), 0644); err != nil {
+		return ReportFile{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return ReportFile{}, err
+	}
+	slog.Info("Wrote report", "report", name)
+	return rp.file(name)
+}
+
+// List returns the rendered reports, newest period first
+func (rp *Reporter) List() ([]ReportFile, error) {
+	entries, err := os.ReadDir(rp.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []ReportFile{}
+	for _, e := range entries {
+		if !reportNamePattern.MatchString(e.Name()) {
+			continue
+		}
+		if f, err := rp.file(e.Name()); err == nil {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].From != files[j].From {
+			return files[i].From > files[j].From
+		}
+		return files[i].Kind < files[j].Kind
+	})
+	return files, nil
+}
+
+func (rp *Reporter) file(name string) (ReportFile, error) {
+	info, err := os.Stat(filepath.Join(rp.dir, name))
+	if err != nil {
+		return ReportFile{}, err
+	}
+	kind, period, _ := strings.Cut(strings.TrimSuffix(name, ".html"), "-")
+	var from time.Time
+	if kind == reportWeekly {
+		var year, week int
+		fmt.Sscanf(period, "%d-W%d", &year, &week)
+		// Jan 4th is always in week 1
+		from = time.Date(year, 1, 4, 0, 0, 0, 0, rp.loc)
+		from = from.AddDate(0, 0, (week-1)*7-(int(from.Weekday())+6)%7)
+	} else {
+		from, _ = time.ParseInLocation("2006-01-02", period, rp.loc)
+	}
+	_, _, from, until := reportPeriod(kind, from, rp.loc)
+	return ReportFile{Name: name, Kind: kind, Period: period, From: from.Format(time.RFC3339), Until: until.Format(time.RFC3339),
+		Size: info.Size(), CreatedAt: store.FormatTime(info.ModTime())}, nil
+}
+
+// Report is one period's traffic, per host
+type Report struct {
+	Kind   string
+	Period string
+	From   time.Time
+	Until  time.Time
+	TZ     string
+	Hosts  []HostReport
+	Events []Event // warnings and worse not about one host
+}
+
+// HostReport is a host's part of a report
+type HostReport struct {
+	Host       string
+	Requests   int
+	Visitors   int // requests from the visitor category
+	UniqueIPs  int
+	Buckets    []DailyHits // per hour in daily reports, per day in weekly ones
+	TopClients []IPStats
+	TopPaths   []PathStats
+	Anomalies  []string
+}
+
+func (rp *Reporter) build(kind, period string, from, until time.Time) (*Report, error) {
+	report := &Report{Kind: kind, Period: period, From: from, Until: until, TZ: rp.loc.String()}
+	rangeArgs := []interface{}{store.FormatTime(from), store.FormatTime(until)}
+	where := " WHERE timestamp >= ? AND timestamp < ?" + rp.own
+	args := append(rangeArgs, rp.ownArgs...)
+
+	rows, err := rp.db.Query(`SELECT COALESCE(host, ''), COUNT(*) AS hits, SUM(category = ?), COUNT(DISTINCT client_ip) FROM connections`+
+		where+` GROUP BY 1 ORDER BY hits DESC LIMIT ?`, append(append([]interface{}{categoryVisitor}, args...), maxReportHosts)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var h HostReport
+		if rows.Scan(&h.Host, &h.Requests, &h.Visitors, &h.UniqueIPs) == nil {
+			report.Hosts = append(report.Hosts, h)
+		}
+	}
+	rows.Close()
+
+	events, err := rp.events(rangeArgs)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := listAnnotations(rp.db, store.FormatTime(from), store.FormatTime(until), "")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if e.Host == "" {
+			report.Events = append(report.Events, e)
+		}
+	}
+
+	for i := range report.Hosts {
+		h := &report.Hosts[i]
+		hostWhere := where + " AND COALESCE(host, '') = ?"
+		hostArgs := append(append([]interface{}{}, args...), h.Host)
+
+		if h.Buckets, err = rp.buckets(kind, from, until, hostWhere, hostArgs); err != nil {
+			return nil, err
+		}
+		h.TopClients, err = rp.topClients(hostWhere, hostArgs)
+		if err != nil {
+			return nil, err
+		}
+		h.TopPaths, err = rp.topPaths(hostWhere, hostArgs)
+		if err != nil {
+			return nil, err
+		}
+		h.Anomalies = spikes(h.Buckets, h.Requests, kind)
+		for _, e := range events {
+			if e.Host == h.Host {
+				h.Anomalies = append(h.Anomalies, fmt.Sprintf("%s %s: %s", e.Time.In(rp.loc).Format("Mon 15:04"), e.Severity, e.Message))
+			}
+		}
+		// Annotated incidents and maintenance explain the dips among the spikes
+		for _, a := range annotations {
+			if a.Covers(h.Host) {
+				h.Anomalies = append(h.Anomalies, fmt.Sprintf("%s %s: %s", rp.annotationSpan(a), a.Kind, a.Note))
+			}
+		}
+	}
+	return report, nil
+}
+
+// annotationSpan renders when an annotation was in the report's zone
+func (rp *Reporter) annotationSpan(a Annotation) string {
+	start, _ := time.Parse(time.RFC3339, a.StartsAt)
+	span := start.In(rp.loc).Format("Mon 15:04")
+	if a.EndsAt == "" {
+		return span + " (ongoing)"
+	}
+	end, _ := time.Parse(time.RFC3339, a.EndsAt)
+	return span + "–" + end.In(rp.loc).Format("Mon 15:04")
+}
+
+// buckets counts requests per UTC hour and folds them into hours or days in
+// the report's zone, as publicStats does
+func (rp *Reporter) buckets(kind string, from, until time.Time, where string, args []interface{}) ([]DailyHits, error) {
+	rows, err := rp.db.Query(`SELECT substr(timestamp, 1, 13), COUNT(*) FROM connections`+where+` GROUP BY 1`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	layout, step := "15:00", time.Hour
+	if kind == reportWeekly {
+		layout, step = "Mon 2006-01-02", 24*time.Hour
+	}
+	counts := make(map[string]int)
+	for rows.Next() {
+		var bucket string
+		var n int
+		if rows.Scan(&bucket, &n) != nil {
+			continue
+		}
+		if t, err := time.Parse("2006-01-02T15", bucket); err == nil {
+			counts[t.In(rp.loc).Format(layout)] += n
+		}
+	}
+	var buckets []DailyHits
+	for t := from; t.Before(until); t = t.Add(step) {
+		if kind == reportWeekly {
+			// Days aren't always 24h long around DST changes
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, rp.loc)
+		}
+		label := t.Format(layout)
+		if len(buckets) > 0 && buckets[len(buckets)-1].Date == label {
+			continue
+		}
+		buckets = append(buckets, DailyHits{Date: label, Hits: counts[label]})
+	}
+	return buckets, rows.Err()
+}
+
+func (rp *Reporter) topClients(where string, args []interface{}) ([]IPStats, error) {
+	rows, err := rp.db.Query(`SELECT client_ip, COALESCE(country, ''), COUNT(*) AS hits, MIN(timestamp), MAX(timestamp) FROM connections`+
+		where+` GROUP BY client_ip ORDER BY hits DESC LIMIT ?`, append(args, reportTopN)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []IPStats
+	for rows.Next() {
+		var s IPStats
+		if rows.Scan(&s.ClientIP, &s.Country, &s.HitCount, &s.FirstSeen, &s.LastSeen) == nil {
+			list = append(list, s)
+		}
+	}
+	return list, rows.Err()
+}
+
+func (rp *Reporter) topPaths(where string, args []interface{}) ([]PathStats, error) {
+	rows, err := rp.db.Query(`SELECT COALESCE(path, ''), COUNT(*) AS hits, COUNT(DISTINCT client_ip), MAX(timestamp) FROM connections`+
+		where+` GROUP BY 1 ORDER BY hits DESC LIMIT ?`, append(args, reportTopN)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []PathStats
+	for rows.Next() {
+		var s PathStats
+		if rows.Scan(&s.Path, &s.HitCount, &s.UniqueIPs, &s.LastSeen) == nil {
+			list = append(list, s)
+		}
+	}
+	return list, rows.Err()
+}
+
+// events returns the period's warning and critical events, oldest first
+func (rp *Reporter) events(rangeArgs []interface{}) ([]Event, error) {
+	rows, err := rp.db.Query(`SELECT timestamp, kind, severity, host, message FROM events
+		WHERE timestamp >= ? AND timestamp < ? AND severity IN (?, ?) ORDER BY timestamp`,
+		append(rangeArgs, severityWarning, severityCritical)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if rows.Scan(&e.Timestamp, &e.Kind, &e.Severity, &e.Host, &e.Message) == nil {
+			e.Time, _ = time.Parse(time.RFC3339, e.Timestamp)
+			events = append(events, e)
+		}
+	}
+	return events, rows.Err()
+}
+
+// spikes describes the buckets far above the host's average
+func spikes(buckets []DailyHits, total int, kind string) []string {
+	if len(buckets) == 0 {
+		return nil
+	}
+	avg := float64(total) / float64(len(buckets))
+	unit := "hour"
+	if kind == reportWeekly {
+		unit = "day"
+	}
+	var out []string
+	for _, b := range buckets {
+		if b.Hits >= spikeMinHits && float64(b.Hits) >= spikeFactor*avg {
+			out = append(out, fmt.Sprintf("%s: %d requests, %.1f× the average %s", b.Date, b.Hits, float64(b.Hits)/avg, unit))
+		}
+	}
+	return out
+}
+
+// renderReport draws a report as a standalone page that prints cleanly, so
+// a browser's "Save as PDF" gives the PDF version
+func renderReport(rep *Report) string {
+	var b strings.Builder
+	title := fmt.Sprintf("Traffic report %s", rep.Period)
+	span := rep.From.Format("Mon 2006-01-02")
+	if rep.Kind == reportWeekly {
+		span += " to " + rep.Until.AddDate(0, 0, -1).Format("Mon 2006-01-02")
+	}
+	total, visitors := 0, 0
+	for _, h := range rep.Hosts {
+		total += h.Requests
+		visitors += h.Visitors
+	}
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>%s</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 900px; margin: 40px auto; padding: 0 20px; color: #1a1a2e; background: #f4f6fa; }
+h1 { font-size: 1.6em; margin-bottom: 4px; }
+h2 { font-size: 1.2em; margin: 32px 0 8px; border-bottom: 2px solid #0077aa; padding-bottom: 4px; }
+h3 { font-size: 1em; color: #666; font-weight: normal; margin: 16px 0 6px; }
+.sub { color: #666; margin-bottom: 24px; }
+.totals span { display: inline-block; margin-right: 24px; }
+.totals b { font-size: 1.3em; }
+.chart { display: flex; align-items: flex-end; gap: 2px; height: 120px; background: #fff; border-radius: 8px; padding: 12px; }
+.bar { flex: 1; background: #0077aa; min-height: 1px; border-radius: 2px 2px 0 0; }
+.axis { display: flex; justify-content: space-between; color: #888; font-size: 0.8em; margin: 4px 12px 8px; }
+.cols { display: flex; gap: 16px; }
+.cols > div { flex: 1; min-width: 0; }
+table { width: 100%%; border-collapse: collapse; background: #fff; border-radius: 8px; overflow: hidden; font-size: 0.9em; }
+th, td { padding: 6px 10px; text-align: left; border-bottom: 1px solid #e3e8f0; overflow-wrap: anywhere; }
+th { color: #666; font-weight: normal; }
+td.n { text-align: right; white-space: nowrap; }
+ul.anomalies { background: #fff4e0; border-radius: 8px; padding: 10px 10px 10px 30px; margin: 8px 0; }
+@media print { body { background: #fff; margin: 0; } section { break-inside: avoid; } .chart, table { border: 1px solid #e3e8f0; } .bar { print-color-adjust: exact; -webkit-print-color-adjust: exact; } }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<div class="sub">%s, times in %s</div>
+<div class="totals"><span><b>%d</b> requests</span><span><b>%d</b> from visitors</span><span><b>%d</b> hosts</span></div>
+`, html.EscapeString(title), html.EscapeString(title), html.EscapeString(span), html.EscapeString(rep.TZ), total, visitors, len(rep.Hosts))
+
+	if len(rep.Events) > 0 {
+		b.WriteString("<h2>Events</h2>\n<ul class=\"anomalies\">\n")
+		for _, e := range rep.Events {
+			fmt.Fprintf(&b, "<li>%s %s %s: %s</li>\n", e.Time.In(rep.From.Location()).Format("Mon 15:04"),
+				html.EscapeString(e.Severity), html.EscapeString(e.Kind), html.EscapeString(e.Message))
+		}
+		b.WriteString("</ul>\n")
+	}
+	if len(rep.Hosts) == 0 {
+		b.WriteString("<p>No traffic in this period.</p>\n")
+	}
+
+	for _, h := range rep.Hosts {
+		host := h.Host
+		if host == "" {
+			host = "(no host)"
+		}
+		fmt.Fprintf(&b, "<section>\n<h2>%s</h2>\n", html.EscapeString(host))
+		fmt.Fprintf(&b, "<div class=\"totals\"><span><b>%d</b> requests</span><span><b>%d</b> from visitors</span><span><b>%d</b> unique IPs</span></div>\n",
+			h.Requests, h.Visitors, h.UniqueIPs)
+		peak := 1
+		for _, bk := range h.Buckets {
+			if bk.Hits > peak {
+				peak = bk.Hits
+			}
+		}
+		b.WriteString("<div class=\"chart\">")
+		for _, bk := range h.Buckets {
+			fmt.Fprintf(&b, `<div class="bar" style="height:%.1f%%" title="%s: %d"></div>`, 100*float64(bk.Hits)/float64(peak), html.EscapeString(bk.Date), bk.Hits)
+		}
+		b.WriteString("</div>\n")
+		if len(h.Buckets) > 0 {
+			fmt.Fprintf(&b, "<div class=\"axis\"><span>%s</span><span>%s</span></div>\n",
+				html.EscapeString(h.Buckets[0].Date), html.EscapeString(h.Buckets[len(h.Buckets)-1].Date))
+		}
+		if len(h.Anomalies) > 0 {
+			b.WriteString("<h3>Anomalies</h3>\n<ul class=\"anomalies\">\n")
+			for _, a := range h.Anomalies {
+				fmt.Fprintf(&b, "<li>%s</li>\n", html.EscapeString(a))
+			}
+			b.WriteString("</ul>\n")
+		}
+		b.WriteString("<div class=\"cols\"><div>\n<h3>Top clients</h3>\n<table>\n<tr><th>IP</th><th>Country</th><th class=\"n\">Requests</th></tr>\n")
+		for _, c := range h.TopClients {
+			fmt.Fprintf(&b, "<tr><td>%s</td><td>%s %s</td><td class=\"n\">%d</td></tr>\n",
+				html.EscapeString(c.ClientIP), countryFlagEmoji(c.Country), html.EscapeString(c.Country), c.HitCount)
+		}
+		b.WriteString("</table>\n</div><div>\n<h3>Top paths</h3>\n<table>\n<tr><th>Path</th><th class=\"n\">Requests</th><th class=\"n\">IPs</th></tr>\n")
+		for _, p := range h.TopPaths {
+			fmt.Fprintf(&b, "<tr><td>%s</td><td class=\"n\">%d</td><td class=\"n\">%d</td></tr>\n", html.EscapeString(p.Path), p.HitCount, p.UniqueIPs)
+		}
+		b.WriteString("</table>\n</div></div>\n</section>\n")
+	}
+	fmt.Fprintf(&b, "<div class=\"sub\">Generated %s by cf-ip-logger.</div>\n</body>\n</html>\n", time.Now().In(rep.From.Location()).Format("2006-01-02 15:04 MST"))
+	return b.String()
+}
+
+// GET  /_proxy/reports                          - rendered reports, newest first
+// GET  /_proxy/reports/daily-2026-10-15.html    - one report
+// POST /_proxy/reports?kind=daily&date=2026-10-15 - render (again) now; admin only
+//
+// Reports cover every host, so host-scoped users can't see them.
+func (app *App) handleReports(w http.ResponseWriter, r *http.Request) {
+	if u := requestUser(r); u != nil && len(u.Hosts) > 0 {
+		http.Error(w, "Reports cover every host", http.StatusForbidden)
+		return
+	}
+	if app.reporter == nil {
+		http.Error(w, "Reports are not enabled (set REPORTS)", http.StatusNotFound)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			files, err := app.reporter.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(files)
+			return
+		}
+		if !reportNamePattern.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		http.ServeFile(w, r, filepath.Join(app.reporter.dir, name))
+
+	case http.MethodPost:
+		if !app.admin.Authorize(w, r) {
+			return
+		}
+		query := r.URL.Query()
+		kind := query.Get("kind")
+		if kind != reportDaily && kind != reportWeekly {
+			http.Error(w, "kind must be daily or weekly", http.StatusBadRequest)
+			return
+		}
+		t := time.Now().In(app.reporter.loc)
+		if date := query.Get("date"); date != "" {
+			var err error
+			if t, err = time.ParseInLocation("2006-01-02", date, app.reporter.loc); err != nil {
+				http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+		f, err := app.reporter.Generate(kind, t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Longest a host's request debugging can be switched on for in one go
+const maxRequestDebug = 24 * time.Hour
+
+// RequestDebugState is one host's debug switch
+type RequestDebugState struct {
+	Host       string  `json:"host"`
+	Until      string  `json:"until"`
+	SampleRate float64 `json:"sample_rate"` // fraction of requests logged, 0 < rate <= 1
+	Logged     int64   `json:"logged"`
+
+	until time.Time
+}
+
+// RequestDebug logs requests to selected hosts in full: the headers sent to
+// the backend and returned to the client, redacted, and where the time went
+// (DNS, connect, TLS, time to first byte). Switched on per host through the
+// API for a limited time, so one misbehaving backend can be looked at without
+// LOG_LEVEL=debug everywhere. Not persisted: a restart switches it off.
+type RequestDebug struct {
+	redact map[string]bool // canonical header names logged as [redacted]
+
+	mu    sync.Mutex
+	hosts map[string]*RequestDebugState
+}
+
+func NewRequestDebug(redact string) *RequestDebug {
+	d := &RequestDebug{redact: make(map[string]bool), hosts: make(map[string]*RequestDebugState)}
+	for _, h := range strings.Split(redact, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			d.redact[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return d
+}
+
+// Wants reports whether this request to host (a route key) is logged,
+// counting it if so
+func (d *RequestDebug) Wants(host string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.hosts[host]
+	if st == nil {
+		return false
+	}
+	if time.Now().After(st.until) {
+		delete(d.hosts, host)
+		slog.Info("Request debugging ended", "host", host, "logged", st.Logged)
+		return false
+	}
+	if st.SampleRate < 1 && mathrand.Float64() >= st.SampleRate {
+		return false
+	}
+	st.Logged++
+	return true
+}
+
+// Enable logs host's requests for d, a sample of them when rate < 1
+func (d *RequestDebug) Enable(host string, dur time.Duration, rate float64) RequestDebugState {
+	until := time.Now().Add(dur)
+	st := &RequestDebugState{Host: host, Until: store.FormatTime(until), SampleRate: rate, until: until}
+	d.mu.Lock()
+	d.hosts[host] = st
+	d.mu.Unlock()
+	return *st
+}
+
+// Disable switches host off, reporting whether it was on
+func (d *RequestDebug) Disable(host string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.hosts[host]
+	delete(d.hosts, host)
+	return ok
+}
+
+// List returns the hosts being debugged, expired ones left out
+func (d *RequestDebug) List() []RequestDebugState {
+	now := time.Now()
+	d.mu.Lock()
+	list := []RequestDebugState{}
+	for _, st := range d.hosts {
+		if now.Before(st.until) {
+			list = append(list, *st)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+// headerAttrs turns headers into a log group, one attribute per header
+func (d *RequestDebug) headerAttrs(name string, h http.Header) slog.Attr {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		value := redactedValue
+		if !d.redact[http.CanonicalHeaderKey(k)] {
+			value = strings.Join(h[k], ", ")
+			if len(value) > maxLoggedHeaderValue {
+				value = strings.ToValidUTF8(value[:maxLoggedHeaderValue], "")
+			}
+		}
+		attrs = append(attrs, slog.String(k, value))
+	}
+	return slog.Group(name, attrs...)
+}
+
+// requestTiming collects the timestamps of one backend round trip through
+// httptrace. Dialling can run on another goroutine, hence the lock.
+type requestTiming struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	wroteRequest, firstByte   time.Time
+	reused                    bool
+	remoteAddr                string
+	sent                      http.Header // request headers as written to the backend
+}
+
+func newRequestTiming() *requestTiming {
+	return &requestTiming{start: time.Now(), sent: make(http.Header)}
+}
+
+func (t *requestTiming) mark(at *time.Time) {
+	t.mu.Lock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *requestTiming) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart:      func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			if info.Conn != nil {
+				t.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+			t.mu.Unlock()
+		},
+		WroteHeaderField: func(key string, value []string) {
+			t.mu.Lock()
+			t.sent[key] = append(t.sent[key], value...)
+			t.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+}
+
+// elapsed is end-begin rounded for logging, 0 when either didn't happen
+func elapsed(begin, end time.Time) time.Duration {
+	if begin.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(begin).Round(time.Microsecond)
+}
+
+// Log writes the request's debug line
+func (d *RequestDebug) Log(host string, r *http.Request, t *requestTiming, status int, response http.Header) {
+	total := time.Since(t.start).Round(time.Microsecond)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slog.Info("Request debug", "log", "debug", "host", host, "method", r.Method, "path", r.URL.Path,
+		"status", status, "backend_addr", t.remoteAddr, "reused_conn", t.reused,
+		"dns", elapsed(t.dnsStart, t.dnsDone),
+		"connect", elapsed(t.connectStart, t.connectDone),
+		"tls", elapsed(t.tlsStart, t.tlsDone),
+		"wait", elapsed(t.wroteRequest, t.firstByte), // backend processing
+		"ttfb", elapsed(t.start, t.firstByte),
+		"total", total,
+		d.headerAttrs("request_headers", t.sent),
+		d.headerAttrs("response_headers", response))
+}
+
+// GET    /_proxy/request-debug        - hosts being debugged
+// POST   /_proxy/request-debug/{host} - {"duration": "15m", "sample_rate": 0.1}
+// DELETE /_proxy/request-debug/{host}
+func (app *App) handleRequestDebug(w http.ResponseWriter, r *http.Request) {
+	host, rt := app.lookupRoute(strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/request-debug"), "/")))
+
+	switch {
+	case r.Method == http.MethodGet && host == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.reqDebug.List())
+
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && host != "":
+		if rt == nil || rt.static != nil {
+			http.Error(w, "Unknown host", http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Duration   string   `json:"duration"`
+			SampleRate *float64 `json:"sample_rate"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		dur := 15 * time.Minute
+		if body.Duration != "" {
+			var ok bool
+			if dur, ok = parseRelative(body.Duration); !ok || dur > maxRequestDebug {
+				http.Error(w, "duration must be a positive duration up to 24h", http.StatusBadRequest)
+				return
+			}
+		}
+		rate := 1.0
+		if body.SampleRate != nil {
+			if rate = *body.SampleRate; rate <= 0 || rate > 1 {
+				http.Error(w, "sample_rate must be above 0 and at most 1", http.StatusBadRequest)
+				return
+			}
+		}
+		st := app.reqDebug.Enable(host, dur, rate)
+		slog.Info("Request debugging started", "host", host, "until", st.Until, "sample_rate", rate)
+		e := Event{Kind: "request_debug", Host: host, Message: "Request debugging started until " + st.Until}
+		if u := requestUser(r); u != nil {
+			e.Message += " by " + u.Name
+		}
+		app.addEvent(e)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+
+	case r.Method == http.MethodDelete && host != "":
+		if !app.reqDebug.Disable(host) {
+			http.Error(w, "Host is not being debugged", http.StatusNotFound)
+			return
+		}
+		slog.Info("Request debugging stopped", "host", host)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Content types rewritten when a rule doesn't list its own
+var defaultRewriteTypes = []string{
+	"text/html", "text/css", "text/javascript", "text/xml",
+	"application/javascript", "application/json", "application/xml",
+}
+
+// Lines longer than this are rewritten in pieces, so a match straddling a
+// piece boundary is missed
+const rewriteMaxLine = 64 << 10
+
+// RewriteRule replaces text in response bodies, e.g. absolute internal URLs
+// a backend renders into its pages
+type RewriteRule struct {
+	Match        string   `json:"match,omitempty"` // literal text to replace
+	Regex        string   `json:"regex,omitempty"` // or a regular expression; replace may use $1
+	Replace      string   `json:"replace"`
+	ContentTypes []string `json:"content_types,omitempty"` // e.g. ["text/html", "text/*"]
+}
+
+type compiledRewrite struct {
+	literal []byte
+	re      *regexp.Regexp
+	replace []byte
+	types   []string
+}
+
+// Rewriter applies a host's rewrite rules to responses as they stream
+// through, one line at a time
+type Rewriter struct {
+	rules []compiledRewrite
+}
+
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	rw := &Rewriter{}
+	for i, r := range rules {
+		c := compiledRewrite{replace: []byte(r.Replace), types: r.ContentTypes}
+		switch {
+		case r.Match != "" && r.Regex != "":
+			return nil, fmt.Errorf("rewrite rule %d: set match or regex, not both", i+1)
+		case r.Match != "":
+			c.literal = []byte(r.Match)
+		case r.Regex != "":
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: %v", i+1, err)
+			}
+			c.re = re
+		default:
+			return nil, fmt.Errorf("rewrite rule %d: match or regex is required", i+1)
+		}
+		if len(c.types) == 0 {
+			c.types = defaultRewriteTypes
+		}
+		rw.rules = append(rw.rules, c)
+	}
+	return rw, nil
+}
+
+// Modify wraps resp.Body with the rules that apply to its content type.
+// Compressed bodies are left alone; the proxy asks rewritten backends for
+// uncompressed responses.
+func (rw *Rewriter) Modify(resp *http.Response) error {
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var rules []compiledRewrite
+	for _, r := range rw.rules {
+		if contentTypeMatches(mediaType, r.types) {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	resp.Body = &rewriteReader{src: resp.Body, rules: rules}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+func contentTypeMatches(mediaType string, types []string) bool {
+	for _, t := range types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteReader applies rules to whole lines of src, so matches can't span
+// a newline
+type rewriteReader struct {
+	src   io.ReadCloser
+	rules []compiledRewrite
+	in    []byte // read but not yet rewritten: an incomplete line
+	out   []byte // rewritten, not yet returned
+	buf   []byte
+	err   error
+}
+
+func (rr *rewriteReader) Read(p []byte) (int, error) {
+	if rr.buf == nil {
+		rr.buf = make([]byte, 32<<10)
+	}
+	for len(rr.out) == 0 && rr.err == nil {
+		n, err := rr.src.Read(rr.buf)
+		rr.in = append(rr.in, rr.buf[:n]...)
+		if err != nil {
+			rr.out = rr.rewrite(rr.in)
+			rr.in = nil
+			rr.err = err
+			break
+		}
+		cut := bytes.LastIndexByte(rr.in, '\n') + 1
+		if cut == 0 && len(rr.in) >= rewriteMaxLine {
+			cut = len(rr.in)
+		}
+		if cut > 0 {
+			rr.out = rr.rewrite(rr.in[:cut])
+			rr.in = append([]byte(nil), rr.in[cut:]...)
+		}
+	}
+	if len(rr.out) > 0 {
+		n := copy(p, rr.out)
+		rr.out = rr.out[n:]
+		return n, nil
+	}
+	return 0, rr.err
+}
+
+func (rr *rewriteReader) rewrite(b []byte) []byte {
+	for _, r := range rr.rules {
+		if r.re != nil {
+			b = r.re.ReplaceAll(b, r.replace)
+		} else {
+			b = bytes.ReplaceAll(b, r.literal, r.replace)
+		}
+	}
+	return b
+}
+
+func (rr *rewriteReader) Close() error {
+	return rr.src.Close()
+}
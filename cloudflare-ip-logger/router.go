@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var recoveredPanics = expvar.NewInt("recovered_panics")
+
+// API requests per endpoint pattern, whether or not LOG_API_REQUESTS logs them
+var apiRequests = expvar.NewMap("api_requests")
+
+// middleware wraps a handler with behavior shared by many routes
+type middleware func(http.Handler) http.Handler
+
+// chain applies mw to h, the first one outermost
+func chain(h http.Handler, mw ...middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Router sends requests for a registered API path on an API host to the API
+// mux, with the prefix stripped, and everything else to the proxy. Paths
+// under the prefix the API doesn't know still reach the backend.
+type Router struct {
+	prefix   string
+	apiHosts map[string]bool // empty serves the API on every host
+	api      *http.ServeMux
+	patterns []string // registered with the API mux, in order
+	apiStack []middleware
+	proxy    http.Handler
+}
+
+func NewRouter(prefix string, apiHosts []string, proxy http.Handler) (*Router, error) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		return nil, fmt.Errorf("API prefix can't be the root path")
+	}
+	rt := &Router{prefix: prefix, apiHosts: make(map[string]bool), api: http.NewServeMux(), proxy: proxy}
+	for _, h := range apiHosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			rt.apiHosts[h] = true
+		}
+	}
+	return rt, nil
+}
+
+// Handle registers an API handler; pattern is relative to the prefix
+func (rt *Router) Handle(pattern string, h http.Handler, mw ...middleware) {
+	rt.api.Handle(pattern, chain(h, mw...))
+	rt.patterns = append(rt.patterns, pattern)
+}
+
+func (rt *Router) HandleFunc(pattern string, h http.HandlerFunc, mw ...middleware) {
+	rt.Handle(pattern, h, mw...)
+}
+
+// Use adds middleware run for every API request
+func (rt *Router) Use(mw ...middleware) {
+	rt.apiStack = append(rt.apiStack, mw...)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, rt.prefix); ok && strings.HasPrefix(rest, "/") && rt.isAPIHost(r.Host) {
+		r2 := r.WithContext(context.WithValue(r.Context(), originalPathKey{}, r.URL.Path))
+		u := *r.URL
+		u.Path, u.RawPath = rest, ""
+		r2.URL = &u
+		if h, pattern := rt.api.Handler(r2); pattern != "" {
+			r2 = r2.WithContext(context.WithValue(r2.Context(), apiPatternKey{}, pattern))
+			chain(h, rt.apiStack...).ServeHTTP(w, r2)
+			return
+		}
+	}
+	rt.proxy.ServeHTTP(w, r)
+}
+
+// originalPathKey holds an API request's path before the prefix was stripped
+type originalPathKey struct{}
+
+// apiPatternKey holds the pattern an API request was routed by
+type apiPatternKey struct{}
+
+func apiPattern(r *http.Request) string {
+	p, _ := r.Context().Value(apiPatternKey{}).(string)
+	return p
+}
+
+// requestPath is the path the client asked for, prefix included
+func requestPath(r *http.Request) string {
+	if p, ok := r.Context().Value(originalPathKey{}).(string); ok {
+		return p
+	}
+	return r.URL.Path
+}
+
+func (rt *Router) isAPIHost(host string) bool {
+	return len(rt.apiHosts) == 0 || rt.apiHosts[strings.ToLower(strings.Split(host, ":")[0])]
+}
+
+// recoverMiddleware turns a panicking handler into a 500 and a logged stack
+// instead of a dropped connection. http.ErrAbortHandler, which the proxy
+// uses to abort a response mid-copy, is passed on.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			recoveredPanics.Add(1)
+			slog.Error("Panic serving request", "method", r.Method, "host", r.Host, "path", r.URL.Path, "err", err, "stack", string(debug.Stack()))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin rejects requests without ADMIN_TOKEN or an admin user's token
+// (once either is configured)
+func (app *App) requireAdmin(next http.Handler) http.Handler {
+	return app.refuseShared(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.admin.Authorize(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	}))
+}
+
+// readOnlyMiddleware turns away API requests that would change anything on a
+// READ_ONLY instance
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Read-only instance", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimiter allows each client a number of requests per minute, counted in
+// fixed one-minute windows
+type RateLimiter struct {
+	perMinute int
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter(perMinute int) *RateLimiter {
+	rl := &RateLimiter{perMinute: perMinute, windows: make(map[string]*rateWindow)}
+	go rl.cleanup()
+	return rl
+}
+
+// Allow counts a request from key and reports whether it is within the
+// limit, and if not how long until the window resets
+func (rl *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	win := rl.windows[key]
+	if win == nil || now.Sub(win.start) >= time.Minute {
+		win = &rateWindow{start: now}
+		rl.windows[key] = win
+	}
+	if win.count >= rl.perMinute {
+		return false, win.start.Add(time.Minute).Sub(now)
+	}
+	win.count++
+	return true, 0
+}
+
+func (rl *RateLimiter) cleanup() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-time.Minute)
+		rl.mu.Lock()
+		for key, win := range rl.windows {
+			if win.start.Before(cutoff) {
+				delete(rl.windows, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// apiLogMiddleware counts API requests per endpoint and, with
+// LOG_API_REQUESTS, logs them as connections like any other request. That is
+// off by default so the dashboard's polling doesn't become the busiest visitor.
+func (app *App) apiLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiRequests.Add(apiPattern(r), 1)
+		if app.logAPICalls {
+			conn := app.extractClientInfo(r)
+			conn.Seq = app.seqGen.New(conn.Timestamp)
+			if err := app.logConnection(conn); err != nil {
+				slog.Error("Error logging connection", "err", err)
+			}
+			r = withLoggedConnection(r, conn)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitMiddleware answers 429 once a client exceeds API_RATE_LIMIT
+func (app *App) rateLimitMiddleware(rl *RateLimiter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := app.ipPolicy.ClientIP(r)
+			if ok, retry := rl.Allow(clientIP, time.Now()); !ok {
+				if app.dryRun {
+					app.observe("api_rate_limit", clientIP, r, "API_RATE_LIMIT")
+					app.recordDecision(loggedConnection(r), decisionObserved, ruleAPIRateLimit)
+				} else {
+					app.recordDecision(loggedConnection(r), decisionRateLimited, ruleAPIRateLimit)
+					w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+					http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Partial addresses typed into the search box, before they parse as an IP
+var ipPrefixPattern = regexp.MustCompile(`^(?:[0-9.]+|[0-9a-fA-F]*:[0-9a-fA-F:]*)$`)
+
+// PathStats is a path's traffic, as path searches return it
+type PathStats struct {
+	Path      string `json:"path"`
+	Host      string `json:"host"`
+	HitCount  int    `json:"hit_count"`
+	UniqueIPs int    `json:"unique_ips"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// likeEscape escapes LIKE wildcards in s, for use with ESCAPE '\'
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// cidrLike narrows a CIDR search to the addresses sharing its whole leading
+// octets, e.g. "10.1.%" for 10.1.0.0/16; the rest is checked in Go
+func cidrLike(n *net.IPNet) string {
+	ip4 := n.IP.To4()
+	if ip4 == nil {
+		return "%:%"
+	}
+	ones, _ := n.Mask.Size()
+	var octets []string
+	for i := 0; i < ones/8; i++ {
+		octets = append(octets, strconv.Itoa(int(ip4[i])))
+	}
+	if len(octets) == 4 {
+		return strings.Join(octets, ".")
+	}
+	return strings.Join(append(octets, "%"), ".")
+}
+
+// GET /_proxy/search?q=203.0.113.7|203.0.113.0/24|203.0.|/wp-login&since=30d&limit=50&tz=Europe/Berlin
+//
+// q is matched as an IP, a CIDR range, the start of an IP, or else a piece
+// of a path. kind says which; ips or paths hold what matched, both empty
+// when nothing did.
+func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q required", http.StatusBadRequest)
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeCond, rangeArgs, err := timeRange(r.URL.Query(), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	rangeCond += scopeCond
+	rangeArgs = append(rangeArgs, scopeArgs...)
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	readDB := app.readerFor(r, "")
+
+	var kind, ipCond string
+	var ipArg interface{}
+	var cidr *net.IPNet
+	switch _, n, cidrErr := net.ParseCIDR(q); {
+	case net.ParseIP(q) != nil:
+		kind, ipCond, ipArg = "ip", "client_ip = ?", q
+	case cidrErr == nil:
+		kind, ipCond, ipArg, cidr = "cidr", "client_ip LIKE ?", cidrLike(n), n
+	case ipPrefixPattern.MatchString(q) && strings.ContainsAny(q, ".:"):
+		kind, ipCond, ipArg = "ip_prefix", `client_ip LIKE ? ESCAPE '\'`, likeEscape(q)+"%"
+	default:
+		kind = "path"
+	}
+
+	response := map[string]interface{}{"query": q, "kind": kind, "ips": []IPStats{}, "paths": []PathStats{}}
+	if kind == "path" {
+		rows, err := readDB.Query(`SELECT path, host, COUNT(*) AS hits, COUNT(DISTINCT client_ip), MAX(timestamp)
+			FROM connections WHERE path LIKE ? ESCAPE '\'`+rangeCond+`
+			GROUP BY path, host ORDER BY hits DESC LIMIT ?`,
+			append(append([]interface{}{"%" + likeEscape(q) + "%"}, rangeArgs...), limit)...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		paths := []PathStats{}
+		for rows.Next() {
+			var p PathStats
+			if err := rows.Scan(&p.Path, &p.Host, &p.HitCount, &p.UniqueIPs, &p.LastSeen); err != nil {
+				continue
+			}
+			p.LastSeen = formatStoredTime(p.LastSeen, loc)
+			paths = append(paths, p)
+		}
+		response["paths"] = paths
+	} else {
+		query := `SELECT client_ip, country, COUNT(*) AS hits, MIN(timestamp), MAX(timestamp)
+			FROM connections WHERE ` + ipCond + rangeCond + ` GROUP BY client_ip ORDER BY hits DESC`
+		args := append([]interface{}{ipArg}, rangeArgs...)
+		// CIDR matches are only known after the range check, so they can't be
+		// cut in SQL
+		if cidr == nil {
+			query += " LIMIT ?"
+			args = append(args, limit)
+		}
+		rows, err := readDB.Query(query, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		ips := []IPStats{}
+		for rows.Next() && len(ips) < limit {
+			var s IPStats
+			if err := rows.Scan(&s.ClientIP, &s.Country, &s.HitCount, &s.FirstSeen, &s.LastSeen); err != nil {
+				continue
+			}
+			if ip := net.ParseIP(s.ClientIP); cidr != nil && (ip == nil || !cidr.Contains(ip)) {
+				continue
+			}
+			s.FirstSeen = formatStoredTime(s.FirstSeen, loc)
+			s.LastSeen = formatStoredTime(s.LastSeen, loc)
+			s.Tag = app.ipTags.TagOf(s.ClientIP)
+			ips = append(ips, s)
+		}
+		response["ips"] = ips
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
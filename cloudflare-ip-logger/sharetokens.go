@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Share token lifetimes: the default, and the longest one can be issued for
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+// Share tokens start with this, so they're told apart from account tokens
+// without trying to verify every bearer token
+const shareTokenPrefix = "cfs1."
+
+// sharedEndpoints are the API patterns a share token may GET: the ones that
+// filter by host and honor since/until, so the token's scope holds
+var sharedEndpoints = map[string]bool{
+	"/connections":     true,
+	"/stats":           true,
+	"/stats/ip/":       true,
+	"/stats/heatmap":   true,
+	"/stats/tls":       true,
+	"/stats/beacons":   true,
+	"/stats/campaigns": true,
+	"/stats/crawlers":  true,
+	"/search":          true,
+	"/events":          true,
+	"/errors":          true,
+	"/annotations":     true,
+}
+
+// ShareScope is what a share token grants: read access to one host's data
+// between Since and Until, until the token expires
+type ShareScope struct {
+	ID        string `json:"id"`
+	Host      string `json:"host"`
+	Since     string `json:"since"`
+	Until     string `json:"until"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// ShareToken is an issued token as listed; the token itself is only in the
+// response that issued it
+type ShareToken struct {
+	ShareScope
+	Note      string `json:"note,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	CreatedAt string `json:"created_at"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+	Token     string `json:"token,omitempty"`
+	URL       string `json:"url,omitempty"` // the dashboard, opened on the shared view
+}
+
+// ShareTokens issues and checks signed, read-only tokens for handing one
+// host's data over a time range to someone without an account. The scope is
+// in the token, signed with HMAC-SHA256; issued tokens are recorded so they
+// can be listed and revoked before they expire.
+type ShareTokens struct {
+	db  *sql.DB
+	key []byte
+
+	mu      sync.RWMutex
+	revoked map[string]bool
+}
+
+// NewShareTokens signs with secret, or without one with a key generated into
+// keyFile on first start and read from it afterwards
+func NewShareTokens(db *sql.DB, secret, keyFile string) (*ShareTokens, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS share_tokens (
+		id TEXT PRIMARY KEY,
+		host TEXT NOT NULL,
+		since DATETIME NOT NULL,
+		until DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		revoked_at DATETIME
+	);`)
+	if err != nil {
+		return nil, err
+	}
+	// Versioned for the admin API's share-tokens kind
+	if _, err := store.AddColumnIfMissing(db, "share_tokens", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	added, err := store.AddColumnIfMissing(db, "share_tokens", "updated_at", "DATETIME NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+	if added {
+		if _, err := db.Exec("UPDATE share_tokens SET updated_at = COALESCE(revoked_at, created_at)"); err != nil {
+			return nil, err
+		}
+	}
+	key := []byte(secret)
+	if secret == "" {
+		if key, err = loadShareKey(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	st := &ShareTokens{db: db, key: key}
+	return st, st.reload()
+}
+
+// loadShareKey reads the signing key from path, creating it if needed
+func loadShareKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// reload refreshes the revoked IDs of tokens that haven't expired yet
+func (st *ShareTokens) reload() error {
+	rows, err := st.db.Query("SELECT id FROM share_tokens WHERE revoked_at IS NOT NULL AND expires_at > ?", store.FormatTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	revoked := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		revoked[id] = true
+	}
+	st.mu.Lock()
+	st.revoked = revoked
+	st.mu.Unlock()
+	return rows.Err()
+}
+
+func (st *ShareTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue records a token for scope, under a new ID unless scope has one, and
+// returns it
+func (st *ShareTokens) Issue(scope ShareScope, note, createdBy string) (ShareToken, error) {
+	if scope.ID == "" {
+		scope.ID = newAdminID()
+	}
+	t := ShareToken{ShareScope: scope, Note: note, CreatedBy: createdBy, CreatedAt: store.FormatTime(time.Now())}
+	_, err := st.db.Exec(`INSERT INTO share_tokens (id, host, since, until, expires_at, note, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, scope.ID, scope.Host, scope.Since, scope.Until, scope.ExpiresAt, note, createdBy, t.CreatedAt, t.CreatedAt)
+	if err != nil {
+		return ShareToken{}, err
+	}
+	data, _ := json.Marshal(scope)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	t.Token = shareTokenPrefix + payload + "." + st.sign(payload)
+	return t, nil
+}
+
+// Lookup returns the scope of a valid, unexpired and unrevoked share token,
+// nil for anything else
+func (st *ShareTokens) Lookup(token string) *ShareScope {
+	rest, ok := strings.CutPrefix(token, shareTokenPrefix)
+	if !ok {
+		return nil
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(st.sign(payload))) {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	var scope ShareScope
+	if json.Unmarshal(data, &scope) != nil || scope.ExpiresAt <= store.FormatTime(time.Now()) {
+		return nil
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.revoked[scope.ID] {
+		return nil
+	}
+	return &scope
+}
+
+// List returns the issued tokens, newest first; expired ones only with all
+func (st *ShareTokens) List(all bool) ([]ShareToken, error) {
+	query, args := `SELECT id, host, since, until, expires_at, note, created_by, created_at, COALESCE(revoked_at, '') FROM share_tokens`, []interface{}{}
+	if !all {
+		query += " WHERE expires_at > ?"
+		args = append(args, store.FormatTime(time.Now()))
+	}
+	rows, err := st.db.Query(query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []ShareToken{}
+	for rows.Next() {
+		var t ShareToken
+		if err := rows.Scan(&t.ID, &t.Host, &t.Since, &t.Until, &t.ExpiresAt, &t.Note, &t.CreatedBy, &t.CreatedAt, &t.RevokedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// Revoke stops a token working before it expires
+func (st *ShareTokens) Revoke(id string) (bool, error) {
+	now := store.FormatTime(time.Now())
+	res, err := st.db.Exec("UPDATE share_tokens SET revoked_at = ?, version = version + 1, updated_at = ? WHERE id = ? AND revoked_at IS NULL", now, now, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, st.reload()
+}
+
+// refuseShared turns share tokens away from admin endpoints with the 403
+// serveShared gives, rather than asking them for credentials
+func (app *App) refuseShared(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.shareTokens.Lookup(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) != nil {
+			http.Error(w, "Not available with a share token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveShared runs next for a request carrying a share token: as a viewer
+// of the token's host, on the endpoints that keep to it, with since and
+// until narrowed to the token's range
+func (app *App) serveShared(w http.ResponseWriter, r *http.Request, next http.Handler, scope *ShareScope) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Share tokens are read-only", http.StatusForbidden)
+		return
+	}
+	if !sharedEndpoints[apiPattern(r)] {
+		http.Error(w, "Not available with a share token", http.StatusForbidden)
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	since, until := scope.Since, scope.Until
+	if v := query.Get("since"); v != "" {
+		t, err := parseTimeParam(v, loc)
+		if err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = max(since, t)
+	}
+	if v := query.Get("until"); v != "" {
+		t, err := parseTimeParam(v, loc)
+		if err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		until = min(until, t)
+	}
+	query.Set("since", since)
+	query.Set("until", until)
+	// Archived days aren't part of a shared view
+	query.Del("archive")
+
+	user := &User{Name: "share:" + scope.ID, Role: roleViewer, Hosts: []string{scope.Host}}
+	r2 := r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	r2.URL = &u
+	next.ServeHTTP(w, r2)
+}
+
+// shareRequest is a request to issue a share token
+type shareRequest struct {
+	Host  string `json:"host"`
+	Since string `json:"since"`           // a time, or a duration back from now
+	Until string `json:"until,omitempty"` // default now, so the view doesn't grow
+	TTL   string `json:"ttl,omitempty"`   // how long the token works, default 24h
+	Note  string `json:"note,omitempty"`
+}
+
+// /_proxy/share-tokens[/{id}] (admin):
+//
+//	GET    /share-tokens?all=true  issued tokens, expired ones too with all
+//	POST   /share-tokens           {"host": "blog.example.com", "since": "2025-01-30T00:00:00Z", "until": "2025-01-31T00:00:00Z", "ttl": "7d", "note": "..."}
+//	DELETE /share-tokens/{id}      revoke
+func (app *App) handleShareTokens(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/share-tokens"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		list, err := app.shareTokens.List(r.URL.Query().Get("all") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case r.Method == http.MethodPost && id == "":
+		var req shareRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		scope, err := app.shareScope(req, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		createdBy := ""
+		if u := app.admin.Authenticate(r); u != nil {
+			createdBy = u.Name
+		}
+		t, err := app.shareTokens.Issue(scope, strings.TrimSpace(req.Note), createdBy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.URL = strings.TrimSuffix(requestPath(r), "/share-tokens") + "/dashboard#share=" + t.Token
+		slog.Info("Share token issued", "id", t.ID, "host", t.Host, "since", t.Since, "until", t.Until, "expires", t.ExpiresAt)
+		app.addEvent(Event{Kind: "share", Host: t.Host,
+			Message: fmt.Sprintf("Share token %s issued by %s for %s to %s, valid until %s", t.ID, orDefault(createdBy, "admin"), t.Since, t.Until, t.ExpiresAt)})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+
+	case r.Method == http.MethodDelete && id != "":
+		found, err := app.shareTokens.Revoke(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "No such share token", http.StatusNotFound)
+			return
+		}
+		app.addEvent(Event{Kind: "share", Message: "Share token " + id + " revoked"})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shareScope checks a share request and turns it into the token's scope,
+// reading times without a zone in loc
+func (app *App) shareScope(req shareRequest, loc *time.Location) (ShareScope, error) {
+	host := strings.ToLower(strings.TrimSpace(req.Host))
+	if host == "" {
+		return ShareScope{}, errors.New("host required")
+	}
+	if canonical, rt := app.lookupRoute(host); rt != nil {
+		host = canonical
+	}
+	if req.Since == "" {
+		return ShareScope{}, errors.New("since required")
+	}
+	now := time.Now()
+	since, err := parseTimeParam(req.Since, loc)
+	if err != nil {
+		return ShareScope{}, fmt.Errorf("since: %v", err)
+	}
+	until := store.FormatTime(now)
+	if req.Until != "" {
+		if until, err = parseTimeParam(req.Until, loc); err != nil {
+			return ShareScope{}, fmt.Errorf("until: %v", err)
+		}
+	}
+	if until <= since {
+		return ShareScope{}, errors.New("until must be after since")
+	}
+	ttl := defaultShareTTL
+	if req.TTL != "" {
+		var ok bool
+		if ttl, ok = parseRelative(req.TTL); !ok || ttl > maxShareTTL {
+			return ShareScope{}, fmt.Errorf("ttl must be a duration of at most %s", maxShareTTL)
+		}
+	}
+	return ShareScope{Host: host, Since: since, Until: until, ExpiresAt: store.FormatTime(now.Add(ttl))}, nil
+}
+
+// shareTokenData is a share token as the admin API's share-tokens kind holds
+// it: the share request it was issued from, and what the server set
+type shareTokenData struct {
+	shareRequest
+	ExpiresAt string `json:"expires_at,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+	Token     string `json:"token,omitempty"` // in the response that issued it only
+}
+
+// shareTokenCollection exposes issued share tokens as the "share-tokens"
+// admin kind. A token's scope is signed into it, so replacing one only
+// changes its note; deleting one revokes it, and the record stays so the
+// token keeps being refused until it expires.
+type shareTokenCollection struct {
+	app *App
+}
+
+const shareTokenObjectColumns = "id, host, since, until, expires_at, note, created_by, created_at, COALESCE(revoked_at, ''), version, updated_at"
+
+func (c shareTokenCollection) scan(row interface{ Scan(...interface{}) error }) (AdminObject, error) {
+	var o AdminObject
+	var d shareTokenData
+	err := row.Scan(&o.ID, &d.Host, &d.Since, &d.Until, &d.ExpiresAt, &d.Note, &d.CreatedBy, &d.CreatedAt, &d.RevokedAt, &o.Version, &o.UpdatedAt)
+	o.Data, _ = json.Marshal(d)
+	return o, err
+}
+
+func (c shareTokenCollection) List() ([]AdminObject, error) {
+	rows, err := c.app.shareTokens.db.Query("SELECT " + shareTokenObjectColumns + " FROM share_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []AdminObject{}
+	for rows.Next() {
+		o, err := c.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+func (c shareTokenCollection) Get(id string) (AdminObject, error) {
+	o, err := c.scan(c.app.shareTokens.db.QueryRow("SELECT "+shareTokenObjectColumns+" FROM share_tokens WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return AdminObject{}, errAdminNotFound
+	}
+	return o, err
+}
+
+func (c shareTokenCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	var d shareTokenData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+	note := strings.TrimSpace(d.Note)
+
+	_, err := c.Get(id)
+	switch {
+	case err == errAdminNotFound:
+		if ifMatch > 0 {
+			return AdminObject{}, errAdminNotFound
+		}
+		scope, err := c.app.shareScope(d.shareRequest, time.UTC)
+		if err != nil {
+			return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+		}
+		scope.ID = id
+		t, err := c.app.shareTokens.Issue(scope, note, "")
+		if err != nil {
+			return AdminObject{}, err
+		}
+		slog.Info("Share token issued", "id", t.ID, "host", t.Host, "since", t.Since, "until", t.Until, "expires", t.ExpiresAt)
+		c.app.addEvent(Event{Kind: "share", Host: t.Host,
+			Message: fmt.Sprintf("Share token %s issued through the admin API for %s to %s, valid until %s", t.ID, t.Since, t.Until, t.ExpiresAt)})
+		o, err := c.Get(id)
+		if err != nil {
+			return o, err
+		}
+		// The token is only ever in this response
+		json.Unmarshal(o.Data, &d)
+		d.Token = t.Token
+		o.Data, _ = json.Marshal(d)
+		return o, nil
+	case err != nil:
+		return AdminObject{}, err
+	case ifMatch < 0:
+		return AdminObject{}, errAdminAlreadyExists
+	case ifMatch == 0:
+		return AdminObject{}, errAdminPreconditionNeeded
+	}
+	res, err := c.app.shareTokens.db.Exec("UPDATE share_tokens SET note = ?, version = version + 1, updated_at = ? WHERE id = ? AND version = ?",
+		note, store.FormatTime(time.Now()), id, ifMatch)
+	if err != nil {
+		return AdminObject{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return AdminObject{}, errAdminVersionMismatch
+	}
+	return c.Get(id)
+}
+
+func (c shareTokenCollection) Delete(id string, ifMatch int64) error {
+	if ifMatch == 0 {
+		return errAdminPreconditionNeeded
+	}
+	now := store.FormatTime(time.Now())
+	res, err := c.app.shareTokens.db.Exec(`UPDATE share_tokens SET revoked_at = COALESCE(revoked_at, ?), version = version + 1, updated_at = ?
+		WHERE id = ? AND version = ?`, now, now, id, ifMatch)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.Get(id); errors.Is(err, errAdminNotFound) {
+			return errAdminNotFound
+		}
+		return errAdminVersionMismatch
+	}
+	c.app.addEvent(Event{Kind: "share", Message: "Share token " + id + " revoked"})
+	return c.app.shareTokens.reload()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Rows a share token for shareHost over the last two hours to one hour ago
+// may see (in), and the ones it mustn't: the same host before and after the
+// range, and another host inside it. Each row's path, client IP, UTM campaign
+// and notes carry its marker, so a leak shows up in any response.
+const (
+	shareHost = "blog.example.com"
+	otherHost = "shop.example.com"
+)
+
+type shareFixture struct {
+	marker string
+	host   string
+	ip     string
+	ago    time.Duration
+}
+
+var shareFixtures = []shareFixture{
+	{"shared-in", shareHost, "203.0.113.10", 90 * time.Minute},
+	{"shared-before", shareHost, "203.0.113.20", 3 * time.Hour},
+	{"shared-after", shareHost, "203.0.113.30", 30 * time.Minute},
+	{"other-in", otherHost, "198.51.100.40", 90 * time.Minute},
+}
+
+// newShareTestApp is an App with a database holding shareFixtures and the API
+// routes registered, with ADMIN_TOKEN "admin-token"
+func newShareTestApp(t *testing.T) (*App, *Router) {
+	t.Helper()
+	db, err := store.Open(t.TempDir() + "/connections.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	app := &App{db: db, readDB: db, crawlers: NewCrawlerAgents(defaultCrawlerAgents), ownTraffic: &ownTraffic{apiPrefix: "/_proxy"}}
+	app.routes.Store(&routeTable{routes: map[string]*route{shareHost: {}, otherHost: {}}, aliases: map[string]string{}})
+	if err := app.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	if app.campaigns, err = NewCampaignParams(""); err != nil {
+		t.Fatal(err)
+	}
+	if app.admin, err = NewAdminAPI(db, "admin-token"); err != nil {
+		t.Fatal(err)
+	}
+	if app.bans, err = NewBanList(db); err != nil {
+		t.Fatal(err)
+	}
+	if app.ipTags, err = NewIPTags(db, defaultScannerPaths); err != nil {
+		t.Fatal(err)
+	}
+	if app.annotations, err = NewAnnotations(db); err != nil {
+		t.Fatal(err)
+	}
+	if app.shareTokens, err = NewShareTokens(db, "test-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i, f := range shareFixtures {
+		ts := store.FormatTime(now.Add(-f.ago))
+		seq := store.SeqFromID(now.Add(-f.ago), int64(i+1))
+		_, err := db.Exec(`INSERT INTO connections (timestamp, client_ip, country, method, path, host, user_agent, referer, category, seq,
+			tls_version, tls_cipher, tls_ja3, utm_source, utm_medium, utm_campaign)
+			VALUES (?, ?, 'DE', 'GET', ?, ?, 'Mozilla/5.0 (compatible; Googlebot/2.1)', '', 'visitor', ?, 'TLS 1.3', ?, ?, 'newsletter', 'email', ?)`,
+			ts, f.ip, "/"+f.marker, f.host, seq, f.marker, f.marker, f.marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO connections (timestamp, client_ip, country, method, path, host, category, source, seq)
+			VALUES (?, ?, 'DE', 'GET', ?, ?, 'beacon', 'beacon', ?)`, ts, f.ip, "/"+f.marker, f.host, seq+"b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO events (timestamp, kind, source, severity, host, client_ip, message) VALUES (?, 'backend', 'logger', 'critical', ?, ?, ?)`,
+			ts, f.host, f.ip, "Backend down: "+f.marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO proxy_errors (timestamp, host, backend, class, message, client_ip, method, path) VALUES (?, ?, 'http://10.0.0.5', 'refused', ?, ?, 'GET', ?)`,
+			ts, f.host, "refused: "+f.marker, f.ip, "/"+f.marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = app.annotations.Add(f.marker, annotationData{Kind: annotationIncident, StartsAt: now.Add(-f.ago).Format(time.RFC3339),
+			Duration: "10m", Hosts: []string{f.host}, Note: "Incident " + f.marker}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router, err := NewRouter("/_proxy", nil, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.registerAPI(router)
+	return app, router
+}
+
+// shareCases are requests on each of sharedEndpoints, with a string the
+// response has to contain for the in-range row
+var shareCases = map[string][]struct {
+	path string
+	code int
+	want string
+}{
+	"/connections":     {{"/connections", http.StatusOK, "/shared-in"}},
+	"/stats":           {{"/stats", http.StatusOK, "203.0.113.10"}},
+	"/stats/ip/":       {{"/stats/ip/203.0.113.10", http.StatusOK, "/shared-in"}, {"/stats/ip/203.0.113.20", http.StatusNotFound, ""}, {"/stats/ip/198.51.100.40", http.StatusNotFound, ""}},
+	"/stats/heatmap":   {{"/stats/heatmap", http.StatusOK, `"total":1,`}},
+	"/stats/tls":       {{"/stats/tls", http.StatusOK, "shared-in"}},
+	"/stats/beacons":   {{"/stats/beacons", http.StatusOK, "/shared-in"}},
+	"/stats/campaigns": {{"/stats/campaigns", http.StatusOK, "shared-in"}},
+	"/stats/crawlers":  {{"/stats/crawlers", http.StatusOK, "/shared-in"}},
+	"/search":          {{"/search?q=shared", http.StatusOK, "/shared-in"}, {"/search?q=203.0.113.0/24", http.StatusOK, "203.0.113.10"}},
+	"/events":          {{"/events", http.StatusOK, "shared-in"}},
+	"/errors":          {{"/errors", http.StatusOK, "shared-in"}},
+	"/annotations":     {{"/annotations", http.StatusOK, "shared-in"}},
+}
+
+// Endpoints that don't look at the bearer token at all
+var publicEndpoints = map[string]bool{
+	"/health": true, "/status": true, "/status.json": true, "/public/": true, "/dashboard": true,
+	"/ingest": true, "/beacon": true, "/beacon.js": true, "/webhook/": true, "/passkeys": true, "/passkeys/": true,
+}
+
+func TestShareTokenScope(t *testing.T) {
+	app, router := newShareTestApp(t)
+	now := time.Now()
+	issued, err := app.shareTokens.Issue(ShareScope{Host: shareHost, Since: store.FormatTime(now.Add(-2 * time.Hour)),
+		Until: store.FormatTime(now.Add(-time.Hour)), ExpiresAt: store.FormatTime(now.Add(time.Hour))}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string) (int, string) {
+		r := httptest.NewRequest(method, "/_proxy"+path, nil)
+		r.Header.Set("Authorization", "Bearer "+issued.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Body)
+		return w.Code, string(body)
+	}
+	// leaks reports the out-of-scope rows showing in body, other than what
+	// the request itself asked for
+	leaks := func(path, body string) []string {
+		var found []string
+		for _, f := range shareFixtures[1:] {
+			for _, s := range []string{f.marker, f.ip} {
+				if strings.Contains(body, s) && !strings.Contains(path, s) {
+					found = append(found, s)
+				}
+			}
+		}
+		return found
+	}
+
+	for pattern := range sharedEndpoints {
+		if _, ok := shareCases[pattern]; !ok {
+			t.Errorf("no test case for shared endpoint %s", pattern)
+		}
+		if !slices.Contains(router.patterns, pattern) {
+			t.Errorf("shared endpoint %s isn't registered", pattern)
+		}
+	}
+
+	for _, cases := range shareCases {
+		for _, tc := range cases {
+			t.Run(tc.path, func(t *testing.T) {
+				sep := "?"
+				if strings.Contains(tc.path, "?") {
+					sep = "&"
+				}
+				code, body := do(http.MethodGet, tc.path)
+				if code != tc.code {
+					t.Fatalf("GET %s = %d %q, want %d", tc.path, code, body, tc.code)
+				}
+				if !strings.Contains(body, tc.want) {
+					t.Errorf("GET %s = %q, want it to contain %q", tc.path, body, tc.want)
+				}
+				if found := leaks(tc.path, body); len(found) > 0 {
+					t.Errorf("GET %s shows %v", tc.path, found)
+				}
+
+				// Asking for more than the token covers gets the token's range
+				wide := tc.path + sep + "since=30d&until=2099-01-01T00:00:00Z"
+				code, body = do(http.MethodGet, wide)
+				if code != tc.code || !strings.Contains(body, tc.want) {
+					t.Errorf("GET %s = %d %q, want %d containing %q", wide, code, body, tc.code, tc.want)
+				}
+				if found := leaks(wide, body); len(found) > 0 {
+					t.Errorf("GET %s shows %v", wide, found)
+				}
+				other := tc.path + sep + "since=30d&host=" + otherHost
+				_, body = do(http.MethodGet, other)
+				if found := leaks(other, body); len(found) > 0 {
+					t.Errorf("GET %s shows %v", other, found)
+				}
+
+				if code, _ := do(http.MethodPost, tc.path); code != http.StatusForbidden {
+					t.Errorf("POST %s = %d, want %d", tc.path, code, http.StatusForbidden)
+				}
+			})
+		}
+	}
+
+	for _, pattern := range router.patterns {
+		if publicEndpoints[pattern] || sharedEndpoints[pattern] {
+			continue
+		}
+		if code, body := do(http.MethodGet, pattern); code != http.StatusForbidden {
+			t.Errorf("GET %s = %d %q, want %d", pattern, code, strings.TrimSpace(body), http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// staticSite serves a local directory for routes with a root instead of a
+// backend. Directory listings and dotfiles are never served.
+type staticSite struct {
+	dir   http.Dir
+	index string
+	spa   bool // serve the root index for unknown paths without an extension
+}
+
+func newStaticSite(root, index string, spa bool) (*staticSite, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	if index == "" {
+		index = "index.html"
+	}
+	return &staticSite{dir: http.Dir(root), index: index, spa: spa}, nil
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	f, st, err := s.open(name)
+	if err == nil && st.IsDir() {
+		f.Close()
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		f, st, err = s.open(path.Join(name, s.index))
+	}
+	if errors.Is(err, fs.ErrNotExist) && s.spa && path.Ext(name) == "" {
+		f, st, err = s.open("/" + s.index)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if st.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, st.Name(), st.ModTime(), f)
+}
+
+// open opens a cleaned, slash-separated path under the root. Paths with a
+// dot-prefixed element (.git, .env) are reported as missing.
+func (s *staticSite) open(name string) (http.File, fs.FileInfo, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+	f, err := s.dir.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, st, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+const sdListenFDStart = 3
+
+// sdNotify sends a state string to systemd over $NOTIFY_SOCKET. It is a no-op
+// when not started by a Type=notify unit.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract namespace sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("sd_notify failed", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("sd_notify failed", "state", state, "err", err)
+	}
+}
+
+// sdWatchdogLoop pings the systemd watchdog at half the configured interval
+// while healthy() holds, so a wedged process gets restarted
+func sdWatchdogLoop(healthy func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	slog.Info("systemd watchdog enabled", "interval", interval)
+	for range time.Tick(interval) {
+		if healthy() {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// sdListener returns the first socket passed by systemd socket activation,
+// or nil when the process wasn't socket-activated
+func sdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		slog.Warn("systemd passed several sockets; only the first is used", "sockets", n)
+	}
+	f := os.NewFile(sdListenFDStart, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err == nil {
+		slog.Info("Using socket passed by systemd (PORT is ignored)", "addr", ln.Addr())
+	}
+	return ln, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a byte-rate limiter: tokens refill at rate bytes/sec up to
+// one second's worth, and writers sleep off any deficit
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: now, lastUsed: now}
+}
+
+// wait reserves n bytes and blocks until they are within budget
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.lastUsed = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttler shapes proxied response bandwidth per connection and per client
+// IP, configured per host
+type Throttler struct {
+	cfgMu   sync.RWMutex
+	perConn map[string]int // host -> bytes/sec for each response
+	perIP   map[string]int // host -> bytes/sec shared by all of an IP's responses
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // host|ip -> shared bucket
+}
+
+func NewThrottler() *Throttler {
+	t := &Throttler{
+		perConn: make(map[string]int),
+		perIP:   make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+	}
+	go t.cleanup()
+	return t
+}
+
+// Configure sets the limits for a host; zero means unlimited
+func (t *Throttler) Configure(host string, perConn, perIP int) {
+	t.cfgMu.Lock()
+	defer t.cfgMu.Unlock()
+	if perConn > 0 {
+		t.perConn[host] = perConn
+	} else {
+		delete(t.perConn, host)
+	}
+	if perIP > 0 {
+		t.perIP[host] = perIP
+	} else {
+		delete(t.perIP, host)
+	}
+}
+
+// Limits returns a host's per-connection and per-IP rates in bytes/sec;
+// zero means unlimited
+func (t *Throttler) Limits(host string) (perConn, perIP int) {
+	t.cfgMu.RLock()
+	defer t.cfgMu.RUnlock()
+	return t.perConn[host], t.perIP[host]
+}
+
+// Wrap returns w unchanged when the host has no limits configured
+func (t *Throttler) Wrap(w http.ResponseWriter, r *http.Request, host, clientIP string) http.ResponseWriter {
+	t.cfgMu.RLock()
+	perConn, perIP := t.perConn[host], t.perIP[host]
+	t.cfgMu.RUnlock()
+
+	var buckets []*tokenBucket
+	if rate := perConn; rate > 0 {
+		buckets = append(buckets, newTokenBucket(rate))
+	}
+	if rate := perIP; rate > 0 {
+		key := host + "|" + clientIP
+		t.mu.Lock()
+		b, ok := t.buckets[key]
+		if !ok {
+			b = newTokenBucket(rate)
+			t.buckets[key] = b
+		}
+		t.mu.Unlock()
+		buckets = append(buckets, b)
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), buckets: buckets}
+}
+
+// cleanup drops per-IP buckets that have been idle for a while
+func (t *Throttler) cleanup() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-5 * time.Minute)
+		t.mu.Lock()
+		for key, b := range t.buckets {
+			b.mu.Lock()
+			idle := b.lastUsed.Before(cutoff)
+			b.mu.Unlock()
+			if idle {
+				delete(t.buckets, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Chunk size for throttled writes, so large writes are paced smoothly
+const throttleChunk = 16 * 1024
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		for _, b := range tw.buckets {
+			if err := b.wait(tw.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush keeps streaming responses (SSE, chunked) working through the wrapper
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
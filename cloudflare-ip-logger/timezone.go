@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// requestLocation returns the zone named by ?tz= (an IANA name such as
+// Europe/Berlin), or UTC when it is absent
+func requestLocation(r *http.Request) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// formatStoredTime renders a stored timestamp as RFC 3339 in loc. Values that
+// don't parse are returned unchanged.
+func formatStoredTime(s string, loc *time.Location) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+// parseTimeParam normalizes a since/until query value to the stored layout.
+// It accepts a duration back from now (30m, 24h, 7d, 2w), RFC 3339, a date,
+// a date and time without an offset (taken to be in loc) or Unix seconds.
+func parseTimeParam(s string, loc *time.Location) (string, error) {
+	if d, ok := parseRelative(s); ok {
+		return store.FormatTime(time.Now().Add(-d)), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return store.FormatTime(t), nil
+	}
+	for _, layout := range []string{store.LegacyTimeLayout, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return store.FormatTime(t), nil
+		}
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return store.FormatTime(time.Unix(secs, 0)), nil
+	}
+	return "", fmt.Errorf("invalid time %q (expected a duration like 24h or 7d, RFC 3339, YYYY-MM-DD or Unix seconds)", s)
+}
+
+// parseRelative parses a positive Go duration, or whole days (7d) or weeks (2w)
+func parseRelative(s string) (time.Duration, bool) {
+	if n := len(s); n > 1 && (s[n-1] == 'd' || s[n-1] == 'w') {
+		count, err := strconv.Atoi(s[:n-1])
+		if err != nil || count <= 0 {
+			return 0, false
+		}
+		day := 24 * time.Hour
+		if s[n-1] == 'w' {
+			day *= 7
+		}
+		return time.Duration(count) * day, true
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d > 0
+}
+
+// timeRange turns the since/until query parameters into a condition on the
+// timestamp column, starting with " AND"; both ends are optional and until
+// is exclusive
+func timeRange(query url.Values, loc *time.Location) (string, []interface{}, error) {
+	var cond string
+	var args []interface{}
+	for _, p := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		value := query.Get(p.param)
+		if value == "" {
+			continue
+		}
+		ts, err := parseTimeParam(value, loc)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", p.param, err)
+		}
+		cond += " AND timestamp " + p.op + " ?"
+		args = append(args, ts)
+	}
+	return cond, args, nil
+}
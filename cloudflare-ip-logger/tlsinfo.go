@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many bytes of a connection are kept while waiting for its ClientHello;
+// a hello is one TLS record, at most 16KB plus the record header
+const maxClientHello = 16<<10 + 5
+
+// How often the certificate files are checked for renewal
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves TLS_CERT/TLS_KEY and picks up renewed files (certbot,
+// acme.sh) without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	st, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, st.ModTime()
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > certCheckInterval {
+		c.checked = time.Now()
+		if st, err := os.Stat(c.certFile); err == nil && !st.ModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				slog.Error("Error reloading TLS certificate, keeping the old one", "err", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "cert", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// helloListener hands out connections that keep the bytes of their
+// ClientHello, for the JA3 fingerprint
+type helloListener struct {
+	net.Listener
+}
+
+func (l helloListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: c}, nil
+}
+
+// helloConn records what the client sends until its ClientHello is complete
+type helloConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	buf  []byte
+	done bool
+	ja3  string
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		if ja3, complete := parseJA3(c.buf); complete || len(c.buf) >= maxClientHello {
+			c.ja3, c.done, c.buf = ja3, true, nil
+		}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// JA3 is the MD5 JA3 fingerprint of the client's hello, "" if it couldn't be
+// read
+func (c *helloConn) JA3() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ja3
+}
+
+type helloConnKey struct{}
+
+// tlsConnContext makes a connection's helloConn available to its requests
+func tlsConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		if hc, ok := tc.NetConn().(*helloConn); ok {
+			return context.WithValue(ctx, helloConnKey{}, hc)
+		}
+	}
+	return ctx
+}
+
+// setTLSInfo fills in conn's TLS fields for requests that came in over the
+// TLS listener
+func setTLSInfo(conn *ConnectionLog, r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+	conn.TLSVersion = tls.VersionName(r.TLS.Version)
+	conn.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	conn.TLSServerName = r.TLS.ServerName
+	conn.TLSALPN = r.TLS.NegotiatedProtocol
+	if hc, ok := r.Context().Value(helloConnKey{}).(*helloConn); ok {
+		conn.TLSJA3 = hc.JA3()
+	}
+}
+
+// parseJA3 reads a ClientHello record from the start of a connection and
+// returns its JA3 fingerprint: the MD5 of version, cipher suites, extensions,
+// curves and point formats, GREASE values left out. complete is false while
+// more bytes are needed; a connection that doesn't start with a hello gives
+// "" and true.
+func parseJA3(b []byte) (ja3 string, complete bool) {
+	if len(b) < 5 {
+		return "", false
+	}
+	if b[0] != 0x16 { // handshake record
+		return "", true
+	}
+	recLen := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < 5+recLen {
+		return "", false
+	}
+	h := b[5 : 5+recLen]
+	if len(h) < 4 || h[0] != 0x01 { // client_hello
+		return "", true
+	}
+	hello := &byteReader{b: h[4:]}
+	version := hello.u16()
+	hello.skip(32) // random
+	hello.skip(int(hello.u8()))
+
+	var ciphers, extensions, curves, points []string
+	suites := hello.sub(int(hello.u16()))
+	for suites.left() >= 2 {
+		if v := suites.u16(); !isGREASE(v) {
+			ciphers = append(ciphers, strconv.Itoa(int(v)))
+		}
+	}
+	hello.skip(int(hello.u8())) // compression methods
+	if hello.left() >= 2 {
+		exts := hello.sub(int(hello.u16()))
+		for exts.left() >= 4 {
+			typ, data := exts.u16(), exts.sub(int(exts.u16()))
+			if isGREASE(typ) {
+				continue
+			}
+			extensions = append(extensions, strconv.Itoa(int(typ)))
+			switch typ {
+			case 10: // supported_groups
+				groups := data.sub(int(data.u16()))
+				for groups.left() >= 2 {
+					if v := groups.u16(); !isGREASE(v) {
+						curves = append(curves, strconv.Itoa(int(v)))
+					}
+				}
+			case 11: // ec_point_formats
+				formats := data.sub(int(data.u8()))
+				for formats.left() >= 1 {
+					points = append(points, strconv.Itoa(int(formats.u8())))
+				}
+			}
+		}
+	}
+	if hello.err {
+		return "", true
+	}
+	s := fmt.Sprintf("%d,%s,%s,%s,%s", version, strings.Join(ciphers, "-"), strings.Join(extensions, "-"),
+		strings.Join(curves, "-"), strings.Join(points, "-"))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// isGREASE reports whether v is one of the reserved values clients send to
+// keep servers tolerant (RFC 8701), which JA3 ignores
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// byteReader reads big-endian fields, remembering instead of panicking when
+// it runs past the end
+type byteReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *byteReader) left() int { return len(r.b) }
+
+func (r *byteReader) take(n int) []byte {
+	if n > len(r.b) {
+		r.err, r.b = true, nil
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *byteReader) skip(n int) { r.take(n) }
+
+func (r *byteReader) u8() uint8 {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *byteReader) u16() uint16 {
+	if v := r.take(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+// sub splits off the next n bytes as a reader of their own; running short
+// marks both
+func (r *byteReader) sub(n int) *byteReader {
+	v := r.take(n)
+	return &byteReader{b: v, err: v == nil && n > 0}
+}
+
+// TLSCount is one value of a TLS property and how often it was seen
+type TLSCount struct {
+	Value string `json:"value"`
+	Hits  int    `json:"hits"`
+}
+
+// TLSFingerprint is a JA3 hash and the traffic that presented it
+type TLSFingerprint struct {
+	JA3        string   `json:"ja3"`
+	Hits       int      `json:"hits"`
+	UniqueIPs  int      `json:"unique_ips"`
+	UserAgents []string `json:"user_agents"` // most frequent first, at most 3
+	LastSeen   string   `json:"last_seen"`
+}
+
+// GET /_proxy/stats/tls?since=7d&tz=Europe/Berlin&limit=50
+//
+// Only counts requests that came in over the TLS listener.
+func (app *App) handleTLSStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rangeCond, rangeArgs, err := timeRange(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopeCond, scopeArgs := hostScope(r, "host")
+	ownCond, ownArgs, err := app.ownTraffic.Filter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	where := " WHERE tls_version != ''" + rangeCond + scopeCond + ownCond
+	args := append(append(rangeArgs, scopeArgs...), ownArgs...)
+	limit := 50
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	readDB := app.readerFor(r, "")
+
+	counts := func(column string) ([]TLSCount, error) {
+		rows, err := readDB.Query("SELECT "+column+", COUNT(*) AS hits FROM connections"+where+" GROUP BY "+column+" ORDER BY hits DESC LIMIT 20", args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		list := []TLSCount{}
+		for rows.Next() {
+			var c TLSCount
+			if rows.Scan(&c.Value, &c.Hits) == nil {
+				list = append(list, c)
+			}
+		}
+		return list, rows.Err()
+	}
+	response := map[string]interface{}{}
+	for key, column := range map[string]string{"versions": "tls_version", "ciphers": "tls_cipher", "alpn": "tls_alpn", "server_names": "tls_sni"} {
+		list, err := counts(column)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response[key] = list
+	}
+
+	rows, err := readDB.Query("SELECT tls_ja3, COUNT(*) AS hits, COUNT(DISTINCT client_ip), MAX(timestamp) FROM connections"+where+
+		" AND tls_ja3 != '' GROUP BY tls_ja3 ORDER BY hits DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fingerprints := []TLSFingerprint{}
+	for rows.Next() {
+		f := TLSFingerprint{UserAgents: []string{}}
+		if rows.Scan(&f.JA3, &f.Hits, &f.UniqueIPs, &f.LastSeen) == nil {
+			f.LastSeen = formatStoredTime(f.LastSeen, loc)
+			fingerprints = append(fingerprints, f)
+		}
+	}
+	rows.Close()
+	// What the clients behind each fingerprint claim to be: a "Chrome" user
+	// agent on a Go or Python TLS stack gives a bot away
+	for i := range fingerprints {
+		rows, err := readDB.Query("SELECT user_agent, COUNT(*) AS n FROM connections"+where+
+			" AND tls_ja3 = ? GROUP BY user_agent ORDER BY n DESC LIMIT 3", append(args, fingerprints[i].JA3)...)
+		if err != nil {
+			continue
+		}
+		for rows.Next() {
+			var ua string
+			var n int
+			if rows.Scan(&ua, &n) == nil {
+				fingerprints[i].UserAgents = append(fingerprints[i].UserAgents, ua)
+			}
+		}
+		rows.Close()
+	}
+	response["fingerprints"] = fingerprints
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
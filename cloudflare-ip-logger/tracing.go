@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLP span kinds and status codes (opentelemetry-proto trace.proto)
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusUnset     = 0
+	otlpStatusError     = 2
+	otlpExportBatchSize = 512
+)
+
+// Tracer emits one server span per proxied request and exports them as
+// OTLP/HTTP JSON, so no OpenTelemetry SDK dependency is needed. Incoming W3C
+// traceparent headers are continued and a new traceparent naming our span as
+// parent is passed to the backend.
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampleRate  float64
+	spans       chan otlpSpan
+	client      *http.Client
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// Span is an in-progress server span
+type Span struct {
+	tracer  *Tracer
+	traceID string
+	spanID  string
+	parent  string
+	flags   string
+	name    string
+	start   time.Time
+	attrs   []otlpKeyValue
+}
+
+// NewTracer returns nil (tracing disabled) when no endpoint is configured.
+// endpoint is the OTLP/HTTP base URL, e.g. http://tempo:4318
+func NewTracer(endpoint, headers, serviceName string, sampleRate float64) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:     make(map[string]string),
+		serviceName: serviceName,
+		sampleRate:  sampleRate,
+		spans:       make(chan otlpSpan, 4096),
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	// OTEL_EXPORTER_OTLP_HEADERS format: key1=value1,key2=value2
+	for _, pair := range strings.Split(headers, ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			t.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	go t.exportLoop()
+	return t
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent reads a version-00 W3C traceparent header
+func parseTraceparent(h string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", "", false
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2] + parts[3]); err != nil {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// Start begins a span for r and rewrites its traceparent header so the
+// backend sees our span as its parent. Returns nil when tracing is off or the
+// request isn't sampled.
+func (t *Tracer) Start(r *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{tracer: t, spanID: randomHex(8), name: name, start: time.Now()}
+	if traceID, parent, flags, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		// Respect the caller's sampling decision
+		if flags == "00" {
+			return nil
+		}
+		span.traceID, span.parent, span.flags = traceID, parent, flags
+	} else {
+		if mathrand.Float64() >= t.sampleRate {
+			return nil
+		}
+		span.traceID, span.flags = randomHex(16), "01"
+	}
+
+	r.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", span.traceID, span.spanID, span.flags))
+	return span
+}
+
+func (s *Span) SetString(key, value string) {
+	if s == nil || value == "" {
+		return
+	}
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": value}})
+}
+
+func (s *Span) SetInt(key string, value int) {
+	if s == nil {
+		return
+	}
+	// OTLP JSON encodes int64 as a string
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(value)}})
+}
+
+// End finishes the span; 5xx responses mark it as an error
+func (s *Span) End(status int) {
+	if s == nil {
+		return
+	}
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parent,
+		Name:              s.name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	span.Status.Code = otlpStatusUnset
+	if status >= 500 {
+		span.Status.Code = otlpStatusError
+	}
+
+	select {
+	case s.tracer.spans <- span:
+	default:
+		// Exporter is behind; drop rather than slow the proxy
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < otlpExportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			slog.Warn("OTLP export failed", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+}
+
+func (t *Tracer) export(spans []otlpSpan) error {
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{
+						{Key: "service.name", Value: map[string]interface{}{"stringValue": t.serviceName}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "cf-ip-logger"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// parseSampleRate clamps TRACING_SAMPLE_RATE to [0, 1]
+func parseSampleRate(s string) float64 {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(rate) {
+		return 1
+	}
+	return math.Max(0, math.Min(1, rate))
+}
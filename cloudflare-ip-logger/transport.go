@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Idle connections kept per backend address unless a route sets its own;
+// Go's default of 2 forces constant reconnects under load
+const defaultMaxIdleConnsPerHost = 32
+
+// TransportConfig tunes the connections to one backend
+type TransportConfig struct {
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     string `json:"idle_conn_timeout,omitempty"` // e.g. 90s
+	DisableKeepAlives   bool   `json:"disable_keep_alives,omitempty"`
+	TLSMinVersion       string `json:"tls_min_version,omitempty"` // 1.0 to 1.3
+	SourceAddress       string `json:"source_address,omitempty"`  // local IP to connect from
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// backendTransport is everything needed to connect to a backend: the proxy's
+// http.Transport and, for WebSocket tunnels, the dialer and TLS settings it
+// is built from
+type backendTransport struct {
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+	http      *http.Transport
+}
+
+// newBackendTransport gives each route its own connection pool. serverName
+// is set when backends are dialed by IP but the certificate names a host.
+func newBackendTransport(cfg ProxyConfig, serverName string) (*backendTransport, error) {
+	tc := cfg.Transport
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if tc.SourceAddress != "" {
+		ip := net.ParseIP(tc.SourceAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source_address %q", tc.SourceAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if cfg.TLSServerName != "" {
+		serverName = cfg.TLSServerName
+	}
+	tlsConfig, err := backendTLSConfig(cfg, serverName)
+	if err != nil {
+		return nil, err
+	}
+	if tc.TLSMinVersion != "" {
+		v, ok := tlsVersions[tc.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls_min_version %q (expected 1.0, 1.1, 1.2 or 1.3)", tc.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialer.DialContext
+	t.TLSClientConfig = tlsConfig
+	t.DisableKeepAlives = tc.DisableKeepAlives
+	t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if tc.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	}
+	if t.MaxIdleConns < t.MaxIdleConnsPerHost {
+		t.MaxIdleConns = t.MaxIdleConnsPerHost
+	}
+	if tc.IdleConnTimeout != "" {
+		d, err := time.ParseDuration(tc.IdleConnTimeout)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid idle_conn_timeout %q", tc.IdleConnTimeout)
+		}
+		t.IdleConnTimeout = d
+	}
+
+	return &backendTransport{dialer: dialer, tlsConfig: tlsConfig, http: t}, nil
+}
+
+var errPinMismatch = errors.New("backend key matches no tls_pin_sha256")
+
+// backendTLSConfig verifies the backend against the system roots, a private
+// CA (tls_ca_file) and/or SPKI pins (tls_pin_sha256). With pins alone the
+// chain and name aren't checked, only the key, which suits self-signed
+// certificates.
+func backendTLSConfig(cfg ProxyConfig, serverName string) (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: cfg.NoTLS, ServerName: serverName}
+
+	if cfg.TLSCAFile != "" {
+		if cfg.NoTLS {
+			return nil, errors.New("tls_ca_file and no_tls_verify can't be combined")
+		}
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls_ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls_ca_file: no PEM certificates in %s", cfg.TLSCAFile)
+		}
+		c.RootCAs = roots
+	}
+
+	if len(cfg.TLSPins) > 0 {
+		pins := make([][]byte, 0, len(cfg.TLSPins))
+		for _, p := range cfg.TLSPins {
+			pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "sha256/"))
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("tls_pin_sha256: %q is not a base64 SHA-256 hash", p)
+			}
+			pins = append(pins, pin)
+		}
+		if cfg.TLSCAFile == "" {
+			// The pin replaces chain verification
+			c.InsecureSkipVerify = true
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("backend sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: sha256/%s", errPinMismatch, base64.StdEncoding.EncodeToString(sum[:]))
+		}
+	}
+	return c, nil
+}
+
+// tlsKey identifies a route's TLS verification options, to detect changes
+// on reload
+func (cfg ProxyConfig) tlsKey() string {
+	return cfg.TLSCAFile + "|" + strings.Join(cfg.TLSPins, ",") + "|" + cfg.TLSServerName
+}
+
+// dial opens a raw connection for a WebSocket tunnel with the route's
+// settings
+func (bt *backendTransport) dial(scheme, addr string) (net.Conn, error) {
+	if scheme == "https" {
+		return tls.DialWithDialer(bt.dialer, "tcp", addr, bt.tlsConfig)
+	}
+	return bt.dialer.Dial("tcp", addr)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// TunnelStatus is what one source says about the tunnel
+type TunnelStatus struct {
+	Source         string   `json:"source"` // "metrics" (cloudflared) or "api" (Cloudflare)
+	Status         string   `json:"status"` // healthy, degraded, down or unreachable
+	Connections    int      `json:"connections"`
+	EdgeLocations  []string `json:"edge_locations"`
+	ActiveRequests *int     `json:"active_requests,omitempty"` // metrics only
+	TotalRequests  *int64   `json:"total_requests,omitempty"`
+	RequestErrors  *int64   `json:"request_errors,omitempty"`
+	Name           string   `json:"name,omitempty"` // api only
+	ConnectorID    string   `json:"connector_id,omitempty"`
+	Version        string   `json:"version,omitempty"`
+	CheckedAt      string   `json:"checked_at"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// TunnelMonitor polls cloudflared's metrics server and/or the Cloudflare
+// API for the tunnel's connections to the edge. When the tunnel goes down,
+// visitors stop arriving and the traffic tables just go quiet, so the change
+// is recorded as an event.
+type TunnelMonitor struct {
+	metricsURL string // CLOUDFLARED_METRICS, e.g. http://localhost:2000
+	apiToken   string // CF_API_TOKEN, with Cloudflare Tunnel Read
+	accountID  string
+	tunnelID   string
+	client     *http.Client
+	onEvent    func(Event)
+
+	mu      sync.Mutex
+	sources []TunnelStatus
+	down    bool
+}
+
+func NewTunnelMonitor(metricsURL, apiToken, accountID, tunnelID string) (*TunnelMonitor, error) {
+	if apiToken != "" && (accountID == "" || tunnelID == "") {
+		return nil, fmt.Errorf("CF_API_TOKEN needs CF_ACCOUNT_ID and CF_TUNNEL_ID")
+	}
+	return &TunnelMonitor{
+		metricsURL: strings.TrimSuffix(metricsURL, "/"),
+		apiToken:   apiToken,
+		accountID:  accountID,
+		tunnelID:   tunnelID,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Run checks the tunnel every interval
+func (m *TunnelMonitor) Run(interval time.Duration) {
+	for {
+		m.Check()
+		time.Sleep(interval)
+	}
+}
+
+func (m *TunnelMonitor) Check() {
+	var sources []TunnelStatus
+	if m.metricsURL != "" {
+		sources = append(sources, m.checkMetrics())
+	}
+	if m.apiToken != "" {
+		sources = append(sources, m.checkAPI())
+	}
+	// Down when no source sees a connection; a source that can't be reached
+	// says nothing about the tunnel
+	down, known := true, false
+	for _, s := range sources {
+		if s.Status != "unreachable" {
+			known = true
+			if s.Connections > 0 {
+				down = false
+			}
+		}
+	}
+	down = down && known
+
+	m.mu.Lock()
+	m.sources = sources
+	changed := down != m.down
+	m.down = down
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if down {
+		msg := "Cloudflare tunnel has no connections to the edge"
+		for _, s := range sources {
+			if s.Error != "" {
+				msg += fmt.Sprintf(" (%s: %s)", s.Source, s.Error)
+			}
+		}
+		slog.Warn("ALERT: " + msg)
+		m.event(severityCritical, msg)
+	} else {
+		slog.Info("Cloudflare tunnel is connected again")
+		m.event(severityInfo, "Cloudflare tunnel is connected again")
+	}
+}
+
+func (m *TunnelMonitor) event(severity, msg string) {
+	if m.onEvent != nil {
+		m.onEvent(Event{Kind: "tunnel", Severity: severity, Message: msg})
+	}
+}
+
+func (m *TunnelMonitor) get(url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	// cloudflared's /ready answers 503 with its JSON when no connection is up
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return body, nil
+}
+
+// checkMetrics reads cloudflared's /ready and Prometheus /metrics
+func (m *TunnelMonitor) checkMetrics() TunnelStatus {
+	s := TunnelStatus{Source: "metrics", EdgeLocations: []string{}, CheckedAt: store.FormatTime(time.Now())}
+	body, err := m.get(m.metricsURL+"/ready", nil)
+	if err != nil {
+		s.Status, s.Error = "unreachable", err.Error()
+		return s
+	}
+	var ready struct {
+		ReadyConnections int    `json:"readyConnections"`
+		ConnectorID      string `json:"connectorId"`
+	}
+	if err := json.Unmarshal(body, &ready); err != nil {
+		s.Status, s.Error = "unreachable", "invalid /ready response: "+err.Error()
+		return s
+	}
+	s.Connections, s.ConnectorID = ready.ReadyConnections, ready.ConnectorID
+	s.Status = tunnelHealth(s.Connections)
+
+	// Traffic counters and edge locations are extras; without them the
+	// connection count still stands
+	body, err = m.get(m.metricsURL+"/metrics", nil)
+	if err != nil {
+		s.Error = "metrics: " + err.Error()
+		return s
+	}
+	locations := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		name, labels, value, ok := parseMetricLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		switch name {
+		case "cloudflared_tunnel_concurrent_requests_per_tunnel":
+			n := int(value)
+			s.ActiveRequests = &n
+		case "cloudflared_tunnel_total_requests":
+			n := int64(value)
+			s.TotalRequests = &n
+		case "cloudflared_tunnel_request_errors":
+			n := int64(value)
+			s.RequestErrors = &n
+		case "cloudflared_tunnel_server_locations":
+			if loc := labels["edge_location"]; loc != "" && value > 0 {
+				locations[loc] = true
+			}
+		case "build_info":
+			if v := labels["version"]; v != "" {
+				s.Version = v
+			}
+		}
+	}
+	for loc := range locations {
+		s.EdgeLocations = append(s.EdgeLocations, loc)
+	}
+	sort.Strings(s.EdgeLocations)
+	return s
+}
+
+// parseMetricLine splits a Prometheus text-format sample into its name,
+// labels and value
+func parseMetricLine(line string) (string, map[string]string, float64, bool) {
+	if line == "" || line[0] == '#' {
+		return "", nil, 0, false
+	}
+	name, rest := line, ""
+	labels := map[string]string{}
+	if i := strings.IndexByte(line, '{'); i >= 0 {
+		j := strings.LastIndexByte(line, '}')
+		if j < i {
+			return "", nil, 0, false
+		}
+		name, rest = line[:i], line[j+1:]
+		for _, pair := range splitLabels(line[i+1 : j]) {
+			k, v, ok := strings.Cut(pair, "=")
+			if ok {
+				if unquoted, err := strconv.Unquote(v); err == nil {
+					labels[strings.TrimSpace(k)] = unquoted
+				}
+			}
+		}
+	} else if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, rest = line[:i], line[i:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	return name, labels, value, err == nil
+}
+
+// splitLabels splits a label list at the commas outside quotes
+func splitLabels(s string) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// checkAPI asks Cloudflare about the tunnel and its connectors
+func (m *TunnelMonitor) checkAPI() TunnelStatus {
+	s := TunnelStatus{Source: "api", EdgeLocations: []string{}, CheckedAt: store.FormatTime(time.Now())}
+	body, err := m.get(fmt.Sprintf("%s/accounts/%s/cfd_tunnel/%s", cloudflareAPI, m.accountID, m.tunnelID),
+		http.Header{"Authorization": {"Bearer " + m.apiToken}})
+	if err != nil {
+		s.Status, s.Error = "unreachable", err.Error()
+		return s
+	}
+	var resp struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result struct {
+			Name        string `json:"name"`
+			Status      string `json:"status"`
+			Connections []struct {
+				ColoName           string `json:"colo_name"`
+				ClientID           string `json:"client_id"`
+				ClientVersion      string `json:"client_version"`
+				IsPendingReconnect bool   `json:"is_pending_reconnect"`
+			} `json:"connections"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		s.Status, s.Error = "unreachable", "invalid API response: "+err.Error()
+		return s
+	}
+	if !resp.Success {
+		s.Status, s.Error = "unreachable", "API request failed"
+		if len(resp.Errors) > 0 {
+			s.Error = resp.Errors[0].Message
+		}
+		return s
+	}
+	s.Name = resp.Result.Name
+	locations := make(map[string]bool)
+	for _, c := range resp.Result.Connections {
+		if c.IsPendingReconnect {
+			continue
+		}
+		s.Connections++
+		locations[c.ColoName] = true
+		s.ConnectorID, s.Version = c.ClientID, c.ClientVersion
+	}
+	for loc := range locations {
+		s.EdgeLocations = append(s.EdgeLocations, loc)
+	}
+	sort.Strings(s.EdgeLocations)
+	// Cloudflare's own verdict: healthy, degraded, down or inactive
+	s.Status = resp.Result.Status
+	if s.Status == "" || s.Status == "inactive" {
+		s.Status = tunnelHealth(s.Connections)
+	}
+	return s
+}
+
+// tunnelHealth judges a connection count: cloudflared normally keeps four
+func tunnelHealth(connections int) string {
+	switch {
+	case connections == 0:
+		return "down"
+	case connections < 4:
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// Down reports whether the last check found the tunnel without connections
+func (m *TunnelMonitor) Down() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.down
+}
+
+func (m *TunnelMonitor) Info() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, known := "healthy", false
+	for _, s := range m.sources {
+		if s.Status == "unreachable" {
+			continue
+		}
+		known = true
+		if s.Status != "healthy" {
+			status = "degraded"
+		}
+	}
+	switch {
+	case m.down:
+		status = "down"
+	case !known:
+		status = "unknown"
+	}
+	return map[string]interface{}{
+		"status":  status,
+		"sources": append([]TunnelStatus{}, m.sources...),
+	}
+}
+
+// GET /_proxy/tunnel
+func (app *App) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	if app.tunnel == nil {
+		http.Error(w, "tunnel status not configured (set CLOUDFLARED_METRICS or CF_API_TOKEN)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.tunnel.Info())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// What happens to requests whose Host matches no route (UNKNOWN_HOST_POLICY)
+const (
+	unknownHostInfo        = "info"        // dashboard at / and /dashboard, visitor info elsewhere
+	unknownHostMisdirected = "misdirected" // 421 Misdirected Request
+	unknownHostRedirect    = "redirect"    // to UNKNOWN_HOST_REDIRECT
+	unknownHostDrop        = "drop"        // close the connection without an answer
+)
+
+// unknownHostPolicy answers requests for hosts without a route, once the
+// default route (if any) has passed on them
+type unknownHostPolicy struct {
+	mode     string
+	redirect string
+}
+
+func newUnknownHostPolicy(mode, redirect string) (*unknownHostPolicy, error) {
+	switch mode {
+	case unknownHostInfo, unknownHostMisdirected, unknownHostDrop:
+	case unknownHostRedirect:
+		u, err := url.Parse(redirect)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("UNKNOWN_HOST_REDIRECT must be an absolute URL, got %q", redirect)
+		}
+	default:
+		return nil, fmt.Errorf("unknown policy %q (want info, misdirected, redirect or drop)", mode)
+	}
+	return &unknownHostPolicy{mode: mode, redirect: redirect}, nil
+}
+
+// Serve answers the request unless the policy leaves it to the dashboard and
+// visitor info page, and reports whether it did
+func (p *unknownHostPolicy) Serve(w http.ResponseWriter, r *http.Request) bool {
+	switch p.mode {
+	case unknownHostMisdirected:
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+	case unknownHostRedirect:
+		http.Redirect(w, r, p.redirect, http.StatusFound)
+	case unknownHostDrop:
+		// Closes the connection (HTTP/1) or resets the stream (HTTP/2)
+		panic(http.ErrAbortHandler)
+	default:
+		return false
+	}
+	return true
+}
+
+// Verdict is what Serve does, for /api/policy/test: the verdict name and
+// the status sent, 0 when nothing is
+func (p *unknownHostPolicy) Verdict() (string, int) {
+	switch p.mode {
+	case unknownHostMisdirected:
+		return "misdirected", http.StatusMisdirectedRequest
+	case unknownHostRedirect:
+		return "redirect", http.StatusFound
+	case unknownHostDrop:
+		return "drop", 0
+	}
+	return "", 0
+}
+
+// validHostname reports whether a Host header names a host at all: an IP
+// address or a DNS name, with an optional port. Anything else is scanner
+// noise and never reaches the default route.
+func validHostname(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment passed to the re-executed binary during an upgrade
+const (
+	envListenFD  = "CF_IP_LOGGER_LISTEN_FD"
+	envReadyFD   = "CF_IP_LOGGER_READY_FD"
+	envSocketFDs = "CF_IP_LOGGER_SOCKET_FDS" // network://addr=fd,... for the other listeners
+)
+
+// SO_REUSEPORT on Linux; the syscall package doesn't export it
+const soReusePort = 0xf
+
+// How long a new process gets to start serving before the upgrade is aborted
+const upgradeReadyTimeout = 30 * time.Second
+
+// listen returns the listening socket handed over by a parent process during
+// an upgrade or by systemd socket activation, or opens a new one. With reusePort the socket is opened with
+// SO_REUSEPORT, so a second instance can bind the same port while this one
+// drains.
+func listen(addr string, reusePort bool) (net.Listener, error) {
+	if fd := os.Getenv(envListenFD); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", envListenFD, err)
+		}
+		os.Unsetenv(envListenFD)
+		f := os.NewFile(uintptr(n), "listener")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	if ln, err := sdListener(); ln != nil || err != nil {
+		return ln, err
+	}
+
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// sockets are the listeners besides the main one (diagnostics, syslog,
+// GELF), by network://addr, so an upgrade can hand them over too instead of
+// the new process failing to bind them while this one still holds them
+var sockets struct {
+	sync.Mutex
+	open      map[string]interface{ File() (*os.File, error) }
+	inherited map[string]int // fds passed by the parent, until taken
+}
+
+// inheritedSocket returns the socket the parent passed on for key, if any
+func inheritedSocket(key string) *os.File {
+	sockets.Lock()
+	defer sockets.Unlock()
+	if sockets.inherited == nil {
+		sockets.inherited = make(map[string]int)
+		for _, kv := range strings.Split(os.Getenv(envSocketFDs), ",") {
+			k, fd, _ := strings.Cut(kv, "=")
+			if n, err := strconv.Atoi(fd); err == nil {
+				sockets.inherited[k] = n
+			}
+		}
+		os.Unsetenv(envSocketFDs)
+	}
+	fd, ok := sockets.inherited[key]
+	if !ok {
+		return nil
+	}
+	delete(sockets.inherited, key)
+	return os.NewFile(uintptr(fd), key)
+}
+
+func keepSocket(key string, s interface{ File() (*os.File, error) }) {
+	sockets.Lock()
+	defer sockets.Unlock()
+	if sockets.open == nil {
+		sockets.open = make(map[string]interface{ File() (*os.File, error) })
+	}
+	sockets.open[key] = s
+}
+
+// listenTCP opens a TCP listener on addr, or takes over the parent's
+func listenTCP(addr string) (net.Listener, error) {
+	key := "tcp://" + addr
+	var ln net.Listener
+	var err error
+	if f := inheritedSocket(key); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keepSocket(key, ln.(*net.TCPListener))
+	return ln, nil
+}
+
+// listenUDP opens a UDP socket on addr, or takes over the parent's
+func listenUDP(addr string) (net.PacketConn, error) {
+	key := "udp://" + addr
+	var conn net.PacketConn
+	var err error
+	if f := inheritedSocket(key); f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keepSocket(key, conn.(*net.UDPConn))
+	return conn, nil
+}
+
+// socketFiles duplicates the open sockets for a new process, whose fds
+// start at first
+func socketFiles(first int) ([]*os.File, string, error) {
+	sockets.Lock()
+	defer sockets.Unlock()
+	var files []*os.File
+	var env []string
+	for key, s := range sockets.open {
+		f, err := s.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, "", fmt.Errorf("%s: %v", key, err)
+		}
+		env = append(env, fmt.Sprintf("%s=%d", key, first+len(files)))
+		files = append(files, f)
+	}
+	return files, strings.Join(env, ","), nil
+}
+
+// notifyReady tells the parent (if any) and systemd that this process is
+// serving, and records our PID so a supervisor following PID_FILE tracks the
+// new process
+func notifyReady(pidFile string) {
+	sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()))
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			slog.Warn("Could not write PID file", "path", pidFile, "err", err)
+		}
+	}
+	if fd := os.Getenv(envReadyFD); fd != "" {
+		os.Unsetenv(envReadyFD)
+		if n, err := strconv.Atoi(fd); err == nil {
+			f := os.NewFile(uintptr(n), "ready")
+			f.Write([]byte{1})
+			f.Close()
+		}
+	}
+}
+
+// startUpgrade re-executes the binary with the listening socket inherited
+// and waits until the new process reports it is serving
+func startUpgrade(ln net.Listener) error {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener is not a TCP socket")
+	}
+	lnFile, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+
+	others, otherFDs, err := socketFiles(5)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range others {
+			f.Close()
+		}
+	}()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// ExtraFiles start at fd 3
+	cmd.ExtraFiles = append([]*os.File{lnFile, readyW}, others...)
+	// WATCHDOG_PID names this process; the new one must ping the watchdog too
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = append(env, envListenFD+"=3", envReadyFD+"=4", envSocketFDs+"="+otherFDs)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			// Pipe closed without a byte: the child exited during startup
+			cmd.Process.Kill()
+			return fmt.Errorf("new process failed to start: %v", err)
+		}
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return errors.New("new process did not become ready in time")
+	}
+	go cmd.Wait()
+	slog.Info("Upgrade: new process is serving", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// handleUpgrades re-executes the binary on SIGUSR2. Once the new process is
+// serving, this one stops accepting, finishes in-flight requests, waits up
+// to drainTimeout (0 = no limit) for open WebSocket tunnels to close, then
+// calls exit.
+func (app *App) handleUpgrades(server *http.Server, ln net.Listener, drainTimeout time.Duration, exit func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	for range sigs {
+		slog.Info("Upgrade: starting new process")
+		sdNotify("RELOADING=1")
+		if err := startUpgrade(ln); err != nil {
+			slog.Error("Upgrade aborted, still serving", "err", err)
+			sdNotify("READY=1")
+			continue
+		}
+		signal.Stop(sigs)
+
+		ctx := context.Background()
+		if drainTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+			defer cancel()
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Upgrade: requests still in flight at drain timeout", "err", err)
+		}
+
+		tunnelsDone := make(chan struct{})
+		go func() {
+			app.tunnels.Wait()
+			close(tunnelsDone)
+		}()
+		slog.Info("Upgrade: waiting for WebSocket tunnels to close", "tunnels", app.openTunnels.Load())
+		select {
+		case <-tunnelsDone:
+		case <-ctx.Done():
+			slog.Warn("Upgrade: closing WebSocket tunnels at drain timeout", "tunnels", app.openTunnels.Load())
+		}
+		exit()
+		return
+	}
+}
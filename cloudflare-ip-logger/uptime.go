@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Windows availability is reported over
+var uptimeWindows = []struct {
+	name string
+	span time.Duration
+}{{"24h", 24 * time.Hour}, {"7d", 7 * 24 * time.Hour}, {"30d", 30 * 24 * time.Hour}}
+
+// Per-minute counts older than this are deleted
+const uptimeRetention = 90 * 24 * time.Hour
+
+// UptimeTracker counts each host's proxied requests and 5xx responses per
+// minute, kept in the host_uptime table. A minute is down when at least
+// errorRatio of its requests failed, or while the backend was marked failing
+// (the backend events); time in maintenance doesn't count either way.
+type UptimeTracker struct {
+	db         *sql.DB
+	errorRatio float64
+	readOnly   bool
+
+	mu      sync.Mutex
+	pending map[uptimeKey]*uptimeCount
+}
+
+type uptimeKey struct {
+	host   string
+	minute int64 // unix seconds, truncated to the minute
+}
+
+type uptimeCount struct {
+	requests, errors int
+}
+
+func NewUptimeTracker(db *sql.DB, errorRatio float64, readOnly bool) (*UptimeTracker, error) {
+	if errorRatio <= 0 || errorRatio > 1 {
+		return nil, fmt.Errorf("error ratio must be above 0 and at most 1, got %v", errorRatio)
+	}
+	t := &UptimeTracker{db: db, errorRatio: errorRatio, readOnly: readOnly, pending: make(map[uptimeKey]*uptimeCount)}
+	if readOnly {
+		return t, nil
+	}
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS host_uptime (
+		host TEXT NOT NULL,
+		minute DATETIME NOT NULL,
+		requests INTEGER NOT NULL,
+		errors INTEGER NOT NULL,
+		PRIMARY KEY (host, minute)
+	) WITHOUT ROWID`)
+	return t, err
+}
+
+// Record counts a response host sent
+func (t *UptimeTracker) Record(host string, status int) {
+	if t.readOnly {
+		return
+	}
+	key := uptimeKey{host, time.Now().Unix() / 60 * 60}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.pending[key]
+	if c == nil {
+		c = &uptimeCount{}
+		t.pending[key] = c
+	}
+	c.requests++
+	if status >= 500 {
+		c.errors++
+	}
+}
+
+// Run writes the counts every interval and prunes old ones hourly
+func (t *UptimeTracker) Run(interval time.Duration) {
+	lastPrune := time.Time{}
+	for {
+		time.Sleep(interval)
+		if err := t.Flush(); err != nil {
+			slog.Error("Error saving uptime counts", "err", err)
+		}
+		if time.Since(lastPrune) >= time.Hour {
+			cutoff := store.FormatTime(time.Now().Add(-uptimeRetention))
+			if _, err := t.db.Exec("DELETE FROM host_uptime WHERE minute < ?", cutoff); err != nil {
+				slog.Error("Error pruning uptime counts", "err", err)
+			}
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// Flush adds the pending counts to the table
+func (t *UptimeTracker) Flush() error {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[uptimeKey]*uptimeCount)
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO host_uptime (host, minute, requests, errors) VALUES (?, ?, ?, ?)
+		ON CONFLICT(host, minute) DO UPDATE SET requests = requests + excluded.requests, errors = errors + excluded.errors`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for k, c := range pending {
+		if _, err := stmt.Exec(k.host, store.FormatTime(time.Unix(k.minute, 0)), c.requests, c.errors); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UptimeWindow is a host's availability over one window
+type UptimeWindow struct {
+	Availability    *float64 `json:"availability"` // percent; null without data
+	DowntimeMinutes int      `json:"downtime_minutes"`
+	Requests        int      `json:"requests"`
+	Errors          int      `json:"errors"` // 5xx responses
+	ErrorRate       float64  `json:"error_rate"`
+}
+
+// HostUptime is a host's current state and availability per window
+type HostUptime struct {
+	Host    string                  `json:"host"`
+	Status  string                  `json:"status"` // up, down or maintenance
+	Windows map[string]UptimeWindow `json:"windows"`
+}
+
+// minuteSet holds unix minutes (seconds / 60)
+type minuteSet map[int64]bool
+
+// addInterval marks the minutes between from and to
+func (s minuteSet) addInterval(from, to time.Time) {
+	for m := from.Unix() / 60; m <= (to.Unix()-1)/60; m++ {
+		s[m] = true
+	}
+}
+
+// eventIntervals turns kind's events into per-host intervals: from an event
+// with startSeverity until the next one of another severity, or until now
+func (app *App) eventIntervals(kind, startSeverity string, since, now time.Time) (map[string]minuteSet, error) {
+	sets := make(map[string]minuteSet)
+	started := make(map[string]time.Time)
+	sinceStr := store.FormatTime(since)
+
+	// The state each host was in when the window opened
+	rows, err := app.db.Query(`SELECT host, severity FROM events e WHERE kind = ? AND host != '' AND timestamp < ?
+		AND id = (SELECT MAX(id) FROM events WHERE kind = e.kind AND host = e.host AND timestamp < ?)`, kind, sinceStr, sinceStr)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var host, severity string
+		if rows.Scan(&host, &severity) == nil && severity == startSeverity {
+			started[host] = since
+		}
+	}
+	rows.Close()
+
+	// Then what changed
+	rows, err = app.db.Query("SELECT host, severity, timestamp FROM events WHERE kind = ? AND host != '' AND timestamp >= ? ORDER BY id",
+		kind, sinceStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var host, severity, ts string
+		if err := rows.Scan(&host, &severity, &ts); err != nil {
+			return nil, err
+		}
+		at, err := time.Parse(store.TimeLayout, ts)
+		if err != nil {
+			continue
+		}
+		if severity == startSeverity {
+			if _, ok := started[host]; !ok {
+				started[host] = at
+			}
+			continue
+		}
+		if from, ok := started[host]; ok {
+			if sets[host] == nil {
+				sets[host] = make(minuteSet)
+			}
+			sets[host].addInterval(from, at)
+			delete(started, host)
+		}
+	}
+	for host, from := range started {
+		if sets[host] == nil {
+			sets[host] = make(minuteSet)
+		}
+		sets[host].addInterval(from, now)
+	}
+	return sets, rows.Err()
+}
+
+// Uptime computes availability for hosts over every window
+func (app *App) Uptime(hosts []string) ([]HostUptime, error) {
+	if err := app.uptime.Flush(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	longest := uptimeWindows[len(uptimeWindows)-1].span
+	since := now.Add(-longest).Truncate(time.Minute)
+
+	backendDown, err := app.eventIntervals("backend", severityCritical, since, now)
+	if err != nil {
+		return nil, err
+	}
+	maintenance, err := app.eventIntervals("maintenance", severityWarning, since, now)
+	if err != nil {
+		return nil, err
+	}
+
+	type minuteCount struct {
+		minute           int64
+		requests, errors int
+	}
+	counts := make(map[string][]minuteCount)
+	firstSeen := make(map[string]int64)
+	rows, err := app.db.Query("SELECT host, minute, requests, errors FROM host_uptime WHERE minute >= ?", store.FormatTime(since))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var host, minute string
+		var c minuteCount
+		if err := rows.Scan(&host, &minute, &c.requests, &c.errors); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		at, err := time.Parse(store.TimeLayout, minute)
+		if err != nil {
+			continue
+		}
+		c.minute = at.Unix() / 60
+		counts[host] = append(counts[host], c)
+		if first, ok := firstSeen[host]; !ok || c.minute < first {
+			firstSeen[host] = c.minute
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	nowMinute := now.Unix() / 60
+	list := make([]HostUptime, 0, len(hosts))
+	for _, host := range hosts {
+		h := HostUptime{Host: host, Status: "up", Windows: make(map[string]UptimeWindow)}
+		down := make(minuteSet)
+		for m := range backendDown[host] {
+			down[m] = true
+		}
+		for _, c := range counts[host] {
+			if c.requests > 0 && float64(c.errors) >= float64(c.requests)*app.uptime.errorRatio {
+				down[c.minute] = true
+			}
+		}
+		// Tracking starts at the first request or backend event seen
+		first, seen := firstSeen[host]
+		for m := range backendDown[host] {
+			if !seen || m < first {
+				first, seen = m, true
+			}
+		}
+		for _, w := range uptimeWindows {
+			var win UptimeWindow
+			start := nowMinute - int64(w.span/time.Minute) + 1
+			for _, c := range counts[host] {
+				if c.minute >= start {
+					win.Requests += c.requests
+					win.Errors += c.errors
+				}
+			}
+			if win.Requests > 0 {
+				win.ErrorRate = float64(win.Errors) / float64(win.Requests)
+			}
+			if seen {
+				if first > start {
+					start = first
+				}
+				total := 0
+				for m := start; m <= nowMinute; m++ {
+					if maintenance[host][m] {
+						continue
+					}
+					total++
+					if down[m] {
+						win.DowntimeMinutes++
+					}
+				}
+				if total > 0 {
+					pct := 100 * float64(total-win.DowntimeMinutes) / float64(total)
+					win.Availability = &pct
+				}
+			}
+			h.Windows[w.name] = win
+		}
+		switch {
+		case app.inMaintenance(host):
+			h.Status = "maintenance"
+		case app.backends.isDown(host) || down[nowMinute]:
+			h.Status = "down"
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+func (app *App) inMaintenance(host string) bool {
+	_, on := app.maintenance.Get(host)
+	return on
+}
+
+// uptimeHosts are the configured hosts, without wildcards
+func (app *App) uptimeHosts() []string {
+	var hosts []string
+	for host := range app.routes.Load().routes {
+		if !strings.Contains(host, "*") {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// GET /_proxy/uptime
+func (app *App) handleUptime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := requestUser(r)
+	var hosts []string
+	for _, host := range app.uptimeHosts() {
+		if user.CanSee(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	list, err := app.Uptime(hosts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// StatusPage is the public status page: only the hosts in STATUS_PAGE_HOSTS
+// ("*" for all), with their state and availability but no traffic numbers
+type StatusPage struct {
+	title string
+	hosts []string // nil = all configured hosts
+}
+
+func NewStatusPage(hosts, title string) *StatusPage {
+	p := &StatusPage{title: title}
+	if strings.TrimSpace(hosts) == "*" {
+		return p
+	}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			p.hosts = append(p.hosts, h)
+		}
+	}
+	return p
+}
+
+// publicStatus is a host as the status page shows it
+type publicStatus struct {
+	Host         string              `json:"host"`
+	Status       string              `json:"status"`
+	Availability map[string]*float64 `json:"availability"`
+}
+
+// GET /_proxy/status (HTML) and /_proxy/status.json, without authentication
+func (app *App) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	if app.statusPage == nil {
+		http.NotFound(w, r)
+		return
+	}
+	hosts := app.statusPage.hosts
+	if hosts == nil {
+		hosts = app.uptimeHosts()
+	}
+	list, err := app.Uptime(hosts)
+	if err != nil {
+		http.Error(w, "Status unavailable", http.StatusInternalServerError)
+		slog.Error("Status page", "err", err)
+		return
+	}
+	statuses := make([]publicStatus, len(list))
+	for i, h := range list {
+		statuses[i] = publicStatus{Host: h.Host, Status: h.Status, Availability: make(map[string]*float64)}
+		for name, win := range h.Windows {
+			statuses[i].Availability[name] = win.Availability
+		}
+	}
+	// What's going on now, what's planned, and the last week's incidents
+	now := time.Now()
+	annotations := app.publicAnnotations(store.FormatTime(now.Add(-statusAnnotationDays*24*time.Hour)), "", hosts)
+	w.Header().Set("Cache-Control", "public, max-age=30")
+
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"title":       app.statusPage.title,
+			"hosts":       statuses,
+			"annotations": annotations,
+			"updated_at":  store.FormatTime(now),
+		})
+		return
+	}
+
+	overall := "All systems operational"
+	for _, s := range statuses {
+		if s.Status == "down" {
+			overall = "Some services are down"
+			break
+		}
+		if s.Status == "maintenance" {
+			overall = "Some services are in maintenance"
+		}
+	}
+	var b strings.Builder
+	title := html.EscapeString(app.statusPage.title)
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>%s</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 760px; margin: 40px auto; padding: 0 20px; color: #1a1a2e; background: #f4f6fa; }
+h1 { font-size: 1.6em; }
+.overall { padding: 14px 18px; border-radius: 8px; color: #fff; background: #2e7d32; margin-bottom: 24px; }
+.overall.down { background: #c62828; }
+.overall.maintenance { background: #b26a00; }
+table { width: 100%%; border-collapse: collapse; background: #fff; border-radius: 8px; overflow: hidden; }
+th, td { padding: 10px 14px; text-align: left; border-bottom: 1px solid #e3e8f0; }
+th { color: #666; font-weight: normal; font-size: 0.9em; }
+.up { color: #2e7d32; } .down { color: #c62828; } .maintenance { color: #b26a00; }
+footer { color: #888; font-size: 0.85em; margin-top: 16px; }
+h2 { font-size: 1.2em; margin-top: 32px; }
+ul.annotations { list-style: none; padding: 0; }
+ul.annotations li { background: #fff; border-radius: 8px; padding: 10px 14px; margin-bottom: 8px; border-left: 4px solid #c62828; }
+ul.annotations li.maintenance { border-left-color: #b26a00; }
+ul.annotations small { color: #888; }
+.ongoing { color: #c62828; } .scheduled { color: #b26a00; } .resolved { color: #2e7d32; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+`, title, title)
+	class := "up"
+	if strings.Contains(overall, "down") {
+		class = "down"
+	} else if strings.Contains(overall, "maintenance") {
+		class = "maintenance"
+	}
+	fmt.Fprintf(&b, "<div class=\"overall %s\">%s</div>\n<table>\n<tr><th>Service</th><th>Status</th>", class, overall)
+	for _, win := range uptimeWindows {
+		fmt.Fprintf(&b, "<th>%s</th>", win.name)
+	}
+	b.WriteString("</tr>\n")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "<tr><td>%s</td><td class=\"%s\">%s</td>", html.EscapeString(s.Host), s.Status, s.Status)
+		for _, win := range uptimeWindows {
+			if pct := s.Availability[win.name]; pct != nil {
+				fmt.Fprintf(&b, "<td>%s%%</td>", formatPercent(*pct))
+			} else {
+				b.WriteString("<td>-</td>")
+			}
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</table>\n")
+	if len(annotations) > 0 {
+		b.WriteString("<h2>Incidents and maintenance</h2>\n<ul class=\"annotations\">\n")
+		nowStored := store.FormatTime(now)
+		// Newest first, like a status history
+		for i := len(annotations) - 1; i >= 0; i-- {
+			a := annotations[i]
+			state := "resolved"
+			switch {
+			case a.StartsAt > nowStored:
+				state = "scheduled"
+			case a.Active(nowStored):
+				state = "ongoing"
+			}
+			affected := "All services"
+			if len(a.Hosts) > 0 {
+				affected = strings.Join(a.Hosts, ", ")
+			}
+			fmt.Fprintf(&b, "<li class=\"%s\"><b>%s</b> <span class=\"%s\">%s</span> <small>%s · %s</small><br>%s</li>\n",
+				a.Kind, strings.ToUpper(a.Kind[:1])+a.Kind[1:], state, state, annotationSpan(a), html.EscapeString(affected), html.EscapeString(a.Note))
+		}
+		b.WriteString("</ul>\n")
+	}
+	fmt.Fprintf(&b, "<footer>Updated %s</footer>\n</body>\n</html>\n", now.UTC().Format("2006-01-02 15:04 UTC"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// Days of past incidents and maintenance the status page lists
+const statusAnnotationDays = 7
+
+// annotationSpan renders when an annotation was, in UTC like the status page
+func annotationSpan(a Annotation) string {
+	start, err := time.Parse(time.RFC3339, a.StartsAt)
+	if err != nil {
+		return a.StartsAt
+	}
+	span := start.UTC().Format("2006-01-02 15:04")
+	if a.EndsAt == "" {
+		return span + " UTC, ongoing"
+	}
+	end, err := time.Parse(time.RFC3339, a.EndsAt)
+	if err != nil {
+		return span + " UTC"
+	}
+	if end.UTC().Format("2006-01-02") == start.UTC().Format("2006-01-02") {
+		return span + "–" + end.UTC().Format("15:04") + " UTC"
+	}
+	return span + " – " + end.UTC().Format("2006-01-02 15:04") + " UTC"
+}
+
+// formatPercent shows availability with as many decimals as tell nines
+// apart (100, 99.95, 99.999), rounded down so it never reads better than it was
+func formatPercent(pct float64) string {
+	switch {
+	case pct >= 100:
+		return "100"
+	case pct >= 99.9:
+		return fmt.Sprintf("%.3f", math.Floor(pct*1000)/1000)
+	}
+	return fmt.Sprintf("%.2f", math.Floor(pct*100)/100)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+const (
+	roleAdmin  = "admin"
+	roleViewer = "viewer"
+)
+
+// User is an API account. Viewers can read stats; admins can also manage
+// bans, captures, maintenance and admin objects. Hosts, when set, limits
+// everything the user sees to connections for those hosts.
+type User struct {
+	Name  string
+	Role  string
+	Hosts []string
+	// PasskeyRequired makes the token alone not enough: it only signs in
+	// together with one of the user's passkeys
+	PasskeyRequired bool
+}
+
+// CanSee reports whether u may see traffic for host
+func (u *User) CanSee(host string) bool {
+	if u == nil || len(u.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.Split(host, ":")[0])
+	for _, h := range u.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+type userKey struct{}
+
+// requestUser is the account the request authenticated as; nil when
+// accounts aren't in use
+func requestUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey{}).(*User)
+	return u
+}
+
+// hostScope restricts a query to the hosts the request's user may see, as a
+// condition on column starting with " AND"; empty for unscoped users
+func hostScope(r *http.Request, column string) (string, []interface{}) {
+	u := requestUser(r)
+	if u == nil || len(u.Hosts) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, len(u.Hosts))
+	for i, h := range u.Hosts {
+		args[i] = h
+	}
+	return " AND " + column + " IN (?" + strings.Repeat(", ?", len(u.Hosts)-1) + ")", args
+}
+
+// userData is a user as stored: the token only as its SHA-256
+type userData struct {
+	Role            string   `json:"role"`
+	Hosts           []string `json:"hosts,omitempty"`
+	PasskeyRequired bool     `json:"passkey_required,omitempty"`
+	Token           string   `json:"token,omitempty"` // on writes; returned once, never stored
+	TokenSHA256     string   `json:"token_sha256,omitempty"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Users holds the accounts, stored as the "users" admin kind and cached by
+// token hash, and the sessions started by signing in with a passkey
+type Users struct {
+	coll     *sqlAdminCollection
+	mu       sync.RWMutex
+	byToken  map[string]*User
+	byName   map[string]*User
+	sessions map[string]userSession // by token hash
+}
+
+// userSession is a temporary token handed out on a passkey sign-in
+type userSession struct {
+	name    string
+	expires time.Time
+}
+
+func NewUsers(db *sql.DB) (*Users, error) {
+	if err := createPasskeysSchema(db); err != nil {
+		return nil, err
+	}
+	u := &Users{coll: &sqlAdminCollection{db: db, kind: "users"}, sessions: make(map[string]userSession)}
+	return u, u.reload()
+}
+
+func (u *Users) reload() error {
+	objects, err := u.coll.List()
+	if err != nil {
+		return err
+	}
+	byToken := make(map[string]*User, len(objects))
+	byName := make(map[string]*User, len(objects))
+	for _, o := range objects {
+		var d userData
+		if err := json.Unmarshal(o.Data, &d); err != nil {
+			return fmt.Errorf("user %s: %w", o.ID, err)
+		}
+		user := &User{Name: o.ID, Role: d.Role, Hosts: d.Hosts, PasskeyRequired: d.PasskeyRequired}
+		byToken[d.TokenSHA256] = user
+		byName[o.ID] = user
+	}
+	u.mu.Lock()
+	u.byToken, u.byName = byToken, byName
+	u.mu.Unlock()
+	return nil
+}
+
+// Any reports whether accounts are in use
+func (u *Users) Any() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.byToken) > 0
+}
+
+// Lookup returns the user a token or passkey session belongs to. Tokens of
+// users with PasskeyRequired aren't accepted on their own.
+func (u *Users) Lookup(token string) *User {
+	if token == "" {
+		return nil
+	}
+	h := hashToken(token)
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if user := u.byToken[h]; user != nil {
+		if user.PasskeyRequired {
+			return nil
+		}
+		return user
+	}
+	if s, ok := u.sessions[h]; ok && time.Now().Before(s.expires) {
+		return u.byName[s.name]
+	}
+	return nil
+}
+
+// Get returns the user called name, nil if there's none
+func (u *Users) Get(name string) *User {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.byName[name]
+}
+
+// TokenUser returns the user a token belongs to, including users whose
+// token needs a passkey as well; sessions don't count
+func (u *Users) TokenUser(token string) *User {
+	if token == "" {
+		return nil
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.byToken[hashToken(token)]
+}
+
+// StartSession hands out a token that acts as name until ttl has passed
+func (u *Users) StartSession(name string, ttl time.Duration) (string, time.Time) {
+	b := make([]byte, 24)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(ttl)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for h, s := range u.sessions {
+		if time.Now().After(s.expires) {
+			delete(u.sessions, h)
+		}
+	}
+	u.sessions[hashToken(token)] = userSession{name: name, expires: expires}
+	return token, expires
+}
+
+// userCollection is the admin API's view of the users kind: tokens are
+// hashed on write and the hash is never returned
+type userCollection struct {
+	users *Users
+	// Without ADMIN_TOKEN the last admin account can't be removed, or nobody
+	// could manage the instance any more
+	requireAdmin bool
+}
+
+func (c userCollection) public(o AdminObject, token string) AdminObject {
+	var d userData
+	json.Unmarshal(o.Data, &d)
+	d.TokenSHA256, d.Token = "", token
+	o.Data, _ = json.Marshal(d)
+	return o
+}
+
+func (c userCollection) List() ([]AdminObject, error) {
+	objects, err := c.users.coll.List()
+	for i := range objects {
+		objects[i] = c.public(objects[i], "")
+	}
+	return objects, err
+}
+
+func (c userCollection) Get(id string) (AdminObject, error) {
+	o, err := c.users.coll.Get(id)
+	if err != nil {
+		return o, err
+	}
+	return c.public(o, ""), nil
+}
+
+// Put stores a user. Without a token an existing user keeps theirs and a new
+// one gets a generated token, returned in the response only.
+func (c userCollection) Put(id string, data json.RawMessage, ifMatch int64) (AdminObject, error) {
+	var d userData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return AdminObject{}, fmt.Errorf("%w: %v", errAdminInvalid, err)
+	}
+	if d.Role != roleAdmin && d.Role != roleViewer {
+		return AdminObject{}, fmt.Errorf("%w: role must be %q or %q", errAdminInvalid, roleAdmin, roleViewer)
+	}
+	for i, h := range d.Hosts {
+		d.Hosts[i] = strings.ToLower(strings.TrimSpace(h))
+	}
+
+	token := d.Token
+	if token == "" {
+		existing, err := c.users.coll.Get(id)
+		switch {
+		case err == nil:
+			var old userData
+			json.Unmarshal(existing.Data, &old)
+			d.TokenSHA256 = old.TokenSHA256
+		case err == errAdminNotFound:
+			b := make([]byte, 24)
+			rand.Read(b)
+			token = base64.RawURLEncoding.EncodeToString(b)
+		default:
+			return AdminObject{}, err
+		}
+	}
+	if token != "" {
+		d.TokenSHA256 = hashToken(token)
+	}
+	d.Token = ""
+
+	if c.requireAdmin && d.Role != roleAdmin && !c.adminRemains(id) {
+		return AdminObject{}, fmt.Errorf("%w: without ADMIN_TOKEN at least one other admin account is needed", errAdminInvalid)
+	}
+	stored, _ := json.Marshal(d)
+	o, err := c.users.coll.Put(id, stored, ifMatch)
+	if err != nil {
+		return o, err
+	}
+	if err := c.users.reload(); err != nil {
+		return o, err
+	}
+	return c.public(o, token), nil
+}
+
+func (c userCollection) Delete(id string, ifMatch int64) error {
+	if c.requireAdmin && !c.adminRemains(id) {
+		return fmt.Errorf("%w: without ADMIN_TOKEN the last admin account can't be deleted", errAdminInvalid)
+	}
+	if err := c.users.coll.Delete(id, ifMatch); err != nil {
+		return err
+	}
+	if _, err := c.users.coll.db.Exec("DELETE FROM passkeys WHERE user_name = ?", id); err != nil {
+		return err
+	}
+	return c.users.reload()
+}
+
+// adminRemains reports whether an admin other than id exists
+func (c userCollection) adminRemains(id string) bool {
+	c.users.mu.RLock()
+	defer c.users.mu.RUnlock()
+	for _, u := range c.users.byToken {
+		if u.Role == roleAdmin && u.Name != id {
+			return true
+		}
+	}
+	return false
+}
+
+// requireViewer lets any account read; without accounts the read API stays
+// open as it always was. A share token reads its own host and time range.
+func (app *App) requireViewer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scope := app.shareTokens.Lookup(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); scope != nil {
+			app.serveShared(w, r, next, scope)
+			return
+		}
+		if !app.admin.users.Any() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user := app.admin.Authenticate(r)
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// runUsers creates accounts from the command line, on the host holding the
+// database. It's how an instance without ADMIN_TOKEN gets its first admin:
+//
+//	cf-ip-logger users add -role admin alice
+func runUsers(args []string) {
+	if len(args) == 0 || args[0] != "add" {
+		fmt.Fprintf(os.Stderr, "Usage: %s users add [-role admin|viewer] [-hosts a.example.com,...] [-token TOKEN] NAME\n", os.Args[0])
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("users add", flag.ExitOnError)
+	dataDir := fs.String("data", getEnv("DATA_DIR", "/data"), "data directory holding connections.db")
+	role := fs.String("role", roleAdmin, "admin or viewer")
+	hosts := fs.String("hosts", "", "comma-separated hosts the user may see (default all)")
+	token := fs.String("token", "", "token to use (default generated and printed)")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := store.LoadKey(); err != nil {
+		log.Fatalf("users: %v", err)
+	}
+	db, err := store.Open(*dataDir + "/connections.db")
+	if err != nil {
+		log.Fatalf("users: %v", err)
+	}
+	defer db.Close()
+	admin, err := NewAdminAPI(db, getEnv("ADMIN_TOKEN", ""))
+	if err != nil {
+		log.Fatalf("users: %v", err)
+	}
+	d := userData{Role: *role, Token: *token}
+	if *hosts != "" {
+		d.Hosts = strings.Split(*hosts, ",")
+	}
+	data, _ := json.Marshal(d)
+	o, err := admin.collections["users"].Put(fs.Arg(0), data, -1)
+	if err != nil {
+		log.Fatalf("users: %v", err)
+	}
+	json.Unmarshal(o.Data, &d)
+	if *token == "" {
+		fmt.Println(d.Token)
+	}
+	fmt.Fprintf(os.Stderr, "Created %s %s\n", d.Role, o.ID)
+}
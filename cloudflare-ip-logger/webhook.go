@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/clientip"
+)
+
+// webhookParser turns a webhook body into the events it reports
+type webhookParser func(body []byte) ([]Event, error)
+
+// Supported webhook senders, by the {source} in /webhook/{source}
+var webhookParsers = map[string]webhookParser{
+	"uptime-kuma": parseUptimeKuma,
+	"cloudflare":  parseCloudflareNotification,
+	"authelia":    parseAutheliaLogs,
+	"generic":     parseGenericEvents,
+}
+
+func webhookSources() []string {
+	names := make([]string, 0, len(webhookParsers))
+	for name := range webhookParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// webhookAuthorized checks the token, which senders that can't set an
+// Authorization header pass in the URL (?token=) or, for Cloudflare, the
+// cf-webhook-auth header
+func webhookAuthorized(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("token")
+	if h := r.Header.Get("cf-webhook-auth"); h != "" {
+		got = h
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		got = strings.TrimPrefix(h, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// POST /_proxy/webhook/{source} - events from a third-party service
+func (app *App) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if app.webhookToken == "" {
+		http.Error(w, "webhooks are disabled (set WEBHOOK_TOKEN)", http.StatusNotFound)
+		return
+	}
+	source := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhook"), "/")
+	parse, ok := webhookParsers[source]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown webhook source %q (expected one of %s)",
+			source, strings.Join(webhookSources(), ", ")), http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !webhookAuthorized(r, app.webhookToken) {
+		slog.Warn("Rejected webhook: invalid token", "source", source, "remote", clientip.RemoteIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIngestBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxIngestBody {
+		http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	events, err := parse(body)
+	if err != nil {
+		http.Error(w, "Invalid "+source+" payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recorded := 0
+	for _, e := range events {
+		e.Source = source
+		e.Host = strings.ToLower(e.Host)
+		if err := app.recordEvent(e); err != nil {
+			slog.Error("Error storing event", "source", source, "err", err)
+			http.Error(w, "Failed to store events", http.StatusInternalServerError)
+			return
+		}
+		recorded++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"recorded": recorded})
+}
+
+// compactJSON is already-parsed raw as stored in events.data
+func compactJSON(raw []byte) json.RawMessage {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// hostFromURL returns the lowercased host of a URL, "" if it has none
+func hostFromURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// parseUptimeKuma reads Uptime Kuma's webhook notification (JSON body):
+// {"heartbeat": {"status": 0|1, "time", "msg"}, "monitor": {"name", "url", "hostname"}, "msg"}
+func parseUptimeKuma(body []byte) ([]Event, error) {
+	var p struct {
+		Heartbeat *struct {
+			Status int    `json:"status"`
+			Time   string `json:"time"`
+			Msg    string `json:"msg"`
+		} `json:"heartbeat"`
+		Monitor *struct {
+			Name     string  `json:"name"`
+			URL      string  `json:"url"`
+			Hostname *string `json:"hostname"`
+		} `json:"monitor"`
+		Msg string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	e := Event{Kind: "monitor", Severity: severityInfo, Message: p.Msg, Data: compactJSON(body)}
+	if p.Monitor != nil {
+		e.Host = hostFromURL(p.Monitor.URL)
+		if e.Host == "" && p.Monitor.Hostname != nil {
+			e.Host = *p.Monitor.Hostname
+		}
+	}
+	if hb := p.Heartbeat; hb != nil {
+		// 0 down, 1 up, 2 pending, 3 maintenance
+		switch hb.Status {
+		case 0:
+			e.Severity = severityCritical
+		case 2:
+			e.Severity = severityWarning
+		}
+		// Heartbeat times are UTC without a zone
+		if t, err := time.Parse("2006-01-02 15:04:05.000", hb.Time); err == nil {
+			e.Time = t
+		} else if t, err := time.Parse("2006-01-02 15:04:05", hb.Time); err == nil {
+			e.Time = t
+		}
+	}
+	if e.Message == "" {
+		return nil, errors.New("no msg")
+	}
+	return []Event{e}, nil
+}
+
+// parseCloudflareNotification reads a Cloudflare Notifications webhook:
+// {"name", "text", "ts", "alert_type", "data": {...}}
+func parseCloudflareNotification(body []byte) ([]Event, error) {
+	var p struct {
+		Name      string                 `json:"name"`
+		Text      string                 `json:"text"`
+		TS        int64                  `json:"ts"`
+		AlertType string                 `json:"alert_type"`
+		Data      map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	e := Event{Kind: "notification", Severity: severityWarning, Message: p.Text, Data: compactJSON(body)}
+	if e.Message == "" {
+		e.Message = p.Name
+	}
+	if e.Message == "" {
+		return nil, errors.New("no text or name")
+	}
+	if p.TS > 0 {
+		e.Time = time.Unix(p.TS, 0)
+	}
+	// DDoS attack alerts are the ones to act on
+	if strings.Contains(strings.ToLower(p.AlertType), "dos") {
+		e.Severity = severityCritical
+	}
+	for _, key := range []string{"zone_name", "domain", "hostname"} {
+		if s, ok := p.Data[key].(string); ok && s != "" {
+			e.Host = s
+			break
+		}
+	}
+	return []Event{e}, nil
+}
+
+// autheliaEntry is one line of Authelia's JSON log (log.format: json)
+type autheliaEntry struct {
+	Level    string `json:"level"`
+	Msg      string `json:"msg"`
+	Time     string `json:"time"`
+	RemoteIP string `json:"remote_ip"`
+	Path     string `json:"path"`
+}
+
+// parseAutheliaLogs reads Authelia JSON log lines, as a log shipper posts
+// them (a JSON array or one object per line), and keeps the ones about
+// authentication
+func parseAutheliaLogs(body []byte) ([]Event, error) {
+	var raws []json.RawMessage
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxIngestBody)
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				raws = append(raws, append(json.RawMessage(nil), line...))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var events []Event
+	for _, raw := range raws {
+		var entry autheliaEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, err
+		}
+		msg := strings.ToLower(entry.Msg)
+		if !strings.Contains(msg, "authentication") && !strings.Contains(msg, "banned") {
+			continue
+		}
+		e := Event{Kind: "auth", Severity: severityInfo, ClientIP: entry.RemoteIP, Message: entry.Msg, Data: compactJSON(raw)}
+		switch {
+		case strings.Contains(msg, "banned"):
+			e.Severity = severityCritical
+		case strings.Contains(msg, "unsuccessful"), entry.Level == "error":
+			e.Severity = severityWarning
+		}
+		if t, err := time.Parse(time.RFC3339, entry.Time); err == nil {
+			e.Time = t
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// parseGenericEvents reads events in this API's own shape, one object or an
+// array: {"kind", "severity", "host", "client_ip", "message", "timestamp", "data"}
+func parseGenericEvents(body []byte) ([]Event, error) {
+	var events []Event
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &events); err != nil {
+			return nil, err
+		}
+	} else {
+		var e Event
+		if err := json.Unmarshal(trimmed, &e); err != nil {
+			return nil, err
+		}
+		events = []Event{e}
+	}
+	for i := range events {
+		e := &events[i]
+		if e.Message == "" {
+			return nil, errors.New("message is required")
+		}
+		if e.Kind == "" {
+			e.Kind = "generic"
+		}
+		switch e.Severity {
+		case "", severityInfo, severityWarning, severityCritical:
+		default:
+			return nil, fmt.Errorf("invalid severity %q", e.Severity)
+		}
+		if e.Timestamp != "" {
+			t, err := time.Parse(time.RFC3339, e.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", e.Timestamp)
+			}
+			e.Time = t
+		}
+		e.ID, e.Data = 0, compactJSON(e.Data)
+	}
+	return events, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// Clients seen this recently count as online in a widget
+const widgetLiveWindow = 5 * time.Minute
+
+// Widget is a share link's host at a glance, small enough for a tile on a
+// start page such as Homepage or Heimdall
+type Widget struct {
+	Host         string `json:"host"`
+	Title        string `json:"title"`
+	LiveVisitors int    `json:"live_visitors"` // distinct visitor IPs in the last 5 minutes
+	Hits24h      int    `json:"hits_24h"`
+	Sparkline    []int  `json:"sparkline"` // visits per hour over the last 24, oldest first
+	UpdatedAt    string `json:"updated_at"`
+}
+
+// widgetStats counts the link's host's visitor traffic over the last day;
+// own, from ownTraffic, leaves out the operator's own requests
+func widgetStats(db *sql.DB, link shareLinkData, own string, ownArgs []interface{}) (*Widget, error) {
+	now := time.Now().UTC()
+	first := now.Truncate(time.Hour).Add(-23 * time.Hour)
+	wg := &Widget{Host: link.Host, Title: link.Title, Sparkline: make([]int, 24), UpdatedAt: store.FormatTime(now)}
+	if wg.Title == "" {
+		wg.Title = link.Host
+	}
+
+	rows, err := db.Query(`SELECT substr(timestamp, 1, 13), COUNT(*) FROM connections
+		WHERE host = ? AND category = ? AND timestamp >= ?`+own+` GROUP BY 1`,
+		append([]interface{}{link.Host, categoryVisitor, store.FormatTime(first)}, ownArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket string
+		var n int
+		if rows.Scan(&bucket, &n) != nil {
+			continue
+		}
+		t, err := time.Parse("2006-01-02T15", bucket)
+		if err != nil {
+			continue
+		}
+		if i := int(t.Sub(first) / time.Hour); i >= 0 && i < len(wg.Sparkline) {
+			wg.Sparkline[i] += n
+			wg.Hits24h += n
+		}
+	}
+	return wg, rows.Err()
+}
+
+// serveWidget answers /public/{token}/widget (HTML for an iframe) and
+// /public/{token}/widget.json
+func (app *App) serveWidget(w http.ResponseWriter, r *http.Request, link shareLinkData, asJSON bool) {
+	own, ownArgs, _ := app.ownTraffic.Filter(nil)
+	wg, err := widgetStats(app.readerFor(r, link.Host), link, own, ownArgs)
+	if err != nil {
+		slog.Error("Widget", "host", link.Host, "err", err)
+		http.Error(w, "Stats unavailable", http.StatusInternalServerError)
+		return
+	}
+	wg.LiveVisitors = app.active.CountHost(link.Host, widgetLiveWindow, time.Now())
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	if asJSON {
+		// Start pages that fetch from the browser need CORS; the token is the access
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wg)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(renderWidget(wg, r.URL.Query().Get("theme") == "dark")))
+}
+
+// renderWidget draws the widget: the online count and an SVG sparkline,
+// on a transparent background so it sits on any start page
+func renderWidget(wg *Widget, dark bool) string {
+	fg, muted, line := "#1a1a2e", "#666", "#0077aa"
+	if dark {
+		fg, muted, line = "#e8eaf0", "#9aa0b0", "#4fc3f7"
+	}
+	peak := 1
+	for _, n := range wg.Sparkline {
+		if n > peak {
+			peak = n
+		}
+	}
+	// 100x30 viewBox, one point per hour
+	points := make([]string, len(wg.Sparkline))
+	for i, n := range wg.Sparkline {
+		x := float64(i) * 100 / float64(len(wg.Sparkline)-1)
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, 29-28*float64(n)/float64(peak))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="robots" content="noindex">
+<meta http-equiv="refresh" content="60">
+<title>%s</title>
+<style>
+html, body { margin: 0; background: transparent; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; color: %s; }
+.w { display: flex; align-items: center; gap: 12px; padding: 6px 10px; }
+.n { font-size: 1.6em; font-weight: bold; line-height: 1; }
+.l { font-size: 0.75em; color: %s; }
+svg { flex: 1; height: 36px; min-width: 60px; }
+</style>
+</head>
+<body>
+<div class="w" title="%s">
+<div><div class="n">%d</div><div class="l">online</div></div>
+<svg viewBox="0 0 100 30" preserveAspectRatio="none"><polyline fill="none" stroke="%s" stroke-width="1.5" vector-effect="non-scaling-stroke" points="%s"/></svg>
+<div><div class="n">%d</div><div class="l">24h</div></div>
+</div>
+</body>
+</html>
+`, html.EscapeString(wg.Title), fg, muted, html.EscapeString(wg.Title), wg.LiveVisitors, line, strings.Join(points, " "), wg.Hits24h)
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cf-ip-logger/pkg/store"
+)
+
+// WSSessions tracks open WebSocket tunnels in memory and writes a summary
+// row for each one when it closes
+type WSSessions struct {
+	db       *sql.DB
+	readOnly bool // open sessions are tracked but not recorded
+	mu       sync.Mutex
+	nextID   int64
+	active   map[int64]*wsSession
+}
+
+type wsSession struct {
+	id         int64
+	host       string
+	clientIP   string
+	path       string
+	backend    string
+	started    time.Time
+	fromClient atomic.Int64
+	toClient   atomic.Int64
+}
+
+// WSSessionInfo is an open session as reported by the API
+type WSSessionInfo struct {
+	ID              int64  `json:"id"`
+	Host            string `json:"host"`
+	ClientIP        string `json:"client_ip"`
+	Path            string `json:"path"`
+	Backend         string `json:"backend"`
+	StartedAt       string `json:"started_at"`
+	DurationSeconds int64  `json:"duration_seconds"`
+	BytesFromClient int64  `json:"bytes_from_client"`
+	BytesToClient   int64  `json:"bytes_to_client"`
+}
+
+func NewWSSessions(db *sql.DB) (*WSSessions, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS ws_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		host TEXT,
+		client_ip TEXT,
+		path TEXT,
+		backend TEXT,
+		started_at DATETIME NOT NULL,
+		ended_at DATETIME NOT NULL,
+		duration_ms INTEGER,
+		bytes_from_client INTEGER,
+		bytes_to_client INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS idx_ws_sessions_started ON ws_sessions(started_at);
+	CREATE INDEX IF NOT EXISTS idx_ws_sessions_host ON ws_sessions(host);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return &WSSessions{db: db, readOnly: store.IsReadOnly(db), active: make(map[int64]*wsSession)}, nil
+}
+
+func (ws *WSSessions) Start(host, clientIP, path, backend string) *wsSession {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.nextID++
+	s := &wsSession{id: ws.nextID, host: host, clientIP: clientIP, path: path, backend: backend, started: time.Now()}
+	ws.active[s.id] = s
+	return s
+}
+
+// End removes s from the open sessions and records its summary
+func (ws *WSSessions) End(s *wsSession) {
+	ws.mu.Lock()
+	delete(ws.active, s.id)
+	ws.mu.Unlock()
+	if ws.readOnly {
+		return
+	}
+
+	ended := time.Now()
+	_, err := ws.db.Exec(`INSERT INTO ws_sessions
+		(host, client_ip, path, backend, started_at, ended_at, duration_ms, bytes_from_client, bytes_to_client)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.host, s.clientIP, s.path, s.backend, store.FormatTime(s.started), store.FormatTime(ended),
+		ended.Sub(s.started).Milliseconds(), s.fromClient.Load(), s.toClient.Load())
+	if err != nil {
+		slog.Error("Error recording WebSocket session", "err", err)
+	}
+}
+
+// Active lists open sessions, longest-running first
+func (ws *WSSessions) Active(now time.Time) []WSSessionInfo {
+	ws.mu.Lock()
+	list := make([]WSSessionInfo, 0, len(ws.active))
+	for _, s := range ws.active {
+		list = append(list, WSSessionInfo{
+			ID:              s.id,
+			Host:            s.host,
+			ClientIP:        s.clientIP,
+			Path:            s.path,
+			Backend:         s.backend,
+			StartedAt:       store.FormatTime(s.started),
+			DurationSeconds: int64(now.Sub(s.started).Seconds()),
+			BytesFromClient: s.fromClient.Load(),
+			BytesToClient:   s.toClient.Load(),
+		})
+	}
+	ws.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// countingWriter adds the bytes written through it to n
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+// GET /_proxy/ws-sessions?host=example.com&tz=Europe/Berlin - open WebSocket tunnels
+func (app *App) handleWSSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := strings.ToLower(r.URL.Query().Get("host"))
+	user := requestUser(r)
+
+	sessions := []WSSessionInfo{}
+	byHost := make(map[string]int)
+	for _, s := range app.wsSessions.Active(time.Now()) {
+		if host != "" && s.Host != host || !user.CanSee(s.Host) {
+			continue
+		}
+		s.StartedAt = formatStoredTime(s.StartedAt, loc)
+		sessions = append(sessions, s)
+		byHost[s.Host]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(sessions),
+		"by_host":  byHost,
+		"sessions": sessions,
+	})
+}